@@ -54,6 +54,21 @@ func AuthMiddleware(region, userPoolID string, authedGroups []string) gin.Handle
 	}
 }
 
+// OptionalAuthMiddleware is AuthMiddleware for public routes: requests without
+// a bearer token go through anonymously, while a token that is sent must be
+// valid and sets username and groups as usual.
+func OptionalAuthMiddleware(region, userPoolID string) gin.HandlerFunc {
+	authenticate := AuthMiddleware(region, userPoolID, []string{string(user), string(employee), string(manager), string(admin)})
+
+	return func(c *gin.Context) {
+		if _, ok := getBearer(c.Request.Header["Authorization"]); !ok {
+			c.Next()
+			return
+		}
+		authenticate(c)
+	}
+}
+
 func validateAWSJwtClaims(claims jwt.MapClaims, region, userPoolID string, authedGroups []string) (string, []string, error) {
 	var err error
 	// 3. Check the iss claim. It should match your user pool.
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// coordinates reads ?lat=&lon=, nil when neither is given.
+func coordinates(c *gin.Context) (*shop.Coordinates, error) {
+	lat, lon := c.Query("lat"), c.Query("lon")
+	if lat == "" && lon == "" {
+		return nil, nil
+	}
+
+	var from shop.Coordinates
+	var err error
+	if from.Latitude, err = strconv.ParseFloat(lat, 64); err != nil {
+		return nil, err
+	}
+	if from.Longitude, err = strconv.ParseFloat(lon, 64); err != nil {
+		return nil, err
+	}
+
+	return &from, nil
+}
+
+// getItemAvailability lists the stores that stock an item, nearest first
+// when asked from ?lat=&lon=.
+func getItemAvailability(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	from, err := coordinates(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": "lat and lon must both be numbers"})
+		return
+	}
+
+	resp, err := shopSrv.GetItemAvailability(itemID, from)
+	switch {
+	case err == nil:
+	case err == shop.ErrItemNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+		return
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	default:
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func barcodeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, shop.ErrBarcodeNotFound):
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case errors.Is(err, shop.ErrBarcodeInUse):
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// lookupBarcode resolves a scanned UPC/EAN code. With ?storeID= it also says
+// whether and where that store stocks the item.
+func lookupBarcode(c *gin.Context) {
+	storeID := 0
+	if store := c.Query("storeID"); store != "" {
+		var err error
+		storeID, err = strconv.Atoi(store)
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "storeID must be a number"})
+			return
+		}
+	}
+
+	resp, err := shopSrv.LookupBarcode(c.Param("code"), storeID)
+	if err != nil {
+		barcodeError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getBarcodes(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetBarcodes(itemID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createBarcode(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	err = c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.AddBarcode(itemID, request.Code)
+	if err != nil {
+		barcodeError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteBarcode(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.DeleteBarcode(itemID, c.Param("code"))
+	if err != nil {
+		barcodeError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
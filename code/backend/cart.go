@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// getLabels lists the controlled vocabularies items, preferences, promotions,
+// categories and stores use.
+func getLabels(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"dietary":         shop.DietaryLabels,
+		"allergens":       shop.Allergens,
+		"servingUnits":    shop.ServingUnits,
+		"dealTypes":       shop.DealTypes,
+		"promotionScopes": shop.PromotionScopes,
+		"taxClasses":      shop.TaxClasses,
+		"provinces":       shop.Provinces(),
+	})
+}
+
+// getCartNutrition totals the nutrition facts for the cart lines in the body.
+func getCartNutrition(c *gin.Context) {
+	var request []*shop.CartLine
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetCartNutrition(request)
+	if err != nil {
+		if shop.IsInvalid(err) {
+			c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func cartError(c *gin.Context, err error) {
+	if rejection, ok := err.(*shop.CouponRejection); ok {
+		c.AbortWithStatusJSON(422, gin.H{"error": rejection.Message, "reason": rejection.Reason})
+		return
+	}
+	switch {
+	case err == shop.ErrStoreNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// getCart prices the caller's saved cart at its store, promotions and coupon
+// included.
+func getCart(c *gin.Context) {
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.GetCart(c.GetString("username"), profile)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// saveCart replaces the caller's cart with the store and lines in the body.
+func saveCart(c *gin.Context) {
+	var request *shop.Cart
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.Username = c.GetString("username")
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.SaveCart(request, profile)
+	if err != nil {
+		cartError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// setCartLine changes the quantity of one line, 0 to remove it.
+func setCartLine(c *gin.Context) {
+	var request *shop.CartLine
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.SetCartLine(c.GetString("username"), request, profile)
+	if err != nil {
+		cartError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func clearCart(c *gin.Context) {
+	resp, err := shopSrv.ClearCart(c.GetString("username"))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
+
+type couponRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// applyCoupon puts a code on the caller's cart. A code that can't be used is
+// turned down with a 422 and a reason.
+func applyCoupon(c *gin.Context) {
+	var request couponRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	username := c.GetString("username")
+	log.Printf("[Main] [ApplyCoupon] %s %s", username, request.Code)
+	resp, err := shopSrv.ApplyCoupon(username, request.Code, profile)
+	if err != nil {
+		cartError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func removeCoupon(c *gin.Context) {
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.RemoveCoupon(c.GetString("username"), profile)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
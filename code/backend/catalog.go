@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// maxCatalogImportSize caps the size of an uploaded catalog file. Rows are
+// read and imported one at a time, so only the report grows with the file.
+const maxCatalogImportSize = 32 << 20
+
+// catalogListSeparator splits dietary labels and allergens inside a CSV cell.
+const catalogListSeparator = "|"
+
+var categoryCSVColumns = map[string]string{
+	"name":     "name",
+	"category": "name",
+	"parent":   "parent",
+	"taxclass": "taxclass",
+}
+
+var itemCSVColumns = map[string]string{
+	"name":        "name",
+	"item":        "name",
+	"description": "description",
+	"category":    "category",
+	"price":       "price",
+	"dietary":     "dietary",
+	"allergens":   "allergens",
+	"sku":         "sku",
+	"variant":     "variant",
+	"size":        "size",
+	"unit":        "unit",
+}
+
+var stockCSVColumns = map[string]string{
+	"storeid": "storeid",
+	"store":   "storeid",
+	"item":    "item",
+	"name":    "item",
+	"sku":     "sku",
+	"row":     "row",
+	"col":     "col",
+}
+
+// catalogImportBody returns the uploaded file, either a multipart "file" field
+// or the raw request body, and whether it is csv or json. ?format= wins over
+// the content type and the file name.
+func catalogImportBody(c *gin.Context) (io.ReadCloser, string, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCatalogImportSize)
+
+	format := strings.ToLower(c.Query("format"))
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, "", fmt.Errorf("missing catalog file: %v", err)
+		}
+		if format == "" && strings.EqualFold(path.Ext(header.Filename), ".json") {
+			format = "json"
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, "", err
+		}
+		return file, catalogFormat(format), nil
+	}
+
+	if format == "" && c.ContentType() == "application/json" {
+		format = "json"
+	}
+	return c.Request.Body, catalogFormat(format), nil
+}
+
+func catalogFormat(format string) string {
+	if format == "json" {
+		return "json"
+	}
+	return "csv"
+}
+
+// csvRows reads a CSV file one record at a time, finding columns by header
+// name as parseEmployeeCSV does.
+type csvRows struct {
+	reader  *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+func newCSVRows(r io.Reader, names map[string]string, required []string) (*csvRows, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("csv is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		key := strings.ToLower(strings.TrimSpace(name))
+		key = strings.NewReplacer("_", "", " ", "").Replace(key)
+		if field, ok := names[key]; ok {
+			columns[field] = i
+		}
+	}
+	for _, field := range required {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("csv header is missing the %q column", field)
+		}
+	}
+
+	return &csvRows{reader: reader, columns: columns, line: 1}, nil
+}
+
+// next reads the next record and returns a getter for its fields.
+func (r *csvRows) next() (func(field string) string, int, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, 0, err
+	}
+	r.line++
+
+	get := func(field string) string {
+		i, ok := r.columns[field]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	return get, r.line, nil
+}
+
+// jsonRows reads a JSON array one element at a time. Line is the element's
+// position in the array.
+type jsonRows struct {
+	decoder *json.Decoder
+	line    int
+}
+
+func newJSONRows(r io.Reader) (*jsonRows, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return nil, errors.New("json is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('[') {
+		return nil, errors.New("json must be an array of rows")
+	}
+
+	return &jsonRows{decoder: decoder}, nil
+}
+
+// next decodes the next element into row. A field of the wrong type only
+// spoils that row, so it is returned as a problem rather than an error.
+func (r *jsonRows) next(row interface{}) (int, []string, error) {
+	if !r.decoder.More() {
+		return 0, nil, io.EOF
+	}
+	r.line++
+
+	err := r.decoder.Decode(row)
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return r.line, []string{fmt.Sprintf("%s should be a %s", typeErr.Field, typeErr.Type)}, nil
+	}
+	return r.line, nil, err
+}
+
+// csvNumber parses a number cell, noting a problem instead of failing. A blank
+// cell is 0.
+func csvNumber(value, field string, problems *[]string) float64 {
+	if value == "" {
+		return 0
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s %q is not a number", field, value))
+	}
+	return number
+}
+
+func csvInt(value, field string, problems *[]string) int {
+	if value == "" {
+		return 0
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s %q is not a whole number", field, value))
+	}
+	return number
+}
+
+func csvList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var list []string
+	for _, v := range strings.Split(value, catalogListSeparator) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func categoryRows(body io.Reader, format string) (func() (*shop.CategoryRow, error), error) {
+	if format == "json" {
+		rows, err := newJSONRows(body)
+		if err != nil {
+			return nil, err
+		}
+		return func() (*shop.CategoryRow, error) {
+			row := &shop.CategoryRow{}
+			var err error
+			row.Line, row.Problems, err = rows.next(row)
+			return row, err
+		}, nil
+	}
+
+	rows, err := newCSVRows(body, categoryCSVColumns, []string{"name"})
+	if err != nil {
+		return nil, err
+	}
+	return func() (*shop.CategoryRow, error) {
+		get, line, err := rows.next()
+		if err != nil {
+			return nil, err
+		}
+		row := &shop.CategoryRow{Name: get("name"), Parent: get("parent"), TaxClass: get("taxclass")}
+		row.Line = line
+		return row, nil
+	}, nil
+}
+
+func itemRows(body io.Reader, format string) (func() (*shop.ItemRow, error), error) {
+	if format == "json" {
+		rows, err := newJSONRows(body)
+		if err != nil {
+			return nil, err
+		}
+		return func() (*shop.ItemRow, error) {
+			row := &shop.ItemRow{}
+			var err error
+			row.Line, row.Problems, err = rows.next(row)
+			return row, err
+		}, nil
+	}
+
+	rows, err := newCSVRows(body, itemCSVColumns, []string{"name"})
+	if err != nil {
+		return nil, err
+	}
+	return func() (*shop.ItemRow, error) {
+		get, line, err := rows.next()
+		if err != nil {
+			return nil, err
+		}
+		row := &shop.ItemRow{
+			Name:        get("name"),
+			Description: get("description"),
+			Category:    get("category"),
+			Dietary:     csvList(get("dietary")),
+			Allergens:   csvList(get("allergens")),
+			SKU:         get("sku"),
+			Variant:     get("variant"),
+			Unit:        get("unit"),
+		}
+		row.Line = line
+		row.Price = csvNumber(get("price"), "price", &row.Problems)
+		row.Size = csvNumber(get("size"), "size", &row.Problems)
+		return row, nil
+	}, nil
+}
+
+func stockRows(body io.Reader, format string) (func() (*shop.StockRow, error), error) {
+	if format == "json" {
+		rows, err := newJSONRows(body)
+		if err != nil {
+			return nil, err
+		}
+		return func() (*shop.StockRow, error) {
+			row := &shop.StockRow{}
+			var err error
+			row.Line, row.Problems, err = rows.next(row)
+			return row, err
+		}, nil
+	}
+
+	rows, err := newCSVRows(body, stockCSVColumns, []string{"item", "row", "col"})
+	if err != nil {
+		return nil, err
+	}
+	return func() (*shop.StockRow, error) {
+		get, line, err := rows.next()
+		if err != nil {
+			return nil, err
+		}
+		row := &shop.StockRow{Item: get("item"), SKU: get("sku")}
+		row.Line = line
+		row.StoreID = csvInt(get("storeid"), "store", &row.Problems)
+		row.Row = csvInt(get("row"), "row", &row.Problems)
+		row.Col = csvInt(get("col"), "col", &row.Problems)
+		return row, nil
+	}, nil
+}
+
+// catalogImported answers an import. A file that stops parsing part way
+// through is a 400 with the report of the rows before it, which a real run
+// has already written.
+func catalogImported(c *gin.Context, name string, report *shop.ImportReport, err error) {
+	if err != nil && report == nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if err != nil {
+		log.Printf("[Main] [%s] stopped after %d rows: %v", name, report.Total, err)
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+
+	log.Printf("[Main] [%s] %s: %d created, %d updated, %d unchanged, %d failed (dryRun=%v)", name, c.GetString("username"), report.Created, report.Updated, report.Unchanged, report.Failed, report.DryRun)
+	c.JSON(200, report)
+}
+
+// importCategories upserts categories from a CSV or JSON upload. Pass
+// ?dryRun=true to only validate.
+func importCategories(c *gin.Context) {
+	body, format, err := catalogImportBody(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	next, err := categoryRows(body, format)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	report, err := shopSrv.ImportCategories(next, dryRun)
+	catalogImported(c, "ImportCategories", report, err)
+}
+
+// importItems upserts items and variants from a CSV or JSON upload.
+func importItems(c *gin.Context) {
+	body, format, err := catalogImportBody(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	next, err := itemRows(body, format)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	report, err := shopSrv.ImportItems(next, c.GetString("username"), dryRun)
+	catalogImported(c, "ImportItems", report, err)
+}
+
+// importStock upserts stock placements from a CSV or JSON upload. Staff can
+// only import into their own store.
+func importStock(c *gin.Context) {
+	storeID, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	body, format, err := catalogImportBody(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	next, err := stockRows(body, format)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	report, err := shopSrv.ImportStock(next, storeID, dryRun)
+	catalogImported(c, "ImportStock", report, err)
+}
+
+// writeCatalog streams rows out as a CSV or JSON attachment, ?format=json for
+// JSON, flushing as it goes rather than building the whole file first.
+func writeCatalog(c *gin.Context, name string, header []string, count int, record func(i int) []string, row func(i int) interface{}) {
+	format := catalogFormat(strings.ToLower(c.Query("format")))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", name, format))
+
+	if format == "json" {
+		c.Header("Content-Type", "application/json")
+		c.Status(200)
+		encoder := json.NewEncoder(c.Writer)
+		c.Writer.WriteString("[")
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				c.Writer.WriteString(",")
+			}
+			if err := encoder.Encode(row(i)); err != nil {
+				log.Printf("[Main] [ExportCatalog] %s: %v", name, err)
+				return
+			}
+		}
+		c.Writer.WriteString("]\n")
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Status(200)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(header)
+	for i := 0; i < count; i++ {
+		writer.Write(record(i))
+		if i%100 == 99 {
+			writer.Flush()
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("[Main] [ExportCatalog] %s: %v", name, err)
+	}
+}
+
+func csvFloat(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func exportCategories(c *gin.Context) {
+	rows, err := shopSrv.ExportCategories()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	writeCatalog(c, "categories", []string{"name", "parent", "tax_class"}, len(rows), func(i int) []string {
+		return []string{rows[i].Name, rows[i].Parent, rows[i].TaxClass}
+	}, func(i int) interface{} {
+		return rows[i]
+	})
+}
+
+func exportItems(c *gin.Context) {
+	rows, err := shopSrv.ExportItems()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	header := []string{"name", "description", "category", "price", "dietary", "allergens", "sku", "variant", "size", "unit"}
+	writeCatalog(c, "items", header, len(rows), func(i int) []string {
+		r := rows[i]
+		return []string{
+			r.Name, r.Description, r.Category, strconv.FormatFloat(r.Price, 'f', -1, 64),
+			strings.Join(r.Dietary, catalogListSeparator), strings.Join(r.Allergens, catalogListSeparator),
+			r.SKU, r.Variant, csvFloat(r.Size), r.Unit,
+		}
+	}, func(i int) interface{} {
+		return rows[i]
+	})
+}
+
+// exportStock exports a store's placements, ?storeID= for admins. Staff get
+// their own store's.
+func exportStock(c *gin.Context) {
+	storeID, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if storeID == 0 {
+		storeID, err = strconv.Atoi(c.Query("storeID"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "storeID is required"})
+			return
+		}
+	}
+
+	rows, err := shopSrv.ExportStock(storeID)
+	if err == shop.ErrStoreNotFound {
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	writeCatalog(c, fmt.Sprintf("stock-%d", storeID), []string{"store_id", "item", "sku", "row", "col"}, len(rows), func(i int) []string {
+		r := rows[i]
+		return []string{strconv.Itoa(r.StoreID), r.Item, r.SKU, strconv.Itoa(r.Row), strconv.Itoa(r.Col)}
+	}, func(i int) interface{} {
+		return rows[i]
+	})
+}
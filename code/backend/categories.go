@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func categoryError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrCategoryNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrCategoryCycle:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+func getCategoryTree(c *gin.Context) {
+	resp, err := shopSrv.GetCategoryTree()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getCategoryItems lists a category's items, ?descendants=true to include its
+// subcategories. Dietary preferences apply as for /item.
+func getCategoryItems(c *gin.Context) {
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	items, err := shopSrv.GetCategoryItems(categoryID, c.Query("descendants") == "true")
+	if err != nil {
+		categoryError(c, err)
+		return
+	}
+
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	items = shop.FilterItems(items, profile, excludeConflicts(c))
+
+	c.JSON(200, &items)
+}
+
+// moveCategory moves a category and its subtree under parentID, 0 for the
+// top level.
+func moveCategory(c *gin.Context) {
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request struct {
+		ParentID int `json:"parentID"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [MoveCategory] %d -> %d", categoryID, request.ParentID)
+	resp, err := shopSrv.MoveCategory(categoryID, request.ParentID)
+	if err != nil {
+		categoryError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func couponError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrCouponNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrCodeInUse:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+func getCoupons(c *gin.Context) {
+	resp, err := shopSrv.GetCoupons()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createCoupon(c *gin.Context) {
+	var request *shop.Coupon
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.CouponID = 0
+	request.CreatedBy = c.GetString("username")
+
+	if !checkDealStore(c, request.StoreID, "coupon") {
+		return
+	}
+
+	log.Printf("[Main] [CreateCoupon] %v", request)
+	resp, err := shopSrv.CreateCoupon(request)
+	if err != nil {
+		couponError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// findCoupon looks up the :id coupon for a change and checks the caller may
+// make it.
+func findCoupon(c *gin.Context) (*shop.Coupon, bool) {
+	couponID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return nil, false
+	}
+
+	coupons, err := shopSrv.GetCoupons()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return nil, false
+	}
+	for _, coupon := range coupons {
+		if coupon.CouponID == couponID {
+			return coupon, checkDealStore(c, coupon.StoreID, "coupon")
+		}
+	}
+
+	couponError(c, shop.ErrCouponNotFound)
+	return nil, false
+}
+
+func updateCoupon(c *gin.Context) {
+	existing, ok := findCoupon(c)
+	if !ok {
+		return
+	}
+
+	var request *shop.Coupon
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.CouponID = existing.CouponID
+
+	if !checkDealStore(c, request.StoreID, "coupon") {
+		return
+	}
+
+	log.Printf("[Main] [UpdateCoupon] %v", request)
+	resp, err := shopSrv.UpdateCoupon(request)
+	if err != nil {
+		couponError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteCoupon(c *gin.Context) {
+	existing, ok := findCoupon(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.DeleteCoupon(existing.CouponID)
+	if err != nil {
+		couponError(c, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
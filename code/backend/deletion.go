@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// deleteOptions reads ?mode=abort|reassign|cascade&reassignTo= off a delete
+// request.
+func deleteOptions(c *gin.Context) (shop.DeleteOptions, error) {
+	var options shop.DeleteOptions
+	mode, err := shop.ParseDeleteMode(c.Query("mode"))
+	if err != nil {
+		return options, err
+	}
+	options.Mode = mode
+
+	if to := c.Query("reassignTo"); to != "" {
+		options.ReassignTo, err = strconv.Atoi(to)
+		if err != nil {
+			return options, err
+		}
+	}
+
+	return options, nil
+}
+
+// deletionError reports a refused delete along with what depends on the
+// target, so the caller can pick a mode.
+func deletionError(c *gin.Context, err error, dependents interface{}) {
+	switch err {
+	case shop.ErrHasDependents:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error(), "dependents": dependents})
+	case shop.ErrReassignToTarget:
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	case shop.ErrCategoryNotFound, shop.ErrStoreNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case shop.ErrCategoryCycle:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+func getCategoryDependents(c *gin.Context) {
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetCategoryDependents(categoryID)
+	if err != nil {
+		categoryError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getStoreDependents(c *gin.Context) {
+	storeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetStoreDependents(storeID)
+	if err != nil {
+		deletionError(c, err, nil)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/gin-gonic/gin"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// maxEmployeeImportSize caps the size of an uploaded employee CSV.
+const maxEmployeeImportSize = 1 << 20
+
+// employeeImportColumns maps accepted CSV header names to the field they fill.
+var employeeImportColumns = map[string]string{
+	"username":  "username",
+	"email":     "email",
+	"firstname": "firstname",
+	"lastname":  "lastname",
+	"storeid":   "storeid",
+	"store":     "storeid",
+}
+
+type employeeImportRow struct {
+	Line      int
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+	StoreID   int
+	errors    []string
+}
+
+type employeeImportResult struct {
+	Line     int      `json:"line"`
+	Username string   `json:"username"`
+	StoreID  int      `json:"storeid"`
+	Status   string   `json:"status"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+type employeeImportReport struct {
+	DryRun  bool                    `json:"dryRun"`
+	Total   int                     `json:"total"`
+	Valid   int                     `json:"valid"`
+	Created int                     `json:"created"`
+	Failed  int                     `json:"failed"`
+	Results []*employeeImportResult `json:"results"`
+}
+
+// importEmployees creates employee accounts from a CSV upload. Every row is
+// validated before anything is created; invalid rows are reported and skipped
+// so one bad row doesn't abort the rest of the batch. Pass ?dryRun=true to get
+// the validation report without creating any accounts.
+func importEmployees(c *gin.Context) {
+	currentUser := c.GetString("username")
+	if currentUser == "" {
+		c.AbortWithError(500, errors.New("Could not get username from token"))
+		return
+	}
+
+	// managers can only add staff to their own store
+	managerStoreID := 0
+	if !isAdmin(c) {
+		managerInfo, err := userSrv.GetProfile(currentUser)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		managerStoreID = managerInfo.StoreID
+	}
+
+	body, err := employeeImportBody(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	rows, err := parseEmployeeCSV(body)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateEmployeeRows(rows, managerStoreID); err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	report := &employeeImportReport{DryRun: dryRun, Total: len(rows)}
+
+	for _, row := range rows {
+		result := &employeeImportResult{Line: row.Line, Username: row.Username, StoreID: row.StoreID}
+		report.Results = append(report.Results, result)
+
+		if len(row.errors) > 0 {
+			result.Status = "invalid"
+			result.Errors = row.errors
+			report.Failed++
+			continue
+		}
+		report.Valid++
+
+		if dryRun {
+			result.Status = "valid"
+			continue
+		}
+
+		if err := provisionEmployee(row); err != nil {
+			log.Printf("[Main] [ImportEmployees] line %d %s: %v", row.Line, row.Username, err)
+			result.Status = "failed"
+			result.Errors = []string{err.Error()}
+			report.Failed++
+			continue
+		}
+		result.Status = "created"
+		report.Created++
+	}
+
+	log.Printf("[Main] [ImportEmployees] %s imported %d/%d rows (dryRun=%v)", currentUser, report.Created, report.Total, dryRun)
+
+	c.JSON(200, report)
+}
+
+// employeeImportBody returns the CSV either from a multipart "file" field or
+// from the raw request body.
+func employeeImportBody(c *gin.Context) (io.ReadCloser, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxEmployeeImportSize)
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("missing csv file: %v", err)
+		}
+		return header.Open()
+	}
+
+	return c.Request.Body, nil
+}
+
+func parseEmployeeCSV(r io.Reader) ([]*employeeImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("csv is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		key := strings.ToLower(strings.TrimSpace(name))
+		key = strings.NewReplacer("_", "", " ", "").Replace(key)
+		if field, ok := employeeImportColumns[key]; ok {
+			columns[field] = i
+		}
+	}
+	for _, field := range []string{"username", "email", "firstname", "lastname", "storeid"} {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("csv header is missing the %q column", field)
+		}
+	}
+
+	var rows []*employeeImportRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		get := func(field string) string {
+			i := columns[field]
+			if i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		row := &employeeImportRow{
+			Line:      line,
+			Username:  get("username"),
+			Email:     get("email"),
+			FirstName: get("firstname"),
+			LastName:  get("lastname"),
+		}
+		if store := get("storeid"); store != "" {
+			storeID, err := strconv.Atoi(store)
+			if err != nil {
+				row.errors = append(row.errors, fmt.Sprintf("store %q is not a number", store))
+				storeID = -1
+			}
+			row.StoreID = storeID
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("csv has no employee rows")
+	}
+
+	return rows, nil
+}
+
+// validateEmployeeRows records every problem with a row on the row itself.
+// managerStoreID is 0 for admins, who may import into any store.
+func validateEmployeeRows(rows []*employeeImportRow, managerStoreID int) error {
+	stores, err := shopSrv.GetStores()
+	if err != nil {
+		return err
+	}
+	knownStores := make(map[int]bool)
+	for _, store := range stores {
+		knownStores[store.StoreID] = true
+	}
+
+	seen := make(map[string]int)
+	for _, row := range rows {
+		if row.Username == "" {
+			row.errors = append(row.errors, "username is required")
+		} else if strings.ContainsAny(row.Username, " \t") {
+			row.errors = append(row.errors, "username cannot contain spaces")
+		} else if first, ok := seen[strings.ToLower(row.Username)]; ok {
+			row.errors = append(row.errors, fmt.Sprintf("username duplicates line %d", first))
+		} else {
+			seen[strings.ToLower(row.Username)] = row.Line
+
+			existing, err := userSrv.GetProfile(row.Username)
+			if err != nil {
+				return err
+			}
+			if existing.Username != "" {
+				row.errors = append(row.errors, "username already exists")
+			}
+		}
+
+		if row.Email == "" {
+			row.errors = append(row.errors, "email is required")
+		} else if _, err := mail.ParseAddress(row.Email); err != nil {
+			row.errors = append(row.errors, fmt.Sprintf("email %q is not valid", row.Email))
+		}
+		if row.FirstName == "" {
+			row.errors = append(row.errors, "first name is required")
+		}
+		if row.LastName == "" {
+			row.errors = append(row.errors, "last name is required")
+		}
+
+		switch {
+		case row.StoreID < 0:
+			// already reported while parsing
+		case row.StoreID == 0 && managerStoreID != 0:
+			row.StoreID = managerStoreID
+		case row.StoreID == 0:
+			row.errors = append(row.errors, "store is required")
+		case !knownStores[row.StoreID]:
+			row.errors = append(row.errors, fmt.Sprintf("store %d does not exist", row.StoreID))
+		case managerStoreID != 0 && row.StoreID != managerStoreID:
+			row.errors = append(row.errors, "The employee's StoreID does not match the Manager's Store ID")
+		}
+	}
+
+	return nil
+}
+
+// provisionEmployee runs the same steps as createEmployee: the Cognito
+// account, the employee group and the profile in the user DB.
+func provisionEmployee(row *employeeImportRow) error {
+	payload := &cognito.AdminCreateUserInput{
+		DesiredDeliveryMediums: []*string{aws.String("EMAIL")},
+		UserAttributes:         []*cognito.AttributeType{{Name: aws.String(cognito.UsernameAttributeTypeEmail), Value: aws.String(row.Email)}},
+		UserPoolId:             aws.String(userPoolID),
+		Username:               aws.String(row.Username),
+	}
+	if _, err := userSrv.CreateEmployee(payload); err != nil {
+		return err
+	}
+
+	group := &cognito.AdminAddUserToGroupInput{
+		GroupName:  aws.String("employee"),
+		UserPoolId: aws.String(userPoolID),
+		Username:   aws.String(row.Username),
+	}
+	if _, err := userSrv.AddUserToGroup(group); err != nil {
+		return fmt.Errorf("account created but not added to the employee group: %v", err)
+	}
+
+	if err := userSrv.CreateProfile(row.Username, row.StoreID, row.FirstName, row.LastName, row.Email); err != nil {
+		return fmt.Errorf("account created but profile failed: %v", err)
+	}
+
+	return nil
+}
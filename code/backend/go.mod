@@ -8,13 +8,19 @@ replace github.com/AkinAD/basedCode/auth => ./auth
 
 replace github.com/AkinAD/basedCode/shop => ./shop
 
+replace github.com/AkinAD/basedCode/media => ./media
+
+replace github.com/AkinAD/basedCode/payment => ./payment
+
 require (
 	github.com/AkinAD/basedCode/auth v1.0.0
+	github.com/AkinAD/basedCode/media v1.0.0
+	github.com/AkinAD/basedCode/payment v1.0.0
 	github.com/AkinAD/basedCode/shop v1.0.0
 	github.com/AkinAD/basedCode/user v1.0.0
 	github.com/aws/aws-sdk-go v1.35.35
 	github.com/gin-contrib/cors v1.3.1
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-gonic/gin v1.7.0 // 1.7 lets a static segment sit beside a param one: /category/tree by /category/:id, /store/nearby by /store/:id, /item/barcode/:code by /item/:id
 	github.com/go-playground/validator/v10 v10.4.1 // indirect
 	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/jackc/pgx/v4 v4.9.2 // indirect
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func hoursError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrStoreNotFound, err == shop.ErrHoursExceptionNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// getNearbyStores ranks the stores within ?radius= km of ?lat=&lon= by
+// distance.
+func getNearbyStores(c *gin.Context) {
+	from, err := coordinates(c)
+	if err != nil || from == nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": "lat and lon are required and must be numbers"})
+		return
+	}
+	radius := 0.0
+	if r := c.Query("radius"); r != "" {
+		if radius, err = strconv.ParseFloat(r, 64); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+	}
+
+	resp, err := shopSrv.GetNearbyStores(from, radius)
+	if err != nil {
+		hoursError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// setStoreHours replaces a store's whole week of opening hours.
+func setStoreHours(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	var request []*shop.OpeningHours
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [SetStoreHours] %d: %d periods", storeID, len(request))
+	resp, err := shopSrv.SetStoreHours(storeID, request)
+	if err != nil {
+		hoursError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func setHoursException(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	var request *shop.HoursException
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.StoreID = storeID
+	request.Date = c.Param("date")
+
+	log.Printf("[Main] [SetHoursException] %d on %s closed=%t", storeID, request.Date, request.Closed)
+	resp, err := shopSrv.SetHoursException(request)
+	if err != nil {
+		hoursError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteHoursException(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.DeleteHoursException(storeID, c.Param("date"))
+	if err != nil {
+		hoursError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	media "github.com/AkinAD/basedCode/media"
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// imageFormOverhead is what a multipart upload may add around the image: the
+// boundaries and part headers.
+const imageFormOverhead = 64 << 10
+
+// newImageStorage picks the image storage backend from IMAGE_STORAGE.
+func newImageStorage() media.Storage {
+	switch imageStorageType {
+	case "s3":
+		storage, err := media.NewS3Storage(awsRegion, awsID, awsSecret, imageBucket, imageEndpoint, imageBaseURL)
+		if err != nil {
+			panic(err)
+		}
+		return storage
+	case "local":
+		return media.NewLocalStorage(imageDir, imageBaseURL)
+	}
+
+	panic(fmt.Sprintf("unknown IMAGE_STORAGE %q, expected local or s3", imageStorageType))
+}
+
+func randomName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// removeItemImage deletes an item image's files. Failures are only logged;
+// at worst an unreferenced file is left behind.
+func removeItemImage(image *shop.ItemImage) {
+	if image == nil {
+		return
+	}
+	for _, key := range []string{image.ImageKey, image.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := imageStore.Delete(key); err != nil {
+			log.Printf("[Main] [RemoveItemImage] %s: %v", key, err)
+		}
+	}
+}
+
+// uploadItemImage replaces an item's picture. The image comes either as the
+// "image" field of a multipart form or as the raw request body.
+func uploadItemImage(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, imageMaxBytes+imageFormOverhead)
+
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		header, err := c.FormFile("image")
+		if err != nil && strings.Contains(err.Error(), "request body too large") {
+			c.AbortWithStatusJSON(413, gin.H{"error": fmt.Sprintf("image must be at most %d bytes", imageMaxBytes)})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "missing image file"})
+			return
+		}
+		file, err := header.Open()
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	upload, err := media.Process(body, imageMaxBytes)
+	switch err {
+	case nil:
+	case media.ErrTooLarge:
+		c.AbortWithStatusJSON(413, gin.H{"error": fmt.Sprintf("image must be at most %d bytes", imageMaxBytes)})
+		return
+	case media.ErrTooManyPixels:
+		c.AbortWithStatusJSON(413, gin.H{"error": err.Error()})
+		return
+	case media.ErrUnsupported:
+		c.AbortWithStatusJSON(415, gin.H{"error": err.Error()})
+		return
+	default:
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := randomName()
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	image := &shop.ItemImage{
+		ImageKey:     fmt.Sprintf("items/%d/%s%s", itemID, name, upload.Ext),
+		ThumbnailKey: fmt.Sprintf("items/%d/%s_thumb%s", itemID, name, upload.ThumbnailExt),
+	}
+
+	image.ImageURL, err = imageStore.Put(image.ImageKey, upload.ContentType, upload.Data)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	image.ThumbnailURL, err = imageStore.Put(image.ThumbnailKey, upload.ThumbnailType, upload.Thumbnail)
+	if err != nil {
+		removeItemImage(image)
+		c.AbortWithError(500, err)
+		return
+	}
+
+	previous, err := shopSrv.SetItemImage(itemID, image)
+	if err != nil {
+		removeItemImage(image)
+		c.AbortWithError(500, err)
+		return
+	}
+	removeItemImage(previous)
+
+	log.Printf("[Main] [UploadItemImage] %d %s %dx%d", itemID, upload.ContentType, upload.Width, upload.Height)
+
+	c.JSON(200, &image)
+}
+
+func deleteItemImage(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	previous, err := shopSrv.SetItemImage(itemID, nil)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	removeItemImage(previous)
+
+	c.JSON(200, true)
+}
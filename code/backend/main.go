@@ -10,6 +10,8 @@ import (
 	"time"
 
 	auth "github.com/AkinAD/basedCode/auth"
+	media "github.com/AkinAD/basedCode/media"
+	payment "github.com/AkinAD/basedCode/payment"
 	shop "github.com/AkinAD/basedCode/shop"
 	user "github.com/AkinAD/basedCode/user"
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
@@ -22,6 +24,9 @@ import (
 var (
 	userSrv user.UserService
 	shopSrv shop.ShopService
+
+	imageStore media.Storage
+	gateway    payment.Gateway
 	//storeSrv db.DbService
 	// authSrv auth.AuthService
 
@@ -32,6 +37,16 @@ var (
 	awsID              string
 	awsSecret          string
 	cognitoAppClientID string
+	imageStorageType   string
+	imageDir           string
+	imageBaseURL       string
+	imageBucket        string
+	imageEndpoint      string
+	imageMaxBytes      int64
+	priceInterval      time.Duration
+	paymentGateway     string
+	paymentWebhookURL  string
+	paymentSecret      string
 )
 
 func main() {
@@ -49,8 +64,17 @@ func main() {
 
 	userSrv = user.NewService(awsRegion, awsID, awsSecret, connString)
 	shopSrv = shop.NewService(connString)
+	imageStore = newImageStorage()
+	gateway = newPaymentGateway()
+	if priceInterval > 0 {
+		go runPriceScheduler(priceInterval)
+	}
 	// authSrv = auth.NewService()
 
+	if imageStorageType == "local" {
+		router.Static("/images", imageDir)
+	}
+
 	// heartbeat
 	router.GET("/", homeHandler)
 	router.GET("/heartbeat", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), heartbeat)
@@ -63,6 +87,8 @@ func main() {
 	router.GET("/account/:user", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), getAccountByUsername)
 	router.PUT("/account/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), updateAccount)
 	//router.GET("/account/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getProfile)
+	router.GET("/preferences", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getPreferences)
+	router.PUT("/preferences", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), updatePreferences)
 
 	//users
 	router.GET("/user", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), getGroupUser)
@@ -70,10 +96,21 @@ func main() {
 	//employees
 	router.GET("/employee", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getGroupEmployee)
 	router.POST("/employee", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), createEmployee)
+	router.POST("/employee/import", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), importEmployees) //?dryRun=true to only validate
 	// router.PUT("/employee", auth.AuthMiddleware(cognitoRegion, userPoolID, []string{"employee", "manager", "admin"}), updateEmployee)
 	// router.DELETE("/employee", auth.AuthMiddleware(cognitoRegion, userPoolID, []string{manager", "admin"}), deleteEmployee)
 	router.DELETE("/employee", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deleteFromAdmin)
 
+	//shifts
+	router.GET("/shift", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getShifts) //?storeID=&username=&from=&to=
+	router.GET("/shift/me", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getMyShifts)
+	router.POST("/shift", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), createShift)
+	router.PUT("/shift/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), updateShift)
+	router.DELETE("/shift/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deleteShift)
+	router.POST("/timeclock/in", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), clockIn)
+	router.POST("/timeclock/out", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), clockOut)
+	router.GET("/timesheet", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getTimesheet) //?storeID=&from=&to=
+
 	//managers
 	router.GET("/manager", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getGroupManager)
 	router.POST("/manager", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), promoteToManager)
@@ -86,29 +123,130 @@ func main() {
 	router.DELETE("/admin", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), deleteFromAdmin)
 
 	//item
-	router.GET("/item", getItems) //?storeID= to get the shops/stock for a specific store
-	router.GET("/item/:id", getItem)
+	router.GET("/item", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getItems) //?storeID= for the items a store stocks at its prices, ?diet=filter to hide items that conflict with the shopper's preferences
+	router.GET("/item/:id", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getItem)
 	router.POST("/item", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), createItem)
 	router.PUT("/item/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), updateItem)
 	router.DELETE("/item/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteItem)
+	router.GET("/item/barcode/:code", lookupBarcode) //?storeID= to also get the item's location in that store
+	router.PUT("/item/:id/image", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), uploadItemImage)
+	router.DELETE("/item/:id/image", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteItemImage)
+	router.GET("/item/:id/variant", getVariants)
+	router.POST("/item/:id/variant", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), createVariant)
+	router.PUT("/item/:id/variant/:variant", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), updateVariant)
+	router.DELETE("/item/:id/variant/:variant", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteVariant)
+	router.GET("/item/:id/price", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getPriceHistory)
+	router.POST("/item/:id/price", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), schedulePriceChange)         //effectiveAt in the future to schedule it
+	router.DELETE("/item/:id/price/:change", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), cancelPriceChange) //pending changes only
+	router.GET("/item/:id/barcode", getBarcodes)
+	router.POST("/item/:id/barcode", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), createBarcode)
+	router.DELETE("/item/:id/barcode/:code", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteBarcode)
+	router.GET("/item/:id/availability", getItemAvailability)                                               //?lat=&lon= to sort stores by distance
+	router.GET("/item/:id/substitutes", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getSubstitutes) //?storeID= (required) to rank what that store stocks, ?limit=
+	router.GET("/item/:id/review", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getItemReviews)      //?sort=newest|oldest|highest|lowest&page=&pageSize=, ?status=hidden for staff
+	router.GET("/item/:id/review/mine", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getMyReview)
+	router.POST("/item/:id/review", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), createReview)
+	router.PUT("/item/:id/review/:review", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), updateReview)    //author only
+	router.DELETE("/item/:id/review/:review", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), deleteReview) //author or staff
+
+	//recommendations
+	router.GET("/recommendations", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getRecommendations) //?storeID= to only suggest what that store stocks, ?limit=
+
+	//review moderation
+	router.GET("/review", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getReviews) //?status=hidden&sort=&page=&pageSize=
+	router.PUT("/review/:review/moderation", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), moderateReview)
+	router.GET("/labels", getLabels) //dietary labels, allergens and serving units items can use
 
 	//store
 	router.GET("/store", getStores)
-	router.GET("/store/:id", getStore) //return store + stock
+	router.GET("/store/nearby", getNearbyStores)                                           //?lat=&lon= (required), ?radius= in km, 25 by default
+	router.GET("/store/:id", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getStore) //return store + stock, ?diet=filter as for /item
 	router.POST("/store", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), createStore)
 	router.PUT("/store", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), updateStore)
-	router.DELETE("/store/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), deleteStore)
+	router.DELETE("/store/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), deleteStore) //?mode=abort|reassign|cascade&reassignTo=
+	router.GET("/store/:id/dependents", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), getStoreDependents)
+	router.PUT("/store/:id/hours", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), setStoreHours)           //replaces the whole week
+	router.PUT("/store/:id/hours/:date", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), setHoursException) //YYYY-MM-DD, {"closed":true} for a holiday
+	router.DELETE("/store/:id/hours/:date", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deleteHoursException)
+	router.GET("/store/:id/slot", getSlots) //?from=&to= RFC 3339, the coming week by default
+	router.GET("/store/:id/slot/template", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getSlotTemplates)
+	router.POST("/store/:id/slot/template", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), createSlotTemplate) //{"weekday":1,"opens":"09:00","closes":"17:00","duration":30,"capacity":5}
+	router.PUT("/store/:id/slot/template/:template", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), updateSlotTemplate)
+	router.DELETE("/store/:id/slot/template/:template", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deleteSlotTemplate)
+	router.GET("/store/:id/slot/picklist", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getPickList) //?start= of the slot
+	router.GET("/store/:id/price", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getStorePrices)
+	router.PUT("/store/:id/price", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), setStorePrice)
+	router.DELETE("/store/:id/price/:item", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deleteStorePrice) //?variantID= for a variant's override
 
 	//stock
 	router.POST("/stock", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), createStock)
 	router.PUT("/stock", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), editStock)
-	router.DELETE("/stock/:store/:item", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteStock)
+	router.DELETE("/stock/:store/:item", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteStock) //removes the item and all its variants
+	router.DELETE("/stock/:store/:item/:variant", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), deleteVariantStock)
+
+	//catalog import/export, csv or json (?format=json)
+	router.POST("/catalog/categories/import", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), importCategories)              //?dryRun=true to only validate
+	router.POST("/catalog/items/import", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), importItems) //?dryRun=true to only validate
+	router.POST("/catalog/stock/import", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), importStock) //?dryRun=true to only validate
+	router.GET("/catalog/categories/export", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), exportCategories)
+	router.GET("/catalog/items/export", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), exportItems)
+	router.GET("/catalog/stock/export", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), exportStock) //?storeID= for admins
+
+	//cart
+	router.POST("/cart/nutrition", getCartNutrition)
+	router.POST("/cart/total", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getCartTotal) //?storeID= to price the cart at that store
+	router.GET("/cart", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getCart)
+	router.PUT("/cart", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), saveCart)
+	router.PUT("/cart/item", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), setCartLine) //quantity 0 removes the line
+	router.DELETE("/cart", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), clearCart)
+	router.POST("/cart/coupon", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), applyCoupon)
+	router.DELETE("/cart/coupon", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), removeCoupon)
+	router.PUT("/cart/slot", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), reserveSlot) //{"templateID":,"startsAt":}, held for 30 minutes
+	router.GET("/cart/slot", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getSlotReservation)
+	router.DELETE("/cart/slot", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), releaseSlot)
+
+	//orders
+	router.POST("/order", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), placeOrder) //checks out the caller's cart at its store
+	router.GET("/order", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getMyOrders) //?status=&page=&pageSize=
+	router.GET("/order/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getOrder)
+	router.PUT("/order/:id/status", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), updateOrderStatus) //shoppers can only cancel a placed order
+	router.GET("/order/:id/payment", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getOrderPayments)
+	router.POST("/order/:id/payment", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), payOrder)          //{"source": card number}, Idempotency-Key header optional
+	router.POST("/order/:id/payment/capture", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), capturePayment)    //{"amount": 0 for what was picked}, also done on completion
+	router.POST("/order/:id/payment/refund", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), refundPayment)                  //{"amount": 0 for all}
+	router.POST("/order/:id/payment/void", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), voidPayment)          //also done on cancellation
+	router.POST("/order/:id/payment/settle", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), settleOrderPayment) //retries capturing or giving back a finished order's payment, see settleError
+	router.GET("/order/:id/return", auth.AuthMiddleware(awsRegion, userPoolID, []string{"user", "employee", "manager", "admin"}), getOrderReturns)
+	router.POST("/order/:id/return", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), recordReturn) //{"lines":[{"itemID":,"variantID":,"quantity":,"reason":,"condition":}],"note":}, refunds on the payment
+	router.POST("/order/:id/return/:return/refund", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), retryReturnRefund)
+	router.POST("/payment/webhook", paymentWebhook)                                                                                       //signed status callbacks from the payment provider
+	router.GET("/store/:id/order", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getOrderQueue)   //?status=&page=&pageSize=, orders to fulfil by default
+	router.POST("/store/:id/pick", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), createPickBatch) //{"orders":[...]} or {"slot": start}, moves them to picking
+	router.GET("/store/:id/pick", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getPickBatches)   //?status=open|done
+	router.GET("/store/:id/pick/:batch", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), getPickBatch)
+	router.PUT("/store/:id/pick/:batch/line/:line", auth.AuthMiddleware(awsRegion, userPoolID, []string{"employee", "manager", "admin"}), pickLine) //{"status":"picked|short|substituted","picked":,"substituteItemID":,"note":}
+	router.GET("/store/:id/returns/report", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getReturnsReport)             //?from=&to= YYYY-MM-DD, the last 30 days by default
+
+	//promotions
+	router.GET("/promotion", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getPromotions) //?storeID=&expired=true
+	router.GET("/promotion/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getPromotion)
+	router.POST("/promotion", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), createPromotion)
+	router.PUT("/promotion/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), updatePromotion)
+	router.DELETE("/promotion/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deletePromotion)
+	router.GET("/coupon", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), getCoupons)
+	router.POST("/coupon", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), createCoupon)
+	router.PUT("/coupon/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), updateCoupon)
+	router.DELETE("/coupon/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"manager", "admin"}), deleteCoupon)
 
 	//item
 	router.GET("/category", getCategories)
 	router.POST("/category", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), createCategory)
 	router.PUT("/category", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), updateCategory)
-	router.DELETE("/category/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), deleteCategory)
+	router.DELETE("/category/:id", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), deleteCategory) //?mode=abort|reassign|cascade&reassignTo=
+	router.GET("/category/:id/dependents", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), getCategoryDependents)
+	router.GET("/category/tree", getCategoryTree)
+	router.GET("/category/:id/items", auth.OptionalAuthMiddleware(awsRegion, userPoolID), getCategoryItems)         //?descendants=true to include subcategories
+	router.PUT("/category/:id/parent", auth.AuthMiddleware(awsRegion, userPoolID, []string{"admin"}), moveCategory) //moves the whole subtree
 
 	if port == "443" {
 		router.RunTLS(":"+port, "./certs/smartshopper_certificate.cer", "./certs/smartshopper_key.key")
@@ -125,6 +263,16 @@ func init() {
 	awsSecret = defaulter("AWS_SECRET", "")
 	userPoolID = defaulter("COGNITO_USER_POOL_ID", "")
 	cognitoAppClientID = defaulter("COGNITO_APP_CLIENT_ID", "")
+	imageStorageType = defaulter("IMAGE_STORAGE", "local")
+	imageDir = defaulter("IMAGE_DIR", "./uploads")
+	imageBaseURL = defaulter("IMAGE_BASE_URL", "/images")
+	imageBucket = defaulter("IMAGE_BUCKET", "")
+	imageEndpoint = defaulter("IMAGE_ENDPOINT", "")
+	imageMaxBytes = defaulterBytes("IMAGE_MAX_BYTES", 5242880)
+	priceInterval = defaulterDuration("PRICE_SCHEDULER_INTERVAL", time.Minute) // 0 turns the scheduler off
+	paymentGateway = defaulter("PAYMENT_GATEWAY", "")                          // payments are off without it, see newPaymentGateway
+	paymentWebhookURL = defaulter("PAYMENT_WEBHOOK_URL", "")
+	paymentSecret = defaulter("PAYMENT_WEBHOOK_SECRET", "") // payments are off without it
 }
 
 func initPostgres() string {
@@ -149,12 +297,44 @@ func defaulter(envName, defaultValue string) string {
 	return input
 }
 
+// defaulterBytes reads a positive byte count, falling back to the default
+// when the variable is unset or isn't one.
+func defaulterBytes(envName string, defaultValue int64) int64 {
+	input := os.Getenv(envName)
+	if len(input) == 0 {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseInt(input, 10, 64)
+	if err != nil || value <= 0 {
+		log.Printf("[Main] %s=%q is not a positive number of bytes, using %d", envName, input, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// defaulterDuration reads a duration such as "30s" or "5m", falling back to
+// the default when it is missing or doesn't parse.
+func defaulterDuration(envName string, defaultValue time.Duration) time.Duration {
+	input := os.Getenv(envName)
+	if len(input) == 0 {
+		return defaultValue
+	}
+
+	value, err := time.ParseDuration(input)
+	if err != nil || value < 0 {
+		log.Printf("[Main] %s=%q is not a duration, using %s", envName, input, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
 var corsMiddleware = cors.New(cors.Config{
 	// AllowOrigins:     []string{"https://wheypal.com", "http://localhost:8080"},
 	AllowOrigins: []string{"*"},
 	AllowMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
 	// AllowMethods:     []string{"*"},
-	AllowHeaders:     []string{"Authorization", "Origin", "Content-Length", "Content-Type"},
+	AllowHeaders:     []string{"Authorization", "Origin", "Content-Length", "Content-Type", "Idempotency-Key"},
 	AllowCredentials: true,
 	MaxAge:           12 * time.Hour,
 })
@@ -608,11 +788,31 @@ func promoteTo(c *gin.Context, group string) {
 }
 
 func getItems(c *gin.Context) {
-	items, err := shopSrv.GetItems()
+	var items []*shop.Item
+	var err error
+	if storeID := c.Query("storeID"); storeID != "" {
+		ID, convErr := strconv.Atoi(storeID)
+		if convErr != nil {
+			c.AbortWithError(400, convErr)
+			return
+		}
+		// only what the store stocks, at the store's prices
+		items, err = shopSrv.GetItemsFromStore(ID)
+	} else {
+		items, err = shopSrv.GetItems()
+	}
 
 	if err != nil {
 		c.JSON(500, err)
+		return
+	}
+
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
 	}
+	items = shop.FilterItems(items, profile, excludeConflicts(c))
 
 	c.JSON(200, &items)
 }
@@ -632,20 +832,41 @@ func getItem(c *gin.Context) {
 		c.JSON(500, err)
 	}
 
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if resp != nil {
+		resp.Conflicts = profile.ConflictsWith(resp)
+	}
+
 	c.JSON(200, &resp)
 }
 
+// itemError answers what the item can't be saved with, such as an unknown
+// dietary label, with a 400.
+func itemError(c *gin.Context, err error) {
+	if shop.IsInvalid(err) {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithError(500, err)
+}
+
 func createItem(c *gin.Context) {
 	var request *shop.Item
 	err := c.ShouldBind(&request)
 	if err != nil {
-		c.AbortWithError(502, err)
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
 	}
 	fmt.Println("createItem lots of boba")
 	// if POSTMAN request body doesn't have itemID then &resp is null
-	resp, err := shopSrv.CreateItem(request)
+	resp, err := shopSrv.CreateItem(request, c.GetString("username"))
 	if err != nil {
-		c.AbortWithError(502, err)
+		itemError(c, err)
+		return
 	}
 
 	c.JSON(200, &resp)
@@ -655,7 +876,8 @@ func updateItem(c *gin.Context) {
 	var request *shop.Item
 	err := c.ShouldBind(&request)
 	if err != nil {
-		c.AbortWithError(502, err)
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
 	idString := c.Param("id")
@@ -670,9 +892,10 @@ func updateItem(c *gin.Context) {
 	fmt.Println("updateItem request")
 	fmt.Printf("%+v\n", request)
 	// if POSTMAN request body doesn't have itemID then &resp is null
-	resp, err := shopSrv.UpdateItem(request)
+	resp, err := shopSrv.UpdateItem(request, c.GetString("username"))
 	if err != nil {
-		c.AbortWithError(502, err)
+		itemError(c, err)
+		return
 	}
 
 	c.JSON(200, &resp)
@@ -719,19 +942,38 @@ func getStore(c *gin.Context) {
 		c.JSON(500, err)
 	}
 
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	resp = shop.FilterStock(resp, profile, excludeConflicts(c))
+
 	c.JSON(200, &resp)
 }
 
+// storeError answers what a store can't be saved with, such as an unknown
+// province, with a 400.
+func storeError(c *gin.Context, err error) {
+	if shop.IsInvalid(err) {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithError(500, err)
+}
+
 func createStore(c *gin.Context) {
 	var request *shop.Store
 	err := c.ShouldBind(&request)
 	if err != nil {
-		c.AbortWithError(502, err)
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
 	resp, err := shopSrv.CreateStore(request)
 	if err != nil {
-		c.AbortWithError(502, err)
+		storeError(c, err)
+		return
 	}
 
 	c.JSON(200, &resp)
@@ -741,12 +983,14 @@ func updateStore(c *gin.Context) {
 	var request *shop.Store
 	err := c.ShouldBind(&request)
 	if err != nil {
-		c.AbortWithError(502, err)
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
 	resp, err := shopSrv.UpdateStore(request)
 	if err != nil {
-		c.AbortWithError(502, err)
+		storeError(c, err)
+		return
 	}
 
 	c.JSON(200, &resp)
@@ -760,13 +1004,35 @@ func deleteStore(c *gin.Context) {
 		return
 	}
 
-	resp, err := shopSrv.DeleteStore(storeID)
-
+	options, err := deleteOptions(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	actor, err := orderActor(c)
 	if err != nil {
 		c.AbortWithError(500, err)
 		return
 	}
 
+	log.Printf("[Main] [DeleteStore] %d mode=%s reassignTo=%d", storeID, options.Mode, options.ReassignTo)
+	resp, err := shopSrv.DeleteStore(storeID, options)
+
+	if err != nil {
+		deletionError(c, err, resp)
+		return
+	}
+
+	// the orders it cancelled give their money back like any other cancellation
+	for _, orderID := range resp.Cancelled {
+		order, err := shopSrv.GetOrder(orderID, actor)
+		if err != nil {
+			log.Printf("[Main] [DeleteStore] order %d: %v", orderID, err)
+			continue
+		}
+		settleOrder(order)
+	}
+
 	c.JSON(200, &resp)
 }
 
@@ -897,7 +1163,9 @@ func getCategories(c *gin.Context) {
 
 func createCategory(c *gin.Context) {
 	type Request struct {
-		Name string `json:"name"`
+		Name     string `json:"name"`
+		TaxClass string `json:"taxClass"`
+		ParentID int    `json:"parentID"`
 	}
 	var request *Request
 	err := c.ShouldBind(&request)
@@ -906,7 +1174,7 @@ func createCategory(c *gin.Context) {
 		return
 	}
 
-	resp, err := shopSrv.CreateCategory(request.Name)
+	resp, err := shopSrv.CreateCategory(&shop.Category{Name: request.Name, TaxClass: request.TaxClass, ParentID: request.ParentID})
 	if err != nil {
 		c.AbortWithError(502, err)
 		return
@@ -941,10 +1209,17 @@ func deleteCategory(c *gin.Context) {
 		return
 	}
 
-	resp, err := shopSrv.DeleteCategory(storeID)
+	options, err := deleteOptions(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[Main] [DeleteCategory] %d mode=%s reassignTo=%d", storeID, options.Mode, options.ReassignTo)
+	resp, err := shopSrv.DeleteCategory(storeID, options)
 
 	if err != nil {
-		c.AbortWithError(500, err)
+		deletionError(c, err, resp)
 		return
 	}
 
@@ -0,0 +1,5 @@
+module media
+
+go 1.15
+
+require github.com/aws/aws-sdk-go v1.35.35
@@ -0,0 +1,158 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	// registered for image.Decode
+	_ "image/gif"
+)
+
+// ThumbnailSize is the largest width or height of a generated thumbnail.
+const ThumbnailSize = 256
+
+// MaxPixels caps width x height. A small compressed file can declare a huge
+// canvas, and decoding allocates all of it.
+const MaxPixels = 40 * 1000 * 1000
+
+var (
+	ErrTooLarge      = errors.New("image is too large")
+	ErrTooManyPixels = fmt.Errorf("image must be at most %d megapixels", MaxPixels/1000/1000)
+	ErrUnsupported   = errors.New("image must be a JPEG, PNG or GIF")
+)
+
+// extensions maps the content types we accept to the file extension they are
+// stored under.
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Upload is a validated image and the thumbnail generated from it.
+type Upload struct {
+	Data          []byte
+	ContentType   string
+	Ext           string
+	Width         int
+	Height        int
+	Thumbnail     []byte
+	ThumbnailType string
+	ThumbnailExt  string
+}
+
+// Process reads at most maxBytes of an uploaded image, checks its real type
+// by sniffing the content (the client's Content-Type isn't trusted) and its
+// dimensions before decoding it, and renders a thumbnail.
+func Process(r io.Reader, maxBytes int64) (*Upload, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := extensions[contentType]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+
+	upload := &Upload{
+		Data:        data,
+		ContentType: contentType,
+		Ext:         ext,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}
+
+	thumb := thumbnail(img, ThumbnailSize)
+	var buf bytes.Buffer
+	// keep PNG for PNGs so transparency survives, everything else becomes JPEG
+	if contentType == "image/png" {
+		err = png.Encode(&buf, thumb)
+		upload.ThumbnailType, upload.ThumbnailExt = "image/png", ".png"
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		upload.ThumbnailType, upload.ThumbnailExt = "image/jpeg", ".jpg"
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload.Thumbnail = buf.Bytes()
+
+	return upload, nil
+}
+
+// thumbnail scales img to fit in a size x size box, keeping its aspect ratio.
+// Each output pixel averages the block of source pixels it covers, which is
+// good enough for downscaling product photos.
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	tw, th := size, size
+	if w > h {
+		th = h * size / w
+	} else {
+		tw = w * size / h
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0 := bounds.Min.Y + y*h/th
+		y1 := bounds.Min.Y + (y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0 := bounds.Min.X + x*w/tw
+			x1 := bounds.Min.X + (x+1)*w/tw
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			thumb.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return thumb
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func orderError(c *gin.Context, err error) {
+	if shortage, ok := err.(*shop.StockShortage); ok {
+		c.AbortWithStatusJSON(409, gin.H{"error": shortage.Error(), "lines": shortage.Lines})
+		return
+	}
+	switch {
+	case err == shop.ErrOrderNotFound, err == shop.ErrStoreNotFound, err == shop.ErrSlotNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrNotYourOrder:
+		c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+	case err == shop.ErrOrderChanged, err == shop.ErrCartChanged, err == shop.ErrOrderUnpaid, err == shop.ErrSlotFull:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case err == shop.ErrEmptyCart, err == shop.ErrNoPickupStore, err == shop.ErrSlotRequired, err == shop.ErrSlotOtherStore, shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// orderActor is the caller as far as orders go. Staff other than admins are
+// kept to the store they work at.
+func orderActor(c *gin.Context) (*shop.OrderActor, error) {
+	actor := &shop.OrderActor{Username: c.GetString("username"), Staff: isStaff(c)}
+	if actor.Staff {
+		storeID, err := managedStore(c)
+		if err != nil {
+			return nil, err
+		}
+		actor.StoreID = storeID
+	}
+	return actor, nil
+}
+
+// orderQuery reads ?status=&page=&pageSize=.
+func orderQuery(c *gin.Context) (*shop.OrderQuery, error) {
+	query := &shop.OrderQuery{Status: c.Query("status")}
+
+	var err error
+	if page := c.Query("page"); page != "" {
+		if query.Page, err = strconv.Atoi(page); err != nil {
+			return nil, err
+		}
+	}
+	if size := c.Query("pageSize"); size != "" {
+		if query.PageSize, err = strconv.Atoi(size); err != nil {
+			return nil, err
+		}
+	}
+
+	return query, nil
+}
+
+// placeOrder checks out the caller's cart at its store.
+func placeOrder(c *gin.Context) {
+	username := c.GetString("username")
+
+	log.Printf("[Main] [PlaceOrder] %s", username)
+	resp, err := shopSrv.PlaceOrder(username)
+	if err != nil {
+		orderError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getMyOrders lists the caller's orders, newest first.
+func getMyOrders(c *gin.Context) {
+	query, err := orderQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	query.Username = c.GetString("username")
+
+	resp, err := shopSrv.GetOrders(query)
+	if err != nil {
+		orderError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getOrderQueue lists a store's orders still to be fulfilled, oldest first,
+// or those in ?status=.
+func getOrderQueue(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	query, err := orderQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	query.StoreID = storeID
+	query.Queue = true
+
+	resp, err := shopSrv.GetOrders(query)
+	if err != nil {
+		orderError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getOrder(c *gin.Context) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	actor, err := orderActor(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.GetOrder(orderID, actor)
+	if err != nil {
+		orderError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func updateOrderStatus(c *gin.Context) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	actor, err := orderActor(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	var request struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [UpdateOrderStatus] %s moved order %d to %s", actor.Username, orderID, request.Status)
+	resp, err := shopSrv.UpdateOrderStatus(orderID, request.Status, actor, request.Note)
+	if err != nil {
+		orderError(c, err)
+		return
+	}
+	settleOrder(resp)
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,344 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Test cards the fake gateway knows out of the box. Any other card number
+// that passes the Luhn check is approved.
+const (
+	CardApproved          = "4242424242424242"
+	CardDeclined          = "4000000000000002"
+	CardInsufficientFunds = "4000000000009995"
+	CardExpired           = "4000000000000069"
+	CardUnavailable       = "4000000000000119"
+)
+
+// FakeConfig sets how the fake gateway behaves. DeclineCards maps card
+// numbers to the decline code they get; FailCards can't reach the "provider"
+// at all. When WebhookURL is set every change is posted there, in order,
+// signed with WebhookSecret.
+type FakeConfig struct {
+	DeclineCards  map[string]string
+	FailCards     []string
+	WebhookURL    string
+	WebhookSecret string
+}
+
+// DefaultFakeConfig declines and fails the test cards above.
+func DefaultFakeConfig() FakeConfig {
+	return FakeConfig{
+		DeclineCards: map[string]string{
+			CardDeclined:          "card_declined",
+			CardInsufficientFunds: "insufficient_funds",
+			CardExpired:           "expired_card",
+		},
+		FailCards: []string{CardUnavailable},
+	}
+}
+
+var declineMessages = map[string]string{
+	"card_declined":      "your card was declined",
+	"insufficient_funds": "your card has insufficient funds",
+	"expired_card":       "your card has expired",
+	"invalid_number":     "that card number is not valid",
+}
+
+// fakeResult is what a call with an idempotency key returned, and what it was
+// asked, so a key can't be reused for something else.
+type fakeResult struct {
+	request     string
+	transaction Transaction
+	err         error
+}
+
+type fakeGateway struct {
+	config FakeConfig
+
+	mu           sync.Mutex
+	seq          int
+	eventSeq     int
+	transactions map[string]*Transaction
+	results      map[string]*fakeResult
+	events       chan *Event
+}
+
+// NewFakeGateway is a gateway that runs in memory with no outside service.
+// It is deterministic: the same calls in the same order get the same
+// transaction IDs and results.
+func NewFakeGateway(config FakeConfig) Gateway {
+	g := &fakeGateway{
+		config:       config,
+		transactions: make(map[string]*Transaction),
+		results:      make(map[string]*fakeResult),
+	}
+	if config.WebhookURL != "" {
+		g.events = make(chan *Event, 100)
+		go g.deliver()
+	}
+	return g
+}
+
+func (g *fakeGateway) Name() string {
+	return "fake"
+}
+
+// once runs a call at most once per idempotency key. request describes the
+// call; the same key with a different request is refused.
+func (g *fakeGateway) once(op, key, request string, call func() (*Transaction, error)) (*Transaction, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if key != "" {
+		if result, ok := g.results[op+":"+key]; ok {
+			if result.request != request {
+				return nil, ErrKeyReused
+			}
+			if result.err != nil {
+				return nil, result.err
+			}
+			transaction := result.transaction
+			return &transaction, nil
+		}
+	}
+
+	transaction, err := call()
+	if err == ErrUnavailable {
+		// nothing happened, so a retry with the same key should try again
+		return nil, err
+	}
+	if key != "" {
+		result := &fakeResult{request: request, err: err}
+		if transaction != nil {
+			result.transaction = *transaction
+		}
+		g.results[op+":"+key] = result
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	g.notify(transaction)
+	copied := *transaction
+	return &copied, nil
+}
+
+func (g *fakeGateway) Authorize(request *AuthorizeRequest) (*Transaction, error) {
+	card := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, request.Source)
+	amount := roundCents(request.Amount)
+	described := fmt.Sprintf("%s %.2f %s %s", card, amount, request.Currency, request.Reference)
+
+	return g.once("authorize", request.IdempotencyKey, described, func() (*Transaction, error) {
+		for _, failing := range g.config.FailCards {
+			if card == failing {
+				return nil, ErrUnavailable
+			}
+		}
+		if !luhn(card) {
+			return nil, decline("invalid_number")
+		}
+		if code, ok := g.config.DeclineCards[card]; ok {
+			return nil, decline(code)
+		}
+		if amount <= 0 {
+			return nil, ErrInvalidAmount
+		}
+
+		g.seq++
+		now := time.Now()
+		transaction := &Transaction{
+			ID:        fmt.Sprintf("fake_txn_%06d", g.seq),
+			Status:    StatusAuthorized,
+			Amount:    amount,
+			Currency:  request.Currency,
+			Reference: request.Reference,
+			Last4:     card[len(card)-4:],
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		g.transactions[transaction.ID] = transaction
+		return transaction, nil
+	})
+}
+
+func (g *fakeGateway) Capture(transactionID string, amount float64, idempotencyKey string) (*Transaction, error) {
+	amount = roundCents(amount)
+	return g.once("capture", idempotencyKey, fmt.Sprintf("%s %.2f", transactionID, amount), func() (*Transaction, error) {
+		transaction, ok := g.transactions[transactionID]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		if transaction.Status != StatusAuthorized {
+			return nil, ErrInvalidRequest
+		}
+		if amount == 0 {
+			amount = transaction.Amount
+		}
+		if amount < 0 || amount > transaction.Amount {
+			return nil, ErrInvalidAmount
+		}
+
+		transaction.Captured = amount
+		transaction.Status = StatusCaptured
+		transaction.UpdatedAt = time.Now()
+		return transaction, nil
+	})
+}
+
+func (g *fakeGateway) Refund(transactionID string, amount float64, idempotencyKey string) (*Transaction, error) {
+	amount = roundCents(amount)
+	return g.once("refund", idempotencyKey, fmt.Sprintf("%s %.2f", transactionID, amount), func() (*Transaction, error) {
+		transaction, ok := g.transactions[transactionID]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		if transaction.Status != StatusCaptured && transaction.Status != StatusPartiallyRefunded {
+			return nil, ErrInvalidRequest
+		}
+		left := roundCents(transaction.Captured - transaction.Refunded)
+		if amount == 0 {
+			amount = left
+		}
+		if amount <= 0 || amount > left {
+			return nil, ErrInvalidAmount
+		}
+
+		transaction.Refunded = roundCents(transaction.Refunded + amount)
+		transaction.Status = StatusPartiallyRefunded
+		if transaction.Refunded == transaction.Captured {
+			transaction.Status = StatusRefunded
+		}
+		transaction.UpdatedAt = time.Now()
+		return transaction, nil
+	})
+}
+
+func (g *fakeGateway) Void(transactionID string, idempotencyKey string) (*Transaction, error) {
+	return g.once("void", idempotencyKey, transactionID, func() (*Transaction, error) {
+		transaction, ok := g.transactions[transactionID]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		if transaction.Status != StatusAuthorized {
+			return nil, ErrInvalidRequest
+		}
+
+		transaction.Status = StatusVoided
+		transaction.UpdatedAt = time.Now()
+		return transaction, nil
+	})
+}
+
+func (g *fakeGateway) ParseWebhook(body []byte, signature string) (*Event, error) {
+	if !verify(g.config.WebhookSecret, body, signature) {
+		return nil, ErrBadSignature
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.Transaction == nil {
+		return nil, fmt.Errorf("event %s has no transaction", event.ID)
+	}
+
+	return &event, nil
+}
+
+// notify queues a callback for the transaction's new state. Called with mu
+// held, so events go out in the order things happened.
+func (g *fakeGateway) notify(transaction *Transaction) {
+	if g.events == nil {
+		return
+	}
+	g.eventSeq++
+	copied := *transaction
+	event := &Event{
+		ID:          fmt.Sprintf("fake_evt_%06d", g.eventSeq),
+		Type:        "transaction." + transaction.Status,
+		Transaction: &copied,
+		At:          transaction.UpdatedAt,
+	}
+	select {
+	case g.events <- event:
+	default:
+		log.Printf("[Payment] [Webhook] %s: queue is full, dropped", event.ID)
+	}
+}
+
+// deliver posts queued events to the webhook URL one at a time. Deliveries
+// that fail are logged and dropped; the caller already has the result.
+func (g *fakeGateway) deliver() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for event := range g.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[Payment] [Webhook] %s: %v", event.ID, err)
+			continue
+		}
+		request, err := http.NewRequest("POST", g.config.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[Payment] [Webhook] %s: %v", event.ID, err)
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set(SignatureHeader, Sign(g.config.WebhookSecret, body))
+
+		response, err := client.Do(request)
+		if err != nil {
+			log.Printf("[Payment] [Webhook] %s: %v", event.ID, err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			log.Printf("[Payment] [Webhook] %s: %s", event.ID, response.Status)
+		}
+	}
+}
+
+func decline(code string) *Decline {
+	message, ok := declineMessages[code]
+	if !ok {
+		message = declineMessages["card_declined"]
+	}
+	return &Decline{Code: code, Message: message}
+}
+
+// luhn checks a card number's check digit.
+func luhn(number string) bool {
+	if len(number) < 12 || len(number) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range number {
+		d := int(number[len(number)-1-i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,110 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Transaction states.
+const (
+	StatusAuthorized        = "authorized"
+	StatusCaptured          = "captured"
+	StatusPartiallyRefunded = "partially_refunded"
+	StatusRefunded          = "refunded"
+	StatusVoided            = "voided"
+)
+
+// SignatureHeader carries a webhook's signature, the hex HMAC-SHA256 of its
+// body.
+const SignatureHeader = "X-Payment-Signature"
+
+var (
+	ErrUnavailable    = errors.New("the payment provider could not be reached, try again")
+	ErrNotFound       = errors.New("transaction not found")
+	ErrKeyReused      = errors.New("idempotency key was already used for a different request")
+	ErrBadSignature   = errors.New("webhook signature does not match")
+	ErrInvalidAmount  = errors.New("amount must be more than 0 and no more than what is left on the transaction")
+	ErrInvalidRequest = errors.New("transaction cannot do that in its current state")
+)
+
+// Decline is a payment the card issuer turned down. Unlike ErrUnavailable,
+// trying again with the same card won't help.
+type Decline struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (d *Decline) Error() string {
+	return d.Message
+}
+
+// AuthorizeRequest holds Amount on Source, a card number or a provider's
+// token for one. Reference ties the transaction to what it pays for.
+type AuthorizeRequest struct {
+	Amount         float64
+	Currency       string
+	Source         string
+	Reference      string
+	IdempotencyKey string
+}
+
+// Transaction is a payment as the provider sees it. Captured and Refunded are
+// how much of Amount has been taken and given back.
+type Transaction struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Amount    float64   `json:"amount"`
+	Captured  float64   `json:"captured"`
+	Refunded  float64   `json:"refunded"`
+	Currency  string    `json:"currency"`
+	Reference string    `json:"reference"`
+	Last4     string    `json:"last4"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Event is a status callback: the transaction as it is after the change.
+type Event struct {
+	ID          string       `json:"id"`
+	Type        string       `json:"type"`
+	Transaction *Transaction `json:"transaction"`
+	At          time.Time    `json:"at"`
+}
+
+// Gateway is a payment provider. Every call that moves money takes an
+// idempotency key: repeating a call with the same key returns the first
+// result instead of charging twice. Capture and Refund take an amount, 0 for
+// all that is left.
+type Gateway interface {
+	Name() string
+	Authorize(request *AuthorizeRequest) (*Transaction, error)
+	Capture(transactionID string, amount float64, idempotencyKey string) (*Transaction, error)
+	Refund(transactionID string, amount float64, idempotencyKey string) (*Transaction, error)
+	Void(transactionID string, idempotencyKey string) (*Transaction, error)
+	// ParseWebhook checks a status callback's signature and decodes it.
+	ParseWebhook(body []byte, signature string) (*Event, error)
+}
+
+// Sign is the signature a webhook body is sent with.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a webhook's signature. Nothing passes without a secret.
+func verify(secret string, body []byte, signature string) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,63 @@
+package payment
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{CardApproved, true},
+		{CardDeclined, true},
+		{CardInsufficientFunds, true},
+		{"5555555555554444", true},
+		{"378282246310005", true}, // 15 digits
+		{"4242424242424241", false},
+		{"4242424242424243", false},
+		{"42424242424a4242", false},
+		{"4242 4242 4242 4242", false}, // callers strip spaces first
+		{"00000000000", false},         // too short
+		{"000000000000", true},
+		{"42424242424242424242", false}, // too long
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := luhn(tt.number); got != tt.valid {
+			t.Errorf("luhn(%q) = %v, want %v", tt.number, got, tt.valid)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":"fake_evt_000001","type":"transaction.captured"}`)
+	signature := Sign("s3cret", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		valid     bool
+	}{
+		{"signed with the secret", "s3cret", body, signature, true},
+		{"upper-case hex", "s3cret", body, strings.ToUpper(signature), true},
+		{"other secret", "other", body, signature, false},
+		{"body changed", "s3cret", []byte(`{"id":"fake_evt_000001","type":"transaction.refunded"}`), signature, false},
+		{"not hex", "s3cret", body, "not-a-signature", false},
+		{"truncated", "s3cret", body, signature[:32], false},
+		{"no signature", "s3cret", body, "", false},
+		{"no secret", "", body, Sign("", body), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verify(tt.secret, tt.body, tt.signature); got != tt.valid {
+				t.Errorf("verify = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+
+	payment "github.com/AkinAD/basedCode/payment"
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// paymentCurrency is what orders are charged in; every store is in Canada.
+const paymentCurrency = "CAD"
+
+var (
+	// errNothingToSettle means the payment is already where the order needs it.
+	errNothingToSettle = errors.New("nothing to settle")
+	errOrderUnfinished = errors.New("only a completed or cancelled order's payment is settled")
+)
+
+// newPaymentGateway picks the payment provider from PAYMENT_GATEWAY. There is
+// no default, so a real deployment can't end up on the fake gateway by
+// leaving it out. Without a provider, or without a webhook secret to check
+// its callbacks against, payments are off: the server still starts, and the
+// payment routes and the webhook answer 503.
+func newPaymentGateway() payment.Gateway {
+	switch {
+	case paymentGateway == "":
+		log.Printf("[Main] PAYMENT_GATEWAY is not set, expected fake; payments are off")
+		return nil
+	case paymentGateway != "fake":
+		log.Printf("[Main] unknown PAYMENT_GATEWAY %q, expected fake; payments are off", paymentGateway)
+		return nil
+	case paymentSecret == "":
+		log.Printf("[Main] PAYMENT_WEBHOOK_SECRET is not set; payments are off")
+		return nil
+	}
+
+	config := payment.DefaultFakeConfig()
+	config.WebhookURL = paymentWebhookURL
+	config.WebhookSecret = paymentSecret
+	return payment.NewFakeGateway(config)
+}
+
+func paymentError(c *gin.Context, err error) {
+	if decline, ok := err.(*payment.Decline); ok {
+		c.AbortWithStatusJSON(402, gin.H{"error": decline.Message, "code": decline.Code})
+		return
+	}
+	switch err {
+	case payment.ErrUnavailable:
+		c.AbortWithStatusJSON(503, gin.H{"error": err.Error()})
+	case payment.ErrNotFound, shop.ErrPaymentNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case payment.ErrKeyReused, payment.ErrInvalidRequest, shop.ErrAlreadyPaid, errOrderUnfinished:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case payment.ErrInvalidAmount:
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		orderError(c, err)
+	}
+}
+
+// idempotencyKey is the Idempotency-Key header, or fallback when the client
+// didn't send one.
+func idempotencyKey(c *gin.Context, fallback string) string {
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		return key
+	}
+	return fallback
+}
+
+// syncedPayment is a payment brought up to date with its transaction.
+func syncedPayment(transaction *payment.Transaction) *shop.Payment {
+	return &shop.Payment{
+		Provider:      gateway.Name(),
+		TransactionID: transaction.ID,
+		Status:        transaction.Status,
+		Amount:        transaction.Amount,
+		Captured:      transaction.Captured,
+		Refunded:      transaction.Refunded,
+		Last4:         transaction.Last4,
+		TransactionAt: transaction.UpdatedAt,
+	}
+}
+
+// pickedAmount is how much of its payment an order takes: what was picked
+// of it, or 0 for all of it when it wasn't picked short.
+func pickedAmount(order *shop.Order, p *shop.Payment) float64 {
+	if order.PickedTotal == nil || *order.PickedTotal >= p.Amount {
+		return 0
+	}
+	return *order.PickedTotal
+}
+
+func captureKey(orderID int, amount float64) string {
+	return fmt.Sprintf("order-%d-capture-%.2f", orderID, amount)
+}
+
+func voidKey(orderID int) string {
+	return fmt.Sprintf("order-%d-void", orderID)
+}
+
+// settlePayment runs op against the order's payment and keeps the result.
+func settlePayment(orderID int, op func(*shop.Payment) (*payment.Transaction, error)) (*shop.Payment, error) {
+	current, err := shopSrv.GetOrderPayment(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if gateway == nil {
+		return nil, payment.ErrUnavailable
+	}
+	transaction, err := op(current)
+	if err != nil {
+		return nil, err
+	}
+
+	return shopSrv.SyncPayment(syncedPayment(transaction))
+}
+
+// settleOrder takes the money for a collected order and gives it back for a
+// cancelled one. A failure is kept on the payment as its SettleError, where
+// staff can see it and retry with settleOrderPayment; settling clears it.
+func settleOrder(order *shop.Order) error {
+	var err error
+	switch order.Status {
+	case shop.OrderCompleted:
+		_, err = settlePayment(order.OrderID, func(p *shop.Payment) (*payment.Transaction, error) {
+			if p.Status != shop.PaymentAuthorized {
+				return nil, errNothingToSettle
+			}
+			if order.PickedTotal != nil && *order.PickedTotal == 0 {
+				// nothing was found for the order, so nothing is taken
+				return gateway.Void(p.TransactionID, voidKey(order.OrderID))
+			}
+			amount := pickedAmount(order, p)
+			return gateway.Capture(p.TransactionID, amount, captureKey(order.OrderID, amount))
+		})
+	case shop.OrderCancelled:
+		_, err = settlePayment(order.OrderID, func(p *shop.Payment) (*payment.Transaction, error) {
+			switch p.Status {
+			case shop.PaymentAuthorized:
+				return gateway.Void(p.TransactionID, voidKey(order.OrderID))
+			case shop.PaymentCaptured, shop.PaymentPartiallyRefunded:
+				return gateway.Refund(p.TransactionID, 0, fmt.Sprintf("order-%d-cancel-refund", order.OrderID))
+			}
+			return nil, errNothingToSettle
+		})
+	default:
+		return errOrderUnfinished
+	}
+	if err == shop.ErrPaymentNotFound {
+		return nil
+	}
+	if err == errNothingToSettle {
+		err = nil
+	}
+
+	message := ""
+	if err != nil {
+		log.Printf("[Main] [SettleOrder] order %d (%s): %v", order.OrderID, order.Status, err)
+		message = err.Error()
+	}
+	if err := shopSrv.SetSettleError(order.OrderID, message); err != nil {
+		log.Printf("[Main] [SettleOrder] order %d: keeping the settle error: %v", order.OrderID, err)
+	}
+	return err
+}
+
+// amountRequest reads an optional {"amount": ...} body, 0 meaning all.
+func amountRequest(c *gin.Context) (float64, error) {
+	var request struct {
+		Amount float64 `json:"amount"`
+	}
+	if c.Request.ContentLength == 0 {
+		return 0, nil
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		return 0, err
+	}
+	if request.Amount < 0 {
+		return 0, errors.New("amount cannot be negative")
+	}
+	return request.Amount, nil
+}
+
+// paymentOrder reads the :id order and makes sure the caller can see it.
+func paymentOrder(c *gin.Context) (*shop.Order, bool) {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return nil, false
+	}
+	actor, err := orderActor(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return nil, false
+	}
+
+	order, err := shopSrv.GetOrder(orderID, actor)
+	if err != nil {
+		orderError(c, err)
+		return nil, false
+	}
+
+	return order, true
+}
+
+// getOrderPayments lists every attempt to pay for an order, newest first.
+func getOrderPayments(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.GetPayments(order.OrderID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// payOrder authorizes the order's total on a card; the money is captured
+// when the order is collected. Declined attempts are kept and answered 402.
+func payOrder(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+
+	if gateway == nil {
+		paymentError(c, payment.ErrUnavailable)
+		return
+	}
+
+	var request struct {
+		Source string `json:"source"`
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil || request.Source == "" {
+		c.AbortWithStatusJSON(400, gin.H{"error": "source is required"})
+		return
+	}
+	if _, err := shopSrv.GetOrderPayment(order.OrderID); err != shop.ErrPaymentNotFound {
+		if err == nil {
+			err = shop.ErrAlreadyPaid
+		}
+		paymentError(c, err)
+		return
+	}
+
+	// the same card on the same order is the same payment, so a double
+	// submit can't authorize twice
+	source := sha256.Sum256([]byte(request.Source))
+	key := idempotencyKey(c, fmt.Sprintf("order-%d-authorize-%s", order.OrderID, hex.EncodeToString(source[:8])))
+
+	log.Printf("[Main] [PayOrder] order %d: %.2f", order.OrderID, order.Total)
+	transaction, err := gateway.Authorize(&payment.AuthorizeRequest{
+		Amount:         order.Total,
+		Currency:       paymentCurrency,
+		Source:         request.Source,
+		Reference:      strconv.Itoa(order.OrderID),
+		IdempotencyKey: key,
+	})
+	if decline, ok := err.(*payment.Decline); ok {
+		declined := &shop.Payment{OrderID: order.OrderID, Provider: gateway.Name(), Status: shop.PaymentDeclined, Amount: order.Total, DeclineCode: decline.Code}
+		if _, err := shopSrv.RecordPayment(declined); err != nil {
+			log.Printf("[Main] [PayOrder] order %d: keeping declined attempt: %v", order.OrderID, err)
+		}
+	}
+	if err != nil {
+		paymentError(c, err)
+		return
+	}
+
+	record := syncedPayment(transaction)
+	record.OrderID = order.OrderID
+	resp, err := shopSrv.RecordPayment(record)
+	if err != nil {
+		// nothing pays for the order, so don't leave the money held
+		if _, err := gateway.Void(transaction.ID, key+"-void"); err != nil {
+			log.Printf("[Main] [PayOrder] order %d: voiding %s: %v", order.OrderID, transaction.ID, err)
+		}
+		paymentError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func capturePayment(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+	amount, err := amountRequest(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[Main] [CapturePayment] %s captured order %d: %.2f", c.GetString("username"), order.OrderID, amount)
+	resp, err := settlePayment(order.OrderID, func(p *shop.Payment) (*payment.Transaction, error) {
+		if amount == 0 {
+			amount = pickedAmount(order, p)
+		}
+		return gateway.Capture(p.TransactionID, amount, idempotencyKey(c, captureKey(order.OrderID, amount)))
+	})
+	if err != nil {
+		paymentError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// refundPayment gives back some or all of what was captured. Refunds of the
+// same amount are taken to be repeats unless they come with their own
+// Idempotency-Key.
+func refundPayment(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+	amount, err := amountRequest(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[Main] [RefundPayment] %s refunded order %d: %.2f", c.GetString("username"), order.OrderID, amount)
+	resp, err := settlePayment(order.OrderID, func(p *shop.Payment) (*payment.Transaction, error) {
+		return gateway.Refund(p.TransactionID, amount, idempotencyKey(c, fmt.Sprintf("order-%d-refund-%.2f", order.OrderID, amount)))
+	})
+	if err != nil {
+		paymentError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func voidPayment(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+
+	log.Printf("[Main] [VoidPayment] %s voided order %d", c.GetString("username"), order.OrderID)
+	resp, err := settlePayment(order.OrderID, func(p *shop.Payment) (*payment.Transaction, error) {
+		return gateway.Void(p.TransactionID, idempotencyKey(c, voidKey(order.OrderID)))
+	})
+	if err != nil {
+		paymentError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// settleOrderPayment retries settling a finished order's payment after
+// settleOrder failed.
+func settleOrderPayment(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+
+	log.Printf("[Main] [SettleOrderPayment] %s settled order %d (%s)", c.GetString("username"), order.OrderID, order.Status)
+	if err := settleOrder(order); err != nil {
+		paymentError(c, err)
+		return
+	}
+	resp, err := shopSrv.GetOrderPayment(order.OrderID)
+	if err != nil {
+		paymentError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// paymentWebhook takes the provider's status callbacks. Callbacks for
+// transactions we don't know are acknowledged and dropped, so the provider
+// doesn't keep retrying them.
+func paymentWebhook(c *gin.Context) {
+	// without a secret anyone could sign a callback, so none are taken
+	if gateway == nil || paymentSecret == "" {
+		paymentError(c, payment.ErrUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	event, err := gateway.ParseWebhook(body, c.GetHeader(payment.SignatureHeader))
+	if err == payment.ErrBadSignature {
+		c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = shopSrv.SyncPayment(syncedPayment(event.Transaction))
+	if err == shop.ErrPaymentNotFound {
+		log.Printf("[Main] [PaymentWebhook] %s: no payment for %s", event.ID, event.Transaction.ID)
+		c.JSON(200, gin.H{"received": event.ID, "ignored": true})
+		return
+	}
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"received": event.ID})
+}
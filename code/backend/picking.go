@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func pickError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrPickBatchNotFound, err == shop.ErrPickLineNotFound, err == shop.ErrOrderNotFound, err == shop.ErrItemNotFound, err == shop.ErrVariantNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrPickBatchDone, err == shop.ErrOrderChanged, errors.Is(err, shop.ErrOrderUnpaid):
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// createPickBatch starts picking the listed orders, or a slot's, together.
+func createPickBatch(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	var request shop.PickBatchRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	picker := c.GetString("username")
+	log.Printf("[Main] [CreatePickBatch] %d by %s: %d orders", storeID, picker, len(request.Orders))
+	resp, err := shopSrv.CreatePickBatch(storeID, &request, picker)
+	if err != nil {
+		pickError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getPickBatches(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.GetPickBatches(storeID, c.Query("status"))
+	if err != nil {
+		pickError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getPickBatch returns a batch with its lines along the pick path.
+func getPickBatch(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	batchID, err := strconv.Atoi(c.Param("batch"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetPickBatch(storeID, batchID)
+	if err != nil {
+		pickError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func pickLine(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	batchID, err := strconv.Atoi(c.Param("batch"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	lineID, err := strconv.Atoi(c.Param("line"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request shop.PickUpdate
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	picker := c.GetString("username")
+	log.Printf("[Main] [PickLine] batch %d line %d by %s: %s", batchID, lineID, picker, request.Status)
+	resp, err := shopSrv.PickLine(storeID, batchID, lineID, &request, picker)
+	if err != nil {
+		pickError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// shopperProfile loads the caller's dietary preferences. It returns nil for
+// anonymous requests, which leaves catalog responses untouched.
+func shopperProfile(c *gin.Context) (*shop.DietaryProfile, error) {
+	username := c.GetString("username")
+	if username == "" {
+		return nil, nil
+	}
+
+	profile, err := userSrv.GetProfile(username)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shop.DietaryProfile{Dietary: profile.Dietary, Allergens: profile.Allergens}, nil
+}
+
+// excludeConflicts reports whether the caller asked for conflicting items to be
+// left out (?diet=filter) rather than flagged.
+func excludeConflicts(c *gin.Context) bool {
+	return c.Query("diet") == "filter"
+}
+
+func getPreferences(c *gin.Context) {
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if profile == nil {
+		c.AbortWithError(500, errors.New("Could not get username from token"))
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"dietary":          profile.Dietary,
+		"allergens":        profile.Allergens,
+		"dietaryOptions":   shop.DietaryLabels,
+		"allergensOptions": shop.Allergens,
+	})
+}
+
+func updatePreferences(c *gin.Context) {
+	var request *shop.DietaryProfile
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	username := c.GetString("username")
+	if username == "" {
+		c.AbortWithError(500, errors.New("Could not get username from token"))
+		return
+	}
+
+	dietary, err := shop.ParseDietaryLabels(request.Dietary)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	allergens, err := shop.ParseAllergens(request.Allergens)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := userSrv.UpdatePreferences(username, dietary, allergens)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
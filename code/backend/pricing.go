@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// priceStore reads the :id store from the path and makes sure the caller
+// manages it. Admins can change any store's prices.
+func priceStore(c *gin.Context) (int, bool) {
+	storeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return 0, false
+	}
+
+	managed, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return 0, false
+	}
+	if managed != 0 && managed != storeID {
+		c.AbortWithStatusJSON(403, gin.H{"error": "The StoreID does not match the Manager's Store ID"})
+		return 0, false
+	}
+
+	return storeID, true
+}
+
+func getStorePrices(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.GetStorePrices(storeID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func setStorePrice(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	var request *shop.StorePrice
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.StoreID = storeID
+
+	log.Printf("[Main] [SetStorePrice] %v", request)
+	resp, err := shopSrv.SetStorePrice(request)
+	if err != nil {
+		variantError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteStorePrice(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	itemID, err := strconv.Atoi(c.Param("item"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	variantID, err := strconv.Atoi(c.DefaultQuery("variantID", "0"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.DeleteStorePrice(storeID, itemID, variantID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
+
+// getCartTotal prices the cart lines in the body at the store given by
+// ?storeID=.
+func getCartTotal(c *gin.Context) {
+	storeID, err := strconv.Atoi(c.Query("storeID"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": "storeID is required"})
+		return
+	}
+
+	var request []*shop.CartLine
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.PriceCart(storeID, request, profile)
+	if err != nil {
+		priceError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func priceError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrStoreNotFound, err == shop.ErrItemNotFound, err == shop.ErrVariantNotFound, err == shop.ErrPriceChangeNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// getPriceHistory lists an item's price changes, including pending ones.
+func getPriceHistory(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetPriceHistory(itemID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// schedulePriceChange sets an item's (or variant's) price, either now or at
+// effectiveAt.
+func schedulePriceChange(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.PriceChange
+	err = c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.ItemID = itemID
+	request.CreatedBy = c.GetString("username")
+
+	log.Printf("[Main] [SchedulePriceChange] %v", request)
+	resp, err := shopSrv.SchedulePriceChange(request)
+	if err != nil {
+		priceError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func cancelPriceChange(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	changeID, err := strconv.Atoi(c.Param("change"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.CancelPriceChange(itemID, changeID)
+	if err != nil {
+		priceError(c, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
+
+// runPriceScheduler applies scheduled price changes as they come due. It runs
+// for the life of the server.
+func runPriceScheduler(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		applied, err := shopSrv.ApplyDuePriceChanges(now)
+		if err != nil {
+			log.Printf("[Main] [PriceScheduler] %v", err)
+			continue
+		}
+		if applied > 0 {
+			log.Printf("[Main] [PriceScheduler] applied %d price changes", applied)
+		}
+	}
+}
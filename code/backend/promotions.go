@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func promotionError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrPromotionNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// checkDealStore makes sure a manager only runs deals and coupons in their
+// own store. Chain-wide ones (StoreID 0) are left to admins.
+func checkDealStore(c *gin.Context, storeID int, what string) bool {
+	managed, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return false
+	}
+	if managed != 0 && storeID != managed {
+		c.AbortWithStatusJSON(403, gin.H{"error": fmt.Sprintf("The %s's StoreID does not match the Manager's Store ID", what)})
+		return false
+	}
+
+	return true
+}
+
+// getPromotions lists current and upcoming promotions, ?expired=true to
+// include past ones. Managers see their store's and the chain-wide ones.
+func getPromotions(c *gin.Context) {
+	storeID, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if storeID == 0 && c.Query("storeID") != "" {
+		storeID, err = strconv.Atoi(c.Query("storeID"))
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+	}
+
+	resp, err := shopSrv.GetPromotions(storeID, c.Query("expired") == "true")
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getPromotion(c *gin.Context) {
+	promotionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetPromotion(promotionID)
+	if err != nil {
+		promotionError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createPromotion(c *gin.Context) {
+	var request *shop.Promotion
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.PromotionID = 0
+	request.CreatedBy = c.GetString("username")
+
+	if !checkDealStore(c, request.StoreID, "promotion") {
+		return
+	}
+
+	log.Printf("[Main] [CreatePromotion] %v", request)
+	resp, err := shopSrv.CreatePromotion(request)
+	if err != nil {
+		promotionError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func updatePromotion(c *gin.Context) {
+	promotionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.Promotion
+	err = c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.PromotionID = promotionID
+
+	existing, err := shopSrv.GetPromotion(promotionID)
+	if err != nil {
+		promotionError(c, err)
+		return
+	}
+	if !checkDealStore(c, existing.StoreID, "promotion") || !checkDealStore(c, request.StoreID, "promotion") {
+		return
+	}
+
+	log.Printf("[Main] [UpdatePromotion] %v", request)
+	resp, err := shopSrv.UpdatePromotion(request)
+	if err != nil {
+		promotionError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deletePromotion(c *gin.Context) {
+	promotionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	existing, err := shopSrv.GetPromotion(promotionID)
+	if err != nil {
+		promotionError(c, err)
+		return
+	}
+	if !checkDealStore(c, existing.StoreID, "promotion") {
+		return
+	}
+
+	resp, err := shopSrv.DeletePromotion(promotionID)
+	if err != nil {
+		promotionError(c, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// getRecommendations suggests items for the signed-in shopper, or popular
+// ones for a guest. ?storeID= keeps to what that store stocks and ?limit= caps
+// how many come back. Items that conflict with the shopper's dietary
+// preferences are left out.
+func getRecommendations(c *gin.Context) {
+	query := &shop.RecommendationQuery{Username: c.GetString("username")}
+
+	var err error
+	if storeID := c.Query("storeID"); storeID != "" {
+		if query.StoreID, err = strconv.Atoi(storeID); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+	}
+
+	query.Profile, err = shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.GetRecommendations(query)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, &resp)
+}
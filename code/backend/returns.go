@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	payment "github.com/AkinAD/basedCode/payment"
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func returnError(c *gin.Context, err error) {
+	switch err {
+	case shop.ErrReturnNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case shop.ErrNotReturnable:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	default:
+		orderError(c, err)
+	}
+}
+
+func returnRefundKey(returnID int) string {
+	return fmt.Sprintf("return-%d-refund", returnID)
+}
+
+// refundReturn gives back a return's refund on its order's payment and
+// records how that went. A failed refund is kept on the return for staff to
+// try again; the return itself stands either way.
+func refundReturn(ret *shop.Return) *shop.Return {
+	if ret.RefundStatus != shop.RefundPending && ret.RefundStatus != shop.RefundFailed {
+		return ret
+	}
+
+	refunded, err := settlePayment(ret.OrderID, func(p *shop.Payment) (*payment.Transaction, error) {
+		if p.Status != shop.PaymentCaptured && p.Status != shop.PaymentPartiallyRefunded {
+			return nil, errNothingToSettle
+		}
+		return gateway.Refund(p.TransactionID, ret.Refund, returnRefundKey(ret.ReturnID))
+	})
+	switch err {
+	case nil:
+		ret.RefundStatus = shop.RefundIssued
+		ret.TransactionID = refunded.TransactionID
+	case errNothingToSettle:
+		ret.RefundStatus, ret.RefundError = shop.RefundFailed, "the order's payment has nothing captured to refund"
+	default:
+		ret.RefundStatus, ret.RefundError = shop.RefundFailed, err.Error()
+		if decline, ok := err.(*payment.Decline); ok {
+			ret.RefundError = decline.Message
+		}
+	}
+	if err != nil {
+		log.Printf("[Main] [RefundReturn] return %d on order %d: %v", ret.ReturnID, ret.OrderID, err)
+	}
+
+	updated, err := shopSrv.SetReturnRefund(ret)
+	if err != nil {
+		log.Printf("[Main] [RefundReturn] return %d: recording %s refund: %v", ret.ReturnID, ret.RefundStatus, err)
+		return ret
+	}
+	return updated
+}
+
+// recordReturn takes back lines of a collected order and refunds them.
+func recordReturn(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+	actor, err := orderActor(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	var request shop.ReturnRequest
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [RecordReturn] %s: order %d, %d lines", actor.Username, order.OrderID, len(request.Lines))
+	resp, err := shopSrv.RecordReturn(order.OrderID, &request, actor)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+	resp = refundReturn(resp)
+
+	c.JSON(200, &resp)
+}
+
+func getOrderReturns(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+	actor, err := orderActor(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.GetReturns(order.OrderID, actor)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// retryReturnRefund tries a return's failed refund again. The refund keeps
+// its idempotency key, so it can't be given twice.
+func retryReturnRefund(c *gin.Context) {
+	order, ok := paymentOrder(c)
+	if !ok {
+		return
+	}
+	returnID, err := strconv.Atoi(c.Param("return"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	ret, err := shopSrv.GetReturn(order.OrderID, returnID)
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+	if ret.RefundStatus != shop.RefundPending && ret.RefundStatus != shop.RefundFailed {
+		c.AbortWithStatusJSON(409, gin.H{"error": fmt.Sprintf("the return's refund is %s, there is nothing to retry", ret.RefundStatus)})
+		return
+	}
+
+	log.Printf("[Main] [RetryReturnRefund] %s: return %d on order %d", c.GetString("username"), returnID, order.OrderID)
+	resp := refundReturn(ret)
+
+	c.JSON(200, &resp)
+}
+
+// getReturnsReport sums up a store's returns from ?from= to ?to=, the last
+// 30 days by default.
+func getReturnsReport(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.GetReturnsReport(storeID, c.Query("from"), c.Query("to"))
+	if err != nil {
+		returnError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
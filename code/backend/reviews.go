@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func reviewError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrReviewNotFound, err == shop.ErrItemNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrNotReviewAuthor:
+		c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+	case err == shop.ErrAlreadyReviewed:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// isStaff reports whether the caller can moderate reviews.
+func isStaff(c *gin.Context) bool {
+	for _, group := range c.GetStringSlice("groups") {
+		if group == "employee" || group == "manager" || group == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewQuery reads ?sort=newest|oldest|highest|lowest&page=&pageSize= and, for
+// staff, ?status=hidden.
+func reviewQuery(c *gin.Context) (*shop.ReviewQuery, error) {
+	query := &shop.ReviewQuery{Sort: c.Query("sort")}
+	if isStaff(c) {
+		query.Status = c.Query("status")
+	}
+
+	var err error
+	if page := c.Query("page"); page != "" {
+		if query.Page, err = strconv.Atoi(page); err != nil {
+			return nil, err
+		}
+	}
+	if size := c.Query("pageSize"); size != "" {
+		if query.PageSize, err = strconv.Atoi(size); err != nil {
+			return nil, err
+		}
+	}
+
+	return query, nil
+}
+
+func getItemReviews(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	query, err := reviewQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	query.ItemID = itemID
+
+	resp, err := shopSrv.GetReviews(query)
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getReviews lists reviews across every item for moderators, ?status=hidden
+// for the ones taken down.
+func getReviews(c *gin.Context) {
+	query, err := reviewQuery(c)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := shopSrv.GetReviews(query)
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getMyReview(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetUserReview(itemID, c.GetString("username"))
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createReview(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.Review
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	review := &shop.Review{
+		ItemID:   itemID,
+		Username: c.GetString("username"),
+		Rating:   request.Rating,
+		Title:    request.Title,
+		Body:     request.Body,
+	}
+
+	resp, err := shopSrv.CreateReview(review)
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func updateReview(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	reviewID, err := strconv.Atoi(c.Param("review"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.Review
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	review := &shop.Review{
+		ReviewID: reviewID,
+		ItemID:   itemID,
+		Username: c.GetString("username"),
+		Rating:   request.Rating,
+		Title:    request.Title,
+		Body:     request.Body,
+	}
+
+	resp, err := shopSrv.UpdateReview(review)
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// deleteReview lets authors delete their own review and staff any review.
+func deleteReview(c *gin.Context) {
+	reviewID, err := strconv.Atoi(c.Param("review"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	author := c.GetString("username")
+	if isStaff(c) {
+		author = ""
+	}
+
+	resp, err := shopSrv.DeleteReview(reviewID, author)
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func moderateReview(c *gin.Context) {
+	reviewID, err := strconv.Atoi(c.Param("review"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [ModerateReview] %s set review %d to %s", c.GetString("username"), reviewID, request.Status)
+	resp, err := shopSrv.ModerateReview(reviewID, request.Status, request.Note, c.GetString("username"))
+	if err != nil {
+		reviewError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	user "github.com/AkinAD/basedCode/user"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPayPeriod is used for timesheets when no range is given.
+const defaultPayPeriod = 14 * 24 * time.Hour
+
+// managedStore returns the store the caller may manage. Admins are not tied to
+// a store, so for them it returns 0 and any store is allowed.
+func managedStore(c *gin.Context) (int, error) {
+	if isAdmin(c) {
+		return 0, nil
+	}
+
+	username := c.GetString("username")
+	if username == "" {
+		return 0, errors.New("Could not get username from token")
+	}
+	profile, err := userSrv.GetProfile(username)
+	if err != nil {
+		return 0, err
+	}
+	if profile.StoreID == 0 {
+		return 0, fmt.Errorf("%s is not assigned to a store", username)
+	}
+
+	return profile.StoreID, nil
+}
+
+// timeParam reads a query parameter given as RFC 3339 or as a plain date.
+func timeParam(c *gin.Context, name string, fallback time.Time) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a date (YYYY-MM-DD) or RFC 3339 time", name)
+	}
+
+	return t, nil
+}
+
+func scheduleError(c *gin.Context, err error) {
+	switch err {
+	case user.ErrInvalidShift:
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	case user.ErrShiftNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case user.ErrShiftOverlap, user.ErrAlreadyClockedIn, user.ErrNotClockedIn:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// checkShiftStaff makes sure a manager only schedules their own store's staff.
+func checkShiftStaff(c *gin.Context, shift *user.Shift) bool {
+	storeID, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return false
+	}
+	if storeID != 0 && shift.StoreID != storeID {
+		c.AbortWithStatusJSON(403, gin.H{"error": "The shift's StoreID does not match the Manager's Store ID"})
+		return false
+	}
+
+	employee, err := userSrv.GetProfile(shift.Username)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return false
+	}
+	if employee.Username == "" {
+		c.AbortWithStatusJSON(400, gin.H{"error": fmt.Sprintf("employee %s does not exist", shift.Username)})
+		return false
+	}
+	if storeID != 0 && employee.StoreID != storeID {
+		c.AbortWithStatusJSON(403, gin.H{"error": "The employee's StoreID does not match the Manager's Store ID"})
+		return false
+	}
+
+	return true
+}
+
+func getShifts(c *gin.Context) {
+	storeID, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if storeID == 0 && c.Query("storeID") != "" {
+		storeID, err = strconv.Atoi(c.Query("storeID"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "storeID must be a number"})
+			return
+		}
+	}
+
+	now := time.Now()
+	from, err := timeParam(c, "from", now)
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := timeParam(c, "to", from.Add(defaultPayPeriod))
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := userSrv.GetShifts(c.Query("username"), storeID, from, to)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getMyShifts returns the caller's own upcoming shifts.
+func getMyShifts(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.AbortWithError(500, errors.New("Could not get username from token"))
+		return
+	}
+
+	from := time.Now()
+	to, err := timeParam(c, "to", from.Add(defaultPayPeriod))
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := userSrv.GetShifts(username, 0, from, to)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createShift(c *gin.Context) {
+	var request *user.Shift
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.ShiftID = 0
+	request.CreatedBy = c.GetString("username")
+
+	if !checkShiftStaff(c, request) {
+		return
+	}
+
+	log.Printf("[Main] [CreateShift] %v", request)
+	resp, err := userSrv.CreateShift(request)
+	if err != nil {
+		scheduleError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func updateShift(c *gin.Context) {
+	shiftID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	existing, err := userSrv.GetShift(shiftID)
+	if err != nil {
+		scheduleError(c, err)
+		return
+	}
+	if !checkShiftStaff(c, existing) {
+		return
+	}
+
+	var request *user.Shift
+	err = c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.ShiftID = shiftID
+	request.CreatedBy = existing.CreatedBy
+
+	if !checkShiftStaff(c, request) {
+		return
+	}
+
+	resp, err := userSrv.UpdateShift(request)
+	if err != nil {
+		scheduleError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteShift(c *gin.Context) {
+	shiftID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	existing, err := userSrv.GetShift(shiftID)
+	if err != nil {
+		scheduleError(c, err)
+		return
+	}
+	if !checkShiftStaff(c, existing) {
+		return
+	}
+
+	resp, err := userSrv.DeleteShift(shiftID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func clockIn(c *gin.Context) {
+	var request struct {
+		StoreID int `json:"storeID"`
+	}
+	err := c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	username := c.GetString("username")
+	if username == "" {
+		c.AbortWithError(500, errors.New("Could not get username from token"))
+		return
+	}
+
+	resp, err := userSrv.ClockIn(username, request.StoreID)
+	if err != nil {
+		scheduleError(c, err)
+		return
+	}
+	if resp.Unassigned {
+		log.Printf("[Main] [ClockIn] %s clocked in at store %d without being assigned to it", username, request.StoreID)
+	}
+
+	c.JSON(200, &resp)
+}
+
+func clockOut(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.AbortWithError(500, errors.New("Could not get username from token"))
+		return
+	}
+
+	resp, err := userSrv.ClockOut(username)
+	if err != nil {
+		scheduleError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getTimesheet reports scheduled vs worked hours for a store over a pay
+// period, ?from= and ?to=, defaulting to the last two weeks.
+func getTimesheet(c *gin.Context) {
+	storeID, err := managedStore(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if storeID == 0 {
+		storeID, err = strconv.Atoi(c.Query("storeID"))
+		if err != nil {
+			c.AbortWithStatusJSON(400, gin.H{"error": "storeID is required"})
+			return
+		}
+	}
+
+	to, err := timeParam(c, "to", time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	from, err := timeParam(c, "from", to.Add(-defaultPayPeriod))
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !to.After(from) {
+		c.AbortWithStatusJSON(400, gin.H{"error": "to must be after from"})
+		return
+	}
+
+	resp, err := userSrv.GetTimesheet(storeID, from, to)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
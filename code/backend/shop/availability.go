@@ -0,0 +1,172 @@
+package shop
+
+import (
+	"math"
+	"sort"
+)
+
+// earthRadiusKm is the mean radius of the earth, for great-circle distances.
+const earthRadiusKm = 6371.0
+
+// Coordinates is a point on the map in decimal degrees.
+type Coordinates struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (c *Coordinates) validate() error {
+	if math.IsNaN(c.Latitude) || c.Latitude < -90 || c.Latitude > 90 {
+		return invalid("latitude must be from -90 to 90")
+	}
+	if math.IsNaN(c.Longitude) || c.Longitude < -180 || c.Longitude > 180 {
+		return invalid("longitude must be from -180 to 180")
+	}
+	return nil
+}
+
+// DistanceKm is the great-circle distance between two points, by the
+// haversine formula.
+func (c *Coordinates) DistanceKm(to *Coordinates) float64 {
+	lat1 := c.Latitude * math.Pi / 180
+	lat2 := to.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (to.Longitude - c.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Coordinates is where the store is, nil if it hasn't been put on the map.
+func (s *Store) Coordinates() *Coordinates {
+	if s.Latitude == nil || s.Longitude == nil {
+		return nil
+	}
+	return &Coordinates{Latitude: *s.Latitude, Longitude: *s.Longitude}
+}
+
+// validateLocation checks a store has both coordinates or neither, and that
+// they are on the map.
+func (s *Store) validateLocation() error {
+	if (s.Latitude == nil) != (s.Longitude == nil) {
+		return invalid("latitude and longitude must be set together")
+	}
+	if c := s.Coordinates(); c != nil {
+		return c.validate()
+	}
+	return nil
+}
+
+// StoreAvailability is where one store has an item: the item priced at that
+// store, where each variant is shelved and how many are on the shelf.
+// Distance is how far the store is in km, when asked from somewhere and the
+// store is on the map.
+type StoreAvailability struct {
+	Store    *Store          `json:"store"`
+	Item     *Item           `json:"item"`
+	Stock    []*StockRequest `json:"stock"`
+	Quantity int             `json:"quantity"`
+	Distance *float64        `json:"distance,omitempty"`
+}
+
+// GetItemAvailability lists every store that stocks an item. Asked from
+// somewhere, the nearest stores come first and stores not on the map last;
+// otherwise they are in store order.
+func (s *shopService) GetItemAvailability(itemID int, from *Coordinates) ([]*StoreAvailability, error) {
+	if from != nil {
+		if err := from.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	items, err := s.db.getItemsByID([]int{itemID})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrItemNotFound
+	}
+	if err := s.attachVariants(items); err != nil {
+		return nil, err
+	}
+
+	placements, err := s.db.getItemPlacements(itemID)
+	if err != nil {
+		return nil, err
+	}
+	stores, err := s.db.getStores()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*Store)
+	for _, store := range stores {
+		byID[store.StoreID] = store
+	}
+
+	byStore := make(map[int]*StoreAvailability)
+	availability := []*StoreAvailability{}
+	for _, p := range placements {
+		a, ok := byStore[p.StoreID]
+		if !ok {
+			store, ok := byID[p.StoreID]
+			if !ok {
+				continue
+			}
+			item, err := s.itemAtStore(items[0], p.StoreID)
+			if err != nil {
+				return nil, err
+			}
+			a = &StoreAvailability{Store: store, Item: item}
+			if here := store.Coordinates(); from != nil && here != nil {
+				distance := roundCents(from.DistanceKm(here))
+				a.Distance = &distance
+			}
+			byStore[p.StoreID] = a
+			availability = append(availability, a)
+		}
+		a.Stock = append(a.Stock, p)
+		if p.Quantity != nil {
+			a.Quantity += *p.Quantity
+		}
+	}
+
+	sort.SliceStable(availability, func(i, j int) bool {
+		a, b := availability[i], availability[j]
+		if a.Distance == nil || b.Distance == nil {
+			if a.Distance != nil || b.Distance != nil {
+				return a.Distance != nil
+			}
+			return a.Store.StoreID < b.Store.StoreID
+		}
+		if *a.Distance != *b.Distance {
+			return *a.Distance < *b.Distance
+		}
+		return a.Store.StoreID < b.Store.StoreID
+	})
+
+	return availability, nil
+}
+
+// itemAtStore is a copy of item, variants and all, priced at a store with its
+// promotions applied.
+func (s *shopService) itemAtStore(item *Item, storeID int) (*Item, error) {
+	priced := *item
+	priced.Variants = make([]*Variant, len(item.Variants))
+	for i, v := range item.Variants {
+		copied := *v
+		priced.Variants[i] = &copied
+	}
+
+	prices, err := s.loadStorePrices(storeID)
+	if err != nil {
+		return nil, err
+	}
+	prices.item(&priced)
+
+	promotions, err := s.activePromotions(storeID)
+	if err != nil {
+		return nil, err
+	}
+	promotions.item(&priced)
+
+	return &priced, nil
+}
@@ -0,0 +1,153 @@
+package shop
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	BarcodeUPCA  = "UPC-A"
+	BarcodeEAN13 = "EAN-13"
+	BarcodeEAN8  = "EAN-8"
+)
+
+var (
+	ErrBarcodeNotFound = errors.New("no item has this barcode")
+	ErrBarcodeInUse    = errors.New("barcode is already assigned to an item")
+)
+
+// Barcode is a scannable code on an item. GTIN is the code zero-padded to 14
+// digits, so the same product scanned as UPC-A or EAN-13 resolves to one row.
+type Barcode struct {
+	Code   string `json:"code" gorm:"column:code"`
+	Format string `json:"format" gorm:"column:format"`
+	GTIN   string `json:"-" gorm:"primaryKey;column:gtin"`
+	ItemID int    `json:"itemID" gorm:"column:itemid"`
+}
+
+// BarcodeLookup is the result of scanning a barcode. When the scan is made at
+// a store, StoreID is set and Location says where the item is shelved there.
+type BarcodeLookup struct {
+	Item     *Item     `json:"item"`
+	Barcode  *Barcode  `json:"barcode"`
+	StoreID  int       `json:"storeID,omitempty"`
+	InStock  bool      `json:"inStock"`
+	Location *Location `json:"location,omitempty"`
+}
+
+// ParseBarcode checks the length and GS1 check digit of a UPC-A, EAN-13 or
+// EAN-8 code.
+func ParseBarcode(code string) (*Barcode, error) {
+	code = strings.TrimSpace(code)
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return nil, invalid("barcode %q must only contain digits", code)
+		}
+	}
+
+	var format string
+	switch len(code) {
+	case 12:
+		format = BarcodeUPCA
+	case 13:
+		format = BarcodeEAN13
+	case 8:
+		format = BarcodeEAN8
+	default:
+		return nil, invalid("barcode %q must be 8 (EAN-8), 12 (UPC-A) or 13 (EAN-13) digits", code)
+	}
+
+	if checkDigit(code[:len(code)-1]) != code[len(code)-1] {
+		return nil, invalid("barcode %q has an invalid check digit", code)
+	}
+
+	return &Barcode{
+		Code:   code,
+		Format: format,
+		GTIN:   strings.Repeat("0", 14-len(code)) + code,
+	}, nil
+}
+
+// checkDigit computes the GS1 mod 10 check digit: from the right, digits are
+// weighted 3, 1, 3, 1...
+func checkDigit(digits string) byte {
+	sum := 0
+	weight := 3
+	for i := len(digits) - 1; i >= 0; i-- {
+		sum += int(digits[i]-'0') * weight
+		weight = 4 - weight
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+func (s *shopService) GetBarcodes(itemID int) ([]*Barcode, error) {
+	barcodes, err := s.db.getBarcodes(itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	return barcodes, nil
+}
+
+func (s *shopService) AddBarcode(itemID int, code string) (*Barcode, error) {
+	barcode, err := ParseBarcode(code)
+	if err != nil {
+		return nil, err
+	}
+	barcode.ItemID = itemID
+
+	barcode, err = s.db.addBarcode(barcode)
+	if err != nil {
+		return nil, err
+	}
+
+	return barcode, nil
+}
+
+func (s *shopService) DeleteBarcode(itemID int, code string) (bool, error) {
+	barcode, err := ParseBarcode(code)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.db.deleteBarcode(itemID, barcode.GTIN)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// LookupBarcode resolves a scanned code to its item. A storeID of 0 skips the
+// store's stock lookup.
+func (s *shopService) LookupBarcode(code string, storeID int) (*BarcodeLookup, error) {
+	barcode, err := ParseBarcode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	barcode, err = s.db.getBarcode(barcode.GTIN)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := s.db.getItem(barcode.ItemID)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := &BarcodeLookup{Item: item, Barcode: barcode}
+	if storeID == 0 {
+		return lookup, nil
+	}
+
+	lookup.StoreID = storeID
+	lookup.Location, err = s.db.getStockLocation(storeID, item.ItemID)
+	if err != nil {
+		return nil, err
+	}
+	lookup.InStock = lookup.Location != nil
+
+	return lookup, nil
+}
@@ -0,0 +1,46 @@
+package shop
+
+import "testing"
+
+func TestParseBarcode(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   string
+		format string
+		gtin   string
+		valid  bool
+	}{
+		{"UPC-A", "036000291452", BarcodeUPCA, "00036000291452", true},
+		{"EAN-13", "4006381333931", BarcodeEAN13, "04006381333931", true},
+		{"EAN-8", "96385074", BarcodeEAN8, "00000096385074", true},
+		{"UPC-A as EAN-13", "0036000291452", BarcodeEAN13, "00036000291452", true},
+		{"surrounding spaces", " 96385074 ", BarcodeEAN8, "00000096385074", true},
+		{"check digit 0", "012345678905", BarcodeUPCA, "00012345678905", true},
+		{"wrong check digit", "036000291453", "", "", false},
+		{"letters", "03600029145A", "", "", false},
+		{"too short", "1234567", "", "", false},
+		{"14 digits", "00036000291452", "", "", false},
+		{"empty", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			barcode, err := ParseBarcode(tt.code)
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("ParseBarcode(%q) = %+v, want an error", tt.code, barcode)
+				}
+				if !IsInvalid(err) {
+					t.Errorf("ParseBarcode(%q) = %v, want an InvalidError", tt.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseBarcode(%q): %v", tt.code, err)
+			}
+			if barcode.Format != tt.format || barcode.GTIN != tt.gtin {
+				t.Errorf("ParseBarcode(%q) = %s %s, want %s %s", tt.code, barcode.Format, barcode.GTIN, tt.format, tt.gtin)
+			}
+		})
+	}
+}
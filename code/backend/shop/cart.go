@@ -0,0 +1,135 @@
+package shop
+
+// Cart is a shopper's saved cart. StoreID is the store it is priced at, 0 for
+// chain-wide prices, and CouponCode the code applied to it, if any.
+type Cart struct {
+	Username   string      `json:"username" gorm:"primaryKey;column:username"`
+	StoreID    int         `json:"storeID" gorm:"column:storeid"`
+	CouponCode string      `json:"couponCode,omitempty" gorm:"column:coupon_code"`
+	Lines      []*CartLine `json:"lines" gorm:"-"`
+}
+
+func (s *shopService) GetCart(username string, profile *DietaryProfile) (*PricedCart, error) {
+	cart, err := s.db.getCart(username)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.priceSavedCart(cart, profile)
+}
+
+// SaveCart replaces the lines of a shopper's cart and the store it is priced
+// at. An applied coupon stays on the cart.
+func (s *shopService) SaveCart(cart *Cart, profile *DietaryProfile) (*PricedCart, error) {
+	merged := mergeCartLines(cart.Lines)
+	if len(merged) > 0 {
+		if _, _, err := s.priceCart(cart.StoreID, merged); err != nil {
+			return nil, err
+		}
+	}
+	cart.Lines = merged
+
+	if err := s.db.saveCart(cart); err != nil {
+		return nil, err
+	}
+
+	return s.GetCart(cart.Username, profile)
+}
+
+// SetCartLine sets how many of an item (variant) are in the cart. A quantity
+// of 0 takes the line out.
+func (s *shopService) SetCartLine(username string, line *CartLine, profile *DietaryProfile) (*PricedCart, error) {
+	cart, err := s.db.getCart(username)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []*CartLine{}
+	for _, l := range cart.Lines {
+		if l.ItemID != line.ItemID || l.VariantID != line.VariantID {
+			lines = append(lines, l)
+		}
+	}
+	if line.Quantity != 0 {
+		lines = append(lines, line)
+	}
+	cart.Lines = lines
+
+	return s.SaveCart(cart, profile)
+}
+
+// ClearCart empties the cart and gives back the use of any coupon applied to
+// it.
+func (s *shopService) ClearCart(username string) (bool, error) {
+	result, err := s.db.deleteCart(username)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// priceSavedCart prices a saved cart, coupon included, and flags lines its
+// store doesn't stock with substitutes suited to profile.
+func (s *shopService) priceSavedCart(cart *Cart, profile *DietaryProfile) (*PricedCart, error) {
+	if len(cart.Lines) == 0 {
+		return &PricedCart{StoreID: cart.StoreID, Lines: []*PricedLine{}}, nil
+	}
+
+	priced, items, err := s.priceCart(cart.StoreID, cart.Lines)
+	if err != nil {
+		return nil, err
+	}
+
+	if cart.CouponCode != "" {
+		coupon, err := s.db.getCoupon(cart.CouponCode)
+		switch err {
+		case nil:
+			parents, err := s.categoryParents()
+			if err != nil {
+				return nil, err
+			}
+			applyCoupon(priced, items, parents, coupon)
+		case ErrCouponNotFound:
+			// the coupon was deleted since it was applied
+		default:
+			return nil, err
+		}
+	}
+
+	if err := s.flagUnavailable(priced, items, profile); err != nil {
+		return nil, err
+	}
+
+	return priced, nil
+}
+
+// same reports whether two reads of a cart hold the same store, coupon and
+// lines.
+func (c *Cart) same(other *Cart) bool {
+	if c.StoreID != other.StoreID || c.CouponCode != other.CouponCode || len(c.Lines) != len(other.Lines) {
+		return false
+	}
+	for i, line := range c.Lines {
+		if *line != *other.Lines[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeCartLines folds lines for the same item and variant into one.
+func mergeCartLines(lines []*CartLine) []*CartLine {
+	merged := []*CartLine{}
+	byKey := make(map[priceKey]*CartLine)
+	for _, line := range lines {
+		key := priceKey{line.ItemID, line.VariantID}
+		if existing, ok := byKey[key]; ok {
+			existing.Quantity += line.Quantity
+			continue
+		}
+		byKey[key] = line
+		merged = append(merged, line)
+	}
+	return merged
+}
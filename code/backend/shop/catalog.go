@@ -0,0 +1,749 @@
+package shop
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// How each row of a catalog import turned out. In a dry run nothing is
+// written and created, updated and unchanged say what would have happened.
+const (
+	ImportCreated   = "created"
+	ImportUpdated   = "updated"
+	ImportUnchanged = "unchanged"
+	ImportInvalid   = "invalid"
+	ImportFailed    = "failed"
+)
+
+// ImportLine is where a row was in the uploaded file, with any problems found
+// while reading it, e.g. a price that isn't a number.
+type ImportLine struct {
+	Line     int      `json:"-"`
+	Problems []string `json:"-"`
+}
+
+// CategoryRow is a category in an import or export, keyed on its name. Parent
+// names the parent category, blank for a top-level one, and must come earlier
+// in the file or already exist. A blank tax class leaves an existing
+// category's class as it is.
+type CategoryRow struct {
+	ImportLine
+	Name     string `json:"name"`
+	Parent   string `json:"parent"`
+	TaxClass string `json:"taxClass"`
+}
+
+// ItemRow is an item, keyed on its name, or with a SKU one of its variants,
+// keyed on the SKU. A variant row's Name is the item it belongs to and its
+// Price, Size and Unit are the variant's. Blank fields leave an existing
+// item's values as they are.
+type ItemRow struct {
+	ImportLine
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	Price       float64  `json:"price"`
+	Dietary     []string `json:"dietary,omitempty"`
+	Allergens   []string `json:"allergens,omitempty"`
+	SKU         string   `json:"sku,omitempty"`
+	Variant     string   `json:"variant,omitempty"`
+	Size        float64  `json:"size,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+}
+
+// StockRow places an item, or with a SKU one of its variants, in a store,
+// keyed on the store, item and variant.
+type StockRow struct {
+	ImportLine
+	StoreID int    `json:"storeID"`
+	Item    string `json:"item"`
+	SKU     string `json:"sku,omitempty"`
+	Row     int    `json:"row"`
+	Col     int    `json:"col"`
+}
+
+type ImportResult struct {
+	Line   int      `json:"line"`
+	Key    string   `json:"key"`
+	ID     int      `json:"id,omitempty"`
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun    bool            `json:"dryRun"`
+	Total     int             `json:"total"`
+	Created   int             `json:"created"`
+	Updated   int             `json:"updated"`
+	Unchanged int             `json:"unchanged"`
+	Failed    int             `json:"failed"`
+	Results   []*ImportResult `json:"results"`
+}
+
+func (r *ImportReport) add(result *ImportResult) {
+	r.Total++
+	r.Results = append(r.Results, result)
+	switch result.Status {
+	case ImportCreated:
+		r.Created++
+	case ImportUpdated:
+		r.Updated++
+	case ImportUnchanged:
+		r.Unchanged++
+	default:
+		r.Failed++
+	}
+}
+
+func (r *ImportResult) invalid(problems []string) *ImportResult {
+	r.Status = ImportInvalid
+	r.Errors = problems
+	return r
+}
+
+func (r *ImportResult) failed(err error) *ImportResult {
+	r.Status = ImportFailed
+	r.Errors = []string{err.Error()}
+	return r
+}
+
+type stockKey struct {
+	storeID   int
+	itemID    int
+	variantID int
+}
+
+// catalogImport is the state of one import. It keeps what the rows so far
+// created, so later rows can refer to them even in a dry run, where they get
+// negative placeholder IDs instead of being written.
+type catalogImport struct {
+	s           *shopService
+	dryRun      bool
+	actor       string
+	placeholder int
+	categories  map[string]*Category
+	items       map[string]*Item
+	ambiguous   map[string]int
+	variants    map[string]*Variant
+	stores      map[int]bool
+	stock       map[stockKey]*StockRequest
+	stockLoaded map[int]bool
+}
+
+// catalogKey makes names match case-insensitively.
+func catalogKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func (s *shopService) newCatalogImport(dryRun bool, actor string) (*catalogImport, error) {
+	imp := &catalogImport{
+		s:           s,
+		dryRun:      dryRun,
+		actor:       actor,
+		categories:  make(map[string]*Category),
+		items:       make(map[string]*Item),
+		ambiguous:   make(map[string]int),
+		variants:    make(map[string]*Variant),
+		stores:      make(map[int]bool),
+		stock:       make(map[stockKey]*StockRequest),
+		stockLoaded: make(map[int]bool),
+	}
+
+	categories, err := s.db.getCategories()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range categories {
+		imp.categories[catalogKey(c.Name)] = c
+	}
+
+	return imp, nil
+}
+
+func (imp *catalogImport) loadItems() error {
+	items, err := imp.s.db.getItems()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		key := catalogKey(item.Name)
+		if _, ok := imp.items[key]; ok {
+			imp.ambiguous[key]++
+		}
+		imp.items[key] = item
+		ids = append(ids, item.ItemID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	variants, err := imp.s.db.getVariants(ids)
+	if err != nil {
+		return err
+	}
+	for _, v := range variants {
+		imp.variants[v.SKU] = v
+	}
+
+	return nil
+}
+
+func (imp *catalogImport) loadStores() error {
+	stores, err := imp.s.db.getStores()
+	if err != nil {
+		return err
+	}
+	for _, store := range stores {
+		imp.stores[store.StoreID] = true
+	}
+
+	return nil
+}
+
+func (imp *catalogImport) loadStock(storeID int) error {
+	if imp.stockLoaded[storeID] {
+		return nil
+	}
+
+	placements, err := imp.s.db.getStore(storeID)
+	if err != nil {
+		return err
+	}
+	for _, p := range placements {
+		imp.stock[stockKey{storeID, p.ItemID, p.VariantID}] = &StockRequest{StoreID: storeID, ItemID: p.ItemID, VariantID: p.VariantID, Location: p.Location}
+	}
+	imp.stockLoaded[storeID] = true
+
+	return nil
+}
+
+func (imp *catalogImport) nextPlaceholder() int {
+	imp.placeholder--
+	return imp.placeholder
+}
+
+// item finds an item by name, adding a problem when there is none or more
+// than one.
+func (imp *catalogImport) item(name string, problems *[]string) *Item {
+	key := catalogKey(name)
+	if n := imp.ambiguous[key]; n > 0 {
+		*problems = append(*problems, fmt.Sprintf("%d items are named %q, rename them before importing", n+1, name))
+		return nil
+	}
+	item, ok := imp.items[key]
+	if !ok {
+		*problems = append(*problems, fmt.Sprintf("item %q does not exist", name))
+		return nil
+	}
+	return item
+}
+
+// ImportCategories upserts categories row by row as next reads them, until it
+// returns io.EOF. Any other error from next stops the import and is returned
+// with the report of the rows done so far.
+func (s *shopService) ImportCategories(next func() (*CategoryRow, error), dryRun bool) (*ImportReport, error) {
+	imp, err := s.newCatalogImport(dryRun, "")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: dryRun, Results: []*ImportResult{}}
+	for {
+		row, err := next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		report.add(imp.category(row))
+	}
+}
+
+func (imp *catalogImport) category(row *CategoryRow) *ImportResult {
+	name := strings.TrimSpace(row.Name)
+	result := &ImportResult{Line: row.Line, Key: name}
+	problems := append([]string{}, row.Problems...)
+
+	if name == "" {
+		problems = append(problems, "name is required")
+	}
+	var parent *Category
+	if strings.TrimSpace(row.Parent) != "" {
+		var ok bool
+		parent, ok = imp.categories[catalogKey(row.Parent)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("parent category %q does not exist", row.Parent))
+		}
+	}
+	var taxClass string
+	if strings.TrimSpace(row.TaxClass) != "" {
+		var err error
+		if taxClass, err = ParseTaxClass(row.TaxClass); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return result.invalid(problems)
+	}
+
+	parentID := 0
+	if parent != nil {
+		parentID = parent.CategoryID
+	}
+
+	existing, ok := imp.categories[catalogKey(name)]
+	if !ok {
+		category := &Category{Name: name, TaxClass: taxClass, ParentID: parentID}
+		if imp.dryRun {
+			category.CategoryID = imp.nextPlaceholder()
+			if category.TaxClass == "" {
+				category.TaxClass = TaxStandard
+			}
+		} else {
+			var err error
+			if category, err = imp.s.CreateCategory(category); err != nil {
+				return result.failed(err)
+			}
+		}
+		imp.categories[catalogKey(name)] = category
+		result.ID = category.CategoryID
+		result.Status = ImportCreated
+		return result
+	}
+
+	result.ID = existing.CategoryID
+	if taxClass == "" {
+		taxClass = existing.TaxClass
+	}
+	renamed := existing.Name != name || existing.TaxClass != taxClass
+	moved := existing.ParentID != parentID
+	if !renamed && !moved {
+		result.Status = ImportUnchanged
+		return result
+	}
+
+	if moved && parentID != 0 {
+		parents := make(categoryParents)
+		for _, c := range imp.categories {
+			parents[c.CategoryID] = c.ParentID
+		}
+		if parents.within(parentID, existing.CategoryID) {
+			return result.invalid([]string{ErrCategoryCycle.Error()})
+		}
+	}
+
+	if !imp.dryRun {
+		if renamed {
+			if _, err := imp.s.UpdateCategory(&Category{CategoryID: existing.CategoryID, Name: name, TaxClass: taxClass}); err != nil {
+				return result.failed(err)
+			}
+		}
+		if moved {
+			if _, err := imp.s.MoveCategory(existing.CategoryID, parentID); err != nil {
+				return result.failed(err)
+			}
+		}
+	}
+
+	existing.Name = name
+	existing.TaxClass = taxClass
+	existing.ParentID = parentID
+	result.Status = ImportUpdated
+	return result
+}
+
+// ImportItems upserts items and their variants row by row, as
+// ImportCategories does. Item categories are matched by name and must exist.
+func (s *shopService) ImportItems(next func() (*ItemRow, error), actor string, dryRun bool) (*ImportReport, error) {
+	imp, err := s.newCatalogImport(dryRun, actor)
+	if err != nil {
+		return nil, err
+	}
+	if err := imp.loadItems(); err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: dryRun, Results: []*ImportResult{}}
+	for {
+		row, err := next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		if strings.TrimSpace(row.SKU) != "" {
+			report.add(imp.variant(row))
+		} else {
+			report.add(imp.itemRow(row))
+		}
+	}
+}
+
+func (imp *catalogImport) itemRow(row *ItemRow) *ImportResult {
+	name := strings.TrimSpace(row.Name)
+	result := &ImportResult{Line: row.Line, Key: name}
+	problems := append([]string{}, row.Problems...)
+
+	if name == "" {
+		problems = append(problems, "name is required")
+	}
+	if row.Price < 0 {
+		problems = append(problems, "price cannot be negative")
+	}
+
+	item := &Item{Name: name, Description: strings.TrimSpace(row.Description), Price: row.Price}
+	if len(row.Dietary) > 0 {
+		item.Dietary = pq.StringArray(row.Dietary)
+	}
+	if len(row.Allergens) > 0 {
+		item.Allergens = pq.StringArray(row.Allergens)
+	}
+	if err := normalizeItemLabels(item); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	var category *Category
+	if strings.TrimSpace(row.Category) != "" {
+		var ok bool
+		category, ok = imp.categories[catalogKey(row.Category)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("category %q does not exist", row.Category))
+		}
+	}
+
+	key := catalogKey(name)
+	if n := imp.ambiguous[key]; n > 0 {
+		problems = append(problems, fmt.Sprintf("%d items are named %q, rename them before importing", n+1, name))
+	}
+	existing, ok := imp.items[key]
+	if !ok && category == nil && strings.TrimSpace(row.Category) == "" {
+		problems = append(problems, "category is required for a new item")
+	}
+	if len(problems) > 0 {
+		return result.invalid(problems)
+	}
+
+	if !ok {
+		item.Category = Category{CategoryID: category.CategoryID}
+		if imp.dryRun {
+			item.ItemID = imp.nextPlaceholder()
+		} else {
+			var err error
+			if item, err = imp.s.CreateItem(item, imp.actor); err != nil {
+				return result.failed(err)
+			}
+		}
+		item.Category = *category
+		imp.items[key] = item
+		result.ID = item.ItemID
+		result.Status = ImportCreated
+		return result
+	}
+
+	result.ID = existing.ItemID
+	changed := existing.Name != name ||
+		(item.Description != "" && item.Description != existing.Description) ||
+		(item.Price != 0 && item.Price != existing.Price) ||
+		(category != nil && category.CategoryID != existing.CategoryID) ||
+		(item.Dietary != nil && !sameStrings(item.Dietary, existing.Dietary)) ||
+		(item.Allergens != nil && !sameStrings(item.Allergens, existing.Allergens))
+	if !changed {
+		result.Status = ImportUnchanged
+		return result
+	}
+
+	// the name of the category is left out, items only store its ID
+	item.ItemID = existing.ItemID
+	if category != nil {
+		item.Category = Category{CategoryID: category.CategoryID}
+	}
+	if !imp.dryRun {
+		if _, err := imp.s.UpdateItem(item, imp.actor); err != nil {
+			return result.failed(err)
+		}
+	}
+
+	existing.Name = name
+	if item.Description != "" {
+		existing.Description = item.Description
+	}
+	if item.Price != 0 {
+		existing.Price = item.Price
+	}
+	if category != nil {
+		existing.Category = *category
+	}
+	if item.Dietary != nil {
+		existing.Dietary = item.Dietary
+	}
+	if item.Allergens != nil {
+		existing.Allergens = item.Allergens
+	}
+	result.Status = ImportUpdated
+	return result
+}
+
+func (imp *catalogImport) variant(row *ItemRow) *ImportResult {
+	sku := strings.TrimSpace(row.SKU)
+	result := &ImportResult{Line: row.Line, Key: sku}
+	problems := append([]string{}, row.Problems...)
+
+	item := imp.item(row.Name, &problems)
+	variant := &Variant{Name: row.Variant, SKU: sku, Size: row.Size, Unit: row.Unit, Price: row.Price}
+	if err := variant.validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	existing, ok := imp.variants[sku]
+	if ok && item != nil && existing.ItemID != item.ItemID {
+		problems = append(problems, fmt.Sprintf("SKU %s belongs to another item", sku))
+	}
+	if len(problems) > 0 {
+		return result.invalid(problems)
+	}
+
+	variant.ItemID = item.ItemID
+	if !ok {
+		if imp.dryRun {
+			variant.VariantID = imp.nextPlaceholder()
+		} else {
+			var err error
+			if variant, err = imp.s.CreateVariant(variant, imp.actor); err != nil {
+				return result.failed(err)
+			}
+		}
+		imp.variants[sku] = variant
+		result.ID = variant.VariantID
+		result.Status = ImportCreated
+		return result
+	}
+
+	result.ID = existing.VariantID
+	if existing.Name == variant.Name && existing.Size == variant.Size && existing.Unit == variant.Unit && existing.Price == variant.Price {
+		result.Status = ImportUnchanged
+		return result
+	}
+
+	variant.VariantID = existing.VariantID
+	if !imp.dryRun {
+		if _, err := imp.s.UpdateVariant(variant, imp.actor); err != nil {
+			return result.failed(err)
+		}
+	}
+
+	imp.variants[sku] = variant
+	result.Status = ImportUpdated
+	return result
+}
+
+// ImportStock upserts stock placements row by row, as ImportCategories does.
+// A storeID other than 0 limits the import to that store, and rows without a
+// store go to it.
+func (s *shopService) ImportStock(next func() (*StockRow, error), storeID int, dryRun bool) (*ImportReport, error) {
+	imp, err := s.newCatalogImport(dryRun, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := imp.loadItems(); err != nil {
+		return nil, err
+	}
+	if err := imp.loadStores(); err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: dryRun, Results: []*ImportResult{}}
+	for {
+		row, err := next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		report.add(imp.placement(row, storeID))
+	}
+}
+
+func (imp *catalogImport) placement(row *StockRow, storeID int) *ImportResult {
+	problems := append([]string{}, row.Problems...)
+
+	switch {
+	case storeID != 0 && row.StoreID == 0:
+		row.StoreID = storeID
+	case storeID != 0 && row.StoreID != storeID:
+		problems = append(problems, fmt.Sprintf("stock can only be imported for store %d", storeID))
+	case row.StoreID == 0:
+		problems = append(problems, "store is required")
+	case !imp.stores[row.StoreID]:
+		problems = append(problems, fmt.Sprintf("store %d does not exist", row.StoreID))
+	}
+	sku := strings.TrimSpace(row.SKU)
+	result := &ImportResult{Line: row.Line, Key: fmt.Sprintf("%d/%s", row.StoreID, strings.TrimSpace(row.Item))}
+	if sku != "" {
+		result.Key += "/" + sku
+	}
+
+	if row.Row < 0 || row.Col < 0 {
+		problems = append(problems, "row and col cannot be negative")
+	}
+
+	item := imp.item(row.Item, &problems)
+	variantID := 0
+	if sku != "" && item != nil {
+		variant, ok := imp.variants[sku]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("SKU %s does not exist", sku))
+		case variant.ItemID != item.ItemID:
+			problems = append(problems, fmt.Sprintf("SKU %s is not a variant of %s", sku, item.Name))
+		default:
+			variantID = variant.VariantID
+		}
+	}
+	if len(problems) > 0 {
+		return result.invalid(problems)
+	}
+
+	if err := imp.loadStock(row.StoreID); err != nil {
+		return result.failed(err)
+	}
+
+	key := stockKey{row.StoreID, item.ItemID, variantID}
+	placement := &StockRequest{StoreID: row.StoreID, ItemID: item.ItemID, VariantID: variantID, Location: Location{Row: row.Row, Col: row.Col}}
+	result.ID = item.ItemID
+
+	existing, ok := imp.stock[key]
+	if ok && existing.Location == placement.Location {
+		result.Status = ImportUnchanged
+		return result
+	}
+
+	if !imp.dryRun {
+		var err error
+		if ok {
+			_, err = imp.s.UpdateStock(placement)
+		} else {
+			_, err = imp.s.CreateStock(placement)
+		}
+		if err != nil {
+			return result.failed(err)
+		}
+	}
+
+	imp.stock[key] = placement
+	result.Status = ImportCreated
+	if ok {
+		result.Status = ImportUpdated
+	}
+	return result
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportCategories lists every category with parents ahead of their
+// children, so the export imports back as it is.
+func (s *shopService) ExportCategories() ([]*CategoryRow, error) {
+	tree, err := s.GetCategoryTree()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []*CategoryRow{}
+	var walk func(nodes []*CategoryNode, parent string)
+	walk = func(nodes []*CategoryNode, parent string) {
+		for _, n := range nodes {
+			rows = append(rows, &CategoryRow{Name: n.Name, Parent: parent, TaxClass: n.TaxClass})
+		}
+		for _, n := range nodes {
+			walk(n.Children, n.Name)
+		}
+	}
+	walk(tree, "")
+
+	return rows, nil
+}
+
+// ExportItems lists every item at its base price, each followed by its
+// variants.
+func (s *shopService) ExportItems() ([]*ItemRow, error) {
+	items, err := s.db.getItems()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachVariants(items); err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+
+	rows := []*ItemRow{}
+	for _, item := range items {
+		rows = append(rows, &ItemRow{
+			Name:        item.Name,
+			Description: item.Description,
+			Category:    item.Category.Name,
+			Price:       item.Price,
+			Dietary:     item.Dietary,
+			Allergens:   item.Allergens,
+		})
+		for _, v := range item.Variants {
+			rows = append(rows, &ItemRow{Name: item.Name, Price: v.Price, SKU: v.SKU, Variant: v.Name, Size: v.Size, Unit: v.Unit})
+		}
+	}
+
+	return rows, nil
+}
+
+// ExportStock lists a store's placements in aisle order.
+func (s *shopService) ExportStock(storeID int) ([]*StockRow, error) {
+	if _, err := s.db.getStoreByID(storeID); err != nil {
+		return nil, err
+	}
+
+	stock, err := s.db.getStore(storeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachStockVariants(stock); err != nil {
+		return nil, err
+	}
+	sort.Slice(stock, func(i, j int) bool {
+		if stock[i].Row != stock[j].Row {
+			return stock[i].Row < stock[j].Row
+		}
+		if stock[i].Col != stock[j].Col {
+			return stock[i].Col < stock[j].Col
+		}
+		return stock[i].Name < stock[j].Name
+	})
+
+	rows := []*StockRow{}
+	for _, inStock := range stock {
+		row := &StockRow{StoreID: storeID, Item: inStock.Name, Row: inStock.Row, Col: inStock.Col}
+		if inStock.Variant != nil {
+			row.SKU = inStock.Variant.SKU
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,126 @@
+package shop
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrCategoryCycle    = errors.New("a category can't be moved under itself or one of its subcategories")
+)
+
+// CategoryNode is a category with its subcategories, for GetCategoryTree.
+type CategoryNode struct {
+	Category
+	Children []*CategoryNode `json:"children"`
+}
+
+// categoryParents maps each category to its parent, 0 for top-level ones.
+type categoryParents map[int]int
+
+// within reports whether categoryID is ancestorID or one of its descendants.
+func (p categoryParents) within(categoryID, ancestorID int) bool {
+	// the step limit guards against a cycle that somehow got into the table
+	for steps := 0; categoryID != 0 && steps <= len(p); steps++ {
+		if categoryID == ancestorID {
+			return true
+		}
+		categoryID = p[categoryID]
+	}
+	return false
+}
+
+func (s *shopService) categoryParents() (categoryParents, error) {
+	categories, err := s.db.getCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(categoryParents)
+	for _, c := range categories {
+		parents[c.CategoryID] = c.ParentID
+	}
+
+	return parents, nil
+}
+
+// GetCategoryTree returns the top-level categories with their subcategories
+// nested under them, each level sorted by name.
+func (s *shopService) GetCategoryTree() ([]*CategoryNode, error) {
+	categories, err := s.db.getCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[int]*CategoryNode)
+	for _, c := range categories {
+		nodes[c.CategoryID] = &CategoryNode{Category: *c, Children: []*CategoryNode{}}
+	}
+
+	roots := []*CategoryNode{}
+	for _, c := range categories {
+		node := nodes[c.CategoryID]
+		if parent, ok := nodes[c.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	sortCategoryNodes(roots)
+	return roots, nil
+}
+
+func sortCategoryNodes(nodes []*CategoryNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	for _, n := range nodes {
+		sortCategoryNodes(n.Children)
+	}
+}
+
+// GetCategoryItems lists the items in a category, and with descendants also
+// those in its subcategories.
+func (s *shopService) GetCategoryItems(categoryID int, descendants bool) ([]*Item, error) {
+	ids := []int{categoryID}
+	if descendants {
+		var err error
+		ids, err = s.db.getCategoryDescendants(categoryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ids) == 0 {
+		return nil, ErrCategoryNotFound
+	}
+
+	items, err := s.db.getItemsInCategories(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.attachVariants(items); err != nil {
+		return nil, err
+	}
+
+	promotions, err := s.activePromotions(0)
+	if err != nil {
+		return nil, err
+	}
+	promotions.items(items)
+
+	return items, nil
+}
+
+// MoveCategory puts a category, along with its whole subtree, under a new
+// parent. A parentID of 0 makes it a top-level category.
+func (s *shopService) MoveCategory(categoryID, parentID int) (*Category, error) {
+	category, err := s.db.moveCategory(categoryID, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return category, nil
+}
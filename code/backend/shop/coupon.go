@@ -0,0 +1,332 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrCouponNotFound = errors.New("coupon not found")
+	ErrCodeInUse      = errors.New("coupon code is already in use")
+)
+
+// Reasons a coupon code is turned down.
+const (
+	RejectUnknownCode     = "unknown_code"
+	RejectNotStarted      = "not_started"
+	RejectExpired         = "expired"
+	RejectWrongStore      = "wrong_store"
+	RejectEmptyCart       = "empty_cart"
+	RejectNoEligibleItems = "no_eligible_items"
+	RejectMinBasket       = "min_basket"
+	RejectUsageLimit      = "usage_limit"
+	RejectUserLimit       = "user_limit"
+)
+
+// CouponRejection says why a code can't be used on a cart.
+type CouponRejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (r *CouponRejection) Error() string {
+	return r.Message
+}
+
+func reject(reason, format string, args ...interface{}) *CouponRejection {
+	return &CouponRejection{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Coupon is a code shoppers enter to take Percent (percent_off) or Amount
+// (amount_off) off their cart. When ItemIDs or CategoryIDs are given only
+// matching lines are discounted; otherwise the whole cart is. MinBasket is
+// checked against the cart after promotions, before tax. MaxUses and
+// MaxUsesPerUser of 0 mean unlimited, and StoreID 0 means the code works at
+// every store.
+type Coupon struct {
+	CouponID       int           `json:"couponID" gorm:"primaryKey;column:couponid"`
+	Code           string        `json:"code" gorm:"column:code"`
+	Type           string        `json:"type" gorm:"column:type"`
+	Percent        float64       `json:"percent,omitempty" gorm:"column:percent"`
+	Amount         float64       `json:"amount,omitempty" gorm:"column:amount"`
+	MinBasket      float64       `json:"minBasket" gorm:"column:min_basket"`
+	MaxUses        int           `json:"maxUses" gorm:"column:max_uses"`
+	MaxUsesPerUser int           `json:"maxUsesPerUser" gorm:"column:max_uses_per_user"`
+	ItemIDs        pq.Int64Array `json:"itemIDs" gorm:"column:itemids;type:integer[]"`
+	CategoryIDs    pq.Int64Array `json:"categoryIDs" gorm:"column:categoryids;type:integer[]"`
+	StoreID        int           `json:"storeID" gorm:"column:storeid"`
+	StartsAt       time.Time     `json:"startsAt" gorm:"column:starts_at"`
+	EndsAt         time.Time     `json:"endsAt" gorm:"column:ends_at"`
+	CreatedBy      string        `json:"createdBy" gorm:"column:created_by"`
+	Uses           int           `json:"uses" gorm:"column:uses;->"`
+	Description    string        `json:"description" gorm:"-"`
+}
+
+// AppliedCoupon is the coupon on a priced cart. When it no longer applies,
+// e.g. the cart dropped below the minimum basket, Applied is false and the
+// rejection says why.
+type AppliedCoupon struct {
+	Code        string           `json:"code"`
+	Description string           `json:"description"`
+	Applied     bool             `json:"applied"`
+	Amount      float64          `json:"amount"`
+	Rejection   *CouponRejection `json:"rejection,omitempty"`
+}
+
+// normalizeCode makes codes case-insensitive.
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (c *Coupon) validate() error {
+	c.Code = normalizeCode(c.Code)
+	if c.Code == "" {
+		return invalid("coupon code is required")
+	}
+	if !c.EndsAt.After(c.StartsAt) {
+		return invalid("coupon must end after it starts")
+	}
+
+	switch c.Type {
+	case DealPercentOff:
+		if c.Percent <= 0 || c.Percent > 100 {
+			return invalid("percent must be between 0 and 100")
+		}
+	case DealAmountOff:
+		if c.Amount <= 0 {
+			return invalid("amount must be positive")
+		}
+	default:
+		return invalid("unknown coupon type %q, expected %s or %s", c.Type, DealPercentOff, DealAmountOff)
+	}
+
+	if c.MinBasket < 0 || c.MaxUses < 0 || c.MaxUsesPerUser < 0 {
+		return invalid("minBasket, maxUses and maxUsesPerUser cannot be negative")
+	}
+
+	return nil
+}
+
+func (c *Coupon) describe() {
+	switch c.Type {
+	case DealPercentOff:
+		c.Description = fmt.Sprintf("%g%% off", c.Percent)
+	case DealAmountOff:
+		c.Description = fmt.Sprintf("$%.2f off", c.Amount)
+	}
+	if len(c.ItemIDs) > 0 || len(c.CategoryIDs) > 0 {
+		c.Description += " selected items"
+	}
+	if c.MinBasket > 0 {
+		c.Description += fmt.Sprintf(" when you spend $%.2f", c.MinBasket)
+	}
+}
+
+// eligible reports whether a line for item can be discounted. Listed
+// categories take in their subcategories.
+func (c *Coupon) eligible(item *Item, parents categoryParents) bool {
+	if len(c.ItemIDs) == 0 && len(c.CategoryIDs) == 0 {
+		return true
+	}
+	for _, id := range c.ItemIDs {
+		if int(id) == item.ItemID {
+			return true
+		}
+	}
+	for _, id := range c.CategoryIDs {
+		if parents.within(item.CategoryID, int(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// check tests everything about a coupon except its usage limits, which are
+// only counted under lock while redeeming it.
+func (c *Coupon) check(cart *PricedCart, items map[int]*Item, parents categoryParents, now time.Time) *CouponRejection {
+	if now.Before(c.StartsAt) {
+		return reject(RejectNotStarted, "code %s can't be used until %s", c.Code, c.StartsAt.Format("Jan 2, 2006"))
+	}
+	if !now.Before(c.EndsAt) {
+		return reject(RejectExpired, "code %s expired on %s", c.Code, c.EndsAt.Format("Jan 2, 2006"))
+	}
+	if c.StoreID != 0 && c.StoreID != cart.StoreID {
+		return reject(RejectWrongStore, "code %s is only valid at store %d", c.Code, c.StoreID)
+	}
+	if len(cart.Lines) == 0 {
+		return reject(RejectEmptyCart, "your cart is empty")
+	}
+
+	eligible := 0.0
+	for _, line := range cart.Lines {
+		if c.eligible(items[line.ItemID], parents) {
+			eligible += line.Total
+		}
+	}
+	if eligible <= 0 {
+		return reject(RejectNoEligibleItems, "nothing in your cart is eligible for code %s", c.Code)
+	}
+	if cart.basket() < c.MinBasket {
+		return reject(RejectMinBasket, "code %s needs a basket of at least $%.2f, yours is $%.2f", c.Code, c.MinBasket, cart.basket())
+	}
+
+	return nil
+}
+
+// applyCoupon takes the coupon off the eligible lines, splitting it in
+// proportion to what each line costs so every line shows its share.
+func applyCoupon(cart *PricedCart, items map[int]*Item, parents categoryParents, coupon *Coupon) {
+	coupon.describe()
+	applied := &AppliedCoupon{Code: coupon.Code, Description: coupon.Description}
+	cart.Coupon = applied
+
+	if rejection := coupon.check(cart, items, parents, time.Now()); rejection != nil {
+		applied.Rejection = rejection
+		return
+	}
+
+	var lines []*PricedLine
+	eligible := 0.0
+	for _, line := range cart.Lines {
+		if coupon.eligible(items[line.ItemID], parents) && line.Total > 0 {
+			lines = append(lines, line)
+			eligible += line.Total
+		}
+	}
+
+	amount := coupon.Amount
+	if coupon.Type == DealPercentOff {
+		amount = eligible * coupon.Percent / 100
+	}
+	if amount > eligible {
+		amount = eligible
+	}
+	amount = roundCents(amount)
+
+	left := amount
+	for i, line := range lines {
+		share := roundCents(amount * line.Total / eligible)
+		if i == len(lines)-1 || share > left {
+			share = left
+		}
+		left = roundCents(left - share)
+
+		line.Discounts = append(line.Discounts, &Discount{
+			Code:        coupon.Code,
+			Name:        "Coupon " + coupon.Code,
+			Description: coupon.Description,
+			Amount:      share,
+		})
+		line.Discount = roundCents(line.Discount + share)
+		line.Total = roundCents(line.Total - share)
+	}
+
+	applied.Applied = true
+	applied.Amount = amount
+	cart.Discount = roundCents(cart.Discount + amount)
+	cart.total(items)
+}
+
+// ApplyCoupon puts a code on the shopper's cart and records its redemption.
+// Applying another code gives back the use of the one it replaces.
+func (s *shopService) ApplyCoupon(username, code string, profile *DietaryProfile) (*PricedCart, error) {
+	coupon, err := s.db.getCoupon(normalizeCode(code))
+	if err == ErrCouponNotFound {
+		return nil, reject(RejectUnknownCode, "%s is not a valid code", normalizeCode(code))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cart, err := s.db.getCart(username)
+	if err != nil {
+		return nil, err
+	}
+	if cart.CouponCode == coupon.Code {
+		return s.priceSavedCart(cart, profile)
+	}
+	if len(cart.Lines) == 0 {
+		return nil, reject(RejectEmptyCart, "your cart is empty")
+	}
+
+	priced, items, err := s.priceCart(cart.StoreID, cart.Lines)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := s.categoryParents()
+	if err != nil {
+		return nil, err
+	}
+	if rejection := coupon.check(priced, items, parents, time.Now()); rejection != nil {
+		return nil, rejection
+	}
+
+	if err := s.db.redeemCoupon(username, coupon); err != nil {
+		return nil, err
+	}
+
+	cart.CouponCode = coupon.Code
+	return s.priceSavedCart(cart, profile)
+}
+
+func (s *shopService) RemoveCoupon(username string, profile *DietaryProfile) (*PricedCart, error) {
+	if err := s.db.releaseCoupon(username); err != nil {
+		return nil, err
+	}
+
+	return s.GetCart(username, profile)
+}
+
+func (s *shopService) GetCoupons() ([]*Coupon, error) {
+	coupons, err := s.db.getCoupons()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range coupons {
+		c.describe()
+	}
+
+	return coupons, nil
+}
+
+func (s *shopService) CreateCoupon(coupon *Coupon) (*Coupon, error) {
+	if err := coupon.validate(); err != nil {
+		return nil, err
+	}
+
+	coupon, err := s.db.addCoupon(coupon)
+	if err != nil {
+		return nil, err
+	}
+
+	coupon.describe()
+	return coupon, nil
+}
+
+func (s *shopService) UpdateCoupon(coupon *Coupon) (*Coupon, error) {
+	if err := coupon.validate(); err != nil {
+		return nil, err
+	}
+
+	coupon, err := s.db.updateCoupon(coupon)
+	if err != nil {
+		return nil, err
+	}
+
+	coupon.describe()
+	return coupon, nil
+}
+
+func (s *shopService) DeleteCoupon(couponID int) (bool, error) {
+	result, err := s.db.deleteCoupon(couponID)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
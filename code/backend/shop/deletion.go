@@ -0,0 +1,117 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrHasDependents    = errors.New("other records still depend on this, delete with mode reassign or cascade")
+	ErrReassignToTarget = errors.New("reassignTo must name another record to move dependents to")
+)
+
+// How DeleteCategory and DeleteStore deal with what depends on the target.
+const (
+	// DeleteAbort only deletes when nothing depends on the target.
+	DeleteAbort = "abort"
+	// DeleteReassign moves dependents over to ReassignTo first.
+	DeleteReassign = "reassign"
+	// DeleteCascade deletes dependents along with the target.
+	DeleteCascade = "cascade"
+)
+
+var DeleteModes = []string{DeleteAbort, DeleteReassign, DeleteCascade}
+
+type DeleteOptions struct {
+	Mode       string `json:"mode"`
+	ReassignTo int    `json:"reassignTo"`
+}
+
+// ParseDeleteMode matches a delete mode, defaulting to abort.
+func ParseDeleteMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return DeleteAbort, nil
+	case DeleteAbort, DeleteReassign, DeleteCascade:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown delete mode %q, expected one of %s", mode, strings.Join(DeleteModes, ", "))
+}
+
+func (o *DeleteOptions) validate(targetID int) error {
+	mode, err := ParseDeleteMode(o.Mode)
+	if err != nil {
+		return err
+	}
+	o.Mode = mode
+
+	if o.Mode == DeleteReassign && (o.ReassignTo == 0 || o.ReassignTo == targetID) {
+		return ErrReassignToTarget
+	}
+	return nil
+}
+
+// CategoryDependents counts what refers to a category. Items and
+// Subcategories are the direct ones only; cascading takes the whole subtree.
+type CategoryDependents struct {
+	CategoryID    int   `json:"categoryID"`
+	Items         int64 `json:"items"`
+	Subcategories int64 `json:"subcategories"`
+	Promotions    int64 `json:"promotions"`
+	Coupons       int64 `json:"coupons"`
+}
+
+func (d *CategoryDependents) none() bool {
+	return d.Items == 0 && d.Subcategories == 0 && d.Promotions == 0 && d.Coupons == 0
+}
+
+// StoreDependents counts what refers to a store. Accounts are the staff
+// assigned to it and the shoppers who picked it as their store; Shifts only
+// counts shifts that haven't started yet, Orders those still to be fulfilled,
+// SlotBookings the pickup slots those orders are booked in, PickBatches the
+// batches still being picked and Returns those still owed a refund. Past
+// shifts, clock-in history, finished orders, done batches and refunded
+// returns are kept whatever the mode. Cancelled lists the orders a cascade
+// cancelled.
+type StoreDependents struct {
+	StoreID          int   `json:"storeID"`
+	Stock            int64 `json:"stock"`
+	StockAdjustments int64 `json:"stockAdjustments"`
+	Prices           int64 `json:"prices"`
+	Promotions       int64 `json:"promotions"`
+	Coupons          int64 `json:"coupons"`
+	Accounts         int64 `json:"accounts"`
+	Shifts           int64 `json:"shifts"`
+	Carts            int64 `json:"carts"`
+	Orders           int64 `json:"orders"`
+	SlotBookings     int64 `json:"slotBookings"`
+	PickBatches      int64 `json:"pickBatches"`
+	Returns          int64 `json:"returns"`
+	Cancelled        []int `json:"cancelled,omitempty"`
+}
+
+func (d *StoreDependents) none() bool {
+	return d.Stock == 0 && d.StockAdjustments == 0 && d.Prices == 0 && d.Promotions == 0 && d.Coupons == 0 &&
+		d.Accounts == 0 && d.Shifts == 0 && d.Carts == 0 && d.Orders == 0 &&
+		d.SlotBookings == 0 && d.PickBatches == 0 && d.Returns == 0
+}
+
+func (s *shopService) GetCategoryDependents(categoryID int) (*CategoryDependents, error) {
+	dependents, err := s.db.getCategoryDependents(categoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	return dependents, nil
+}
+
+func (s *shopService) GetStoreDependents(storeID int) (*StoreDependents, error) {
+	dependents, err := s.db.getStoreDependents(storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return dependents, nil
+}
@@ -0,0 +1,167 @@
+package shop
+
+import "strings"
+
+// DietaryLabels is the controlled list of labels an item can carry and a
+// shopper can require.
+var DietaryLabels = []string{
+	"vegan",
+	"vegetarian",
+	"gluten-free",
+	"dairy-free",
+	"halal",
+	"kosher",
+	"organic",
+}
+
+// Allergens is the controlled list of allergens, following Health Canada's
+// priority food allergens.
+var Allergens = []string{
+	"milk",
+	"eggs",
+	"peanuts",
+	"tree-nuts",
+	"soy",
+	"wheat",
+	"fish",
+	"crustaceans",
+	"shellfish",
+	"sesame",
+	"mustard",
+	"sulphites",
+}
+
+// DietaryProfile is what a shopper has asked for: every label in Dietary must
+// be on an item, and none of the Allergens may be.
+type DietaryProfile struct {
+	Dietary   []string `json:"dietary"`
+	Allergens []string `json:"allergens"`
+}
+
+// ParseDietaryLabels normalizes labels ("Gluten Free" -> "gluten-free") and
+// rejects anything not in DietaryLabels.
+func ParseDietaryLabels(labels []string) ([]string, error) {
+	return parseLabels(labels, DietaryLabels, "dietary label")
+}
+
+// ParseAllergens normalizes allergens and rejects anything not in Allergens.
+func ParseAllergens(allergens []string) ([]string, error) {
+	return parseLabels(allergens, Allergens, "allergen")
+}
+
+func parseLabels(input []string, allowed []string, kind string) ([]string, error) {
+	labels := []string{}
+	seen := make(map[string]bool)
+	for _, raw := range input {
+		label := normalizeLabel(raw)
+		if label == "" || seen[label] {
+			continue
+		}
+		if !containsLabel(allowed, label) {
+			return nil, invalid("unknown %s %q, expected one of %s", kind, raw, strings.Join(allowed, ", "))
+		}
+		seen[label] = true
+		labels = append(labels, label)
+	}
+
+	return labels, nil
+}
+
+func normalizeLabel(label string) string {
+	label = strings.ToLower(strings.TrimSpace(label))
+	return strings.NewReplacer(" ", "-", "_", "-").Replace(label)
+}
+
+func containsLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether the profile places no restrictions at all.
+func (p *DietaryProfile) Empty() bool {
+	return p == nil || (len(p.Dietary) == 0 && len(p.Allergens) == 0)
+}
+
+// ConflictsWith lists the reasons an item doesn't suit the profile, e.g.
+// "not vegan" or "contains peanuts".
+func (p *DietaryProfile) ConflictsWith(item *Item) []string {
+	if p.Empty() {
+		return nil
+	}
+
+	var conflicts []string
+	for _, label := range p.Dietary {
+		if !containsLabel(item.Dietary, label) {
+			conflicts = append(conflicts, "not "+label)
+		}
+	}
+	for _, allergen := range p.Allergens {
+		if containsLabel(item.Allergens, allergen) {
+			conflicts = append(conflicts, "contains "+allergen)
+		}
+	}
+
+	return conflicts
+}
+
+// FilterItems sets Conflicts on every item. With exclude set, conflicting
+// items are dropped instead of flagged.
+func FilterItems(items []*Item, p *DietaryProfile, exclude bool) []*Item {
+	if p.Empty() {
+		return items
+	}
+
+	filtered := items[:0]
+	for _, item := range items {
+		item.Conflicts = p.ConflictsWith(item)
+		if exclude && len(item.Conflicts) > 0 {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+
+	return filtered
+}
+
+// FilterStock is FilterItems for a store's stock.
+func FilterStock(stock []*ItemInStock, p *DietaryProfile, exclude bool) []*ItemInStock {
+	if p.Empty() {
+		return stock
+	}
+
+	filtered := stock[:0]
+	for _, inStock := range stock {
+		inStock.Conflicts = p.ConflictsWith(&inStock.Item)
+		if exclude && len(inStock.Conflicts) > 0 {
+			continue
+		}
+		filtered = append(filtered, inStock)
+	}
+
+	return filtered
+}
+
+// normalizeItemLabels validates an item's labels before it is saved. Labels
+// left out of the request (nil) are left alone so updates don't clear them.
+func normalizeItemLabels(item *Item) error {
+	if item.Dietary != nil {
+		dietary, err := ParseDietaryLabels(item.Dietary)
+		if err != nil {
+			return err
+		}
+		item.Dietary = dietary
+	}
+	if item.Allergens != nil {
+		allergens, err := ParseAllergens(item.Allergens)
+		if err != nil {
+			return err
+		}
+		item.Allergens = allergens
+	}
+
+	return nil
+}
@@ -4,7 +4,7 @@ go 1.15
 
 require (
 	github.com/jackc/pgx/v4 v4.9.2 // indirect
-	github.com/lib/pq v1.8.0 // indirect
+	github.com/lib/pq v1.8.0
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/crypto v0.0.0-20201124201722-c8d3bf9c5392 // indirect
 	golang.org/x/text v0.3.4 // indirect
@@ -0,0 +1,316 @@
+package shop
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	// the server image has no zoneinfo of its own
+	_ "time/tzdata"
+)
+
+const (
+	// dateLayout is how holiday exceptions are dated, in the store's timezone.
+	dateLayout = "2006-01-02"
+	// clockLayout is how opening and closing times are written.
+	clockLayout = "15:04"
+	// defaultNearbyRadiusKm is how far nearby stores are looked for when no
+	// radius is given.
+	defaultNearbyRadiusKm = 25
+	maxNearbyRadiusKm     = 500
+)
+
+var ErrHoursExceptionNotFound = errors.New("no opening hours exception for that date")
+
+// OpeningHours is when a store opens on a day of the week, Weekday 0 being
+// Sunday. A day can have more than one period, e.g. closed over lunch. A
+// period closing at or before it opens runs past midnight, and "24:00" closes
+// at midnight.
+type OpeningHours struct {
+	StoreID int    `json:"storeID" gorm:"column:storeid"`
+	Weekday int    `json:"weekday" gorm:"column:weekday"`
+	Opens   string `json:"opens" gorm:"column:opens"`
+	Closes  string `json:"closes" gorm:"column:closes"`
+}
+
+// HoursException replaces a store's weekly hours on one date, such as a
+// holiday. Closed stores don't open that day at all; otherwise Opens and
+// Closes are that day's only period.
+type HoursException struct {
+	StoreID int    `json:"storeID" gorm:"primaryKey;column:storeid"`
+	Date    string `json:"date" gorm:"primaryKey;column:date"`
+	Closed  bool   `json:"closed" gorm:"column:closed"`
+	Opens   string `json:"opens,omitempty" gorm:"column:opens"`
+	Closes  string `json:"closes,omitempty" gorm:"column:closes"`
+	Note    string `json:"note,omitempty" gorm:"column:note"`
+}
+
+// clockMinutes turns "HH:MM" into minutes since midnight, allowing "24:00".
+func clockMinutes(clock string) (int, error) {
+	if clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return 0, invalid("%q is not a time of day, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// period is an opening period in minutes since midnight. It runs past
+// midnight when closes is at or before opens.
+type period struct {
+	opens, closes int
+}
+
+func parsePeriod(opens, closes string) (period, error) {
+	o, err := clockMinutes(opens)
+	if err != nil {
+		return period{}, err
+	}
+	if o == 24*60 {
+		return period{}, invalid("a store cannot open at 24:00")
+	}
+	c, err := clockMinutes(closes)
+	if err != nil {
+		return period{}, err
+	}
+	return period{o, c}, nil
+}
+
+func (p period) overnight() bool {
+	return p.closes <= p.opens
+}
+
+func (h *OpeningHours) validate() error {
+	if h.Weekday < 0 || h.Weekday > 6 {
+		return invalid("weekday must be from 0 (Sunday) to 6 (Saturday)")
+	}
+	_, err := parsePeriod(h.Opens, h.Closes)
+	return err
+}
+
+func (e *HoursException) validate() error {
+	if _, err := time.Parse(dateLayout, e.Date); err != nil {
+		return invalid("%q is not a date, expected YYYY-MM-DD", e.Date)
+	}
+	e.Note = strings.TrimSpace(e.Note)
+	if e.Closed {
+		e.Opens, e.Closes = "", ""
+		return nil
+	}
+	_, err := parsePeriod(e.Opens, e.Closes)
+	return err
+}
+
+// validateTimezone checks the store's timezone is a known IANA name.
+func (s *Store) validateTimezone() error {
+	if s.Timezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return invalid("unknown timezone %q", s.Timezone)
+	}
+	return nil
+}
+
+// periods is when a store opens on the given local date: its exception for
+// that date if it has one, else its hours for that day of the week.
+func (s *Store) periods(date time.Time) []period {
+	for _, e := range s.Exceptions {
+		if e.Date != date.Format(dateLayout) {
+			continue
+		}
+		if e.Closed {
+			return nil
+		}
+		if p, err := parsePeriod(e.Opens, e.Closes); err == nil {
+			return []period{p}
+		}
+		return nil
+	}
+
+	var periods []period
+	for _, h := range s.Hours {
+		if h.Weekday != int(date.Weekday()) {
+			continue
+		}
+		if p, err := parsePeriod(h.Opens, h.Closes); err == nil {
+			periods = append(periods, p)
+		}
+	}
+	return periods
+}
+
+// openAt reports whether the store is open at t, in its own timezone. It is
+// nil when that can't be known: the store has no timezone or no hours.
+func (s *Store) openAt(t time.Time) *bool {
+	if s.Timezone == "" || len(s.Hours) == 0 {
+		return nil
+	}
+	zone, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil
+	}
+
+	local := t.In(zone)
+	minute := local.Hour()*60 + local.Minute()
+	open := false
+	for _, p := range s.periods(local) {
+		if minute >= p.opens && (p.overnight() || minute < p.closes) {
+			open = true
+		}
+	}
+	// still open from a period that started yesterday
+	for _, p := range s.periods(local.AddDate(0, 0, -1)) {
+		if p.overnight() && minute < p.closes {
+			open = true
+		}
+	}
+	return &open
+}
+
+// attachHours loads the stores' weekly hours and upcoming exceptions and
+// works out whether each is open now.
+func (s *shopService) attachHours(stores []*Store) error {
+	if len(stores) == 0 {
+		return nil
+	}
+
+	var ids []int
+	byID := make(map[int]*Store)
+	for _, store := range stores {
+		ids = append(ids, store.StoreID)
+		byID[store.StoreID] = store
+	}
+
+	hours, err := s.db.getStoreHours(ids)
+	if err != nil {
+		return err
+	}
+	for _, h := range hours {
+		byID[h.StoreID].Hours = append(byID[h.StoreID].Hours, h)
+	}
+
+	// yesterday's exception can still be open past midnight, wherever the
+	// store is
+	now := time.Now()
+	exceptions, err := s.db.getHoursExceptions(ids, now.AddDate(0, 0, -2).Format(dateLayout))
+	if err != nil {
+		return err
+	}
+	for _, e := range exceptions {
+		byID[e.StoreID].Exceptions = append(byID[e.StoreID].Exceptions, e)
+	}
+
+	for _, store := range stores {
+		store.OpenNow = store.openAt(now)
+	}
+
+	return nil
+}
+
+// SetStoreHours replaces a store's weekly opening hours. No hours at all
+// means they aren't known, not that the store never opens.
+func (s *shopService) SetStoreHours(storeID int, hours []*OpeningHours) ([]*OpeningHours, error) {
+	for _, h := range hours {
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+		h.StoreID = storeID
+	}
+	sort.SliceStable(hours, func(i, j int) bool {
+		if hours[i].Weekday != hours[j].Weekday {
+			return hours[i].Weekday < hours[j].Weekday
+		}
+		return hours[i].Opens < hours[j].Opens
+	})
+
+	if _, err := s.db.getStoreByID(storeID); err != nil {
+		return nil, err
+	}
+	hours, err := s.db.setStoreHours(storeID, hours)
+	if err != nil {
+		return nil, err
+	}
+
+	return hours, nil
+}
+
+// SetHoursException sets a store's hours for one date, replacing any
+// exception already on that date.
+func (s *shopService) SetHoursException(exception *HoursException) (*HoursException, error) {
+	if err := exception.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.getStoreByID(exception.StoreID); err != nil {
+		return nil, err
+	}
+
+	exception, err := s.db.setHoursException(exception)
+	if err != nil {
+		return nil, err
+	}
+
+	return exception, nil
+}
+
+func (s *shopService) DeleteHoursException(storeID int, date string) (bool, error) {
+	result, err := s.db.deleteHoursException(storeID, date)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// GetNearbyStores lists the stores within radiusKm of a point, nearest first,
+// with each one's Distance set. Stores not on the map are left out. A radius
+// of 0 looks 25km around.
+func (s *shopService) GetNearbyStores(from *Coordinates, radiusKm float64) ([]*Store, error) {
+	if err := from.validate(); err != nil {
+		return nil, err
+	}
+	if radiusKm < 0 {
+		return nil, invalid("radius cannot be negative")
+	}
+	if radiusKm == 0 {
+		radiusKm = defaultNearbyRadiusKm
+	}
+	if radiusKm > maxNearbyRadiusKm {
+		radiusKm = maxNearbyRadiusKm
+	}
+
+	stores, err := s.db.getStores()
+	if err != nil {
+		return nil, err
+	}
+
+	nearby := []*Store{}
+	for _, store := range stores {
+		here := store.Coordinates()
+		if here == nil {
+			continue
+		}
+		distance := from.DistanceKm(here)
+		if distance > radiusKm {
+			continue
+		}
+		distance = roundCents(distance)
+		store.Distance = &distance
+		nearby = append(nearby, store)
+	}
+	sort.SliceStable(nearby, func(i, j int) bool {
+		if *nearby[i].Distance != *nearby[j].Distance {
+			return *nearby[i].Distance < *nearby[j].Distance
+		}
+		return nearby[i].StoreID < nearby[j].StoreID
+	})
+
+	if err := s.attachHours(nearby); err != nil {
+		return nil, err
+	}
+
+	return nearby, nil
+}
@@ -0,0 +1,68 @@
+package shop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpenAt(t *testing.T) {
+	zone, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	store := &Store{
+		Timezone: "America/Toronto",
+		Hours: []*OpeningHours{
+			{Weekday: 5, Opens: "22:00", Closes: "02:00"}, // Friday night into Saturday
+			{Weekday: 6, Opens: "09:00", Closes: "17:00"},
+		},
+		Exceptions: []*HoursException{
+			{Date: "2021-01-08", Closed: true},
+			{Date: "2021-01-15", Opens: "20:00", Closes: "24:00"},
+		},
+	}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, time.January, day, hour, minute, 0, 0, zone)
+	}
+
+	// 1 January 2021 is a Friday
+	tests := []struct {
+		name string
+		at   time.Time
+		open bool
+	}{
+		{"before the overnight period", at(1, 21, 59), false},
+		{"overnight period opens", at(1, 22, 0), true},
+		{"before midnight", at(1, 23, 59), true},
+		{"after midnight", at(2, 1, 59), true},
+		{"overnight period closes", at(2, 2, 0), false},
+		{"between periods", at(2, 8, 59), false},
+		{"day period", at(2, 9, 0), true},
+		{"day period closes", at(2, 17, 0), false},
+		{"day without hours", at(3, 12, 0), false},
+		{"closed on the date", at(8, 23, 0), false},
+		{"closed the night before", at(9, 1, 0), false},
+		{"exception until 24:00", at(15, 23, 59), true},
+		{"exception does not run overnight", at(16, 0, 30), false},
+		{"asked in another timezone", at(1, 23, 0).UTC(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open := store.openAt(tt.at)
+			if open == nil {
+				t.Fatalf("openAt(%s) = nil", tt.at)
+			}
+			if *open != tt.open {
+				t.Errorf("openAt(%s) = %v, want %v", tt.at, *open, tt.open)
+			}
+		})
+	}
+
+	if open := (&Store{Hours: store.Hours}).openAt(at(2, 12, 0)); open != nil {
+		t.Errorf("openAt without a timezone = %v, want nil", *open)
+	}
+	if open := (&Store{Timezone: store.Timezone}).openAt(at(2, 12, 0)); open != nil {
+		t.Errorf("openAt without hours = %v, want nil", *open)
+	}
+}
@@ -0,0 +1,26 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+)
+
+// InvalidError is a request turned down for what it asks for, as opposed to
+// the store failing to carry it out. Handlers answer it with a 400.
+type InvalidError struct {
+	Message string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Message
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &InvalidError{Message: fmt.Sprintf(format, args...)}
+}
+
+// IsInvalid reports whether err, or one it wraps, is an InvalidError.
+func IsInvalid(err error) bool {
+	var invalid *InvalidError
+	return errors.As(err, &invalid)
+}
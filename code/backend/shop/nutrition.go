@@ -0,0 +1,195 @@
+package shop
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// NutritionFacts follows the Canadian nutrition facts table. Amounts are per
+// serving; fats, carbohydrates and protein are in grams, cholesterol and
+// sodium in milligrams. It is stored as jsonb on the item.
+type NutritionFacts struct {
+	ServingSize          float64 `json:"servingSize"`
+	ServingUnit          string  `json:"servingUnit"`
+	ServingsPerContainer float64 `json:"servingsPerContainer"`
+	Calories             float64 `json:"calories"`
+	Fat                  float64 `json:"fat"`
+	SaturatedFat         float64 `json:"saturatedFat"`
+	TransFat             float64 `json:"transFat"`
+	Cholesterol          float64 `json:"cholesterol"`
+	Sodium               float64 `json:"sodium"`
+	Carbohydrate         float64 `json:"carbohydrate"`
+	Fibre                float64 `json:"fibre"`
+	Sugars               float64 `json:"sugars"`
+	Protein              float64 `json:"protein"`
+}
+
+// ServingUnits are the units a serving size can be given in.
+var ServingUnits = []string{"g", "ml", "each"}
+
+// CartLine is one item and how many of it are in a shopper's cart. VariantID
+// is set when a particular variant of the item was picked.
+type CartLine struct {
+	ItemID    int `json:"itemID" gorm:"column:itemid"`
+	VariantID int `json:"variantID,omitempty" gorm:"column:variantid"`
+	Quantity  int `json:"quantity" gorm:"column:quantity"`
+}
+
+// CartNutrition totals the nutrition facts of everything in a cart.
+// Items without nutrition data are listed in Missing and left out of Total.
+type CartNutrition struct {
+	Total     NutritionFacts `json:"total"`
+	Items     int            `json:"items"`
+	Missing   []int          `json:"missing"`
+	Allergens []string       `json:"allergens"`
+	// Dietary holds the labels that every item in the cart carries.
+	Dietary []string `json:"dietary"`
+}
+
+func (n NutritionFacts) Value() (driver.Value, error) {
+	return json.Marshal(n)
+}
+
+func (n *NutritionFacts) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, n)
+	case string:
+		return json.Unmarshal([]byte(v), n)
+	}
+	return fmt.Errorf("cannot scan %T into NutritionFacts", value)
+}
+
+// validate rejects negative amounts and fills in defaults.
+func (n *NutritionFacts) validate() error {
+	amounts := map[string]float64{
+		"servingSize":          n.ServingSize,
+		"servingsPerContainer": n.ServingsPerContainer,
+		"calories":             n.Calories,
+		"fat":                  n.Fat,
+		"saturatedFat":         n.SaturatedFat,
+		"transFat":             n.TransFat,
+		"cholesterol":          n.Cholesterol,
+		"sodium":               n.Sodium,
+		"carbohydrate":         n.Carbohydrate,
+		"fibre":                n.Fibre,
+		"sugars":               n.Sugars,
+		"protein":              n.Protein,
+	}
+	for name, amount := range amounts {
+		if amount < 0 {
+			return invalid("nutrition %s cannot be negative", name)
+		}
+	}
+
+	if n.SaturatedFat+n.TransFat > n.Fat {
+		return invalid("nutrition saturated and trans fat cannot exceed total fat")
+	}
+	if n.Fibre+n.Sugars > n.Carbohydrate {
+		return invalid("nutrition fibre and sugars cannot exceed total carbohydrate")
+	}
+
+	n.ServingUnit = normalizeLabel(n.ServingUnit)
+	if n.ServingUnit == "" {
+		n.ServingUnit = "g"
+	}
+	if !containsLabel(ServingUnits, n.ServingUnit) {
+		return invalid("unknown serving unit %q, expected one of g, ml, each", n.ServingUnit)
+	}
+	if n.ServingsPerContainer == 0 {
+		n.ServingsPerContainer = 1
+	}
+
+	return nil
+}
+
+// add adds the nutrients of times servings of other to n.
+func (n *NutritionFacts) add(other *NutritionFacts, times float64) {
+	n.Calories += other.Calories * times
+	n.Fat += other.Fat * times
+	n.SaturatedFat += other.SaturatedFat * times
+	n.TransFat += other.TransFat * times
+	n.Cholesterol += other.Cholesterol * times
+	n.Sodium += other.Sodium * times
+	n.Carbohydrate += other.Carbohydrate * times
+	n.Fibre += other.Fibre * times
+	n.Sugars += other.Sugars * times
+	n.Protein += other.Protein * times
+}
+
+func (s *shopService) GetCartNutrition(lines []*CartLine) (*CartNutrition, error) {
+	items, err := s.cartItems(lines)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &CartNutrition{Missing: []int{}, Allergens: []string{}, Dietary: []string{}}
+	allergens := make(map[string]bool)
+	dietary := make(map[string]int)
+
+	for _, line := range lines {
+		item := items[line.ItemID]
+		summary.Items += line.Quantity
+
+		for _, allergen := range item.Allergens {
+			if !allergens[allergen] {
+				allergens[allergen] = true
+				summary.Allergens = append(summary.Allergens, allergen)
+			}
+		}
+		for _, label := range item.Dietary {
+			dietary[label]++
+		}
+
+		if item.Nutrition == nil {
+			summary.Missing = append(summary.Missing, item.ItemID)
+			continue
+		}
+		servings := item.Nutrition.ServingsPerContainer
+		if servings == 0 {
+			servings = 1
+		}
+		summary.Total.add(item.Nutrition, servings*float64(line.Quantity))
+	}
+
+	for _, label := range DietaryLabels {
+		if dietary[label] == len(lines) {
+			summary.Dietary = append(summary.Dietary, label)
+		}
+	}
+
+	return summary, nil
+}
+
+// cartItems validates cart lines and loads the items they refer to.
+func (s *shopService) cartItems(lines []*CartLine) (map[int]*Item, error) {
+	if len(lines) == 0 {
+		return nil, invalid("cart is empty")
+	}
+
+	var ids []int
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			return nil, invalid("quantity for item %d must be positive", line.ItemID)
+		}
+		ids = append(ids, line.ItemID)
+	}
+
+	found, err := s.db.getItemsByID(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[int]*Item)
+	for _, item := range found {
+		items[item.ItemID] = item
+	}
+	for _, id := range ids {
+		if _, ok := items[id]; !ok {
+			return nil, invalid("item %d does not exist", id)
+		}
+	}
+
+	return items, nil
+}
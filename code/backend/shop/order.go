@@ -0,0 +1,361 @@
+package shop
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrEmptyCart     = errors.New("your cart is empty")
+	ErrNoPickupStore = errors.New("choose a store to pick your order up from")
+	ErrNotYourOrder  = errors.New("that order is not yours to see or change")
+	ErrOrderChanged  = errors.New("the order has changed since it was loaded, reload it and try again")
+	ErrCartChanged   = errors.New("your cart changed while checking out, review it and try again")
+)
+
+// Order states. Orders start out placed, are picked and made ready by staff
+// and completed when the shopper collects them. Cancelled orders give their
+// stock back.
+const (
+	OrderPlaced    = "placed"
+	OrderPicking   = "picking"
+	OrderReady     = "ready"
+	OrderCompleted = "completed"
+	OrderCancelled = "cancelled"
+)
+
+var OrderStatuses = []string{OrderPlaced, OrderPicking, OrderReady, OrderCompleted, OrderCancelled}
+
+// activeOrderStatuses are the orders still to be fulfilled.
+var activeOrderStatuses = []string{OrderPlaced, OrderPicking, OrderReady}
+
+// orderTransitions is where an order can go from each state. Shoppers may
+// only cancel an order nobody has started picking; every other move is
+// staff's.
+var orderTransitions = map[string][]string{
+	OrderPlaced:  {OrderPicking, OrderCancelled},
+	OrderPicking: {OrderReady, OrderCancelled},
+	OrderReady:   {OrderCompleted, OrderCancelled},
+}
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+// Order is a snapshot of a cart as it was checked out: what was bought, at
+// what price, with which discounts and taxes. Nothing but its Status changes
+// once it is placed, until picking ends and PickedTotal is what the shopper
+// is charged for what was found. CouponCode is set only when the coupon
+// applied, and SlotStart and SlotEnd only at stores that hand out pickup
+// slots.
+type Order struct {
+	OrderID     int           `json:"orderID" gorm:"primaryKey;column:orderid"`
+	Username    string        `json:"username" gorm:"column:username"`
+	StoreID     int           `json:"storeID" gorm:"column:storeid"`
+	Province    string        `json:"province" gorm:"column:province"`
+	Status      string        `json:"status" gorm:"column:status"`
+	Subtotal    float64       `json:"subtotal" gorm:"column:subtotal"`
+	Discount    float64       `json:"discount" gorm:"column:discount"`
+	Taxes       LineTaxes     `json:"taxes" gorm:"column:taxes;type:jsonb"`
+	Tax         float64       `json:"tax" gorm:"column:tax"`
+	Total       float64       `json:"total" gorm:"column:total"`
+	PickedTotal *float64      `json:"pickedTotal,omitempty" gorm:"column:picked_total"`
+	CouponCode  string        `json:"couponCode,omitempty" gorm:"column:coupon_code"`
+	SlotStart   *time.Time    `json:"slotStart,omitempty" gorm:"column:slot_start"`
+	SlotEnd     *time.Time    `json:"slotEnd,omitempty" gorm:"column:slot_end"`
+	PlacedAt    time.Time     `json:"placedAt" gorm:"column:placed_at"`
+	UpdatedAt   time.Time     `json:"updatedAt" gorm:"column:updated_at"`
+	Lines       []*OrderLine  `json:"lines,omitempty" gorm:"-"`
+	History     []*OrderEvent `json:"history,omitempty" gorm:"-"`
+}
+
+// OrderLine is one priced cart line as it was ordered.
+type OrderLine struct {
+	OrderID   int       `json:"-" gorm:"column:orderid"`
+	Position  int       `json:"-" gorm:"column:position"`
+	ItemID    int       `json:"itemID" gorm:"column:itemid"`
+	VariantID int       `json:"variantID,omitempty" gorm:"column:variantid"`
+	Name      string    `json:"name" gorm:"column:name"`
+	Quantity  int       `json:"quantity" gorm:"column:quantity"`
+	UnitPrice float64   `json:"unitPrice" gorm:"column:unit_price"`
+	LineTotal float64   `json:"lineTotal" gorm:"column:line_total"`
+	Discounts Discounts `json:"discounts" gorm:"column:discounts;type:jsonb"`
+	Discount  float64   `json:"discount" gorm:"column:discount"`
+	Total     float64   `json:"total" gorm:"column:total"`
+	Taxes     LineTaxes `json:"taxes" gorm:"column:taxes;type:jsonb"`
+	Tax       float64   `json:"tax" gorm:"column:tax"`
+}
+
+// OrderEvent records an order moving to Status, who moved it and why.
+type OrderEvent struct {
+	OrderID int       `json:"-" gorm:"column:orderid"`
+	Status  string    `json:"status" gorm:"column:status"`
+	Actor   string    `json:"actor" gorm:"column:actor"`
+	Note    string    `json:"note,omitempty" gorm:"column:note"`
+	At      time.Time `json:"at" gorm:"column:at"`
+}
+
+// OrderActor is who is looking at or moving an order: its shopper, or staff.
+// StoreID limits staff to their own store's orders, 0 for admins.
+type OrderActor struct {
+	Username string
+	Staff    bool
+	StoreID  int
+}
+
+// OrderQuery picks a page of orders; an empty Username and StoreID 0 match
+// anyone and any store. A Queue lists the oldest first and, without a Status,
+// only orders still to be fulfilled; otherwise the newest come first.
+type OrderQuery struct {
+	Username string
+	StoreID  int
+	Status   string
+	Queue    bool
+	Page     int
+	PageSize int
+}
+
+type OrderPage struct {
+	Orders   []*Order `json:"orders"`
+	Page     int      `json:"page"`
+	PageSize int      `json:"pageSize"`
+	Total    int64    `json:"total"`
+}
+
+// StockShortage is why an order couldn't be placed: the store doesn't have
+// enough of the lines listed.
+type StockShortage struct {
+	Lines []*ShortLine `json:"lines"`
+}
+
+type ShortLine struct {
+	ItemID    int    `json:"itemID"`
+	VariantID int    `json:"variantID,omitempty"`
+	Name      string `json:"name"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+func (e *StockShortage) Error() string {
+	names := make([]string, 0, len(e.Lines))
+	for _, l := range e.Lines {
+		names = append(names, fmt.Sprintf("%s (%d left)", l.Name, l.Available))
+	}
+	return "not enough in stock: " + strings.Join(names, ", ")
+}
+
+// Discounts and LineTaxes are kept on order lines as JSON.
+type Discounts []*Discount
+type LineTaxes []*LineTax
+
+func (d Discounts) Value() (driver.Value, error) {
+	return json.Marshal(d)
+}
+
+func (d *Discounts) Scan(value interface{}) error {
+	return scanJSON(value, d)
+}
+
+func (t LineTaxes) Value() (driver.Value, error) {
+	return json.Marshal(t)
+}
+
+func (t *LineTaxes) Scan(value interface{}) error {
+	return scanJSON(value, t)
+}
+
+func scanJSON(value interface{}, into interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, into)
+	case string:
+		return json.Unmarshal([]byte(v), into)
+	case nil:
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into %T", value, into)
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// can reports whether the actor may see the order: their own, or any of
+// their store's for staff.
+func (a *OrderActor) can(order *Order) bool {
+	if order.Username == a.Username {
+		return true
+	}
+	return a.Staff && (a.StoreID == 0 || a.StoreID == order.StoreID)
+}
+
+func (q *OrderQuery) validate() error {
+	if q.Status != "" {
+		known := false
+		for _, status := range OrderStatuses {
+			known = known || q.Status == status
+		}
+		if !known {
+			return invalid("unknown order status %q, expected one of %s", q.Status, strings.Join(OrderStatuses, ", "))
+		}
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 {
+		q.PageSize = defaultOrderPageSize
+	}
+	if q.PageSize > maxOrderPageSize {
+		q.PageSize = maxOrderPageSize
+	}
+	return nil
+}
+
+// PlaceOrder checks out a shopper's cart at its store: the priced cart is
+// snapshotted into an order, the store's stock is taken down by what was
+// ordered, the coupon's redemption is tied to the order and the cart is
+// emptied, all or nothing. A cart the store can't fill is turned down with a
+// StockShortage, and one changed while it was being checked out with
+// ErrCartChanged. At stores that hand out pickup slots the shopper must hold
+// one there, and the order keeps its place.
+func (s *shopService) PlaceOrder(username string) (*Order, error) {
+	cart, err := s.db.getCart(username)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Lines) == 0 {
+		return nil, ErrEmptyCart
+	}
+	if cart.StoreID == 0 {
+		return nil, ErrNoPickupStore
+	}
+	slot, err := s.checkoutSlot(username, cart.StoreID)
+	if err != nil {
+		return nil, err
+	}
+
+	priced, err := s.priceSavedCart(cart, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &Order{
+		Username: username,
+		StoreID:  priced.StoreID,
+		Province: priced.Province,
+		Status:   OrderPlaced,
+		Subtotal: priced.Subtotal,
+		Discount: priced.Discount,
+		Taxes:    priced.Taxes,
+		Tax:      priced.Tax,
+		Total:    priced.Total,
+		PlacedAt: time.Now(),
+	}
+	order.UpdatedAt = order.PlacedAt
+	if priced.Coupon != nil && priced.Coupon.Applied {
+		order.CouponCode = priced.Coupon.Code
+	}
+	if slot != nil {
+		order.SlotStart, order.SlotEnd = &slot.StartsAt, &slot.EndsAt
+		slot.HeldAt = order.PlacedAt
+	}
+	for i, line := range priced.Lines {
+		order.Lines = append(order.Lines, &OrderLine{
+			Position:  i,
+			ItemID:    line.ItemID,
+			VariantID: line.VariantID,
+			Name:      line.Name,
+			Quantity:  line.Quantity,
+			UnitPrice: line.UnitPrice,
+			LineTotal: line.LineTotal,
+			Discounts: line.Discounts,
+			Discount:  line.Discount,
+			Total:     line.Total,
+			Taxes:     line.Taxes,
+			Tax:       line.Tax,
+		})
+	}
+
+	order, err = s.db.addOrder(order, cart, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (s *shopService) GetOrder(orderID int, actor *OrderActor) (*Order, error) {
+	order, err := s.db.getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.can(order) {
+		return nil, ErrNotYourOrder
+	}
+
+	return order, nil
+}
+
+// GetOrders lists a page of orders, without their lines.
+func (s *shopService) GetOrders(query *OrderQuery) (*OrderPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+
+	orders, total, err := s.db.getOrders(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrderPage{Orders: orders, Page: query.Page, PageSize: query.PageSize, Total: total}, nil
+}
+
+// UpdateOrderStatus moves an order along. Staff move their store's orders
+// through picking, ready and completed, or cancel them before they are
+// collected; shoppers can cancel their own until picking starts. Picking
+// can't start until the order is paid for. Cancelling puts the stock back and
+// gives back the use of the coupon.
+func (s *shopService) UpdateOrderStatus(orderID int, status string, actor *OrderActor, note string) (*Order, error) {
+	order, err := s.db.getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.can(order) {
+		return nil, ErrNotYourOrder
+	}
+	if !canTransition(order.Status, status) {
+		return nil, invalid("a %s order cannot be moved to %s", order.Status, status)
+	}
+	staff := actor.Staff && (actor.StoreID == 0 || actor.StoreID == order.StoreID)
+	if !staff && !(order.Status == OrderPlaced && status == OrderCancelled) {
+		return nil, invalid("only staff can move an order along, or cancel it once picking has started")
+	}
+	if status == OrderPicking {
+		payment, err := s.GetOrderPayment(orderID)
+		if err != nil && err != ErrPaymentNotFound {
+			return nil, err
+		}
+		if payment == nil || payment.Status != PaymentAuthorized && payment.Status != PaymentCaptured {
+			return nil, ErrOrderUnpaid
+		}
+	}
+
+	event := &OrderEvent{OrderID: orderID, Status: status, Actor: actor.Username, Note: strings.TrimSpace(note), At: time.Now()}
+	order, err = s.db.updateOrderStatus(order.Status, event)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
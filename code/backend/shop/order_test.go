@@ -0,0 +1,94 @@
+package shop
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{OrderPlaced, OrderPicking, true},
+		{OrderPlaced, OrderCancelled, true},
+		{OrderPlaced, OrderReady, false},
+		{OrderPlaced, OrderCompleted, false},
+		{OrderPicking, OrderReady, true},
+		{OrderPicking, OrderCancelled, true},
+		{OrderPicking, OrderPlaced, false},
+		{OrderReady, OrderCompleted, true},
+		{OrderReady, OrderCancelled, true},
+		{OrderReady, OrderPicking, false},
+		{OrderCompleted, OrderCancelled, false},
+		{OrderCancelled, OrderPlaced, false},
+		{OrderPlaced, OrderPlaced, false},
+		{OrderPlaced, "shipped", false},
+		{"", OrderPlaced, false},
+	}
+
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestOrderActorCan(t *testing.T) {
+	order := &Order{Username: "alice", StoreID: 3}
+
+	tests := []struct {
+		name  string
+		actor *OrderActor
+		want  bool
+	}{
+		{"its shopper", &OrderActor{Username: "alice"}, true},
+		{"another shopper", &OrderActor{Username: "bob"}, false},
+		{"staff at its store", &OrderActor{Username: "carol", Staff: true, StoreID: 3}, true},
+		{"staff at another store", &OrderActor{Username: "carol", Staff: true, StoreID: 4}, false},
+		{"admin", &OrderActor{Username: "dave", Staff: true}, true},
+		{"shopper with a store", &OrderActor{Username: "bob", StoreID: 3}, false},
+		{"staff's own order elsewhere", &OrderActor{Username: "alice", Staff: true, StoreID: 4}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.actor.can(order); got != tt.want {
+				t.Errorf("can = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCartSame(t *testing.T) {
+	cart := func(storeID int, coupon string, lines ...CartLine) *Cart {
+		c := &Cart{Username: "alice", StoreID: storeID, CouponCode: coupon, Lines: []*CartLine{}}
+		for i := range lines {
+			c.Lines = append(c.Lines, &lines[i])
+		}
+		return c
+	}
+	milk := CartLine{ItemID: 1, Quantity: 2}
+	bread := CartLine{ItemID: 2, VariantID: 5, Quantity: 1}
+
+	tests := []struct {
+		name string
+		a, b *Cart
+		want bool
+	}{
+		{"unchanged", cart(3, "SAVE", milk, bread), cart(3, "SAVE", milk, bread), true},
+		{"both empty", cart(3, ""), cart(3, ""), true},
+		{"line added", cart(3, "", milk), cart(3, "", milk, bread), false},
+		{"line removed", cart(3, "", milk, bread), cart(3, "", milk), false},
+		{"quantity changed", cart(3, "", milk), cart(3, "", CartLine{ItemID: 1, Quantity: 3}), false},
+		{"variant changed", cart(3, "", bread), cart(3, "", CartLine{ItemID: 2, VariantID: 6, Quantity: 1}), false},
+		{"lines reordered", cart(3, "", milk, bread), cart(3, "", bread, milk), false},
+		{"store changed", cart(3, "", milk), cart(4, "", milk), false},
+		{"coupon removed", cart(3, "SAVE", milk), cart(3, "", milk), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.same(tt.b); got != tt.want {
+				t.Errorf("same = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package shop
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrPaymentNotFound = errors.New("the order has no payment")
+	ErrAlreadyPaid     = errors.New("the order has already been paid for")
+	ErrOrderUnpaid     = errors.New("the order hasn't been paid for yet")
+)
+
+// Payment states. The first five follow the provider's transaction; declined
+// attempts are kept so staff can see what a shopper tried.
+const (
+	PaymentAuthorized        = "authorized"
+	PaymentCaptured          = "captured"
+	PaymentPartiallyRefunded = "partially_refunded"
+	PaymentRefunded          = "refunded"
+	PaymentVoided            = "voided"
+	PaymentDeclined          = "declined"
+)
+
+// livePayments hold money for an order, or did: an order has at most one.
+var livePayments = []string{PaymentAuthorized, PaymentCaptured, PaymentPartiallyRefunded, PaymentRefunded}
+
+// Payment is an attempt to pay for an order through a payment provider.
+// Captured and Refunded are how much of Amount was taken and given back.
+// TransactionAt is when the provider last changed the transaction, so a late
+// status callback can't undo a newer one. SettleError is why the payment
+// couldn't be captured or given back when its order was finished, until it is.
+type Payment struct {
+	PaymentID     int       `json:"paymentID" gorm:"primaryKey;column:paymentid"`
+	OrderID       int       `json:"orderID" gorm:"column:orderid"`
+	Provider      string    `json:"provider" gorm:"column:provider"`
+	TransactionID string    `json:"transactionID,omitempty" gorm:"column:transaction_id"`
+	Status        string    `json:"status" gorm:"column:status"`
+	Amount        float64   `json:"amount" gorm:"column:amount"`
+	Captured      float64   `json:"captured" gorm:"column:captured"`
+	Refunded      float64   `json:"refunded" gorm:"column:refunded"`
+	Last4         string    `json:"last4,omitempty" gorm:"column:last4"`
+	DeclineCode   string    `json:"declineCode,omitempty" gorm:"column:decline_code"`
+	SettleError   string    `json:"settleError,omitempty" gorm:"column:settle_error"`
+	TransactionAt time.Time `json:"-" gorm:"column:transaction_at"`
+	CreatedAt     time.Time `json:"createdAt" gorm:"column:created_at"`
+	UpdatedAt     time.Time `json:"updatedAt" gorm:"column:updated_at"`
+}
+
+func isLivePayment(status string) bool {
+	for _, s := range livePayments {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPayments lists every payment attempt on an order, newest first.
+func (s *shopService) GetPayments(orderID int) ([]*Payment, error) {
+	payments, err := s.db.getPayments(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	return payments, nil
+}
+
+// GetOrderPayment is the payment holding money for an order.
+func (s *shopService) GetOrderPayment(orderID int) (*Payment, error) {
+	payments, err := s.db.getPayments(orderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payments {
+		if isLivePayment(p.Status) {
+			return p, nil
+		}
+	}
+
+	return nil, ErrPaymentNotFound
+}
+
+// RecordPayment keeps a payment attempt. Only a placed order can be paid
+// for, and only once.
+func (s *shopService) RecordPayment(payment *Payment) (*Payment, error) {
+	now := time.Now()
+	payment.CreatedAt = now
+	payment.UpdatedAt = now
+
+	payment, err := s.db.addPayment(payment)
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// SyncPayment brings a payment up to date with its provider's transaction,
+// found by Provider and TransactionID. Changes older than what the payment
+// already shows are ignored.
+func (s *shopService) SyncPayment(payment *Payment) (*Payment, error) {
+	payment.UpdatedAt = time.Now()
+
+	payment, err := s.db.syncPayment(payment)
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// SetSettleError keeps why the order's payment couldn't be settled, or clears
+// it with an empty message.
+func (s *shopService) SetSettleError(orderID int, message string) error {
+	err := s.db.setSettleError(orderID, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
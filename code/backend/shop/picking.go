@@ -0,0 +1,396 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPickBatchNotFound = errors.New("pick batch not found")
+	ErrPickLineNotFound  = errors.New("pick line not found in this batch")
+	ErrPickBatchDone     = errors.New("the pick batch is already done")
+)
+
+// Pick batch states.
+const (
+	PickBatchOpen = "open"
+	PickBatchDone = "done"
+)
+
+// Pick line states. A line is pending until the picker takes it off the
+// shelf, comes back short or puts something else in its place.
+const (
+	PickPending     = "pending"
+	PickPicked      = "picked"
+	PickShort       = "short"
+	PickSubstituted = "substituted"
+)
+
+const maxBatchOrders = 20
+
+// PickBatch is one walk around a store picking several orders at once.
+// Lines are in the order the picker comes to them.
+type PickBatch struct {
+	BatchID     int           `json:"batchID" gorm:"primaryKey;column:batchid"`
+	StoreID     int           `json:"storeID" gorm:"column:storeid"`
+	Picker      string        `json:"picker" gorm:"column:picker"`
+	Status      string        `json:"status" gorm:"column:status"`
+	CreatedAt   time.Time     `json:"createdAt" gorm:"column:created_at"`
+	CompletedAt *time.Time    `json:"completedAt,omitempty" gorm:"column:completed_at"`
+	Orders      []int         `json:"orders,omitempty" gorm:"-"`
+	Lines       []*PickLine   `json:"lines,omitempty" gorm:"-"`
+	Progress    *PickProgress `json:"progress,omitempty" gorm:"-"`
+}
+
+// PickLine is an order line to be picked. Picked is how many were put in the
+// order, of the substitute when there is one.
+type PickLine struct {
+	LineID              int        `json:"lineID" gorm:"primaryKey;column:lineid"`
+	BatchID             int        `json:"-" gorm:"column:batchid"`
+	OrderID             int        `json:"orderID" gorm:"column:orderid"`
+	Position            int        `json:"-" gorm:"column:position"`
+	ItemID              int        `json:"itemID" gorm:"column:itemid"`
+	VariantID           int        `json:"variantID,omitempty" gorm:"column:variantid"`
+	Name                string     `json:"name" gorm:"column:name"`
+	Quantity            int        `json:"quantity" gorm:"column:quantity"`
+	Status              string     `json:"status" gorm:"column:status"`
+	Picked              int        `json:"picked" gorm:"column:picked"`
+	SubstituteItemID    int        `json:"substituteItemID,omitempty" gorm:"column:substitute_itemid"`
+	SubstituteVariantID int        `json:"substituteVariantID,omitempty" gorm:"column:substitute_variantid"`
+	SubstituteName      string     `json:"substituteName,omitempty" gorm:"column:substitute_name"`
+	Note                string     `json:"note,omitempty" gorm:"column:note"`
+	PickedBy            string     `json:"pickedBy,omitempty" gorm:"column:picked_by"`
+	PickedAt            *time.Time `json:"pickedAt,omitempty" gorm:"column:picked_at"`
+	Location            *Location  `json:"location,omitempty" gorm:"-"`
+}
+
+// PickProgress counts a batch's lines by state.
+type PickProgress struct {
+	Lines       int `json:"lines"`
+	Pending     int `json:"pending"`
+	Picked      int `json:"picked"`
+	Short       int `json:"short"`
+	Substituted int `json:"substituted"`
+}
+
+// PickBatchRequest picks the orders to batch: those listed, or the placed
+// orders collected in the slot starting at Slot.
+type PickBatchRequest struct {
+	Orders []int      `json:"orders"`
+	Slot   *time.Time `json:"slot"`
+}
+
+// PickUpdate is what the picker found for a line. Picked defaults to the
+// whole quantity for picked and substituted lines.
+type PickUpdate struct {
+	Status              string `json:"status" binding:"required"`
+	Picked              *int   `json:"picked"`
+	SubstituteItemID    int    `json:"substituteItemID"`
+	SubstituteVariantID int    `json:"substituteVariantID"`
+	Note                string `json:"note"`
+}
+
+func (p *PickProgress) count(status string) {
+	p.Lines++
+	switch status {
+	case PickPending:
+		p.Pending++
+	case PickPicked:
+		p.Picked++
+	case PickShort:
+		p.Short++
+	case PickSubstituted:
+		p.Substituted++
+	}
+}
+
+// summary describes how an order's picking went, for its history.
+func (p *PickProgress) summary(batchID int) string {
+	var issues []string
+	if p.Short > 0 {
+		issues = append(issues, fmt.Sprintf("%d short", p.Short))
+	}
+	if p.Substituted > 0 {
+		issues = append(issues, fmt.Sprintf("%d substituted", p.Substituted))
+	}
+	note := fmt.Sprintf("picked in batch %d", batchID)
+	if len(issues) > 0 {
+		note += ": " + strings.Join(issues, ", ")
+	}
+	return note
+}
+
+// pickedTotal is what the order comes to for what was picked: its total less
+// what was paid for the units not found, worked out per unit as returns are.
+// A substitute is charged as the line it stands in for.
+func pickedTotal(order *Order, picks []*PickLine) float64 {
+	byPosition := make(map[int]*OrderLine)
+	for _, line := range order.Lines {
+		byPosition[line.Position] = line
+	}
+
+	total := order.Total
+	for _, pick := range picks {
+		line, ok := byPosition[pick.Position]
+		if !ok || line.Quantity == 0 || pick.Picked >= line.Quantity {
+			continue
+		}
+		paid := (line.Total + line.Tax) / float64(line.Quantity)
+		total -= roundCents(paid * float64(line.Quantity-pick.Picked))
+	}
+	return math.Max(roundCents(total), 0)
+}
+
+// shortfall is how many of the line's own item checkout took off the shelf
+// that weren't picked for it: those not found on a short line and all of a
+// substituted one. They go back on the shelf when the line is picked.
+func (l *PickLine) shortfall() int {
+	switch l.Status {
+	case PickShort:
+		return l.Quantity - l.Picked
+	case PickSubstituted:
+		return l.Quantity
+	}
+	return 0
+}
+
+// validate checks the update against the line it is for and fills in the
+// quantity picked.
+func (u *PickUpdate) validate(line *PickLine) error {
+	picked := line.Quantity
+	if u.Picked != nil {
+		picked = *u.Picked
+	}
+	switch u.Status {
+	case PickPicked:
+		if picked != line.Quantity {
+			return invalid("a picked line has all %d, mark it short if fewer were found", line.Quantity)
+		}
+	case PickShort:
+		if u.Picked == nil {
+			picked = 0
+		}
+		if picked < 0 || picked >= line.Quantity {
+			return invalid("a short line has from 0 to %d picked", line.Quantity-1)
+		}
+	case PickSubstituted:
+		if u.SubstituteItemID == 0 {
+			return invalid("substituteItemID is required for a substituted line")
+		}
+		if u.SubstituteItemID == line.ItemID && u.SubstituteVariantID == line.VariantID {
+			return invalid("a substitute must be a different item or variant")
+		}
+		if picked < 1 || picked > line.Quantity {
+			return invalid("a substituted line has from 1 to %d picked", line.Quantity)
+		}
+	default:
+		return invalid("unknown pick status %q, expected one of %s", u.Status, strings.Join([]string{PickPicked, PickShort, PickSubstituted}, ", "))
+	}
+	u.Picked = &picked
+	if u.Status != PickSubstituted {
+		u.SubstituteItemID, u.SubstituteVariantID = 0, 0
+	}
+	u.Note = strings.TrimSpace(u.Note)
+	return nil
+}
+
+// CreatePickBatch starts picking a store's orders together. Every order must
+// be placed at the store and paid for; they all move on to picking.
+func (s *shopService) CreatePickBatch(storeID int, request *PickBatchRequest, picker string) (*PickBatch, error) {
+	orderIDs := request.Orders
+	if request.Slot != nil {
+		orders, err := s.db.getSlotOrders(storeID, *request.Slot)
+		if err != nil {
+			return nil, err
+		}
+		orderIDs = nil
+		for _, order := range orders {
+			if order.Status == OrderPlaced {
+				orderIDs = append(orderIDs, order.OrderID)
+			}
+		}
+	}
+	if len(orderIDs) == 0 {
+		return nil, invalid("there are no orders to pick")
+	}
+	if len(orderIDs) > maxBatchOrders {
+		return nil, invalid("a batch can have at most %d orders", maxBatchOrders)
+	}
+
+	seen := make(map[int]bool)
+	for _, orderID := range orderIDs {
+		if seen[orderID] {
+			return nil, invalid("order %d is listed twice", orderID)
+		}
+		seen[orderID] = true
+
+		order, err := s.db.getOrder(orderID)
+		if err != nil {
+			return nil, err
+		}
+		if order.StoreID != storeID {
+			return nil, invalid("order %d is not at this store", orderID)
+		}
+		if order.Status != OrderPlaced {
+			return nil, invalid("order %d is %s, only placed orders can be picked", orderID, order.Status)
+		}
+		payment, err := s.GetOrderPayment(orderID)
+		if err != nil && err != ErrPaymentNotFound {
+			return nil, err
+		}
+		if payment == nil || payment.Status != PaymentAuthorized && payment.Status != PaymentCaptured {
+			return nil, fmt.Errorf("order %d: %w", orderID, ErrOrderUnpaid)
+		}
+	}
+
+	batch := &PickBatch{StoreID: storeID, Picker: picker, Status: PickBatchOpen, CreatedAt: time.Now()}
+	batch, err := s.db.addPickBatch(batch, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.walkBatch(batch)
+}
+
+// GetPickBatch returns a batch of the store's with its lines in pick order.
+func (s *shopService) GetPickBatch(storeID, batchID int) (*PickBatch, error) {
+	batch, err := s.db.getPickBatch(batchID)
+	if err != nil {
+		return nil, err
+	}
+	if batch.StoreID != storeID {
+		return nil, ErrPickBatchNotFound
+	}
+
+	return s.walkBatch(batch)
+}
+
+// GetPickBatches lists a store's batches, newest first, without their lines.
+func (s *shopService) GetPickBatches(storeID int, status string) ([]*PickBatch, error) {
+	if status != "" && status != PickBatchOpen && status != PickBatchDone {
+		return nil, invalid("unknown batch status %q, expected %s or %s", status, PickBatchOpen, PickBatchDone)
+	}
+
+	batches, err := s.db.getPickBatches(storeID, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return batches, nil
+}
+
+// PickLine records what the picker found for a line. A substitute is taken
+// off the store's stock; nothing is put back for what wasn't on the shelf,
+// that is left for the next stock count. Once every line of an order is
+// dealt with the order is ready, and once every order is the batch is done.
+func (s *shopService) PickLine(storeID, batchID, lineID int, update *PickUpdate, picker string) (*PickBatch, error) {
+	batch, err := s.db.getPickBatch(batchID)
+	if err != nil {
+		return nil, err
+	}
+	if batch.StoreID != storeID {
+		return nil, ErrPickBatchNotFound
+	}
+	var line *PickLine
+	for _, l := range batch.Lines {
+		if l.LineID == lineID {
+			line = l
+		}
+	}
+	if line == nil {
+		return nil, ErrPickLineNotFound
+	}
+	if err := update.validate(line); err != nil {
+		return nil, err
+	}
+
+	picked := *line
+	picked.Status = update.Status
+	picked.Picked = *update.Picked
+	picked.SubstituteItemID = update.SubstituteItemID
+	picked.SubstituteVariantID = update.SubstituteVariantID
+	picked.SubstituteName = ""
+	picked.Note = update.Note
+	picked.PickedBy = picker
+	now := time.Now()
+	picked.PickedAt = &now
+	if picked.Status == PickSubstituted {
+		if picked.SubstituteName, err = s.substituteName(picked.SubstituteItemID, picked.SubstituteVariantID); err != nil {
+			return nil, err
+		}
+	}
+
+	batch, err = s.db.pickLine(&picked)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.walkBatch(batch)
+}
+
+func (s *shopService) substituteName(itemID, variantID int) (string, error) {
+	items, err := s.db.getItemsByID([]int{itemID})
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", ErrItemNotFound
+	}
+	if variantID == 0 {
+		return items[0].Name, nil
+	}
+
+	variant, err := s.db.getVariant(variantID)
+	if err != nil {
+		return "", err
+	}
+	if variant.ItemID != itemID {
+		return "", ErrVariantNotFound
+	}
+	return items[0].Name + " " + variant.Name, nil
+}
+
+// walkBatch puts a batch's lines in the order the picker walks the store and
+// counts its progress.
+func (s *shopService) walkBatch(batch *PickBatch) (*PickBatch, error) {
+	placements, err := s.db.getStockPlacements(batch.StoreID)
+	if err != nil {
+		return nil, err
+	}
+	shelves := make(map[priceKey]Location)
+	for _, p := range placements {
+		shelves[priceKey{p.ItemID, p.VariantID}] = p.Location
+	}
+
+	batch.Progress = &PickProgress{}
+	seen := make(map[int]bool)
+	batch.Orders = nil
+	for _, line := range batch.Lines {
+		line.Location = shelfOf(shelves, line.ItemID, line.VariantID)
+		batch.Progress.count(line.Status)
+		if !seen[line.OrderID] {
+			seen[line.OrderID] = true
+			batch.Orders = append(batch.Orders, line.OrderID)
+		}
+	}
+	sort.SliceStable(batch.Lines, func(i, j int) bool {
+		a, b := batch.Lines[i], batch.Lines[j]
+		if c := compareShelves(a.Location, b.Location); c != 0 {
+			return c < 0
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.OrderID != b.OrderID {
+			return a.OrderID < b.OrderID
+		}
+		return a.Position < b.Position
+	})
+	sort.Ints(batch.Orders)
+
+	return batch, nil
+}
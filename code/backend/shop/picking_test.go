@@ -0,0 +1,170 @@
+package shop
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestPickUpdateValidate(t *testing.T) {
+	line := &PickLine{ItemID: 1, VariantID: 2, Quantity: 3}
+	count := func(n int) *int { return &n }
+
+	tests := []struct {
+		name   string
+		update PickUpdate
+		valid  bool
+		picked int
+	}{
+		{"picked", PickUpdate{Status: PickPicked}, true, 3},
+		{"picked all", PickUpdate{Status: PickPicked, Picked: count(3)}, true, 3},
+		{"picked too few", PickUpdate{Status: PickPicked, Picked: count(2)}, false, 0},
+		{"short", PickUpdate{Status: PickShort}, true, 0},
+		{"short some", PickUpdate{Status: PickShort, Picked: count(2)}, true, 2},
+		{"short all", PickUpdate{Status: PickShort, Picked: count(3)}, false, 0},
+		{"short negative", PickUpdate{Status: PickShort, Picked: count(-1)}, false, 0},
+		{"substituted", PickUpdate{Status: PickSubstituted, SubstituteItemID: 4}, true, 3},
+		{"substituted some", PickUpdate{Status: PickSubstituted, SubstituteItemID: 4, Picked: count(1)}, true, 1},
+		{"substituted none", PickUpdate{Status: PickSubstituted, SubstituteItemID: 4, Picked: count(0)}, false, 0},
+		{"substituted too many", PickUpdate{Status: PickSubstituted, SubstituteItemID: 4, Picked: count(4)}, false, 0},
+		{"substituted another variant", PickUpdate{Status: PickSubstituted, SubstituteItemID: 1, SubstituteVariantID: 5}, true, 3},
+		{"substituted with itself", PickUpdate{Status: PickSubstituted, SubstituteItemID: 1, SubstituteVariantID: 2}, false, 0},
+		{"substitute missing", PickUpdate{Status: PickSubstituted}, false, 0},
+		{"pending", PickUpdate{Status: PickPending}, false, 0},
+		{"unknown status", PickUpdate{Status: "lost"}, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := tt.update
+			err := update.validate(line)
+			if (err == nil) != tt.valid {
+				t.Fatalf("validate = %v, want valid %v", err, tt.valid)
+			}
+			if err != nil {
+				if !IsInvalid(err) {
+					t.Errorf("validate = %v, want an InvalidError", err)
+				}
+				return
+			}
+			if *update.Picked != tt.picked {
+				t.Errorf("picked = %d, want %d", *update.Picked, tt.picked)
+			}
+			if update.Status != PickSubstituted && (update.SubstituteItemID != 0 || update.SubstituteVariantID != 0) {
+				t.Errorf("a %s line kept substitute %d/%d", update.Status, update.SubstituteItemID, update.SubstituteVariantID)
+			}
+		})
+	}
+}
+
+func TestCompareShelves(t *testing.T) {
+	shelf := func(row, col int) *Location { return &Location{Row: row, Col: col} }
+	shelves := []*Location{nil, shelf(1, 1), shelf(2, 3), shelf(0, 2), shelf(1, 3), shelf(2, 1), shelf(0, 1), nil, shelf(1, 2)}
+
+	sort.SliceStable(shelves, func(i, j int) bool { return compareShelves(shelves[i], shelves[j]) < 0 })
+
+	// up row 0, back down row 1, up row 2, then nowhere
+	want := []*Location{shelf(0, 1), shelf(0, 2), shelf(1, 3), shelf(1, 2), shelf(1, 1), shelf(2, 1), shelf(2, 3), nil, nil}
+	for i := range want {
+		got := shelves[i]
+		if (got == nil) != (want[i] == nil) || got != nil && *got != *want[i] {
+			t.Fatalf("walk %d is %v, want %v", i, got, want[i])
+		}
+	}
+
+	tests := []struct {
+		name string
+		a, b *Location
+		want int
+	}{
+		{"same shelf", shelf(1, 2), shelf(1, 2), 0},
+		{"both nowhere", nil, nil, 0},
+		{"nowhere last", nil, shelf(0, 0), 1},
+		{"earlier row first", shelf(0, 9), shelf(1, 0), -1},
+		{"even row ascending", shelf(2, 1), shelf(2, 2), -1},
+		{"odd row descending", shelf(3, 1), shelf(3, 2), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compareShelves(tt.a, tt.b)
+			if sign(got) != tt.want {
+				t.Errorf("compareShelves = %d, want sign %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestPickedTotal(t *testing.T) {
+	order := &Order{
+		Total: 25.55,
+		Lines: []*OrderLine{
+			{Position: 0, Quantity: 3, Total: 10, Tax: 1.30},
+			{Position: 1, Quantity: 1, Total: 5, Tax: 0},
+			{Position: 2, Quantity: 2, Total: 9, Tax: 0.25},
+		},
+	}
+	pick := func(position, picked int, status string) *PickLine {
+		return &PickLine{Position: position, Picked: picked, Status: status}
+	}
+
+	tests := []struct {
+		name  string
+		picks []*PickLine
+		want  float64
+	}{
+		{"all picked", []*PickLine{pick(0, 3, PickPicked), pick(1, 1, PickPicked), pick(2, 2, PickPicked)}, 25.55},
+		{"one of three short", []*PickLine{pick(0, 2, PickShort), pick(1, 1, PickPicked), pick(2, 2, PickPicked)}, 21.78},
+		{"line missing", []*PickLine{pick(0, 3, PickPicked), pick(1, 0, PickShort), pick(2, 2, PickPicked)}, 20.55},
+		{"substitute charged as the line", []*PickLine{pick(0, 3, PickSubstituted), pick(1, 1, PickPicked), pick(2, 2, PickPicked)}, 25.55},
+		{"fewer substituted", []*PickLine{pick(0, 3, PickPicked), pick(1, 1, PickPicked), pick(2, 1, PickSubstituted)}, 20.92},
+		{"nothing found", []*PickLine{pick(0, 0, PickShort), pick(1, 0, PickShort), pick(2, 0, PickShort)}, 0},
+		{"unknown line ignored", []*PickLine{pick(7, 0, PickShort)}, 25.55},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickedTotal(order, tt.picks); got != tt.want {
+				t.Errorf("pickedTotal = %.2f, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickLineShortfall(t *testing.T) {
+	pick := func(status string, picked int) *PickLine {
+		return &PickLine{ItemID: 1, Quantity: 3, Status: status, Picked: picked}
+	}
+
+	tests := []struct {
+		name     string
+		previous *PickLine
+		line     *PickLine
+		restock  int
+	}{
+		{"picked", pick(PickPending, 0), pick(PickPicked, 3), 0},
+		{"short some", pick(PickPending, 0), pick(PickShort, 1), 2},
+		{"short all", pick(PickPending, 0), pick(PickShort, 0), 3},
+		{"substituted", pick(PickPending, 0), pick(PickSubstituted, 2), 3},
+		{"more found", pick(PickShort, 1), pick(PickShort, 2), -1},
+		{"all found after all", pick(PickShort, 0), pick(PickPicked, 3), -3},
+		{"substitute for a short line", pick(PickShort, 1), pick(PickSubstituted, 3), 1},
+		{"picked again", pick(PickPicked, 3), pick(PickPicked, 3), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.line.shortfall() - tt.previous.shortfall(); got != tt.restock {
+				t.Errorf("restocked %d, want %d", got, tt.restock)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package shop
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrItemNotFound        = errors.New("item not found")
+	ErrPriceChangeNotFound = errors.New("pending price change not found")
+)
+
+// PriceChange is one entry in an item's price timeline. VariantID is 0 for the
+// item's own price. Changes made through UpdateItem and UpdateVariant are
+// applied on the spot; ones scheduled for later stay pending (AppliedAt nil)
+// until ApplyDuePriceChanges picks them up. PreviousPrice is the price that was
+// replaced when the change went live.
+type PriceChange struct {
+	ChangeID      int        `json:"changeID" gorm:"primaryKey;column:changeid"`
+	ItemID        int        `json:"itemID" gorm:"column:itemid"`
+	VariantID     int        `json:"variantID,omitempty" gorm:"column:variantid"`
+	Price         float64    `json:"price" gorm:"column:price"`
+	PreviousPrice *float64   `json:"previousPrice" gorm:"column:previous_price"`
+	EffectiveAt   time.Time  `json:"effectiveAt" gorm:"column:effective_at"`
+	CreatedBy     string     `json:"createdBy" gorm:"column:created_by"`
+	CreatedAt     time.Time  `json:"createdAt" gorm:"column:created_at"`
+	AppliedAt     *time.Time `json:"appliedAt" gorm:"column:applied_at"`
+}
+
+func (s *shopService) GetPriceHistory(itemID int) ([]*PriceChange, error) {
+	changes, err := s.db.getPriceChanges(itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// SchedulePriceChange stages a new price for an item or one of its variants.
+// A change without an effective time, or with one that has already passed, is
+// applied immediately.
+func (s *shopService) SchedulePriceChange(change *PriceChange) (*PriceChange, error) {
+	if change.Price < 0 {
+		return nil, invalid("price cannot be negative")
+	}
+
+	items, err := s.db.getItemsByID([]int{change.ItemID})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrItemNotFound
+	}
+	if change.VariantID != 0 {
+		variant, err := s.db.getVariant(change.VariantID)
+		if err != nil {
+			return nil, err
+		}
+		if variant.ItemID != change.ItemID {
+			return nil, invalid("variant %d is not a variant of item %d", change.VariantID, change.ItemID)
+		}
+	}
+
+	now := time.Now()
+	change.ChangeID = 0
+	change.CreatedAt = now
+	change.PreviousPrice = nil
+	change.AppliedAt = nil
+
+	if change.EffectiveAt.IsZero() || !change.EffectiveAt.After(now) {
+		change.EffectiveAt = now
+		change, err = s.db.applyPriceChange(change)
+	} else {
+		change, err = s.db.addPriceChange(change)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+func (s *shopService) CancelPriceChange(itemID, changeID int) (bool, error) {
+	result, err := s.db.cancelPriceChange(itemID, changeID)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// ApplyDuePriceChanges puts every pending change effective at or before now
+// live, oldest first, and reports how many were applied.
+func (s *shopService) ApplyDuePriceChanges(now time.Time) (int, error) {
+	applied, err := s.db.applyDuePriceChanges(now)
+	if err != nil {
+		return 0, err
+	}
+
+	return applied, nil
+}
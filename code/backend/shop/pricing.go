@@ -0,0 +1,247 @@
+package shop
+
+import (
+	"errors"
+)
+
+var ErrStoreNotFound = errors.New("store not found")
+
+// StorePrice overrides an item's base price at one store. VariantID is 0 for
+// the item itself, otherwise the override is for that variant.
+type StorePrice struct {
+	StoreID   int     `json:"storeID" gorm:"primaryKey;column:storeid"`
+	ItemID    int     `json:"itemID" gorm:"primaryKey;column:itemid"`
+	VariantID int     `json:"variantID" gorm:"primaryKey;column:variantid"`
+	Price     float64 `json:"price" gorm:"column:price"`
+}
+
+// PricedCart is a cart priced at a store. Subtotal is before promotions,
+// Discount what they took off, Tax the sales tax on the rest (broken out per
+// tax type in Taxes) and Total what is left to pay.
+type PricedCart struct {
+	StoreID  int           `json:"storeID"`
+	Province string        `json:"province,omitempty"`
+	Lines    []*PricedLine `json:"lines"`
+	Subtotal float64       `json:"subtotal"`
+	Discount float64       `json:"discount"`
+	Taxes    []*LineTax    `json:"taxes"`
+	Tax      float64       `json:"tax"`
+	Total    float64       `json:"total"`
+	// Coupon is only set on a saved cart with a code applied.
+	Coupon *AppliedCoupon `json:"coupon,omitempty"`
+}
+
+// PricedLine is one cart line. LineTotal is UnitPrice times Quantity and Total
+// the line after the Discounts listed, before the Taxes charged on it.
+// Unavailable lines aren't stocked at the cart's store and come with
+// Substitutes it does stock.
+type PricedLine struct {
+	ItemID      int           `json:"itemID"`
+	VariantID   int           `json:"variantID,omitempty"`
+	Name        string        `json:"name"`
+	Quantity    int           `json:"quantity"`
+	UnitPrice   float64       `json:"unitPrice"`
+	LineTotal   float64       `json:"lineTotal"`
+	Discounts   []*Discount   `json:"discounts"`
+	Discount    float64       `json:"discount"`
+	Total       float64       `json:"total"`
+	Taxes       []*LineTax    `json:"taxes"`
+	Tax         float64       `json:"tax"`
+	Unavailable bool          `json:"unavailable,omitempty"`
+	Substitutes []*Substitute `json:"substitutes,omitempty"`
+}
+
+type priceKey struct {
+	itemID    int
+	variantID int
+}
+
+// storePrices is a store's overrides keyed by item and variant.
+type storePrices map[priceKey]float64
+
+func (p storePrices) item(item *Item) {
+	if price, ok := p[priceKey{item.ItemID, 0}]; ok {
+		item.BasePrice = item.Price
+		item.Price = price
+	}
+	for _, v := range item.Variants {
+		p.variant(v)
+	}
+}
+
+func (p storePrices) variant(v *Variant) {
+	if price, ok := p[priceKey{v.ItemID, v.VariantID}]; ok {
+		v.BasePrice = v.Price
+		v.Price = price
+		v.computeUnitPrice()
+	}
+}
+
+func (s *shopService) loadStorePrices(storeID int) (storePrices, error) {
+	prices, err := s.db.getStorePrices(storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(storePrices)
+	for _, p := range prices {
+		byKey[priceKey{p.ItemID, p.VariantID}] = p.Price
+	}
+
+	return byKey, nil
+}
+
+func (s *shopService) GetStorePrices(storeID int) ([]*StorePrice, error) {
+	prices, err := s.db.getStorePrices(storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return prices, nil
+}
+
+func (s *shopService) SetStorePrice(price *StorePrice) (*StorePrice, error) {
+	if price.Price < 0 {
+		return nil, invalid("price cannot be negative")
+	}
+	if price.VariantID == 0 {
+		items, err := s.db.getItemsByID([]int{price.ItemID})
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return nil, ErrItemNotFound
+		}
+	} else {
+		variant, err := s.db.getVariant(price.VariantID)
+		if err != nil {
+			return nil, err
+		}
+		if variant.ItemID != price.ItemID {
+			return nil, invalid("variant %d is not a variant of item %d", price.VariantID, price.ItemID)
+		}
+	}
+
+	price, err := s.db.setStorePrice(price)
+	if err != nil {
+		return nil, err
+	}
+
+	return price, nil
+}
+
+func (s *shopService) DeleteStorePrice(storeID, itemID, variantID int) (bool, error) {
+	result, err := s.db.deleteStorePrice(storeID, itemID, variantID)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// PriceCart prices cart lines at a store, using the store's overrides where it
+// has them, and applies the promotions running there. Lines the store doesn't
+// stock are flagged with substitutes that don't conflict with profile.
+func (s *shopService) PriceCart(storeID int, lines []*CartLine, profile *DietaryProfile) (*PricedCart, error) {
+	cart, items, err := s.priceCart(storeID, lines)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.flagUnavailable(cart, items, profile); err != nil {
+		return nil, err
+	}
+
+	return cart, nil
+}
+
+// priceCart also returns the items the lines refer to, priced at the store.
+func (s *shopService) priceCart(storeID int, lines []*CartLine) (*PricedCart, map[int]*Item, error) {
+	cart := &PricedCart{StoreID: storeID}
+	if storeID != 0 {
+		store, err := s.db.getStoreByID(storeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		cart.Province = store.Province
+	}
+
+	items, err := s.cartItems(lines)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list := make([]*Item, 0, len(items))
+	for _, item := range items {
+		list = append(list, item)
+	}
+	if err := s.attachVariants(list); err != nil {
+		return nil, nil, err
+	}
+
+	prices, err := s.loadStorePrices(storeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, item := range list {
+		prices.item(item)
+	}
+
+	promotions, err := s.activePromotions(storeID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, line := range lines {
+		item := items[line.ItemID]
+		priced := &PricedLine{
+			ItemID:    item.ItemID,
+			VariantID: line.VariantID,
+			Name:      item.Name,
+			Quantity:  line.Quantity,
+			UnitPrice: item.Price,
+		}
+
+		if line.VariantID != 0 {
+			variant := findVariant(item, line.VariantID)
+			if variant == nil {
+				return nil, nil, invalid("variant %d is not a variant of item %d", line.VariantID, line.ItemID)
+			}
+			priced.Name = item.Name + " " + variant.Name
+			priced.UnitPrice = variant.Price
+		}
+
+		priced.LineTotal = roundCents(priced.UnitPrice * float64(line.Quantity))
+		priced.Discounts, priced.Total = promotions.priceLine(item, priced.UnitPrice, line.Quantity)
+		priced.Discount = roundCents(priced.LineTotal - priced.Total)
+
+		cart.Subtotal += priced.LineTotal
+		cart.Discount += priced.Discount
+		cart.Lines = append(cart.Lines, priced)
+	}
+	cart.Subtotal = roundCents(cart.Subtotal)
+	cart.Discount = roundCents(cart.Discount)
+	cart.total(items)
+
+	return cart, items, nil
+}
+
+// total taxes the cart as it now stands and adds it up. It is run again
+// whenever discounts change.
+func (cart *PricedCart) total(items map[int]*Item) {
+	taxCart(cart, items, cart.Province)
+	cart.Total = roundCents(cart.Subtotal - cart.Discount + cart.Tax)
+}
+
+// basket is what the cart costs before tax.
+func (cart *PricedCart) basket() float64 {
+	return roundCents(cart.Subtotal - cart.Discount)
+}
+
+func findVariant(item *Item, variantID int) *Variant {
+	for _, v := range item.Variants {
+		if v.VariantID == variantID {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrPromotionNotFound = errors.New("promotion not found")
+
+// Deal types.
+const (
+	DealPercentOff = "percent_off"
+	DealAmountOff  = "amount_off"
+	DealBuyXGetY   = "buy_x_get_y"
+	DealMultiBuy   = "multi_buy"
+)
+
+// Promotion scopes.
+const (
+	ScopeItem     = "item"
+	ScopeCategory = "category"
+	ScopeStore    = "store"
+)
+
+var DealTypes = []string{DealPercentOff, DealAmountOff, DealBuyXGetY, DealMultiBuy}
+var PromotionScopes = []string{ScopeItem, ScopeCategory, ScopeStore}
+
+// Promotion is a time-boxed deal on an item, a category or everything in a
+// store. TargetID is the item or category ID; StoreID limits item and
+// category deals to one store (0 means every store) and names the store for
+// store-wide deals. Which fields matter depends on Type:
+//
+//	percent_off  Percent off the price
+//	amount_off   Amount off each unit
+//	buy_x_get_y  buy BuyQuantity, get GetQuantity more free
+//	multi_buy    BundleQuantity for BundlePrice
+//
+// Deals are tried from the highest Priority down. The first deal that applies
+// to a line always counts; later ones are only added while every deal applied
+// so far, and the new one, are Stackable.
+type Promotion struct {
+	PromotionID    int       `json:"promotionID" gorm:"primaryKey;column:promotionid"`
+	Name           string    `json:"name" gorm:"column:name"`
+	Type           string    `json:"type" gorm:"column:type"`
+	Scope          string    `json:"scope" gorm:"column:scope"`
+	TargetID       int       `json:"targetID" gorm:"column:targetid"`
+	StoreID        int       `json:"storeID" gorm:"column:storeid"`
+	Percent        float64   `json:"percent,omitempty" gorm:"column:percent"`
+	Amount         float64   `json:"amount,omitempty" gorm:"column:amount"`
+	BuyQuantity    int       `json:"buyQuantity,omitempty" gorm:"column:buy_quantity"`
+	GetQuantity    int       `json:"getQuantity,omitempty" gorm:"column:get_quantity"`
+	BundleQuantity int       `json:"bundleQuantity,omitempty" gorm:"column:bundle_quantity"`
+	BundlePrice    float64   `json:"bundlePrice,omitempty" gorm:"column:bundle_price"`
+	Priority       int       `json:"priority" gorm:"column:priority"`
+	Stackable      bool      `json:"stackable" gorm:"column:stackable"`
+	StartsAt       time.Time `json:"startsAt" gorm:"column:starts_at"`
+	EndsAt         time.Time `json:"endsAt" gorm:"column:ends_at"`
+	CreatedBy      string    `json:"-" gorm:"column:created_by"`
+	Description    string    `json:"description" gorm:"-"`
+}
+
+// Discount explains how much one promotion, or a coupon (Code), took off a
+// line.
+type Discount struct {
+	PromotionID int     `json:"promotionID,omitempty"`
+	Code        string  `json:"code,omitempty"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+func (p *Promotion) validate() error {
+	if p.Name == "" {
+		return invalid("promotion name is required")
+	}
+	if !p.EndsAt.After(p.StartsAt) {
+		return invalid("promotion must end after it starts")
+	}
+
+	switch p.Scope {
+	case ScopeItem, ScopeCategory:
+		if p.TargetID == 0 {
+			return invalid("targetID is required for %s promotions", p.Scope)
+		}
+	case ScopeStore:
+		if p.StoreID == 0 {
+			return invalid("storeID is required for store promotions")
+		}
+		p.TargetID = 0
+	default:
+		return invalid("unknown scope %q, expected one of %v", p.Scope, PromotionScopes)
+	}
+
+	switch p.Type {
+	case DealPercentOff:
+		if p.Percent <= 0 || p.Percent > 100 {
+			return invalid("percent must be between 0 and 100")
+		}
+	case DealAmountOff:
+		if p.Amount <= 0 {
+			return invalid("amount must be positive")
+		}
+	case DealBuyXGetY:
+		if p.BuyQuantity < 1 || p.GetQuantity < 1 {
+			return invalid("buyQuantity and getQuantity must be at least 1")
+		}
+	case DealMultiBuy:
+		if p.BundleQuantity < 2 || p.BundlePrice <= 0 {
+			return invalid("bundleQuantity must be at least 2 and bundlePrice positive")
+		}
+	default:
+		return invalid("unknown deal type %q, expected one of %v", p.Type, DealTypes)
+	}
+
+	return nil
+}
+
+func (p *Promotion) describe() {
+	switch p.Type {
+	case DealPercentOff:
+		p.Description = fmt.Sprintf("%g%% off", p.Percent)
+	case DealAmountOff:
+		p.Description = fmt.Sprintf("$%.2f off each", p.Amount)
+	case DealBuyXGetY:
+		p.Description = fmt.Sprintf("buy %d get %d free", p.BuyQuantity, p.GetQuantity)
+	case DealMultiBuy:
+		p.Description = fmt.Sprintf("%d for $%.2f", p.BundleQuantity, p.BundlePrice)
+	}
+}
+
+// covers reports whether the deal is on item. Category deals take in the
+// category's subcategories too.
+func (p *Promotion) covers(item *Item, parents categoryParents) bool {
+	switch p.Scope {
+	case ScopeItem:
+		return p.TargetID == item.ItemID
+	case ScopeCategory:
+		return parents.within(item.CategoryID, p.TargetID)
+	case ScopeStore:
+		return true
+	}
+	return false
+}
+
+// discount works out what the deal takes off quantity units that currently
+// cost remaining in total. It is 0 when the deal doesn't trigger, e.g. too few
+// units for a multi-buy.
+func (p *Promotion) discount(remaining float64, quantity int) float64 {
+	if remaining <= 0 || quantity <= 0 {
+		return 0
+	}
+	unit := remaining / float64(quantity)
+
+	var amount float64
+	switch p.Type {
+	case DealPercentOff:
+		amount = remaining * p.Percent / 100
+	case DealAmountOff:
+		amount = p.Amount * float64(quantity)
+	case DealBuyXGetY:
+		free := quantity / (p.BuyQuantity + p.GetQuantity) * p.GetQuantity
+		amount = unit * float64(free)
+	case DealMultiBuy:
+		bundles := quantity / p.BundleQuantity
+		amount = float64(bundles) * (unit*float64(p.BundleQuantity) - p.BundlePrice)
+	}
+
+	if amount > remaining {
+		amount = remaining
+	}
+	if amount < 0 {
+		return 0
+	}
+	return roundCents(amount)
+}
+
+// promotionSet is the deals in effect at one store, highest priority first.
+type promotionSet struct {
+	deals   []*Promotion
+	parents categoryParents
+}
+
+func (s *shopService) activePromotions(storeID int) (*promotionSet, error) {
+	now := time.Now()
+	promotions, err := s.db.getActivePromotions(storeID, now)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := s.categoryParents()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range promotions {
+		p.describe()
+	}
+	sort.SliceStable(promotions, func(i, j int) bool {
+		if promotions[i].Priority != promotions[j].Priority {
+			return promotions[i].Priority > promotions[j].Priority
+		}
+		return promotions[i].PromotionID < promotions[j].PromotionID
+	})
+
+	return &promotionSet{deals: promotions, parents: parents}, nil
+}
+
+func (set *promotionSet) forItem(item *Item) []*Promotion {
+	var deals []*Promotion
+	for _, p := range set.deals {
+		if p.covers(item, set.parents) {
+			deals = append(deals, p)
+		}
+	}
+	return deals
+}
+
+// priceLine applies the stacking rules to quantity units of item at
+// unitPrice and explains each discount taken.
+func (set *promotionSet) priceLine(item *Item, unitPrice float64, quantity int) ([]*Discount, float64) {
+	remaining := roundCents(unitPrice * float64(quantity))
+	discounts := []*Discount{}
+	stackable := true
+
+	for _, p := range set.forItem(item) {
+		if len(discounts) > 0 && !(stackable && p.Stackable) {
+			continue
+		}
+
+		amount := p.discount(remaining, quantity)
+		if amount <= 0 {
+			continue
+		}
+
+		discounts = append(discounts, &Discount{
+			PromotionID: p.PromotionID,
+			Name:        p.Name,
+			Description: p.Description,
+			Amount:      amount,
+		})
+		remaining = roundCents(remaining - amount)
+		stackable = stackable && p.Stackable
+	}
+
+	return discounts, remaining
+}
+
+// items fills in the sale price of a single unit and lists the deals on
+// offer, including multi-buys that only kick in for larger quantities.
+func (set *promotionSet) items(items []*Item) {
+	if len(set.deals) == 0 {
+		return
+	}
+	for _, item := range items {
+		set.item(item)
+	}
+}
+
+func (set *promotionSet) item(item *Item) {
+	item.Deals = set.forItem(item)
+	if len(item.Deals) == 0 {
+		return
+	}
+
+	if discounts, price := set.priceLine(item, item.Price, 1); len(discounts) > 0 {
+		item.SalePrice = &price
+	}
+	for _, v := range item.Variants {
+		set.variant(item, v)
+	}
+}
+
+func (set *promotionSet) variant(item *Item, v *Variant) {
+	if discounts, price := set.priceLine(item, v.Price, 1); len(discounts) > 0 {
+		v.SalePrice = &price
+	}
+}
+
+func (s *shopService) GetPromotions(storeID int, includeExpired bool) ([]*Promotion, error) {
+	promotions, err := s.db.getPromotions(storeID, includeExpired)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range promotions {
+		p.describe()
+	}
+
+	return promotions, nil
+}
+
+func (s *shopService) GetPromotion(promotionID int) (*Promotion, error) {
+	promotion, err := s.db.getPromotion(promotionID)
+	if err != nil {
+		return nil, err
+	}
+
+	promotion.describe()
+	return promotion, nil
+}
+
+func (s *shopService) CreatePromotion(promotion *Promotion) (*Promotion, error) {
+	if err := promotion.validate(); err != nil {
+		return nil, err
+	}
+
+	promotion, err := s.db.addPromotion(promotion)
+	if err != nil {
+		return nil, err
+	}
+
+	promotion.describe()
+	return promotion, nil
+}
+
+func (s *shopService) UpdatePromotion(promotion *Promotion) (*Promotion, error) {
+	if err := promotion.validate(); err != nil {
+		return nil, err
+	}
+
+	promotion, err := s.db.updatePromotion(promotion)
+	if err != nil {
+		return nil, err
+	}
+
+	promotion.describe()
+	return promotion, nil
+}
+
+func (s *shopService) DeletePromotion(promotionID int) (bool, error) {
+	result, err := s.db.deletePromotion(promotionID)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,318 @@
+package shop
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Why an item was recommended.
+const (
+	// ReasonBoughtTogether items turn up in baskets alongside what is in the
+	// shopper's cart.
+	ReasonBoughtTogether = "bought_together"
+	// ReasonCustomersLikeYou items are in the baskets of shoppers whose
+	// history overlaps the shopper's.
+	ReasonCustomersLikeYou = "customers_like_you"
+	// ReasonPopularInCategory items are the favourites of the most popular
+	// categories, for shoppers without enough history.
+	ReasonPopularInCategory = "popular_in_category"
+)
+
+const (
+	defaultRecommendations = 10
+	maxRecommendations     = 50
+	// similarShoppers is how many of the closest shoppers count towards
+	// customers like you.
+	similarShoppers = 20
+	// basketHistory is how far back ratings and orders are read, and
+	// maxBasketLines how many of the most recent items shoppers showed
+	// interest in are read at most.
+	basketHistory  = 180 * 24 * time.Hour
+	maxBasketLines = 20000
+)
+
+// RecommendationQuery asks for suggestions for a shopper, "" for a guest, who
+// only gets popular items. StoreID other than 0 keeps to what the store stocks,
+// at its prices. Items conflicting with Profile are never suggested.
+type RecommendationQuery struct {
+	Username string
+	StoreID  int
+	Limit    int
+	Profile  *DietaryProfile
+}
+
+// Recommendation is a suggested item. An item suggested for more than one
+// reason keeps the first, bought together being the strongest signal, and
+// Because lists the cart items such a suggestion came from.
+type Recommendation struct {
+	Item    *Item   `json:"item"`
+	Score   float64 `json:"score"`
+	Reason  string  `json:"reason"`
+	Because []int   `json:"because,omitempty"`
+}
+
+// basketLine is one item in one shopper's history: carted, ordered or rated
+// well.
+type basketLine struct {
+	Username string `gorm:"column:username"`
+	ItemID   int    `gorm:"column:itemid"`
+}
+
+type basket map[int]bool
+
+// GetRecommendations suggests items from what shoppers keep in their carts,
+// order and rate well. A shopper's own cart seeds the bought-together suggestions,
+// their whole history finds customers like them, and popular items from the
+// most popular categories fill whatever is left.
+func (s *shopService) GetRecommendations(query *RecommendationQuery) ([]*Recommendation, error) {
+	if query.Limit < 0 {
+		return nil, errors.New("limit cannot be negative")
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultRecommendations
+	}
+	if query.Limit > maxRecommendations {
+		query.Limit = maxRecommendations
+	}
+
+	var items []*Item
+	var err error
+	if query.StoreID != 0 {
+		items, err = s.GetItemsFromStore(query.StoreID)
+	} else {
+		items, err = s.GetItems()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := s.db.getBaskets(time.Now().Add(-basketHistory), maxBasketLines)
+	if err != nil {
+		return nil, err
+	}
+	baskets := make(map[string]basket)
+	for _, line := range lines {
+		if baskets[line.Username] == nil {
+			baskets[line.Username] = make(basket)
+		}
+		baskets[line.Username][line.ItemID] = true
+	}
+
+	mine := baskets[query.Username]
+	seeds := mine
+	if query.Username != "" {
+		cart, err := s.db.getCart(query.Username)
+		if err != nil {
+			return nil, err
+		}
+		if len(cart.Lines) > 0 {
+			seeds = make(basket)
+			for _, line := range cart.Lines {
+				seeds[line.ItemID] = true
+			}
+		}
+	}
+	delete(baskets, query.Username)
+
+	candidates := make(map[int]*Item)
+	for _, item := range items {
+		if mine[item.ItemID] || seeds[item.ItemID] {
+			continue
+		}
+		if query.Profile != nil && len(query.Profile.ConflictsWith(item)) > 0 {
+			continue
+		}
+		candidates[item.ItemID] = item
+	}
+
+	picks := make(map[int]*Recommendation)
+	pick := func(itemID int, reason string, score float64) *Recommendation {
+		item, ok := candidates[itemID]
+		if !ok {
+			return nil
+		}
+		rec, ok := picks[itemID]
+		if !ok {
+			rec = &Recommendation{Item: item, Reason: reason}
+			picks[itemID] = rec
+		}
+		rec.Score += score
+		return rec
+	}
+
+	boughtTogether(baskets, seeds, pick)
+	customersLikeYou(baskets, mine, pick)
+
+	recommendations := make([]*Recommendation, 0, len(picks))
+	for _, rec := range picks {
+		recommendations = append(recommendations, rec)
+	}
+	sortRecommendations(recommendations)
+	if len(recommendations) > query.Limit {
+		return recommendations[:query.Limit], nil
+	}
+
+	for _, rec := range popularInCategories(baskets, candidates, picks) {
+		if len(recommendations) == query.Limit {
+			break
+		}
+		recommendations = append(recommendations, rec)
+	}
+
+	return recommendations, nil
+}
+
+// boughtTogether scores each item by how often baskets holding a seed also
+// hold it, summed over the seeds.
+func boughtTogether(baskets map[string]basket, seeds basket, pick func(int, string, float64) *Recommendation) {
+	for seed := range seeds {
+		holding := 0
+		together := make(map[int]int)
+		for _, b := range baskets {
+			if !b[seed] {
+				continue
+			}
+			holding++
+			for itemID := range b {
+				if itemID != seed {
+					together[itemID]++
+				}
+			}
+		}
+
+		for itemID, n := range together {
+			rec := pick(itemID, ReasonBoughtTogether, float64(n)/float64(holding))
+			if rec != nil && rec.Reason == ReasonBoughtTogether {
+				rec.Because = append(rec.Because, seed)
+			}
+		}
+	}
+}
+
+// customersLikeYou finds the shoppers whose history overlaps the shopper's
+// most (by Jaccard similarity) and scores what they have that the shopper
+// doesn't by how similar they are.
+func customersLikeYou(baskets map[string]basket, mine basket, pick func(int, string, float64) *Recommendation) {
+	if len(mine) == 0 {
+		return
+	}
+
+	type neighbour struct {
+		basket     basket
+		similarity float64
+	}
+	var neighbours []neighbour
+	for _, b := range baskets {
+		shared := 0
+		for itemID := range b {
+			if mine[itemID] {
+				shared++
+			}
+		}
+		if shared == 0 {
+			continue
+		}
+		neighbours = append(neighbours, neighbour{b, float64(shared) / float64(len(mine)+len(b)-shared)})
+	}
+	sort.Slice(neighbours, func(i, j int) bool {
+		return neighbours[i].similarity > neighbours[j].similarity
+	})
+	if len(neighbours) > similarShoppers {
+		neighbours = neighbours[:similarShoppers]
+	}
+
+	for _, n := range neighbours {
+		for itemID := range n.basket {
+			pick(itemID, ReasonCustomersLikeYou, n.similarity)
+		}
+	}
+}
+
+// popularInCategories ranks categories by how many baskets their items are
+// in and takes the most popular items from each in turn, so the list isn't
+// all one aisle. Items already picked are skipped.
+func popularInCategories(baskets map[string]basket, candidates map[int]*Item, picked map[int]*Recommendation) []*Recommendation {
+	popularity := make(map[int]int)
+	for _, b := range baskets {
+		for itemID := range b {
+			popularity[itemID]++
+		}
+	}
+
+	byCategory := make(map[int][]*Item)
+	categoryPopularity := make(map[int]int)
+	var categories []int
+	for _, item := range candidates {
+		if _, ok := picked[item.ItemID]; ok {
+			continue
+		}
+		if _, ok := byCategory[item.CategoryID]; !ok {
+			categories = append(categories, item.CategoryID)
+		}
+		byCategory[item.CategoryID] = append(byCategory[item.CategoryID], item)
+		categoryPopularity[item.CategoryID] += popularity[item.ItemID]
+	}
+
+	sort.Slice(categories, func(i, j int) bool {
+		a, b := categories[i], categories[j]
+		if categoryPopularity[a] != categoryPopularity[b] {
+			return categoryPopularity[a] > categoryPopularity[b]
+		}
+		return a < b
+	})
+	for _, items := range byCategory {
+		sort.Slice(items, func(i, j int) bool {
+			a, b := items[i], items[j]
+			if popularity[a.ItemID] != popularity[b.ItemID] {
+				return popularity[a.ItemID] > popularity[b.ItemID]
+			}
+			if a.Rating != b.Rating {
+				return a.Rating > b.Rating
+			}
+			return a.Name < b.Name
+		})
+	}
+
+	total := float64(len(baskets))
+	if total == 0 {
+		total = 1
+	}
+
+	var recommendations []*Recommendation
+	for round := 0; len(recommendations) < len(candidates); round++ {
+		added := false
+		for _, categoryID := range categories {
+			items := byCategory[categoryID]
+			if round >= len(items) {
+				continue
+			}
+			item := items[round]
+			recommendations = append(recommendations, &Recommendation{
+				Item:   item,
+				Score:  roundCents(float64(popularity[item.ItemID]) / total),
+				Reason: ReasonPopularInCategory,
+			})
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+
+	return recommendations
+}
+
+func sortRecommendations(recommendations []*Recommendation) {
+	for _, rec := range recommendations {
+		rec.Score = roundCents(rec.Score)
+		sort.Ints(rec.Because)
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		a, b := recommendations[i], recommendations[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Item.Name < b.Item.Name
+	})
+}
@@ -1,8 +1,11 @@
 package shop
 
 import (
+	"fmt"
 	"log"
+	"time"
 
+	"github.com/lib/pq"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -11,23 +14,114 @@ type ShopRepo interface {
 	getItems() ([]*Item, error)
 	getItemsFromStore(ID int) ([]*Item, error)
 	getItem(ID int) (*Item, error)
-	addItem(*Item) (*Item, error)
-	updateItem(*Item) (*Item, error)
+	addItem(item *Item, actor string) (*Item, error)
+	updateItem(item *Item, actor string) (*Item, error)
 	deleteItem(int) (bool, error)
 	getStores() ([]*Store, error)
 	getStore(ID int) ([]*ItemInStock, error)
+	getStoreByID(ID int) (*Store, error)
 	addStore(*Store) (*Store, error)
 	updateStore(*Store) (*Store, error)
-	deleteStore(int) (bool, error)
+	deleteStore(storeID int, options DeleteOptions) (*StoreDependents, error)
+	getStoreDependents(storeID int) (*StoreDependents, error)
 	addStock(*StockRequest) (*StockRequest, error)
 	updateStock(*StockRequest) (*StockRequest, error)
 	deleteStock(int, int) (bool, error)
 	getCategories() ([]*Category, error)
-	createCategory(string) (*Category, error)
+	createCategory(*Category) (*Category, error)
 	editCategory(*Category) (*Category, error)
-	deleteCategory(int) (bool, error)
+	deleteCategory(categoryID int, options DeleteOptions) (*CategoryDependents, error)
+	getCategoryDependents(categoryID int) (*CategoryDependents, error)
+	getCategoryDescendants(categoryID int) ([]int, error)
+	getItemsInCategories(categoryIDs []int) ([]*Item, error)
+	moveCategory(categoryID, parentID int) (*Category, error)
+	getItemsByID(IDs []int) ([]*Item, error)
+	getBarcodes(itemID int) ([]*Barcode, error)
+	getBarcode(gtin string) (*Barcode, error)
+	addBarcode(*Barcode) (*Barcode, error)
+	deleteBarcode(itemID int, gtin string) (bool, error)
+	getStockLocation(storeID, itemID int) (*Location, error)
+	setItemImage(itemID int, image *ItemImage) (*ItemImage, error)
+	getVariants(itemIDs []int) ([]*Variant, error)
+	getVariant(variantID int) (*Variant, error)
+	addVariant(variant *Variant, actor string) (*Variant, error)
+	updateVariant(variant *Variant, actor string) (*Variant, error)
+	deleteVariant(itemID, variantID int) (bool, error)
+	deleteVariantStock(storeID, itemID, variantID int) (bool, error)
+	getStorePrices(storeID int) ([]*StorePrice, error)
+	setStorePrice(*StorePrice) (*StorePrice, error)
+	deleteStorePrice(storeID, itemID, variantID int) (bool, error)
+	getPriceChanges(itemID int) ([]*PriceChange, error)
+	addPriceChange(*PriceChange) (*PriceChange, error)
+	applyPriceChange(*PriceChange) (*PriceChange, error)
+	cancelPriceChange(itemID, changeID int) (bool, error)
+	applyDuePriceChanges(now time.Time) (int, error)
+	getActivePromotions(storeID int, now time.Time) ([]*Promotion, error)
+	getPromotions(storeID int, includeExpired bool) ([]*Promotion, error)
+	getPromotion(promotionID int) (*Promotion, error)
+	addPromotion(*Promotion) (*Promotion, error)
+	updatePromotion(*Promotion) (*Promotion, error)
+	deletePromotion(promotionID int) (bool, error)
+	getCart(username string) (*Cart, error)
+	saveCart(*Cart) error
+	deleteCart(username string) (bool, error)
+	getCoupons() ([]*Coupon, error)
+	getCoupon(code string) (*Coupon, error)
+	addCoupon(*Coupon) (*Coupon, error)
+	updateCoupon(*Coupon) (*Coupon, error)
+	deleteCoupon(couponID int) (bool, error)
+	redeemCoupon(username string, coupon *Coupon) error
+	releaseCoupon(username string) error
+	getReviews(query *ReviewQuery) ([]*Review, int64, error)
+	getRatingTotals(itemID int) (*RatingTotals, error)
+	getUserReview(itemID int, username string) (*Review, error)
+	addReview(*Review) (*Review, error)
+	updateReview(*Review) (*Review, error)
+	moderateReview(reviewID int, status, note, moderator string) (*Review, error)
+	deleteReview(reviewID int, username string) (bool, error)
+	getBaskets(since time.Time, limit int) ([]*basketLine, error)
+	getStockPlacements(storeID int) ([]*StockRequest, error)
+	getItemPlacements(itemID int) ([]*StockRequest, error)
+	getStoreHours(storeIDs []int) ([]*OpeningHours, error)
+	setStoreHours(storeID int, hours []*OpeningHours) ([]*OpeningHours, error)
+	getHoursExceptions(storeIDs []int, from string) ([]*HoursException, error)
+	setHoursException(*HoursException) (*HoursException, error)
+	deleteHoursException(storeID int, date string) (bool, error)
+	addOrder(order *Order, cart *Cart, slot *SlotBooking) (*Order, error)
+	getOrder(orderID int) (*Order, error)
+	getOrders(*OrderQuery) ([]*Order, int64, error)
+	updateOrderStatus(from string, event *OrderEvent) (*Order, error)
+	getPayments(orderID int) ([]*Payment, error)
+	addPayment(*Payment) (*Payment, error)
+	syncPayment(*Payment) (*Payment, error)
+	setSettleError(orderID int, message string, at time.Time) error
+	getSlotTemplates(storeID int) ([]*SlotTemplate, error)
+	getSlotTemplate(templateID int) (*SlotTemplate, error)
+	addSlotTemplate(*SlotTemplate) (*SlotTemplate, error)
+	updateSlotTemplate(*SlotTemplate) (*SlotTemplate, error)
+	deleteSlotTemplate(storeID, templateID int) (bool, error)
+	getSlotBookingCounts(storeID int, from, to, heldSince time.Time) (map[slotKey]int, error)
+	reserveSlot(booking *SlotBooking, heldSince time.Time) (*SlotBooking, error)
+	getSlotReservation(username string, heldSince time.Time) (*SlotBooking, error)
+	releaseSlot(username string) (bool, error)
+	getSlotOrders(storeID int, startsAt time.Time) ([]*Order, error)
+	addPickBatch(batch *PickBatch, orderIDs []int) (*PickBatch, error)
+	getPickBatch(batchID int) (*PickBatch, error)
+	getPickBatches(storeID int, status string) ([]*PickBatch, error)
+	pickLine(*PickLine) (*PickBatch, error)
+	addReturn(*Return) (*Return, error)
+	getReturns(orderID int) ([]*Return, error)
+	getReturn(returnID int) (*Return, error)
+	setReturnRefund(*Return) (*Return, error)
+	getReturnsReport(storeID int, from, to time.Time) (*ReturnsReport, error)
 }
 
+// itemColumns selects everything on Item from items i joined to categories c,
+// with the item's rating over its published reviews.
+const itemColumns = "i.itemid, i.name as name, i.description, i.categoryid as categoryid, c.category as category, c.tax_class, i.price, i.dietary, i.allergens, i.nutrition, i.image_url, i.thumbnail_url, i.image_key, i.thumbnail_key, " +
+	"coalesce((SELECT round(avg(r.rating), 2) FROM item_reviews r WHERE r.itemid = i.itemid AND r.status = 'published'), 0) AS rating, " +
+	"(SELECT count(*) FROM item_reviews r WHERE r.itemid = i.itemid AND r.status = 'published') AS review_count"
+
 type shopRepo struct {
 	db *gorm.DB
 }
@@ -48,7 +142,7 @@ func initDatabase(config string) *gorm.DB {
 
 func (r *shopRepo) getItem(ID int) (*Item, error) {
 	var items []*Item
-	result := r.db.Raw("select itemid, i.name as name, description, i.categoryid as categoryid, price, c.category as category from items i join categories c on c.categoryid = i.categoryid where itemid = ?", ID).Scan(&items)
+	result := r.db.Raw("select "+itemColumns+" from items i join categories c on c.categoryid = i.categoryid where i.itemid = ?", ID).Scan(&items)
 
 	err := result.Error
 
@@ -61,10 +155,16 @@ func (r *shopRepo) getItem(ID int) (*Item, error) {
 	return items[0], nil
 }
 
-func (r *shopRepo) addItem(item *Item) (*Item, error) {
-	result := r.db.Exec("INSERT INTO items (name, description, categoryid, price) VALUES (?, ?, ?, ?)", item.Name, item.Description, item.CategoryID, item.Price)
+func (r *shopRepo) addItem(item *Item, actor string) (*Item, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		row := tx.Raw("INSERT INTO items (name, description, categoryid, price, dietary, allergens, nutrition) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING itemid", item.Name, item.Description, item.CategoryID, item.Price, item.Dietary, item.Allergens, item.Nutrition).Row()
+		if err := row.Scan(&item.ItemID); err != nil {
+			return err
+		}
 
-	err := result.Error
+		// the starting price opens the item's price history
+		return recordPrice(tx, &PriceChange{ItemID: item.ItemID, Price: item.Price, CreatedBy: actor}, nil)
+	})
 
 	if err != nil {
 		return nil, err
@@ -75,7 +175,11 @@ func (r *shopRepo) addItem(item *Item) (*Item, error) {
 
 func (r *shopRepo) addStock(input *StockRequest) (*StockRequest, error) {
 	// result := r.db.Table("stock").Create(&input)
-	result := r.db.Exec("INSERT INTO stock (storeid, itemid, row, col) VALUES (?, ?, ?, ?)", input.StoreID, input.ItemID, input.Row, input.Col)
+	quantity := 0
+	if input.Quantity != nil {
+		quantity = *input.Quantity
+	}
+	result := r.db.Exec("INSERT INTO stock (storeid, itemid, variantid, row, col, quantity) VALUES (?, ?, ?, ?, ?, ?)", input.StoreID, input.ItemID, input.VariantID, input.Row, input.Col, quantity)
 
 	if result.Error != nil {
 		return nil, result.Error
@@ -93,7 +197,7 @@ func (r *shopRepo) deleteStock(storeID, itemID int) (bool, error) {
 
 func (r *shopRepo) getItems() ([]*Item, error) {
 	var items []*Item
-	result := r.db.Raw("select itemid, i.name as name, description, i.categoryid as categoryid, price, c.category as category from items i join categories c on c.categoryid = i.categoryid").Scan(&items)
+	result := r.db.Raw("select " + itemColumns + " from items i join categories c on c.categoryid = i.categoryid").Scan(&items)
 
 	err := result.Error
 
@@ -104,18 +208,53 @@ func (r *shopRepo) getItems() ([]*Item, error) {
 	return items, nil
 }
 
+func (r *shopRepo) getItemsByID(IDs []int) ([]*Item, error) {
+	var items []*Item
+	result := r.db.Raw("select "+itemColumns+" from items i join categories c on c.categoryid = i.categoryid where i.itemid in ?", IDs).Scan(&items)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return items, nil
+}
+
 func (r *shopRepo) getItemsFromStore(ID int) ([]*Item, error) {
-	return nil, nil
+	var items []*Item
+	result := r.db.Raw("select "+itemColumns+" from items i join categories c on c.categoryid = i.categoryid where i.itemid in (select itemid from stock where storeid = ?)", ID).Scan(&items)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return items, nil
 }
 
-func (r *shopRepo) updateItem(item *Item) (*Item, error) {
+func (r *shopRepo) updateItem(item *Item, actor string) (*Item, error) {
 	// for fields that aren't in request body, it updates item to 0 or empty string. for categoryID, it uses that in WHERE clause instead of updating it
 	// result := r.db.Debug().Model(&item).Updates(map[string]interface{}{"name": item.Name, "description": item.Description, "categoryid": item.CategoryID, "price": item.Price})
 
-	result := r.db.Debug().Table("items").Model(&item).Omit("itemid").Updates(&item)
+	// images are only changed through setItemImage
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		previous, err := lockPrice(tx, item.ItemID, 0)
+		if err != nil {
+			return err
+		}
 
-	if result.Error != nil {
-		return nil, result.Error
+		result := tx.Debug().Table("items").Model(&item).Omit("itemid", "image_url", "thumbnail_url", "image_key", "thumbnail_key", "tax_class", "parentid").Updates(&item)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		// a zero price is left out of the update like any other empty field
+		if previous == nil || item.Price == 0 || item.Price == *previous {
+			return nil
+		}
+		return recordPrice(tx, &PriceChange{ItemID: item.ItemID, Price: item.Price, CreatedBy: actor}, previous)
+	})
+
+	if err != nil {
+		return nil, err
 	}
 	return item, nil
 }
@@ -143,7 +282,7 @@ func (r *shopRepo) getStores() ([]*Store, error) {
 
 func (r *shopRepo) getStore(storeID int) ([]*ItemInStock, error) {
 	var itemsInStore []*ItemInStock
-	stmt := "select i.itemid, i.name as name, description,  c.categoryid, c.category as category, price, row, col from stock join items i on stock.itemid = i.itemid join categories c on c.categoryid = i.categoryid where storeid = ?"
+	stmt := "select " + itemColumns + ", stock.variantid, row, col, quantity from stock join items i on stock.itemid = i.itemid join categories c on c.categoryid = i.categoryid where storeid = ?"
 	result := r.db.Raw(stmt, storeID).Scan(&itemsInStore)
 	if result.Error != nil {
 		return nil, result.Error
@@ -152,6 +291,19 @@ func (r *shopRepo) getStore(storeID int) ([]*ItemInStock, error) {
 	return itemsInStore, nil
 }
 
+func (r *shopRepo) getStoreByID(ID int) (*Store, error) {
+	var stores []*Store
+	result := r.db.Table("stores").Where("storeid = ?", ID).Find(&stores)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(stores) == 0 {
+		return nil, ErrStoreNotFound
+	}
+
+	return stores[0], nil
+}
+
 func (r *shopRepo) addStore(store *Store) (*Store, error) {
 	result := r.db.Table("stores").Create(&store)
 	if result.Error != nil {
@@ -171,17 +323,8 @@ func (r *shopRepo) updateStore(store *Store) (*Store, error) {
 	return store, nil
 }
 
-func (r *shopRepo) deleteStore(ID int) (bool, error) {
-	result := r.db.Table("stores").Delete(&Store{StoreID: ID})
-	if result.Error != nil {
-		return false, result.Error
-	}
-
-	return true, nil
-}
-
 func (r *shopRepo) updateStock(item *StockRequest) (*StockRequest, error) {
-	result := r.db.Table("stock").Model(&item).Omit("storeid", "itemid").Updates(&item)
+	result := r.db.Table("stock").Model(&item).Where("variantid = ?", item.VariantID).Omit("storeid", "itemid", "variantid").Updates(&item)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -200,15 +343,13 @@ func (r *shopRepo) getCategories() ([]*Category, error) {
 
 	return categories, nil
 }
-func (r *shopRepo) createCategory(name string) (*Category, error) {
+func (r *shopRepo) createCategory(cat *Category) (*Category, error) {
 	// var cat *Category
 	// err := r.db.Exec("INSERT INTO categories (category) VALUES (?) RETURNING *", name).Row().Scan(&cat)
 	// if err != nil {
 	// 	return nil, err
 	// }
 
-	cat := &Category{Name: name}
-
 	result := r.db.Create(&cat)
 	if result.Error != nil {
 		return nil, result.Error
@@ -217,18 +358,2535 @@ func (r *shopRepo) createCategory(name string) (*Category, error) {
 	return cat, nil
 }
 func (r *shopRepo) editCategory(cat *Category) (*Category, error) {
-	result := r.db.Table("categories").Where("categoryid = ?", cat.CategoryID).Updates(map[string]interface{}{"category": cat.Name})
+	changes := map[string]interface{}{"category": cat.Name}
+	if cat.TaxClass != "" {
+		changes["tax_class"] = cat.TaxClass
+	}
+	result := r.db.Table("categories").Where("categoryid = ?", cat.CategoryID).Updates(changes)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
 	return cat, nil
 }
-func (r *shopRepo) deleteCategory(categoryID int) (bool, error) {
-	result := r.db.Table("categories").Delete(&Category{CategoryID: categoryID})
+
+func (r *shopRepo) getBarcodes(itemID int) ([]*Barcode, error) {
+	var barcodes []*Barcode
+	result := r.db.Table("item_barcodes").Where("itemid = ?", itemID).Order("code").Find(&barcodes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return barcodes, nil
+}
+
+func (r *shopRepo) getBarcode(gtin string) (*Barcode, error) {
+	var barcodes []*Barcode
+	result := r.db.Table("item_barcodes").Where("gtin = ?", gtin).Find(&barcodes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(barcodes) == 0 {
+		return nil, ErrBarcodeNotFound
+	}
+
+	return barcodes[0], nil
+}
+
+// addBarcode checks for an existing owner inside the insert's transaction; the
+// primary key on gtin backs this up if two requests race.
+func (r *shopRepo) addBarcode(barcode *Barcode) (*Barcode, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var existing []*Barcode
+		result := tx.Table("item_barcodes").Where("gtin = ?", barcode.GTIN).Find(&existing)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("%w (item %d)", ErrBarcodeInUse, existing[0].ItemID)
+		}
+
+		return tx.Table("item_barcodes").Create(barcode).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return barcode, nil
+}
+
+func (r *shopRepo) deleteBarcode(itemID int, gtin string) (bool, error) {
+	result := r.db.Exec("DELETE FROM item_barcodes WHERE itemid = ? AND gtin = ?", itemID, gtin)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+// getStockLocation returns nil when the store doesn't stock the item.
+func (r *shopRepo) getStockLocation(storeID, itemID int) (*Location, error) {
+	var locations []*Location
+	result := r.db.Raw("SELECT row, col FROM stock WHERE storeid = ? AND itemid = ?", storeID, itemID).Scan(&locations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(locations) == 0 {
+		return nil, nil
+	}
+
+	return locations[0], nil
+}
+
+// setItemImage replaces an item's image (nil clears it) and returns the one it
+// replaced so the caller can remove the old files.
+func (r *shopRepo) setItemImage(itemID int, image *ItemImage) (*ItemImage, error) {
+	if image == nil {
+		image = &ItemImage{}
+	}
+
+	var previous []*ItemImage
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Raw("SELECT image_url, thumbnail_url, image_key, thumbnail_key FROM items WHERE itemid = ? FOR UPDATE", itemID).Scan(&previous)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(previous) == 0 {
+			return fmt.Errorf("item %d does not exist", itemID)
+		}
+
+		return tx.Table("items").Where("itemid = ?", itemID).Updates(map[string]interface{}{
+			"image_url":     image.ImageURL,
+			"thumbnail_url": image.ThumbnailURL,
+			"image_key":     image.ImageKey,
+			"thumbnail_key": image.ThumbnailKey,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return previous[0], nil
+}
+
+func (r *shopRepo) getVariants(itemIDs []int) ([]*Variant, error) {
+	var variants []*Variant
+	result := r.db.Table("item_variants").Where("itemid in ?", itemIDs).Order("itemid, size").Find(&variants)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return variants, nil
+}
+
+func (r *shopRepo) getVariant(variantID int) (*Variant, error) {
+	var variants []*Variant
+	result := r.db.Table("item_variants").Where("variantid = ?", variantID).Find(&variants)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(variants) == 0 {
+		return nil, ErrVariantNotFound
+	}
+
+	return variants[0], nil
+}
+
+// skuTaken checks SKU uniqueness inside the caller's transaction. An empty SKU
+// is allowed on any number of variants.
+func skuTaken(tx *gorm.DB, variant *Variant) (bool, error) {
+	if variant.SKU == "" {
+		return false, nil
+	}
+
+	var count int64
+	result := tx.Table("item_variants").Where("sku = ? AND variantid <> ?", variant.SKU, variant.VariantID).Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return count > 0, nil
+}
+
+func (r *shopRepo) addVariant(variant *Variant, actor string) (*Variant, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		taken, err := skuTaken(tx, variant)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrSKUInUse
+		}
+		item, err := lockPrice(tx, variant.ItemID, 0)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return ErrItemNotFound
+		}
+
+		if err := tx.Table("item_variants").Omit("variantid").Create(variant).Error; err != nil {
+			return err
+		}
+
+		return recordPrice(tx, &PriceChange{ItemID: variant.ItemID, VariantID: variant.VariantID, Price: variant.Price, CreatedBy: actor}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return variant, nil
+}
+
+func (r *shopRepo) updateVariant(variant *Variant, actor string) (*Variant, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		taken, err := skuTaken(tx, variant)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrSKUInUse
+		}
+
+		previous, err := lockPrice(tx, variant.ItemID, variant.VariantID)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			return ErrVariantNotFound
+		}
+
+		result := tx.Table("item_variants").Where("variantid = ? AND itemid = ?", variant.VariantID, variant.ItemID).Updates(map[string]interface{}{
+			"name":  variant.Name,
+			"sku":   variant.SKU,
+			"size":  variant.Size,
+			"unit":  variant.Unit,
+			"price": variant.Price,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrVariantNotFound
+		}
+
+		if *previous == variant.Price {
+			return nil
+		}
+		return recordPrice(tx, &PriceChange{ItemID: variant.ItemID, VariantID: variant.VariantID, Price: variant.Price, CreatedBy: actor}, previous)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return variant, nil
+}
+
+// deleteVariant also removes the variant's stock placements.
+func (r *shopRepo) deleteVariant(itemID, variantID int) (bool, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM stock WHERE itemid = ? AND variantid = ?", itemID, variantID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Exec("DELETE FROM item_variants WHERE itemid = ? AND variantid = ?", itemID, variantID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrVariantNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r *shopRepo) deleteVariantStock(storeID, itemID, variantID int) (bool, error) {
+	result := r.db.Exec("DELETE FROM stock WHERE storeid = ? AND itemid = ? AND variantid = ?", storeID, itemID, variantID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return true, nil
+}
+
+func (r *shopRepo) getStorePrices(storeID int) ([]*StorePrice, error) {
+	var prices []*StorePrice
+	result := r.db.Table("store_prices").Where("storeid = ?", storeID).Order("itemid, variantid").Find(&prices)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return prices, nil
+}
+
+func (r *shopRepo) setStorePrice(price *StorePrice) (*StorePrice, error) {
+	result := r.db.Exec("INSERT INTO store_prices (storeid, itemid, variantid, price) VALUES (?, ?, ?, ?) ON CONFLICT (storeid, itemid, variantid) DO UPDATE SET price = EXCLUDED.price", price.StoreID, price.ItemID, price.VariantID, price.Price)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return price, nil
+}
+
+func (r *shopRepo) deleteStorePrice(storeID, itemID, variantID int) (bool, error) {
+	result := r.db.Exec("DELETE FROM store_prices WHERE storeid = ? AND itemid = ? AND variantid = ?", storeID, itemID, variantID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+// lockPrice reads the current price of an item, or of one of its variants,
+// and locks the row for the rest of the transaction. It returns nil when there
+// is no such item or variant.
+func lockPrice(tx *gorm.DB, itemID, variantID int) (*float64, error) {
+	var rows []struct{ Price float64 }
+	var result *gorm.DB
+	if variantID == 0 {
+		result = tx.Raw("SELECT price FROM items WHERE itemid = ? FOR UPDATE", itemID).Scan(&rows)
+	} else {
+		result = tx.Raw("SELECT price FROM item_variants WHERE itemid = ? AND variantid = ? FOR UPDATE", itemID, variantID).Scan(&rows)
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return &rows[0].Price, nil
+}
+
+// writePrice sets the price of an item or variant and returns the one it
+// replaced.
+func writePrice(tx *gorm.DB, itemID, variantID int, price float64) (float64, error) {
+	previous, err := lockPrice(tx, itemID, variantID)
+	if err != nil {
+		return 0, err
+	}
+	if previous == nil {
+		if variantID != 0 {
+			return 0, ErrVariantNotFound
+		}
+		return 0, ErrItemNotFound
+	}
+
+	var result *gorm.DB
+	if variantID == 0 {
+		result = tx.Exec("UPDATE items SET price = ? WHERE itemid = ?", price, itemID)
+	} else {
+		result = tx.Exec("UPDATE item_variants SET price = ? WHERE itemid = ? AND variantid = ?", price, itemID, variantID)
+	}
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return *previous, nil
+}
+
+// recordPrice adds a change that has just gone live to the price history.
+func recordPrice(tx *gorm.DB, change *PriceChange, previous *float64) error {
+	now := time.Now()
+	if change.EffectiveAt.IsZero() {
+		change.EffectiveAt = now
+	}
+	if change.CreatedAt.IsZero() {
+		change.CreatedAt = now
+	}
+	change.PreviousPrice = previous
+	change.AppliedAt = &now
+
+	return tx.Table("price_changes").Omit("changeid").Create(change).Error
+}
+
+func (r *shopRepo) getPriceChanges(itemID int) ([]*PriceChange, error) {
+	var changes []*PriceChange
+	result := r.db.Table("price_changes").Where("itemid = ?", itemID).Order("effective_at, changeid").Find(&changes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return changes, nil
+}
+
+func (r *shopRepo) addPriceChange(change *PriceChange) (*PriceChange, error) {
+	result := r.db.Table("price_changes").Omit("changeid").Create(change)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return change, nil
+}
+
+func (r *shopRepo) applyPriceChange(change *PriceChange) (*PriceChange, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		previous, err := writePrice(tx, change.ItemID, change.VariantID, change.Price)
+		if err != nil {
+			return err
+		}
+
+		return recordPrice(tx, change, &previous)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return change, nil
+}
+
+func (r *shopRepo) cancelPriceChange(itemID, changeID int) (bool, error) {
+	result := r.db.Exec("DELETE FROM price_changes WHERE itemid = ? AND changeid = ? AND applied_at IS NULL", itemID, changeID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, ErrPriceChangeNotFound
+	}
+
+	return true, nil
+}
+
+// applyDuePriceChanges locks the due changes with SKIP LOCKED so that several
+// server instances can run the scheduler without applying a change twice.
+// Changes for items or variants deleted in the meantime are dropped.
+func (r *shopRepo) applyDuePriceChanges(now time.Time) (int, error) {
+	applied := 0
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var due []*PriceChange
+		result := tx.Raw("SELECT * FROM price_changes WHERE applied_at IS NULL AND effective_at <= ? ORDER BY effective_at, changeid FOR UPDATE SKIP LOCKED", now).Scan(&due)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for _, change := range due {
+			previous, err := writePrice(tx, change.ItemID, change.VariantID, change.Price)
+			if err == ErrItemNotFound || err == ErrVariantNotFound {
+				log.Printf("[Shop] [Repo] [ApplyDuePriceChanges] dropping change %d: %v", change.ChangeID, err)
+				if err := tx.Exec("DELETE FROM price_changes WHERE changeid = ?", change.ChangeID).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			result := tx.Exec("UPDATE price_changes SET previous_price = ?, applied_at = ? WHERE changeid = ?", previous, now, change.ChangeID)
+			if result.Error != nil {
+				return result.Error
+			}
+			applied++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return applied, nil
+}
+
+// getActivePromotions returns the deals running at a store right now. With
+// storeID 0 only the chain-wide ones are returned.
+func (r *shopRepo) getActivePromotions(storeID int, now time.Time) ([]*Promotion, error) {
+	var promotions []*Promotion
+	result := r.db.Table("promotions").Where("starts_at <= ? AND ends_at > ? AND (storeid = 0 OR storeid = ?)", now, now, storeID).Find(&promotions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return promotions, nil
+}
+
+// getPromotions lists promotions for managing them. storeID 0 lists every
+// store's; otherwise the store's own and the chain-wide ones.
+func (r *shopRepo) getPromotions(storeID int, includeExpired bool) ([]*Promotion, error) {
+	var promotions []*Promotion
+	query := r.db.Table("promotions")
+	if storeID != 0 {
+		query = query.Where("storeid = 0 OR storeid = ?", storeID)
+	}
+	if !includeExpired {
+		query = query.Where("ends_at > ?", time.Now())
+	}
+
+	result := query.Order("starts_at, promotionid").Find(&promotions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return promotions, nil
+}
+
+func (r *shopRepo) getPromotion(promotionID int) (*Promotion, error) {
+	var promotions []*Promotion
+	result := r.db.Table("promotions").Where("promotionid = ?", promotionID).Find(&promotions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(promotions) == 0 {
+		return nil, ErrPromotionNotFound
+	}
+
+	return promotions[0], nil
+}
+
+func (r *shopRepo) addPromotion(promotion *Promotion) (*Promotion, error) {
+	result := r.db.Table("promotions").Omit("promotionid").Create(promotion)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return promotion, nil
+}
+
+func (r *shopRepo) updatePromotion(promotion *Promotion) (*Promotion, error) {
+	result := r.db.Table("promotions").Where("promotionid = ?", promotion.PromotionID).Select("*").Omit("promotionid", "created_by").Updates(promotion)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPromotionNotFound
+	}
+
+	return promotion, nil
+}
+
+func (r *shopRepo) deletePromotion(promotionID int) (bool, error) {
+	result := r.db.Exec("DELETE FROM promotions WHERE promotionid = ?", promotionID)
 	if result.Error != nil {
 		return false, result.Error
 	}
+	if result.RowsAffected == 0 {
+		return false, ErrPromotionNotFound
+	}
 
 	return true, nil
 }
+
+// getCart returns an empty cart for shoppers who haven't saved one yet.
+func (r *shopRepo) getCart(username string) (*Cart, error) {
+	return readCart(r.db, username, false)
+}
+
+// readCart reads a shopper's cart, locking its row for the rest of the
+// transaction when lock is set.
+func readCart(tx *gorm.DB, username string, lock bool) (*Cart, error) {
+	query := "SELECT * FROM carts WHERE username = ?"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var carts []*Cart
+	result := tx.Raw(query, username).Scan(&carts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(carts) == 0 {
+		return &Cart{Username: username, Lines: []*CartLine{}}, nil
+	}
+
+	cart := carts[0]
+	result = tx.Table("cart_lines").Where("username = ?", username).Order("position").Find(&cart.Lines)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return cart, nil
+}
+
+func (r *shopRepo) saveCart(cart *Cart) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("INSERT INTO carts (username, storeid) VALUES (?, ?) ON CONFLICT (username) DO UPDATE SET storeid = EXCLUDED.storeid", cart.Username, cart.StoreID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Exec("DELETE FROM cart_lines WHERE username = ?", cart.Username)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for i, line := range cart.Lines {
+			result = tx.Exec("INSERT INTO cart_lines (username, position, itemid, variantid, quantity) VALUES (?, ?, ?, ?, ?)", cart.Username, i, line.ItemID, line.VariantID, line.Quantity)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+}
+
+// deleteCart also releases the coupon redemption held by the cart.
+func (r *shopRepo) deleteCart(username string) (bool, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"DELETE FROM coupon_redemptions WHERE username = ? AND orderid IS NULL",
+			"DELETE FROM cart_lines WHERE username = ?",
+			"DELETE FROM carts WHERE username = ?",
+		} {
+			if err := tx.Exec(stmt, username).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// couponColumns adds how often each coupon has been redeemed.
+const couponColumns = "coupons.*, (SELECT count(*) FROM coupon_redemptions cr WHERE cr.couponid = coupons.couponid) AS uses"
+
+func (r *shopRepo) getCoupons() ([]*Coupon, error) {
+	var coupons []*Coupon
+	result := r.db.Raw("SELECT " + couponColumns + " FROM coupons ORDER BY starts_at, couponid").Scan(&coupons)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return coupons, nil
+}
+
+func (r *shopRepo) getCoupon(code string) (*Coupon, error) {
+	var coupons []*Coupon
+	result := r.db.Raw("SELECT "+couponColumns+" FROM coupons WHERE code = ?", code).Scan(&coupons)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(coupons) == 0 {
+		return nil, ErrCouponNotFound
+	}
+
+	return coupons[0], nil
+}
+
+func codeTaken(tx *gorm.DB, coupon *Coupon) (bool, error) {
+	var count int64
+	result := tx.Table("coupons").Where("code = ? AND couponid <> ?", coupon.Code, coupon.CouponID).Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return count > 0, nil
+}
+
+func (r *shopRepo) addCoupon(coupon *Coupon) (*Coupon, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		taken, err := codeTaken(tx, coupon)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrCodeInUse
+		}
+
+		return tx.Table("coupons").Omit("couponid").Create(coupon).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+func (r *shopRepo) updateCoupon(coupon *Coupon) (*Coupon, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		taken, err := codeTaken(tx, coupon)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrCodeInUse
+		}
+
+		result := tx.Table("coupons").Where("couponid = ?", coupon.CouponID).Select("*").Omit("couponid", "created_by", "uses").Updates(coupon)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrCouponNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+func (r *shopRepo) deleteCoupon(couponID int) (bool, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("UPDATE carts SET coupon_code = '' WHERE coupon_code = (SELECT code FROM coupons WHERE couponid = ?)", couponID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Exec("DELETE FROM coupons WHERE couponid = ?", couponID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrCouponNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// redeemCoupon records a use of the coupon for the shopper's cart. The coupon
+// row stays locked while its uses are counted, so concurrent redemptions of a
+// limited code are taken one at a time and can't go over the limit. The
+// shopper's previous code, if any, is released first.
+func (r *shopRepo) redeemCoupon(username string, coupon *Coupon) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var locked []*Coupon
+		result := tx.Raw("SELECT * FROM coupons WHERE couponid = ? FOR UPDATE", coupon.CouponID).Scan(&locked)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(locked) == 0 {
+			return reject(RejectUnknownCode, "%s is not a valid code", coupon.Code)
+		}
+		coupon = locked[0]
+
+		result = tx.Exec("DELETE FROM coupon_redemptions WHERE username = ? AND orderid IS NULL", username)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var uses, userUses int64
+		result = tx.Table("coupon_redemptions").Where("couponid = ?", coupon.CouponID).Count(&uses)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Table("coupon_redemptions").Where("couponid = ? AND username = ?", coupon.CouponID, username).Count(&userUses)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if coupon.MaxUses > 0 && uses >= int64(coupon.MaxUses) {
+			return reject(RejectUsageLimit, "code %s has been fully redeemed", coupon.Code)
+		}
+		if coupon.MaxUsesPerUser > 0 && userUses >= int64(coupon.MaxUsesPerUser) {
+			return reject(RejectUserLimit, "you have already used code %s the maximum of %d times", coupon.Code, coupon.MaxUsesPerUser)
+		}
+
+		result = tx.Exec("INSERT INTO coupon_redemptions (couponid, username, redeemed_at) VALUES (?, ?, ?)", coupon.CouponID, username, time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Exec("UPDATE carts SET coupon_code = ? WHERE username = ?", coupon.Code, username)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return reject(RejectEmptyCart, "your cart is empty")
+		}
+		return nil
+	})
+}
+
+func (r *shopRepo) releaseCoupon(username string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM coupon_redemptions WHERE username = ? AND orderid IS NULL", username)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return tx.Exec("UPDATE carts SET coupon_code = '' WHERE username = ?", username).Error
+	})
+}
+
+// categorySubtree selects the IDs of a category and everything below it.
+const categorySubtree = "WITH RECURSIVE subtree AS (SELECT categoryid FROM categories WHERE categoryid = ? UNION SELECT c.categoryid FROM categories c JOIN subtree s ON c.parentid = s.categoryid) "
+
+func (r *shopRepo) getCategoryDescendants(categoryID int) ([]int, error) {
+	var rows []struct {
+		CategoryID int `gorm:"column:categoryid"`
+	}
+	result := r.db.Raw(categorySubtree+"SELECT categoryid FROM subtree", categoryID).Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	ids := make([]int, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.CategoryID)
+	}
+
+	return ids, nil
+}
+
+func (r *shopRepo) getItemsInCategories(categoryIDs []int) ([]*Item, error) {
+	var items []*Item
+	result := r.db.Raw("select "+itemColumns+" from items i join categories c on c.categoryid = i.categoryid where i.categoryid in ? order by i.name", categoryIDs).Scan(&items)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return items, nil
+}
+
+// moveCategory locks the categories table against other writers while it
+// checks for cycles, so two concurrent moves can't put categories under each
+// other.
+func (r *shopRepo) moveCategory(categoryID, parentID int) (*Category, error) {
+	var category *Category
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+
+		var categories []*Category
+		result := tx.Table("categories").Where("categoryid = ?", categoryID).Find(&categories)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(categories) == 0 {
+			return ErrCategoryNotFound
+		}
+		category = categories[0]
+
+		if parentID != 0 {
+			var count int64
+			result = tx.Table("categories").Where("categoryid = ?", parentID).Count(&count)
+			if result.Error != nil {
+				return result.Error
+			}
+			if count == 0 {
+				return ErrCategoryNotFound
+			}
+
+			var cycle []struct {
+				CategoryID int `gorm:"column:categoryid"`
+			}
+			result = tx.Raw(categorySubtree+"SELECT categoryid FROM subtree WHERE categoryid = ?", categoryID, parentID).Scan(&cycle)
+			if result.Error != nil {
+				return result.Error
+			}
+			if len(cycle) > 0 {
+				return ErrCategoryCycle
+			}
+		}
+
+		category.ParentID = parentID
+		return tx.Exec("UPDATE categories SET parentid = ? WHERE categoryid = ?", parentID, categoryID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return category, nil
+}
+
+func (r *shopRepo) getCategoryDependents(categoryID int) (*CategoryDependents, error) {
+	var dependents *CategoryDependents
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		dependents, err = countCategoryDependents(tx, categoryID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dependents, nil
+}
+
+func countCategoryDependents(tx *gorm.DB, categoryID int) (*CategoryDependents, error) {
+	var count int64
+	result := tx.Table("categories").Where("categoryid = ?", categoryID).Count(&count)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if count == 0 {
+		return nil, ErrCategoryNotFound
+	}
+
+	dependents := &CategoryDependents{CategoryID: categoryID}
+	counts := []struct {
+		count *int64
+		query *gorm.DB
+	}{
+		{&dependents.Items, tx.Table("items").Where("categoryid = ?", categoryID)},
+		{&dependents.Subcategories, tx.Table("categories").Where("parentid = ?", categoryID)},
+		{&dependents.Promotions, tx.Table("promotions").Where("scope = ? AND targetid = ?", ScopeCategory, categoryID)},
+		{&dependents.Coupons, tx.Table("coupons").Where("? = ANY(categoryids)", categoryID)},
+	}
+	for _, c := range counts {
+		if err := c.query.Count(c.count).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return dependents, nil
+}
+
+// deleteCategory holds the same table lock as moveCategory, so the subtree it
+// reassigns or cascades over can't change underneath it.
+func (r *shopRepo) deleteCategory(categoryID int, options DeleteOptions) (*CategoryDependents, error) {
+	var dependents *CategoryDependents
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+
+		var err error
+		dependents, err = countCategoryDependents(tx, categoryID)
+		if err != nil {
+			return err
+		}
+
+		switch options.Mode {
+		case DeleteAbort:
+			if !dependents.none() {
+				return ErrHasDependents
+			}
+		case DeleteReassign:
+			err = reassignCategory(tx, categoryID, options.ReassignTo)
+		case DeleteCascade:
+			err = cascadeCategory(tx, categoryID)
+		}
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec("DELETE FROM categories WHERE categoryid = ?", categoryID).Error
+	})
+	if err != nil {
+		return dependents, err
+	}
+
+	return dependents, nil
+}
+
+// reassignCategory moves a category's items, subcategories and deals over to
+// another category, which can't be in the subtree being deleted.
+func reassignCategory(tx *gorm.DB, categoryID, targetID int) error {
+	var count int64
+	result := tx.Table("categories").Where("categoryid = ?", targetID).Count(&count)
+	if result.Error != nil {
+		return result.Error
+	}
+	if count == 0 {
+		return ErrCategoryNotFound
+	}
+
+	var cycle []struct {
+		CategoryID int `gorm:"column:categoryid"`
+	}
+	result = tx.Raw(categorySubtree+"SELECT categoryid FROM subtree WHERE categoryid = ?", categoryID, targetID).Scan(&cycle)
+	if result.Error != nil {
+		return result.Error
+	}
+	if len(cycle) > 0 {
+		return ErrCategoryCycle
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE items SET categoryid = ? WHERE categoryid = ?", []interface{}{targetID, categoryID}},
+		{"UPDATE categories SET parentid = ? WHERE parentid = ?", []interface{}{targetID, categoryID}},
+		{"UPDATE promotions SET targetid = ? WHERE scope = ? AND targetid = ?", []interface{}{targetID, ScopeCategory, categoryID}},
+		{"UPDATE coupons SET categoryids = array_replace(categoryids, ?, ?) WHERE ? = ANY(categoryids)", []interface{}{categoryID, targetID, categoryID}},
+	}
+	for _, st := range statements {
+		if err := tx.Exec(st.query, st.args...).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cascadeCategory deletes everything below a category along with the items
+// and deals in its subtree. The category itself is left for the caller.
+func cascadeCategory(tx *gorm.DB, categoryID int) error {
+	var categories []struct {
+		CategoryID int `gorm:"column:categoryid"`
+	}
+	result := tx.Raw(categorySubtree+"SELECT categoryid FROM subtree", categoryID).Scan(&categories)
+	if result.Error != nil {
+		return result.Error
+	}
+	subtree := make([]int, 0, len(categories))
+	for _, c := range categories {
+		subtree = append(subtree, c.CategoryID)
+	}
+
+	var items []struct {
+		ItemID int `gorm:"column:itemid"`
+	}
+	result = tx.Raw("SELECT itemid FROM items WHERE categoryid IN ?", subtree).Scan(&items)
+	if result.Error != nil {
+		return result.Error
+	}
+	itemIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ItemID)
+	}
+	if err := deleteItemsTx(tx, itemIDs); err != nil {
+		return err
+	}
+
+	result = tx.Exec("DELETE FROM promotions WHERE scope = ? AND targetid IN ?", ScopeCategory, subtree)
+	if result.Error != nil {
+		return result.Error
+	}
+	if err := pruneCouponTargets(tx, "categoryids", subtree); err != nil {
+		return err
+	}
+
+	return tx.Exec("DELETE FROM categories WHERE categoryid IN ? AND categoryid <> ?", subtree, categoryID).Error
+}
+
+// deleteItemsTx deletes items along with their variants, barcodes, stock,
+// prices and item deals, and takes them out of saved carts.
+func deleteItemsTx(tx *gorm.DB, itemIDs []int) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+
+	statements := []string{
+		"DELETE FROM stock WHERE itemid IN ?",
+		"DELETE FROM store_prices WHERE itemid IN ?",
+		"DELETE FROM price_changes WHERE itemid IN ?",
+		"DELETE FROM item_barcodes WHERE itemid IN ?",
+		"DELETE FROM item_variants WHERE itemid IN ?",
+		"DELETE FROM cart_lines WHERE itemid IN ?",
+		"DELETE FROM item_reviews WHERE itemid IN ?",
+	}
+	for _, query := range statements {
+		if err := tx.Exec(query, itemIDs).Error; err != nil {
+			return err
+		}
+	}
+
+	result := tx.Exec("DELETE FROM promotions WHERE scope = ? AND targetid IN ?", ScopeItem, itemIDs)
+	if result.Error != nil {
+		return result.Error
+	}
+	if err := pruneCouponTargets(tx, "itemids", itemIDs); err != nil {
+		return err
+	}
+
+	return tx.Exec("DELETE FROM items WHERE itemid IN ?", itemIDs).Error
+}
+
+// pruneCouponTargets takes deleted items or categories out of the coupons
+// restricted to them. A coupon left with no targets at all is ended rather
+// than widened to the whole cart.
+func pruneCouponTargets(tx *gorm.DB, column string, ids []int) error {
+	other := "categoryids"
+	if column == "categoryids" {
+		other = "itemids"
+	}
+
+	targets := make(pq.Int64Array, 0, len(ids))
+	for _, id := range ids {
+		targets = append(targets, int64(id))
+	}
+
+	query := fmt.Sprintf("UPDATE coupons SET "+
+		"%[1]s = ARRAY(SELECT unnest(%[1]s) EXCEPT SELECT unnest(?::integer[])), "+
+		"ends_at = CASE WHEN %[1]s <@ ?::integer[] AND coalesce(cardinality(%[2]s), 0) = 0 THEN least(ends_at, ?) ELSE ends_at END "+
+		"WHERE %[1]s && ?::integer[]", column, other)
+	return tx.Exec(query, targets, targets, time.Now(), targets).Error
+}
+
+func (r *shopRepo) getStoreDependents(storeID int) (*StoreDependents, error) {
+	var dependents *StoreDependents
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		dependents, err = countStoreDependents(tx, storeID, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dependents, nil
+}
+
+func countStoreDependents(tx *gorm.DB, storeID int, now time.Time) (*StoreDependents, error) {
+	var count int64
+	result := tx.Table("stores").Where("storeid = ?", storeID).Count(&count)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if count == 0 {
+		return nil, ErrStoreNotFound
+	}
+
+	dependents := &StoreDependents{StoreID: storeID}
+	counts := []struct {
+		count *int64
+		query *gorm.DB
+	}{
+		{&dependents.Stock, tx.Table("stock").Where("storeid = ?", storeID)},
+		{&dependents.Prices, tx.Table("store_prices").Where("storeid = ?", storeID)},
+		{&dependents.Promotions, tx.Table("promotions").Where("storeid = ?", storeID)},
+		{&dependents.Coupons, tx.Table("coupons").Where("storeid = ?", storeID)},
+		{&dependents.Accounts, tx.Table("accounts").Where("storeid = ?", storeID)},
+		{&dependents.Shifts, tx.Table("shifts").Where("storeid = ? AND starts_at > ?", storeID, now)},
+		{&dependents.Carts, tx.Table("carts").Where("storeid = ?", storeID)},
+		{&dependents.Orders, tx.Table("orders").Where("storeid = ? AND status IN ?", storeID, activeOrderStatuses)},
+		{&dependents.StockAdjustments, tx.Table("stock_adjustments").Where("storeid = ?", storeID)},
+		{&dependents.SlotBookings, tx.Table("slot_bookings").Where("storeid = ? AND orderid IN (SELECT orderid FROM orders WHERE status IN ?)", storeID, activeOrderStatuses)},
+		{&dependents.PickBatches, tx.Table("pick_batches").Where("storeid = ? AND status = ?", storeID, PickBatchOpen)},
+		{&dependents.Returns, tx.Table("returns").Where("storeid = ? AND refund_status IN ?", storeID, owedRefunds)},
+	}
+	for _, c := range counts {
+		if err := c.query.Count(c.count).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return dependents, nil
+}
+
+// deleteStore locks the store row first so stock can't be added to it while
+// its dependents are counted and dealt with.
+func (r *shopRepo) deleteStore(storeID int, options DeleteOptions) (*StoreDependents, error) {
+	var dependents *StoreDependents
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var stores []*Store
+		result := tx.Raw("SELECT * FROM stores WHERE storeid = ? FOR UPDATE", storeID).Scan(&stores)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(stores) == 0 {
+			return ErrStoreNotFound
+		}
+
+		now := time.Now()
+		var err error
+		dependents, err = countStoreDependents(tx, storeID, now)
+		if err != nil {
+			return err
+		}
+
+		switch options.Mode {
+		case DeleteAbort:
+			if !dependents.none() {
+				return ErrHasDependents
+			}
+		case DeleteReassign:
+			err = reassignStore(tx, stores[0], options.ReassignTo, now)
+		case DeleteCascade:
+			dependents.Cancelled, err = cascadeStore(tx, storeID, now)
+		}
+		if err != nil {
+			return err
+		}
+
+		// a store's hours and pickup slots go with it whatever the mode, and so
+		// do holds on its slots and the bookings of its finished orders
+		for _, table := range []string{"store_hours", "store_hours_exceptions", "slot_templates", "slot_bookings"} {
+			if err := tx.Exec("DELETE FROM "+table+" WHERE storeid = ?", storeID).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec("DELETE FROM stores WHERE storeid = ?", storeID).Error
+	})
+	if err != nil {
+		return dependents, err
+	}
+
+	return dependents, nil
+}
+
+// reassignStore moves a store's stock, prices, deals, staff, upcoming shifts,
+// carts and unfinished orders to another store, along with the orders' slot
+// bookings, its open pick batches, the returns it still owes refunds on and
+// its stock adjustments. Stock and prices the other store already has for
+// the same item are kept as they are there.
+func reassignStore(tx *gorm.DB, store *Store, targetID int, now time.Time) error {
+	storeID := store.StoreID
+	var stores []*Store
+	result := tx.Raw("SELECT * FROM stores WHERE storeid = ? FOR SHARE", targetID).Scan(&stores)
+	if result.Error != nil {
+		return result.Error
+	}
+	if len(stores) == 0 {
+		return ErrStoreNotFound
+	}
+	if err := reassignSlotBookings(tx, storeID, stores[0]); err != nil {
+		return err
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE stock s SET storeid = ? WHERE s.storeid = ? AND NOT EXISTS (SELECT 1 FROM stock t WHERE t.storeid = ? AND t.itemid = s.itemid AND t.variantid = s.variantid)", []interface{}{targetID, storeID, targetID}},
+		{"DELETE FROM stock WHERE storeid = ?", []interface{}{storeID}},
+		{"UPDATE stock_adjustments SET storeid = ? WHERE storeid = ?", []interface{}{targetID, storeID}},
+		{"UPDATE store_prices p SET storeid = ? WHERE p.storeid = ? AND NOT EXISTS (SELECT 1 FROM store_prices t WHERE t.storeid = ? AND t.itemid = p.itemid AND t.variantid = p.variantid)", []interface{}{targetID, storeID, targetID}},
+		{"DELETE FROM store_prices WHERE storeid = ?", []interface{}{storeID}},
+		{"UPDATE promotions SET storeid = ? WHERE storeid = ?", []interface{}{targetID, storeID}},
+		{"UPDATE coupons SET storeid = ? WHERE storeid = ?", []interface{}{targetID, storeID}},
+		{"UPDATE accounts SET storeid = ? WHERE storeid = ?", []interface{}{targetID, storeID}},
+		{"UPDATE shifts SET storeid = ? WHERE storeid = ? AND starts_at > ?", []interface{}{targetID, storeID, now}},
+		{"UPDATE carts SET storeid = ? WHERE storeid = ?", []interface{}{targetID, storeID}},
+		{"UPDATE pick_batches SET storeid = ? WHERE storeid = ? AND status = ?", []interface{}{targetID, storeID, PickBatchOpen}},
+		{"UPDATE returns SET storeid = ? WHERE storeid = ? AND refund_status IN ?", []interface{}{targetID, storeID, owedRefunds}},
+		{"UPDATE orders SET storeid = ? WHERE storeid = ? AND status IN ?", []interface{}{targetID, storeID, activeOrderStatuses}},
+	}
+	for _, st := range statements {
+		if err := tx.Exec(st.query, st.args...).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reassignSlotBookings moves the bookings of a store's unfinished orders to
+// the target store. A booking takes a place in the target's template running
+// a slot at the same time when there is one; otherwise it keeps the order's
+// pickup time without counting against any of the target's slots.
+func reassignSlotBookings(tx *gorm.DB, storeID int, target *Store) error {
+	var bookings []*SlotBooking
+	result := tx.Table("slot_bookings").Where("storeid = ? AND orderid IN (SELECT orderid FROM orders WHERE status IN ?)", storeID, activeOrderStatuses).Find(&bookings)
+	if result.Error != nil {
+		return result.Error
+	}
+	if len(bookings) == 0 {
+		return nil
+	}
+
+	var templates []*SlotTemplate
+	result = tx.Table("slot_templates").Where("storeid = ?", target.StoreID).Order("templateid").Find(&templates)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	loc := target.location()
+	for _, booking := range bookings {
+		templateID := matchingTemplate(templates, booking.StartsAt.In(loc), booking.EndsAt)
+		result := tx.Exec("UPDATE slot_bookings SET storeid = ?, templateid = ? WHERE bookingid = ?", target.StoreID, templateID, booking.BookingID)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+// matchingTemplate finds the template with a slot from startsAt to endsAt,
+// or returns 0 when there is none.
+func matchingTemplate(templates []*SlotTemplate, startsAt, endsAt time.Time) int {
+	for _, t := range templates {
+		for _, slot := range t.slotsOn(startsAt) {
+			if slot.StartsAt.Equal(startsAt) && slot.EndsAt.Equal(endsAt) {
+				return t.TemplateID
+			}
+		}
+	}
+	return 0
+}
+
+// cascadeStore deletes a store's stock and its adjustments, prices, deals and
+// upcoming shifts, cancels the orders it hasn't fulfilled and closes the
+// batches picking them. Staff are left without a store and carts are kept but
+// no longer priced at one. Returns still owed a refund are kept so the refund
+// can be retried. It returns the orders it cancelled, whose payments still
+// need settling.
+func cascadeStore(tx *gorm.DB, storeID int, now time.Time) ([]int, error) {
+	var cancelled []int
+	result := tx.Raw("SELECT orderid FROM orders WHERE storeid = ? AND status IN ? ORDER BY orderid FOR UPDATE", storeID, activeOrderStatuses).Scan(&cancelled)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM stock WHERE storeid = ?", []interface{}{storeID}},
+		{"DELETE FROM stock_adjustments WHERE storeid = ?", []interface{}{storeID}},
+		{"DELETE FROM store_prices WHERE storeid = ?", []interface{}{storeID}},
+		{"DELETE FROM promotions WHERE storeid = ?", []interface{}{storeID}},
+		{"UPDATE carts SET coupon_code = '' WHERE coupon_code IN (SELECT code FROM coupons WHERE storeid = ?)", []interface{}{storeID}},
+		{"DELETE FROM coupons WHERE storeid = ?", []interface{}{storeID}},
+		{"UPDATE accounts SET storeid = 0 WHERE storeid = ?", []interface{}{storeID}},
+		{"DELETE FROM shifts WHERE storeid = ? AND starts_at > ?", []interface{}{storeID, now}},
+		{"UPDATE carts SET storeid = 0 WHERE storeid = ?", []interface{}{storeID}},
+		{"INSERT INTO order_events (orderid, status, actor, note, at) SELECT orderid, ?, '', 'store closed', ? FROM orders WHERE storeid = ? AND status IN ?", []interface{}{OrderCancelled, now, storeID, activeOrderStatuses}},
+		{"DELETE FROM coupon_redemptions WHERE orderid IN (SELECT orderid FROM orders WHERE storeid = ? AND status IN ?)", []interface{}{storeID, activeOrderStatuses}},
+		{"UPDATE orders SET status = ?, updated_at = ? WHERE storeid = ? AND status IN ?", []interface{}{OrderCancelled, now, storeID, activeOrderStatuses}},
+		{"UPDATE pick_batches SET status = ?, completed_at = ? WHERE storeid = ? AND status = ?", []interface{}{PickBatchDone, now, storeID, PickBatchOpen}},
+	}
+	for _, st := range statements {
+		if err := tx.Exec(st.query, st.args...).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return cancelled, nil
+}
+
+// reviewOrder maps the review sorts to ORDER BY clauses; the review ID breaks
+// ties so pages don't overlap.
+var reviewOrder = map[string]string{
+	ReviewsNewest:  "created_at DESC, reviewid DESC",
+	ReviewsOldest:  "created_at, reviewid",
+	ReviewsHighest: "rating DESC, created_at DESC, reviewid DESC",
+	ReviewsLowest:  "rating, created_at DESC, reviewid DESC",
+}
+
+func (r *shopRepo) getReviews(query *ReviewQuery) ([]*Review, int64, error) {
+	base := r.db.Table("item_reviews").Where("status = ?", query.Status)
+	if query.ItemID != 0 {
+		base = base.Where("itemid = ?", query.ItemID)
+	}
+
+	var total int64
+	result := base.Session(&gorm.Session{}).Count(&total)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	reviews := []*Review{}
+	result = base.Session(&gorm.Session{}).Order(reviewOrder[query.Sort]).Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&reviews)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	return reviews, total, nil
+}
+
+func (r *shopRepo) getRatingTotals(itemID int) (*RatingTotals, error) {
+	var rows []struct {
+		Rating int   `gorm:"column:rating"`
+		Count  int64 `gorm:"column:count"`
+	}
+	result := r.db.Raw("SELECT rating, count(*) AS count FROM item_reviews WHERE itemid = ? AND status = ? GROUP BY rating", itemID, ReviewPublished).Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	totals := &RatingTotals{Stars: map[int]int64{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}}
+	sum := 0.0
+	for _, row := range rows {
+		totals.Stars[row.Rating] = row.Count
+		totals.Count += row.Count
+		sum += float64(row.Rating * int(row.Count))
+	}
+	if totals.Count > 0 {
+		totals.Average = roundCents(sum / float64(totals.Count))
+	}
+
+	return totals, nil
+}
+
+func (r *shopRepo) getUserReview(itemID int, username string) (*Review, error) {
+	var reviews []*Review
+	result := r.db.Table("item_reviews").Where("itemid = ? AND username = ?", itemID, username).Find(&reviews)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(reviews) == 0 {
+		return nil, ErrReviewNotFound
+	}
+
+	return reviews[0], nil
+}
+
+// addReview relies on the unique (itemid, username) index to keep to one
+// review per shopper, checking first only to give a clearer error. It locks
+// the item first so two reviews by the same shopper can't both find none
+// there before them.
+func (r *shopRepo) addReview(review *Review) (*Review, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var items []int
+		result := tx.Raw("SELECT itemid FROM items WHERE itemid = ? FOR UPDATE", review.ItemID).Scan(&items)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(items) == 0 {
+			return ErrItemNotFound
+		}
+
+		var count int64
+		result = tx.Table("item_reviews").Where("itemid = ? AND username = ?", review.ItemID, review.Username).Count(&count)
+		if result.Error != nil {
+			return result.Error
+		}
+		if count > 0 {
+			return ErrAlreadyReviewed
+		}
+
+		now := time.Now()
+		review.CreatedAt = now
+		review.UpdatedAt = now
+		return tx.Table("item_reviews").Omit("reviewid").Create(review).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+func (r *shopRepo) updateReview(review *Review) (*Review, error) {
+	var updated *Review
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var reviews []*Review
+		result := tx.Raw("SELECT * FROM item_reviews WHERE reviewid = ? AND itemid = ? FOR UPDATE", review.ReviewID, review.ItemID).Scan(&reviews)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(reviews) == 0 {
+			return ErrReviewNotFound
+		}
+		updated = reviews[0]
+		if updated.Username != review.Username {
+			return ErrNotReviewAuthor
+		}
+
+		updated.Rating = review.Rating
+		updated.Title = review.Title
+		updated.Body = review.Body
+		updated.UpdatedAt = time.Now()
+		return tx.Exec("UPDATE item_reviews SET rating = ?, title = ?, body = ?, updated_at = ? WHERE reviewid = ?", updated.Rating, updated.Title, updated.Body, updated.UpdatedAt, updated.ReviewID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+func (r *shopRepo) moderateReview(reviewID int, status, note, moderator string) (*Review, error) {
+	result := r.db.Exec("UPDATE item_reviews SET status = ?, moderation_note = ?, moderated_by = ? WHERE reviewid = ?", status, note, moderator, reviewID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrReviewNotFound
+	}
+
+	var reviews []*Review
+	result = r.db.Table("item_reviews").Where("reviewid = ?", reviewID).Find(&reviews)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(reviews) == 0 {
+		return nil, ErrReviewNotFound
+	}
+
+	return reviews[0], nil
+}
+
+func (r *shopRepo) deleteReview(reviewID int, username string) (bool, error) {
+	query := r.db.Where("reviewid = ?", reviewID)
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	result := query.Table("item_reviews").Delete(&Review{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, ErrReviewNotFound
+	}
+
+	return true, nil
+}
+
+// getBaskets lists what shoppers have shown they want: the items in their
+// saved carts, the ones they rated 4 stars or more and the ones they ordered.
+// Ratings and orders only count from since on, and only the limit most
+// recently shown interests are returned, carts being the most recent.
+func (r *shopRepo) getBaskets(since time.Time, limit int) ([]*basketLine, error) {
+	var lines []*basketLine
+	result := r.db.Raw(`SELECT username, itemid FROM (
+			SELECT username, itemid, now() AS at FROM cart_lines
+			UNION ALL SELECT username, itemid, updated_at FROM item_reviews WHERE status = ? AND rating >= 4 AND updated_at >= ?
+			UNION ALL SELECT o.username, l.itemid, o.placed_at FROM order_lines l JOIN orders o ON o.orderid = l.orderid WHERE o.status <> ? AND o.placed_at >= ?
+		) history GROUP BY username, itemid ORDER BY max(at) DESC LIMIT ?`, ReviewPublished, since, OrderCancelled, since, limit).Scan(&lines)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return lines, nil
+}
+
+func (r *shopRepo) getStockPlacements(storeID int) ([]*StockRequest, error) {
+	var stocked []*StockRequest
+	result := r.db.Raw("SELECT storeid, itemid, variantid, row, col, quantity FROM stock WHERE storeid = ?", storeID).Scan(&stocked)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return stocked, nil
+}
+
+func (r *shopRepo) getItemPlacements(itemID int) ([]*StockRequest, error) {
+	var placements []*StockRequest
+	result := r.db.Raw("SELECT storeid, itemid, variantid, row, col, quantity FROM stock WHERE itemid = ? ORDER BY storeid, variantid", itemID).Scan(&placements)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return placements, nil
+}
+
+func (r *shopRepo) getStoreHours(storeIDs []int) ([]*OpeningHours, error) {
+	var hours []*OpeningHours
+	result := r.db.Raw("SELECT storeid, weekday, opens, closes FROM store_hours WHERE storeid IN ? ORDER BY storeid, weekday, opens", storeIDs).Scan(&hours)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return hours, nil
+}
+
+// setStoreHours replaces the whole week in one go, so nobody sees it half
+// written.
+func (r *shopRepo) setStoreHours(storeID int, hours []*OpeningHours) ([]*OpeningHours, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM store_hours WHERE storeid = ?", storeID).Error; err != nil {
+			return err
+		}
+		for _, h := range hours {
+			if err := tx.Exec("INSERT INTO store_hours (storeid, weekday, opens, closes) VALUES (?, ?, ?, ?)", storeID, h.Weekday, h.Opens, h.Closes).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hours, nil
+}
+
+// getHoursExceptions returns the stores' exceptions dated from on or after.
+func (r *shopRepo) getHoursExceptions(storeIDs []int, from string) ([]*HoursException, error) {
+	var exceptions []*HoursException
+	result := r.db.Raw("SELECT storeid, to_char(date, 'YYYY-MM-DD') AS date, closed, opens, closes, note FROM store_hours_exceptions WHERE storeid IN ? AND date >= ? ORDER BY storeid, date", storeIDs, from).Scan(&exceptions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return exceptions, nil
+}
+
+func (r *shopRepo) setHoursException(exception *HoursException) (*HoursException, error) {
+	result := r.db.Exec(`INSERT INTO store_hours_exceptions (storeid, date, closed, opens, closes, note) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (storeid, date) DO UPDATE SET closed = EXCLUDED.closed, opens = EXCLUDED.opens, closes = EXCLUDED.closes, note = EXCLUDED.note`,
+		exception.StoreID, exception.Date, exception.Closed, exception.Opens, exception.Closes, exception.Note)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return exception, nil
+}
+
+func (r *shopRepo) deleteHoursException(storeID int, date string) (bool, error) {
+	result := r.db.Exec("DELETE FROM store_hours_exceptions WHERE storeid = ? AND date = ?", storeID, date)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, ErrHoursExceptionNotFound
+	}
+
+	return true, nil
+}
+
+// stockRow locks the stock row an item (variant) draws on: the variant's own
+// placement if it has one, else the item's. It is nil when the store doesn't
+// stock the item.
+func stockRow(tx *gorm.DB, storeID, itemID, variantID int) (*StockRequest, error) {
+	var rows []*StockRequest
+	result := tx.Raw("SELECT storeid, itemid, variantid, row, col, quantity FROM stock WHERE storeid = ? AND itemid = ? AND variantid IN (?, 0) ORDER BY variantid DESC LIMIT 1 FOR UPDATE", storeID, itemID, variantID).Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return rows[0], nil
+}
+
+// lockedStock is the stock rows order lines can draw on, by item and variant.
+type lockedStock map[priceKey]*StockRequest
+
+// lockStock locks every stock row of the store the lines' items have, all in
+// one statement sorted by row, so checkouts and cancellations sharing rows
+// take their locks in the same order.
+func lockStock(tx *gorm.DB, storeID int, lines []*OrderLine) (lockedStock, error) {
+	itemIDs := make([]int, 0, len(lines))
+	for _, line := range lines {
+		itemIDs = append(itemIDs, line.ItemID)
+	}
+	var rows []*StockRequest
+	result := tx.Raw("SELECT storeid, itemid, variantid, row, col, quantity FROM stock WHERE storeid = ? AND itemid IN ? ORDER BY itemid, variantid FOR UPDATE", storeID, itemIDs).Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	stock := make(lockedStock)
+	for _, row := range rows {
+		stock[priceKey{row.ItemID, row.VariantID}] = row
+	}
+	return stock, nil
+}
+
+// row is the stock row a line draws on: the variant's own placement if it has
+// one, else the item's. It is nil when the store doesn't stock the item.
+func (s lockedStock) row(itemID, variantID int) *StockRequest {
+	if row, ok := s[priceKey{itemID, variantID}]; ok {
+		return row
+	}
+	return s[priceKey{itemID, 0}]
+}
+
+// addOrder places the order, taking its pickup slot for good when it has
+// one. cart is the cart as it was priced; the order is turned down if the
+// cart has changed since.
+func (r *shopRepo) addOrder(order *Order, cart *Cart, slot *SlotBooking) (*Order, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		current, err := readCart(tx, order.Username, true)
+		if err != nil {
+			return err
+		}
+		if !current.same(cart) {
+			return ErrCartChanged
+		}
+
+		if slot != nil {
+			// the hold may have run out and the slot filled up since
+			if _, err := claimSlot(tx, slot, order.PlacedAt.Add(-slotHold)); err != nil {
+				return err
+			}
+		}
+
+		stock, err := lockStock(tx, order.StoreID, order.Lines)
+		if err != nil {
+			return err
+		}
+		shortage := &StockShortage{}
+		taken := make(map[priceKey]int)
+		for _, line := range order.Lines {
+			row := stock.row(line.ItemID, line.VariantID)
+			if row != nil && row.Quantity == nil {
+				// the store doesn't count this item, so it is never short
+				continue
+			}
+			available := 0
+			if row != nil {
+				key := priceKey{row.ItemID, row.VariantID}
+				available = *row.Quantity - taken[key]
+				if available >= line.Quantity {
+					taken[key] += line.Quantity
+					continue
+				}
+			}
+			shortage.Lines = append(shortage.Lines, &ShortLine{ItemID: line.ItemID, VariantID: line.VariantID, Name: line.Name, Requested: line.Quantity, Available: available})
+		}
+		if len(shortage.Lines) > 0 {
+			return shortage
+		}
+		for key, quantity := range taken {
+			result := tx.Exec("UPDATE stock SET quantity = quantity - ? WHERE storeid = ? AND itemid = ? AND variantid = ?", quantity, order.StoreID, key.itemID, key.variantID)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if err := tx.Table("orders").Omit("orderid").Create(order).Error; err != nil {
+			return err
+		}
+		for _, line := range order.Lines {
+			line.OrderID = order.OrderID
+			if err := tx.Table("order_lines").Create(line).Error; err != nil {
+				return err
+			}
+		}
+		event := &OrderEvent{OrderID: order.OrderID, Status: OrderPlaced, Actor: order.Username, At: order.PlacedAt}
+		if err := tx.Table("order_events").Create(event).Error; err != nil {
+			return err
+		}
+		order.History = []*OrderEvent{event}
+		if slot != nil {
+			if err := tx.Exec("UPDATE slot_bookings SET orderid = ? WHERE bookingid = ?", order.OrderID, slot.BookingID).Error; err != nil {
+				return err
+			}
+		}
+
+		// the coupon's use now belongs to the order; one that no longer
+		// applied is given back
+		if order.CouponCode != "" {
+			if err := tx.Exec("UPDATE coupon_redemptions SET orderid = ? WHERE username = ? AND orderid IS NULL", order.OrderID, order.Username).Error; err != nil {
+				return err
+			}
+		}
+		for _, stmt := range []string{
+			"DELETE FROM coupon_redemptions WHERE username = ? AND orderid IS NULL",
+			"DELETE FROM cart_lines WHERE username = ?",
+			"DELETE FROM carts WHERE username = ?",
+		} {
+			if err := tx.Exec(stmt, order.Username).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (r *shopRepo) getOrder(orderID int) (*Order, error) {
+	var orders []*Order
+	result := r.db.Table("orders").Where("orderid = ?", orderID).Find(&orders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(orders) == 0 {
+		return nil, ErrOrderNotFound
+	}
+
+	order := orders[0]
+	result = r.db.Table("order_lines").Where("orderid = ?", orderID).Order("position").Find(&order.Lines)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = r.db.Table("order_events").Where("orderid = ?", orderID).Order("at").Find(&order.History)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return order, nil
+}
+
+func (r *shopRepo) getOrders(query *OrderQuery) ([]*Order, int64, error) {
+	base := r.db.Table("orders")
+	if query.Username != "" {
+		base = base.Where("username = ?", query.Username)
+	}
+	if query.StoreID != 0 {
+		base = base.Where("storeid = ?", query.StoreID)
+	}
+	switch {
+	case query.Status != "":
+		base = base.Where("status = ?", query.Status)
+	case query.Queue:
+		base = base.Where("status IN ?", activeOrderStatuses)
+	}
+
+	var total int64
+	result := base.Session(&gorm.Session{}).Count(&total)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	order := "placed_at DESC, orderid DESC"
+	if query.Queue {
+		order = "placed_at, orderid"
+	}
+	orders := []*Order{}
+	result = base.Session(&gorm.Session{}).Order(order).Limit(query.PageSize).Offset((query.Page - 1) * query.PageSize).Find(&orders)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	return orders, total, nil
+}
+
+// updateOrderStatus moves an order on from the status it was loaded in,
+// failing with ErrOrderChanged if someone else moved it first. A cancelled
+// order's stock, or what was picked for it, goes back on the shelf and its
+// coupon use is given back.
+func (r *shopRepo) updateOrderStatus(from string, event *OrderEvent) (*Order, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("UPDATE orders SET status = ?, updated_at = ? WHERE orderid = ? AND status = ?", event.Status, event.At, event.OrderID, from)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrOrderChanged
+		}
+		if err := tx.Table("order_events").Create(event).Error; err != nil {
+			return err
+		}
+		if err := closePickedBatches(tx, event.OrderID, event.At); err != nil {
+			return err
+		}
+		if event.Status != OrderCancelled {
+			return nil
+		}
+
+		var order Order
+		if err := tx.Table("orders").Where("orderid = ?", event.OrderID).Take(&order).Error; err != nil {
+			return err
+		}
+		var lines []*OrderLine
+		if err := tx.Table("order_lines").Where("orderid = ?", event.OrderID).Find(&lines).Error; err != nil {
+			return err
+		}
+		lines, err := pickedLines(tx, event.OrderID, lines)
+		if err != nil {
+			return err
+		}
+		stock, err := lockStock(tx, order.StoreID, lines)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			row := stock.row(line.ItemID, line.VariantID)
+			if row == nil {
+				// the store has stopped stocking it
+				continue
+			}
+			result := tx.Exec("UPDATE stock SET quantity = quantity + ? WHERE storeid = ? AND itemid = ? AND variantid = ?", line.Quantity, order.StoreID, row.ItemID, row.VariantID)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if err := tx.Exec("DELETE FROM slot_bookings WHERE orderid = ?", event.OrderID).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM coupon_redemptions WHERE orderid = ?", event.OrderID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getOrder(event.OrderID)
+}
+
+func (r *shopRepo) getPayments(orderID int) ([]*Payment, error) {
+	payments := []*Payment{}
+	result := r.db.Table("payments").Where("orderid = ?", orderID).Order("created_at DESC, paymentid DESC").Find(&payments)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return payments, nil
+}
+
+// addPayment locks the order so two attempts can't both pay for it.
+func (r *shopRepo) addPayment(payment *Payment) (*Payment, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var orders []*Order
+		result := tx.Raw("SELECT * FROM orders WHERE orderid = ? FOR UPDATE", payment.OrderID).Scan(&orders)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(orders) == 0 {
+			return ErrOrderNotFound
+		}
+
+		if isLivePayment(payment.Status) {
+			if orders[0].Status != OrderPlaced {
+				return invalid("a %s order cannot be paid for", orders[0].Status)
+			}
+			var live int64
+			result = tx.Table("payments").Where("orderid = ? AND status IN ?", payment.OrderID, livePayments).Count(&live)
+			if result.Error != nil {
+				return result.Error
+			}
+			if live > 0 {
+				return ErrAlreadyPaid
+			}
+		}
+
+		return tx.Table("payments").Omit("paymentid").Create(payment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+func (r *shopRepo) syncPayment(payment *Payment) (*Payment, error) {
+	result := r.db.Exec("UPDATE payments SET status = ?, captured = ?, refunded = ?, transaction_at = ?, updated_at = ? WHERE provider = ? AND transaction_id = ? AND transaction_at <= ?",
+		payment.Status, payment.Captured, payment.Refunded, payment.TransactionAt, payment.UpdatedAt, payment.Provider, payment.TransactionID, payment.TransactionAt)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var payments []*Payment
+	result = r.db.Table("payments").Where("provider = ? AND transaction_id = ?", payment.Provider, payment.TransactionID).Find(&payments)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(payments) == 0 {
+		return nil, ErrPaymentNotFound
+	}
+
+	return payments[0], nil
+}
+
+func (r *shopRepo) setSettleError(orderID int, message string, at time.Time) error {
+	result := r.db.Exec("UPDATE payments SET settle_error = ?, updated_at = ? WHERE orderid = ? AND status IN ?", message, at, orderID, livePayments)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPaymentNotFound
+	}
+
+	return nil
+}
+
+func (r *shopRepo) getSlotTemplates(storeID int) ([]*SlotTemplate, error) {
+	templates := []*SlotTemplate{}
+	result := r.db.Table("slot_templates").Where("storeid = ?", storeID).Order("weekday, opens, templateid").Find(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return templates, nil
+}
+
+func (r *shopRepo) getSlotTemplate(templateID int) (*SlotTemplate, error) {
+	var templates []*SlotTemplate
+	result := r.db.Table("slot_templates").Where("templateid = ?", templateID).Find(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(templates) == 0 {
+		return nil, ErrSlotTemplateNotFound
+	}
+
+	return templates[0], nil
+}
+
+func (r *shopRepo) addSlotTemplate(template *SlotTemplate) (*SlotTemplate, error) {
+	result := r.db.Table("slot_templates").Omit("templateid").Create(template)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return template, nil
+}
+
+func (r *shopRepo) updateSlotTemplate(template *SlotTemplate) (*SlotTemplate, error) {
+	result := r.db.Exec("UPDATE slot_templates SET weekday = ?, opens = ?, closes = ?, duration = ?, capacity = ? WHERE templateid = ? AND storeid = ?",
+		template.Weekday, template.Opens, template.Closes, template.Duration, template.Capacity, template.TemplateID, template.StoreID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrSlotTemplateNotFound
+	}
+
+	return template, nil
+}
+
+func (r *shopRepo) deleteSlotTemplate(storeID, templateID int) (bool, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM slot_templates WHERE templateid = ? AND storeid = ?", templateID, storeID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrSlotTemplateNotFound
+		}
+		return tx.Exec("DELETE FROM slot_bookings WHERE templateid = ? AND orderid IS NULL", templateID).Error
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// liveBookings are the places taken in slots: those of orders, and holds
+// made after heldSince.
+const liveBookings = "(orderid IS NOT NULL OR held_at > ?)"
+
+// getSlotBookingCounts counts the places taken in a store's slots starting
+// from from until to.
+func (r *shopRepo) getSlotBookingCounts(storeID int, from, to, heldSince time.Time) (map[slotKey]int, error) {
+	var rows []struct {
+		TemplateID int       `gorm:"column:templateid"`
+		StartsAt   time.Time `gorm:"column:starts_at"`
+		Booked     int       `gorm:"column:booked"`
+	}
+	result := r.db.Raw("SELECT templateid, starts_at, count(*) AS booked FROM slot_bookings WHERE storeid = ? AND starts_at >= ? AND starts_at < ? AND "+liveBookings+" GROUP BY templateid, starts_at",
+		storeID, from, to, heldSince).Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	counts := make(map[slotKey]int)
+	for _, row := range rows {
+		counts[slotKey{row.TemplateID, row.StartsAt.Unix()}] = row.Booked
+	}
+	return counts, nil
+}
+
+// claimSlot takes a place in a slot for the booking's shopper, in place of
+// the hold they had. The slot's template row is locked while its places are
+// counted, so two shoppers can't both take its last place.
+func claimSlot(tx *gorm.DB, booking *SlotBooking, heldSince time.Time) (*SlotBooking, error) {
+	var templates []*SlotTemplate
+	result := tx.Raw("SELECT * FROM slot_templates WHERE templateid = ? FOR UPDATE", booking.TemplateID).Scan(&templates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(templates) == 0 {
+		return nil, ErrSlotNotFound
+	}
+
+	var taken int64
+	result = tx.Table("slot_bookings").
+		Where("templateid = ? AND starts_at = ? AND "+liveBookings, booking.TemplateID, booking.StartsAt, heldSince).
+		Where("NOT (username = ? AND orderid IS NULL)", booking.Username).
+		Count(&taken)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if taken >= int64(templates[0].Capacity) {
+		return nil, ErrSlotFull
+	}
+
+	if err := tx.Exec("DELETE FROM slot_bookings WHERE username = ? AND orderid IS NULL", booking.Username).Error; err != nil {
+		return nil, err
+	}
+	booking.BookingID, booking.OrderID = 0, nil
+	if err := tx.Table("slot_bookings").Omit("bookingid").Create(booking).Error; err != nil {
+		return nil, err
+	}
+
+	return booking, nil
+}
+
+func (r *shopRepo) reserveSlot(booking *SlotBooking, heldSince time.Time) (*SlotBooking, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		booking, err = claimSlot(tx, booking, heldSince)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return booking, nil
+}
+
+// getSlotReservation returns the slot a shopper has held since heldSince and
+// not yet checked out with.
+func (r *shopRepo) getSlotReservation(username string, heldSince time.Time) (*SlotBooking, error) {
+	var bookings []*SlotBooking
+	result := r.db.Table("slot_bookings").Where("username = ? AND orderid IS NULL AND held_at > ?", username, heldSince).Order("held_at DESC").Limit(1).Find(&bookings)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(bookings) == 0 {
+		return nil, ErrNoReservation
+	}
+
+	return bookings[0], nil
+}
+
+func (r *shopRepo) releaseSlot(username string) (bool, error) {
+	result := r.db.Exec("DELETE FROM slot_bookings WHERE username = ? AND orderid IS NULL", username)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, ErrNoReservation
+	}
+
+	return true, nil
+}
+
+// getSlotOrders returns a store's orders for the slot starting at startsAt
+// that are still to be picked, with their lines.
+func (r *shopRepo) getSlotOrders(storeID int, startsAt time.Time) ([]*Order, error) {
+	orders := []*Order{}
+	result := r.db.Table("orders").Where("storeid = ? AND slot_start = ? AND status IN ?", storeID, startsAt, []string{OrderPlaced, OrderPicking}).Order("placed_at, orderid").Find(&orders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(orders) == 0 {
+		return orders, nil
+	}
+
+	ids := make([]int, 0, len(orders))
+	byID := make(map[int]*Order)
+	for _, order := range orders {
+		ids = append(ids, order.OrderID)
+		byID[order.OrderID] = order
+	}
+	var lines []*OrderLine
+	result = r.db.Table("order_lines").Where("orderid IN ?", ids).Order("orderid, position").Find(&lines)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for _, line := range lines {
+		byID[line.OrderID].Lines = append(byID[line.OrderID].Lines, line)
+	}
+
+	return orders, nil
+}
+
+// pickedLines is what an order's lines put back on the shelves: what was
+// picked of each line once it has been, the substitute in its place. What
+// wasn't picked went back when the line was.
+func pickedLines(tx *gorm.DB, orderID int, lines []*OrderLine) ([]*OrderLine, error) {
+	var picks []*PickLine
+	result := tx.Table("pick_lines").Where("orderid = ? AND status <> ?", orderID, PickPending).Find(&picks)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	byPosition := make(map[int]*PickLine)
+	for _, pick := range picks {
+		byPosition[pick.Position] = pick
+	}
+
+	restock := make([]*OrderLine, 0, len(lines))
+	for _, line := range lines {
+		pick, ok := byPosition[line.Position]
+		if !ok {
+			restock = append(restock, line)
+			continue
+		}
+		back := *line
+		back.Quantity = pick.Picked
+		if pick.Status == PickSubstituted {
+			back.ItemID, back.VariantID = pick.SubstituteItemID, pick.SubstituteVariantID
+		}
+		restock = append(restock, &back)
+	}
+	return restock, nil
+}
+
+// closePickedBatches marks done the open batches an order is in once none
+// of their orders still being picked has a line left to pick.
+func closePickedBatches(tx *gorm.DB, orderID int, now time.Time) error {
+	return tx.Exec(`UPDATE pick_batches b SET status = ?, completed_at = ?
+		WHERE b.status = ? AND b.batchid IN (SELECT batchid FROM pick_lines WHERE orderid = ?)
+		AND NOT EXISTS (SELECT 1 FROM pick_lines l JOIN orders o ON o.orderid = l.orderid WHERE l.batchid = b.batchid AND l.status = ? AND o.status = ?)`,
+		PickBatchDone, now, PickBatchOpen, orderID, PickPending, OrderPicking).Error
+}
+
+// addPickBatch locks the orders so none of them is cancelled or batched
+// twice while the batch is made, moves them on to picking and copies their
+// lines to pick.
+func (r *shopRepo) addPickBatch(batch *PickBatch, orderIDs []int) (*PickBatch, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var orders []*Order
+		result := tx.Raw("SELECT * FROM orders WHERE orderid IN ? ORDER BY orderid FOR UPDATE", orderIDs).Scan(&orders)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(orders) != len(orderIDs) {
+			return ErrOrderNotFound
+		}
+		for _, order := range orders {
+			if order.StoreID != batch.StoreID || order.Status != OrderPlaced {
+				return ErrOrderChanged
+			}
+		}
+
+		if err := tx.Table("pick_batches").Omit("batchid").Create(batch).Error; err != nil {
+			return err
+		}
+		for _, order := range orders {
+			result := tx.Exec("UPDATE orders SET status = ?, updated_at = ? WHERE orderid = ?", OrderPicking, batch.CreatedAt, order.OrderID)
+			if result.Error != nil {
+				return result.Error
+			}
+			event := &OrderEvent{OrderID: order.OrderID, Status: OrderPicking, Actor: batch.Picker, Note: fmt.Sprintf("batch %d", batch.BatchID), At: batch.CreatedAt}
+			if err := tx.Table("order_events").Create(event).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec(`INSERT INTO pick_lines (batchid, orderid, position, itemid, variantid, name, quantity, status, picked)
+			SELECT ?, orderid, position, itemid, variantid, name, quantity, ?, 0 FROM order_lines WHERE orderid IN ?`, batch.BatchID, PickPending, orderIDs).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getPickBatch(batch.BatchID)
+}
+
+func (r *shopRepo) getPickBatch(batchID int) (*PickBatch, error) {
+	var batches []*PickBatch
+	result := r.db.Table("pick_batches").Where("batchid = ?", batchID).Find(&batches)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(batches) == 0 {
+		return nil, ErrPickBatchNotFound
+	}
+
+	batch := batches[0]
+	result = r.db.Table("pick_lines").Where("batchid = ?", batchID).Order("orderid, position").Find(&batch.Lines)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return batch, nil
+}
+
+func (r *shopRepo) getPickBatches(storeID int, status string) ([]*PickBatch, error) {
+	query := r.db.Table("pick_batches").Where("storeid = ?", storeID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	batches := []*PickBatch{}
+	result := query.Order("created_at DESC, batchid DESC").Find(&batches)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return batches, nil
+}
+
+// pickLine records a line as picked, short or substituted. The batch, line
+// and order are locked in that order, so the line can be corrected while the
+// order is still being picked but not once it has moved on. A substitute is
+// taken off the shelf, and one the line had before put back; what checkout
+// took of the line's own item but wasn't picked goes back too.
+func (r *shopRepo) pickLine(line *PickLine) (*PickBatch, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var batches []*PickBatch
+		result := tx.Raw("SELECT * FROM pick_batches WHERE batchid = ? FOR UPDATE", line.BatchID).Scan(&batches)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(batches) == 0 {
+			return ErrPickBatchNotFound
+		}
+		batch := batches[0]
+		if batch.Status != PickBatchOpen {
+			return ErrPickBatchDone
+		}
+
+		var lines []*PickLine
+		result = tx.Raw("SELECT * FROM pick_lines WHERE lineid = ? AND batchid = ? FOR UPDATE", line.LineID, line.BatchID).Scan(&lines)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(lines) == 0 {
+			return ErrPickLineNotFound
+		}
+		previous := lines[0]
+
+		var orders []*Order
+		result = tx.Raw("SELECT * FROM orders WHERE orderid = ? FOR UPDATE", previous.OrderID).Scan(&orders)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(orders) == 0 {
+			return ErrOrderNotFound
+		}
+		if orders[0].Status != OrderPicking {
+			return invalid("order %d is %s and can no longer be picked", previous.OrderID, orders[0].Status)
+		}
+
+		adjustments := []struct {
+			pick  *PickLine
+			delta int
+		}{{previous, 1}, {line, -1}}
+		for _, a := range adjustments {
+			if a.pick.Status != PickSubstituted {
+				continue
+			}
+			row, err := stockRow(tx, batch.StoreID, a.pick.SubstituteItemID, a.pick.SubstituteVariantID)
+			if err != nil {
+				return err
+			}
+			if row == nil || row.Quantity == nil {
+				continue
+			}
+			result := tx.Exec("UPDATE stock SET quantity = greatest(quantity + ?, 0) WHERE storeid = ? AND itemid = ? AND variantid = ?", a.delta*a.pick.Picked, batch.StoreID, row.ItemID, row.VariantID)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		if restock := line.shortfall() - previous.shortfall(); restock != 0 {
+			row, err := stockRow(tx, batch.StoreID, previous.ItemID, previous.VariantID)
+			if err != nil {
+				return err
+			}
+			if row != nil && row.Quantity != nil {
+				result := tx.Exec("UPDATE stock SET quantity = greatest(quantity + ?, 0) WHERE storeid = ? AND itemid = ? AND variantid = ?", restock, batch.StoreID, row.ItemID, row.VariantID)
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+		}
+
+		result = tx.Exec(`UPDATE pick_lines SET status = ?, picked = ?, substitute_itemid = ?, substitute_variantid = ?, substitute_name = ?, note = ?, picked_by = ?, picked_at = ? WHERE lineid = ?`,
+			line.Status, line.Picked, line.SubstituteItemID, line.SubstituteVariantID, line.SubstituteName, line.Note, line.PickedBy, line.PickedAt, line.LineID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		// the order is ready once all its lines are dealt with
+		var orderLines []*PickLine
+		result = tx.Table("pick_lines").Where("batchid = ? AND orderid = ?", line.BatchID, previous.OrderID).Find(&orderLines)
+		if result.Error != nil {
+			return result.Error
+		}
+		progress := &PickProgress{}
+		for _, l := range orderLines {
+			progress.count(l.Status)
+		}
+		if progress.Pending == 0 {
+			order := orders[0]
+			if err := tx.Table("order_lines").Where("orderid = ?", order.OrderID).Find(&order.Lines).Error; err != nil {
+				return err
+			}
+			result := tx.Exec("UPDATE orders SET status = ?, picked_total = ?, updated_at = ? WHERE orderid = ?", OrderReady, pickedTotal(order, orderLines), *line.PickedAt, order.OrderID)
+			if result.Error != nil {
+				return result.Error
+			}
+			event := &OrderEvent{OrderID: previous.OrderID, Status: OrderReady, Actor: line.PickedBy, Note: progress.summary(line.BatchID), At: *line.PickedAt}
+			if err := tx.Table("order_events").Create(event).Error; err != nil {
+				return err
+			}
+		}
+
+		return closePickedBatches(tx, previous.OrderID, *line.PickedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getPickBatch(line.BatchID)
+}
+
+// adjustStock changes a store's count of an item and records why. It reports
+// false, changing nothing, when the store doesn't stock the item or keeps no
+// count of it.
+func adjustStock(tx *gorm.DB, adjustment *StockAdjustment) (bool, error) {
+	row, err := stockRow(tx, adjustment.StoreID, adjustment.ItemID, adjustment.VariantID)
+	if err != nil {
+		return false, err
+	}
+	if row == nil || row.Quantity == nil {
+		return false, nil
+	}
+
+	result := tx.Exec("UPDATE stock SET quantity = greatest(quantity + ?, 0) WHERE storeid = ? AND itemid = ? AND variantid = ?", adjustment.Delta, adjustment.StoreID, row.ItemID, row.VariantID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	adjustment.VariantID = row.VariantID
+	if err := tx.Table("stock_adjustments").Create(adjustment).Error; err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// addReturn locks the order so two returns can't both take back the last of
+// a line. Each line can come back up to what was picked of it, less what
+// earlier returns took back.
+func (r *shopRepo) addReturn(ret *Return) (*Return, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var orders []*Order
+		result := tx.Raw("SELECT * FROM orders WHERE orderid = ? FOR UPDATE", ret.OrderID).Scan(&orders)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(orders) == 0 {
+			return ErrOrderNotFound
+		}
+		if orders[0].Status != OrderCompleted {
+			return ErrNotReturnable
+		}
+
+		var lines []*OrderLine
+		if err := tx.Table("order_lines").Where("orderid = ?", ret.OrderID).Find(&lines).Error; err != nil {
+			return err
+		}
+		received, err := pickedLines(tx, ret.OrderID, lines)
+		if err != nil {
+			return err
+		}
+		byPosition := make(map[int]*OrderLine)
+		for _, line := range received {
+			byPosition[line.Position] = line
+		}
+
+		var returned []struct {
+			Position int `gorm:"column:position"`
+			Quantity int `gorm:"column:quantity"`
+		}
+		result = tx.Raw("SELECT l.position, sum(l.quantity) AS quantity FROM return_lines l JOIN returns r ON r.returnid = l.returnid WHERE r.orderid = ? GROUP BY l.position", ret.OrderID).Scan(&returned)
+		if result.Error != nil {
+			return result.Error
+		}
+		taken := make(map[int]int)
+		for _, row := range returned {
+			taken[row.Position] = row.Quantity
+		}
+
+		for _, line := range ret.Lines {
+			got, ok := byPosition[line.Position]
+			if !ok {
+				return invalid("%s is not on the order", line.Name)
+			}
+			if left := got.Quantity - taken[line.Position]; line.Quantity > left {
+				return invalid("%s: only %d left to return", line.Name, left)
+			}
+			line.RestockItemID, line.RestockVariantID = got.ItemID, got.VariantID
+		}
+
+		if err := tx.Table("returns").Omit("returnid").Create(ret).Error; err != nil {
+			return err
+		}
+		for _, line := range ret.Lines {
+			line.ReturnID = ret.ReturnID
+			if line.Condition == ConditionSellable {
+				line.Restocked, err = adjustStock(tx, &StockAdjustment{
+					StoreID:   ret.StoreID,
+					ItemID:    line.RestockItemID,
+					VariantID: line.RestockVariantID,
+					Delta:     line.Quantity,
+					Reason:    "return",
+					Reference: fmt.Sprintf("return %d", ret.ReturnID),
+					Actor:     ret.RecordedBy,
+					At:        ret.CreatedAt,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if err := tx.Table("return_lines").Create(line).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (r *shopRepo) attachReturnLines(returns []*Return) error {
+	if len(returns) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(returns))
+	byID := make(map[int]*Return)
+	for _, ret := range returns {
+		ids = append(ids, ret.ReturnID)
+		byID[ret.ReturnID] = ret
+	}
+	var lines []*ReturnLine
+	result := r.db.Table("return_lines").Where("returnid IN ?", ids).Order("returnid, position").Find(&lines)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, line := range lines {
+		byID[line.ReturnID].Lines = append(byID[line.ReturnID].Lines, line)
+	}
+
+	return nil
+}
+
+func (r *shopRepo) getReturns(orderID int) ([]*Return, error) {
+	returns := []*Return{}
+	result := r.db.Table("returns").Where("orderid = ?", orderID).Order("created_at, returnid").Find(&returns)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if err := r.attachReturnLines(returns); err != nil {
+		return nil, err
+	}
+
+	return returns, nil
+}
+
+func (r *shopRepo) getReturn(returnID int) (*Return, error) {
+	var returns []*Return
+	result := r.db.Table("returns").Where("returnid = ?", returnID).Find(&returns)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(returns) == 0 {
+		return nil, ErrReturnNotFound
+	}
+	if err := r.attachReturnLines(returns); err != nil {
+		return nil, err
+	}
+
+	return returns[0], nil
+}
+
+// setReturnRefund never moves a refunded return back, in case a retry and
+// its first attempt finish out of order.
+func (r *shopRepo) setReturnRefund(ret *Return) (*Return, error) {
+	result := r.db.Exec("UPDATE returns SET refund_status = ?, refund_error = ?, transaction_id = ?, refunded_at = ? WHERE returnid = ? AND refund_status <> ?",
+		ret.RefundStatus, ret.RefundError, ret.TransactionID, ret.RefundedAt, ret.ReturnID, RefundIssued)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return r.getReturn(ret.ReturnID)
+}
+
+// getReturnsReport sums up a store's returns made from from until to.
+func (r *shopRepo) getReturnsReport(storeID int, from, to time.Time) (*ReturnsReport, error) {
+	report := &ReturnsReport{ByReason: []*ReturnsTotal{}, ByItem: []*ReturnsTotal{}}
+	result := r.db.Raw(`SELECT count(*) AS returns,
+		coalesce(sum(refund) FILTER (WHERE refund_status = ?), 0) AS refunded,
+		coalesce(sum(refund) FILTER (WHERE refund_status IN ?), 0) AS pending
+		FROM returns WHERE storeid = ? AND created_at >= ? AND created_at < ?`,
+		RefundIssued, []string{RefundPending, RefundFailed}, storeID, from, to).Scan(report)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	lines := "FROM return_lines l JOIN returns r ON r.returnid = l.returnid WHERE r.storeid = ? AND r.created_at >= ? AND r.created_at < ?"
+	result = r.db.Raw("SELECT coalesce(sum(l.quantity), 0) AS units, coalesce(sum(l.quantity) FILTER (WHERE l.restocked), 0) AS restocked "+lines, storeID, from, to).Scan(report)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = r.db.Raw("SELECT l.reason, sum(l.quantity) AS units, sum(l.refund) AS refund "+lines+" GROUP BY l.reason ORDER BY units DESC, l.reason", storeID, from, to).Scan(&report.ByReason)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = r.db.Raw("SELECT l.itemid, l.variantid, min(l.name) AS name, sum(l.quantity) AS units, sum(l.refund) AS refund "+lines+" GROUP BY l.itemid, l.variantid ORDER BY units DESC, refund DESC LIMIT ?", storeID, from, to, maxReportItems).Scan(&report.ByItem)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return report, nil
+}
@@ -0,0 +1,323 @@
+package shop
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReturnNotFound = errors.New("return not found")
+	ErrNotReturnable  = errors.New("only collected orders can be returned")
+)
+
+// Why a line came back.
+const (
+	ReturnDamaged        = "damaged"
+	ReturnWrongItem      = "wrong_item"
+	ReturnNotAsDescribed = "not_as_described"
+	ReturnExpired        = "expired"
+	ReturnUnwanted       = "unwanted"
+	ReturnOther          = "other"
+)
+
+var ReturnReasons = []string{ReturnDamaged, ReturnWrongItem, ReturnNotAsDescribed, ReturnExpired, ReturnUnwanted, ReturnOther}
+
+// What state a returned line came back in. Only sellable lines go back on
+// the shelf.
+const (
+	ConditionSellable = "sellable"
+	ConditionOpened   = "opened"
+	ConditionDamaged  = "damaged"
+)
+
+var ReturnConditions = []string{ConditionSellable, ConditionOpened, ConditionDamaged}
+
+// Where a return's refund is. It is none when there was nothing to give
+// back, and failed until staff try it again.
+const (
+	RefundPending = "pending"
+	RefundIssued  = "refunded"
+	RefundFailed  = "failed"
+	RefundNone    = "none"
+)
+
+// owedRefunds are the refund states of returns not yet paid back.
+var owedRefunds = []string{RefundPending, RefundFailed}
+
+// Return is lines of a collected order brought back to its store, and what
+// was refunded for them. An order can be returned in several goes, up to
+// what the shopper took home of each line.
+type Return struct {
+	ReturnID      int           `json:"returnID" gorm:"primaryKey;column:returnid"`
+	OrderID       int           `json:"orderID" gorm:"column:orderid"`
+	StoreID       int           `json:"storeID" gorm:"column:storeid"`
+	RecordedBy    string        `json:"recordedBy" gorm:"column:recorded_by"`
+	Note          string        `json:"note,omitempty" gorm:"column:note"`
+	Refund        float64       `json:"refund" gorm:"column:refund"`
+	RefundStatus  string        `json:"refundStatus" gorm:"column:refund_status"`
+	RefundError   string        `json:"refundError,omitempty" gorm:"column:refund_error"`
+	TransactionID string        `json:"transactionID,omitempty" gorm:"column:transaction_id"`
+	CreatedAt     time.Time     `json:"createdAt" gorm:"column:created_at"`
+	RefundedAt    *time.Time    `json:"refundedAt,omitempty" gorm:"column:refunded_at"`
+	Lines         []*ReturnLine `json:"lines,omitempty" gorm:"-"`
+}
+
+// ReturnLine is some of an order line brought back. RestockItemID and
+// RestockVariantID are what went back on the shelf: the substitute when one
+// was picked in the line's place.
+type ReturnLine struct {
+	ReturnID         int     `json:"-" gorm:"column:returnid"`
+	Position         int     `json:"-" gorm:"column:position"`
+	ItemID           int     `json:"itemID" gorm:"column:itemid"`
+	VariantID        int     `json:"variantID,omitempty" gorm:"column:variantid"`
+	Name             string  `json:"name" gorm:"column:name"`
+	Quantity         int     `json:"quantity" gorm:"column:quantity"`
+	Reason           string  `json:"reason" gorm:"column:reason"`
+	Condition        string  `json:"condition" gorm:"column:condition"`
+	RestockItemID    int     `json:"restockItemID,omitempty" gorm:"column:restock_itemid"`
+	RestockVariantID int     `json:"restockVariantID,omitempty" gorm:"column:restock_variantid"`
+	Restocked        bool    `json:"restocked" gorm:"column:restocked"`
+	Refund           float64 `json:"refund" gorm:"column:refund"`
+}
+
+// ReturnRequest lists the order's lines coming back, by the item and
+// variant ordered.
+type ReturnRequest struct {
+	Lines []*ReturnLineRequest `json:"lines" binding:"required"`
+	Note  string               `json:"note"`
+}
+
+type ReturnLineRequest struct {
+	ItemID    int    `json:"itemID" binding:"required"`
+	VariantID int    `json:"variantID"`
+	Quantity  int    `json:"quantity" binding:"required"`
+	Reason    string `json:"reason" binding:"required"`
+	Condition string `json:"condition" binding:"required"`
+}
+
+// StockAdjustment is a change to a store's count of an item made other than
+// by selling it, and why.
+type StockAdjustment struct {
+	StoreID   int       `json:"storeID" gorm:"column:storeid"`
+	ItemID    int       `json:"itemID" gorm:"column:itemid"`
+	VariantID int       `json:"variantID,omitempty" gorm:"column:variantid"`
+	Delta     int       `json:"delta" gorm:"column:delta"`
+	Reason    string    `json:"reason" gorm:"column:reason"`
+	Reference string    `json:"reference,omitempty" gorm:"column:reference"`
+	Actor     string    `json:"actor" gorm:"column:actor"`
+	At        time.Time `json:"at" gorm:"column:at"`
+}
+
+// ReturnsReport sums up what came back to a store between From and To.
+type ReturnsReport struct {
+	StoreID   int             `json:"storeID"`
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Returns   int             `json:"returns"`
+	Units     int             `json:"units"`
+	Restocked int             `json:"restocked"`
+	Refunded  float64         `json:"refunded"`
+	Pending   float64         `json:"pending"`
+	ByReason  []*ReturnsTotal `json:"byReason" gorm:"-"`
+	ByItem    []*ReturnsTotal `json:"byItem" gorm:"-"`
+}
+
+// ReturnsTotal is what came back for one reason or of one item.
+type ReturnsTotal struct {
+	Reason    string  `json:"reason,omitempty" gorm:"column:reason"`
+	ItemID    int     `json:"itemID,omitempty" gorm:"column:itemid"`
+	VariantID int     `json:"variantID,omitempty" gorm:"column:variantid"`
+	Name      string  `json:"name,omitempty" gorm:"column:name"`
+	Units     int     `json:"units" gorm:"column:units"`
+	Refund    float64 `json:"refund" gorm:"column:refund"`
+}
+
+const maxReportItems = 20
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// returnLines checks the request against the order and prices each line's
+// refund: what was paid for a unit of it, tax included, times how many came
+// back.
+func (r *ReturnRequest) returnLines(order *Order) ([]*ReturnLine, error) {
+	if len(r.Lines) == 0 {
+		return nil, invalid("a return needs at least one line")
+	}
+
+	byKey := make(map[priceKey]*OrderLine)
+	for _, line := range order.Lines {
+		byKey[priceKey{line.ItemID, line.VariantID}] = line
+	}
+	seen := make(map[priceKey]bool)
+	var lines []*ReturnLine
+	for _, l := range r.Lines {
+		key := priceKey{l.ItemID, l.VariantID}
+		ordered, ok := byKey[key]
+		if !ok {
+			return nil, invalid("item %d (variant %d) is not on the order", l.ItemID, l.VariantID)
+		}
+		if seen[key] {
+			return nil, invalid("%s is listed twice", ordered.Name)
+		}
+		seen[key] = true
+		if l.Quantity < 1 {
+			return nil, invalid("%s: quantity must be at least 1", ordered.Name)
+		}
+		if !oneOf(l.Reason, ReturnReasons) {
+			return nil, invalid("unknown return reason %q, expected one of %s", l.Reason, strings.Join(ReturnReasons, ", "))
+		}
+		if !oneOf(l.Condition, ReturnConditions) {
+			return nil, invalid("unknown condition %q, expected one of %s", l.Condition, strings.Join(ReturnConditions, ", "))
+		}
+
+		paid := (ordered.Total + ordered.Tax) / float64(ordered.Quantity)
+		lines = append(lines, &ReturnLine{
+			Position:  ordered.Position,
+			ItemID:    ordered.ItemID,
+			VariantID: ordered.VariantID,
+			Name:      ordered.Name,
+			Quantity:  l.Quantity,
+			Reason:    l.Reason,
+			Condition: l.Condition,
+			Refund:    roundCents(paid * float64(l.Quantity)),
+		})
+	}
+	return lines, nil
+}
+
+// RecordReturn takes back lines of a collected order; only staff at its
+// store can record one. Sellable lines go back into the store's stock with
+// an adjustment, and the refund is left pending for the payment layer.
+func (s *shopService) RecordReturn(orderID int, request *ReturnRequest, actor *OrderActor) (*Return, error) {
+	order, err := s.db.getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.Staff || actor.StoreID != 0 && actor.StoreID != order.StoreID {
+		return nil, ErrNotYourOrder
+	}
+	if order.Status != OrderCompleted {
+		return nil, ErrNotReturnable
+	}
+
+	lines, err := request.returnLines(order)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Return{
+		OrderID:      orderID,
+		StoreID:      order.StoreID,
+		RecordedBy:   actor.Username,
+		Note:         strings.TrimSpace(request.Note),
+		RefundStatus: RefundPending,
+		CreatedAt:    time.Now(),
+		Lines:        lines,
+	}
+	for _, line := range lines {
+		ret.Refund += line.Refund
+	}
+	ret.Refund = roundCents(ret.Refund)
+	if ret.Refund == 0 {
+		ret.RefundStatus = RefundNone
+	}
+
+	ret, err = s.db.addReturn(ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (s *shopService) GetReturns(orderID int, actor *OrderActor) ([]*Return, error) {
+	order, err := s.db.getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.can(order) {
+		return nil, ErrNotYourOrder
+	}
+
+	returns, err := s.db.getReturns(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	return returns, nil
+}
+
+func (s *shopService) GetReturn(orderID, returnID int) (*Return, error) {
+	ret, err := s.db.getReturn(returnID)
+	if err != nil {
+		return nil, err
+	}
+	if ret.OrderID != orderID {
+		return nil, ErrReturnNotFound
+	}
+
+	return ret, nil
+}
+
+// SetReturnRefund records how refunding a return went: the transaction it
+// was refunded on, or why it failed.
+func (s *shopService) SetReturnRefund(ret *Return) (*Return, error) {
+	switch ret.RefundStatus {
+	case RefundIssued:
+		now := time.Now()
+		ret.RefundedAt = &now
+		ret.RefundError = ""
+	case RefundFailed:
+		ret.RefundedAt = nil
+	default:
+		return nil, invalid("a refund cannot be set to %s", ret.RefundStatus)
+	}
+
+	ret, err := s.db.setReturnRefund(ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// GetReturnsReport sums up a store's returns dated from on to to, both
+// YYYY-MM-DD and included. It covers the last 30 days by default.
+func (s *shopService) GetReturnsReport(storeID int, from, to string) (*ReturnsReport, error) {
+	if to == "" {
+		to = time.Now().Format(dateLayout)
+	}
+	end, err := time.Parse(dateLayout, to)
+	if err != nil {
+		return nil, invalid("to must be a YYYY-MM-DD date")
+	}
+	if from == "" {
+		from = end.AddDate(0, 0, -29).Format(dateLayout)
+	}
+	start, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return nil, invalid("from must be a YYYY-MM-DD date")
+	}
+	if start.After(end) {
+		return nil, invalid("from must not be after to")
+	}
+	if _, err := s.db.getStoreByID(storeID); err != nil {
+		return nil, err
+	}
+
+	report, err := s.db.getReturnsReport(storeID, start, end.AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	report.StoreID, report.From, report.To = storeID, from, to
+	return report, nil
+}
@@ -0,0 +1,62 @@
+package shop
+
+import "testing"
+
+func TestReturnLines(t *testing.T) {
+	order := &Order{
+		Lines: []*OrderLine{
+			{Position: 0, ItemID: 1, Name: "Apples", Quantity: 3, Total: 10, Tax: 1.30},
+			{Position: 1, ItemID: 2, VariantID: 5, Name: "Milk 2L", Quantity: 2, Total: 9, Tax: 0},
+			{Position: 2, ItemID: 3, Name: "Free Sample", Quantity: 1, Total: 0, Tax: 0},
+		},
+	}
+	line := func(itemID, variantID, quantity int) *ReturnLineRequest {
+		return &ReturnLineRequest{ItemID: itemID, VariantID: variantID, Quantity: quantity, Reason: ReturnDamaged, Condition: ConditionSellable}
+	}
+
+	tests := []struct {
+		name    string
+		lines   []*ReturnLineRequest
+		refunds []float64
+	}{
+		{"two of three", []*ReturnLineRequest{line(1, 0, 2)}, []float64{7.53}},
+		{"one of three", []*ReturnLineRequest{line(1, 0, 1)}, []float64{3.77}},
+		{"all of a line", []*ReturnLineRequest{line(1, 0, 3)}, []float64{11.30}},
+		{"several lines", []*ReturnLineRequest{line(2, 5, 1), line(1, 0, 3)}, []float64{4.50, 11.30}},
+		{"nothing paid", []*ReturnLineRequest{line(3, 0, 1)}, []float64{0}},
+		{"no lines", nil, nil},
+		{"listed twice", []*ReturnLineRequest{line(1, 0, 1), line(1, 0, 1)}, nil},
+		{"not on the order", []*ReturnLineRequest{line(4, 0, 1)}, nil},
+		{"another variant", []*ReturnLineRequest{line(2, 6, 1)}, nil},
+		{"no quantity", []*ReturnLineRequest{line(1, 0, 0)}, nil},
+		{"unknown reason", []*ReturnLineRequest{{ItemID: 1, Quantity: 1, Reason: "changed_mind", Condition: ConditionSellable}}, nil},
+		{"unknown condition", []*ReturnLineRequest{{ItemID: 1, Quantity: 1, Reason: ReturnDamaged, Condition: "mint"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &ReturnRequest{Lines: tt.lines}
+			lines, err := request.returnLines(order)
+			if tt.refunds == nil {
+				if err == nil {
+					t.Fatalf("returnLines = %d lines, want an error", len(lines))
+				}
+				if !IsInvalid(err) {
+					t.Errorf("returnLines = %v, want an InvalidError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("returnLines = %v", err)
+			}
+			if len(lines) != len(tt.refunds) {
+				t.Fatalf("returnLines gave %d lines, want %d", len(lines), len(tt.refunds))
+			}
+			for i, l := range lines {
+				if l.Refund != tt.refunds[i] {
+					t.Errorf("line %d refunds %.2f, want %.2f", i, l.Refund, tt.refunds[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package shop
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReviewNotFound  = errors.New("review not found")
+	ErrAlreadyReviewed = errors.New("you have already reviewed this item, edit your review instead")
+	ErrNotReviewAuthor = errors.New("only the author can edit a review")
+)
+
+// Review states. Hidden reviews are left out of listings and ratings but kept
+// so a moderator can publish them again.
+const (
+	ReviewPublished = "published"
+	ReviewHidden    = "hidden"
+)
+
+var ReviewStatuses = []string{ReviewPublished, ReviewHidden}
+
+// How review listings can be sorted, newest first by default.
+const (
+	ReviewsNewest  = "newest"
+	ReviewsOldest  = "oldest"
+	ReviewsHighest = "highest"
+	ReviewsLowest  = "lowest"
+)
+
+var ReviewSorts = []string{ReviewsNewest, ReviewsOldest, ReviewsHighest, ReviewsLowest}
+
+const (
+	defaultReviewPageSize = 20
+	maxReviewPageSize     = 100
+	maxReviewLength       = 5000
+)
+
+// Review is one shopper's rating of an item, 1 to 5 stars, with optional
+// words. A shopper has at most one review per item.
+type Review struct {
+	ReviewID       int       `json:"reviewID" gorm:"primaryKey;column:reviewid"`
+	ItemID         int       `json:"itemID" gorm:"column:itemid"`
+	Username       string    `json:"username" gorm:"column:username"`
+	Rating         int       `json:"rating" gorm:"column:rating"`
+	Title          string    `json:"title" gorm:"column:title"`
+	Body           string    `json:"body" gorm:"column:body"`
+	Status         string    `json:"status" gorm:"column:status"`
+	ModeratedBy    string    `json:"moderatedBy,omitempty" gorm:"column:moderated_by"`
+	ModerationNote string    `json:"moderationNote,omitempty" gorm:"column:moderation_note"`
+	CreatedAt      time.Time `json:"createdAt" gorm:"column:created_at"`
+	UpdatedAt      time.Time `json:"updatedAt" gorm:"column:updated_at"`
+}
+
+// ReviewQuery picks a page of reviews. ItemID 0 lists reviews of every item
+// and an empty Status lists published ones.
+type ReviewQuery struct {
+	ItemID   int
+	Status   string
+	Sort     string
+	Page     int
+	PageSize int
+}
+
+// ReviewPage is one page of a review listing. Rating sums up every published
+// review of the item, not just this page.
+type ReviewPage struct {
+	Reviews  []*Review     `json:"reviews"`
+	Page     int           `json:"page"`
+	PageSize int           `json:"pageSize"`
+	Total    int64         `json:"total"`
+	Rating   *RatingTotals `json:"rating,omitempty"`
+}
+
+// RatingTotals is an item's average rating with how many reviews gave each
+// number of stars.
+type RatingTotals struct {
+	Average float64       `json:"average"`
+	Count   int64         `json:"count"`
+	Stars   map[int]int64 `json:"stars"`
+}
+
+func (r *Review) validate() error {
+	if r.Rating < 1 || r.Rating > 5 {
+		return invalid("rating must be from 1 to 5")
+	}
+	r.Title = strings.TrimSpace(r.Title)
+	r.Body = strings.TrimSpace(r.Body)
+	if len(r.Title) > 200 {
+		return invalid("title can be at most 200 characters")
+	}
+	if len(r.Body) > maxReviewLength {
+		return invalid("review can be at most %d characters", maxReviewLength)
+	}
+	return nil
+}
+
+func (q *ReviewQuery) validate() error {
+	switch q.Status {
+	case "":
+		q.Status = ReviewPublished
+	case ReviewPublished, ReviewHidden:
+	default:
+		return invalid("unknown review status %q, expected one of %s", q.Status, strings.Join(ReviewStatuses, ", "))
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = ReviewsNewest
+	case ReviewsNewest, ReviewsOldest, ReviewsHighest, ReviewsLowest:
+	default:
+		return invalid("unknown sort %q, expected one of %s", q.Sort, strings.Join(ReviewSorts, ", "))
+	}
+
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PageSize < 1 {
+		q.PageSize = defaultReviewPageSize
+	}
+	if q.PageSize > maxReviewPageSize {
+		q.PageSize = maxReviewPageSize
+	}
+	return nil
+}
+
+// GetReviews lists a page of reviews, with the item's rating totals when the
+// query is for one item.
+func (s *shopService) GetReviews(query *ReviewQuery) (*ReviewPage, error) {
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+
+	reviews, total, err := s.db.getReviews(query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ReviewPage{Reviews: reviews, Page: query.Page, PageSize: query.PageSize, Total: total}
+	if query.ItemID != 0 {
+		page.Rating, err = s.db.getRatingTotals(query.ItemID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// GetUserReview returns a shopper's own review of an item, whatever its
+// status.
+func (s *shopService) GetUserReview(itemID int, username string) (*Review, error) {
+	review, err := s.db.getUserReview(itemID, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+func (s *shopService) CreateReview(review *Review) (*Review, error) {
+	if err := review.validate(); err != nil {
+		return nil, err
+	}
+	items, err := s.db.getItemsByID([]int{review.ItemID})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrItemNotFound
+	}
+
+	review.Status = ReviewPublished
+	review, err = s.db.addReview(review)
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// UpdateReview changes the rating and words of a review. Only its author can,
+// and a review a moderator hid stays hidden.
+func (s *shopService) UpdateReview(review *Review) (*Review, error) {
+	if err := review.validate(); err != nil {
+		return nil, err
+	}
+
+	review, err := s.db.updateReview(review)
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// ModerateReview publishes or hides a review, noting who did and why.
+func (s *shopService) ModerateReview(reviewID int, status, note, moderator string) (*Review, error) {
+	if status != ReviewPublished && status != ReviewHidden {
+		return nil, invalid("unknown review status %q, expected one of %s", status, strings.Join(ReviewStatuses, ", "))
+	}
+
+	review, err := s.db.moderateReview(reviewID, status, strings.TrimSpace(note), moderator)
+	if err != nil {
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// DeleteReview removes a review. username limits it to that author's review;
+// moderators pass "".
+func (s *shopService) DeleteReview(reviewID int, username string) (bool, error) {
+	result, err := s.db.deleteReview(reviewID, username)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
@@ -1,24 +1,115 @@
 package shop
 
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
 type ShopService interface {
 	GetItems() ([]*Item, error)
 	GetItemsFromStore(ID int) ([]*Item, error)
 	GetItem(ID int) (*Item, error)
-	CreateItem(*Item) (*Item, error)
-	UpdateItem(*Item) (*Item, error)
+	CreateItem(item *Item, actor string) (*Item, error)
+	UpdateItem(item *Item, actor string) (*Item, error)
 	DeleteItem(int) (bool, error)
 	GetStores() ([]*Store, error)
 	GetStore(ID int) ([]*ItemInStock, error)
 	CreateStore(*Store) (*Store, error)
 	UpdateStore(*Store) (*Store, error)
-	DeleteStore(int) (bool, error)
+	DeleteStore(storeID int, options DeleteOptions) (*StoreDependents, error)
+	GetStoreDependents(storeID int) (*StoreDependents, error)
 	CreateStock(*StockRequest) (*StockRequest, error)
 	UpdateStock(*StockRequest) (*StockRequest, error)
 	DeleteStock(int, int) (bool, error)
 	GetCategories() ([]*Category, error)
-	CreateCategory(string) (*Category, error)
+	CreateCategory(*Category) (*Category, error)
 	UpdateCategory(*Category) (*Category, error)
-	DeleteCategory(int) (bool, error)
+	DeleteCategory(categoryID int, options DeleteOptions) (*CategoryDependents, error)
+	GetCategoryDependents(categoryID int) (*CategoryDependents, error)
+	GetCategoryTree() ([]*CategoryNode, error)
+	GetCategoryItems(categoryID int, descendants bool) ([]*Item, error)
+	MoveCategory(categoryID, parentID int) (*Category, error)
+	GetCartNutrition([]*CartLine) (*CartNutrition, error)
+	GetBarcodes(itemID int) ([]*Barcode, error)
+	AddBarcode(itemID int, code string) (*Barcode, error)
+	DeleteBarcode(itemID int, code string) (bool, error)
+	LookupBarcode(code string, storeID int) (*BarcodeLookup, error)
+	SetItemImage(itemID int, image *ItemImage) (*ItemImage, error)
+	GetVariants(itemID int) ([]*Variant, error)
+	CreateVariant(variant *Variant, actor string) (*Variant, error)
+	UpdateVariant(variant *Variant, actor string) (*Variant, error)
+	DeleteVariant(itemID, variantID int) (bool, error)
+	DeleteVariantStock(storeID, itemID, variantID int) (bool, error)
+	GetStorePrices(storeID int) ([]*StorePrice, error)
+	SetStorePrice(*StorePrice) (*StorePrice, error)
+	DeleteStorePrice(storeID, itemID, variantID int) (bool, error)
+	PriceCart(storeID int, lines []*CartLine, profile *DietaryProfile) (*PricedCart, error)
+	GetPriceHistory(itemID int) ([]*PriceChange, error)
+	SchedulePriceChange(*PriceChange) (*PriceChange, error)
+	CancelPriceChange(itemID, changeID int) (bool, error)
+	ApplyDuePriceChanges(now time.Time) (int, error)
+	GetPromotions(storeID int, includeExpired bool) ([]*Promotion, error)
+	GetPromotion(promotionID int) (*Promotion, error)
+	CreatePromotion(*Promotion) (*Promotion, error)
+	UpdatePromotion(*Promotion) (*Promotion, error)
+	DeletePromotion(promotionID int) (bool, error)
+	GetCart(username string, profile *DietaryProfile) (*PricedCart, error)
+	SaveCart(cart *Cart, profile *DietaryProfile) (*PricedCart, error)
+	SetCartLine(username string, line *CartLine, profile *DietaryProfile) (*PricedCart, error)
+	ClearCart(username string) (bool, error)
+	ApplyCoupon(username, code string, profile *DietaryProfile) (*PricedCart, error)
+	RemoveCoupon(username string, profile *DietaryProfile) (*PricedCart, error)
+	GetCoupons() ([]*Coupon, error)
+	CreateCoupon(*Coupon) (*Coupon, error)
+	UpdateCoupon(*Coupon) (*Coupon, error)
+	DeleteCoupon(couponID int) (bool, error)
+	ImportCategories(next func() (*CategoryRow, error), dryRun bool) (*ImportReport, error)
+	ImportItems(next func() (*ItemRow, error), actor string, dryRun bool) (*ImportReport, error)
+	ImportStock(next func() (*StockRow, error), storeID int, dryRun bool) (*ImportReport, error)
+	ExportCategories() ([]*CategoryRow, error)
+	ExportItems() ([]*ItemRow, error)
+	ExportStock(storeID int) ([]*StockRow, error)
+	GetReviews(query *ReviewQuery) (*ReviewPage, error)
+	GetUserReview(itemID int, username string) (*Review, error)
+	CreateReview(*Review) (*Review, error)
+	UpdateReview(*Review) (*Review, error)
+	ModerateReview(reviewID int, status, note, moderator string) (*Review, error)
+	DeleteReview(reviewID int, username string) (bool, error)
+	GetRecommendations(query *RecommendationQuery) ([]*Recommendation, error)
+	GetSubstitutes(storeID, itemID, limit int, profile *DietaryProfile) ([]*Substitute, error)
+	GetItemAvailability(itemID int, from *Coordinates) ([]*StoreAvailability, error)
+	GetNearbyStores(from *Coordinates, radiusKm float64) ([]*Store, error)
+	SetStoreHours(storeID int, hours []*OpeningHours) ([]*OpeningHours, error)
+	SetHoursException(*HoursException) (*HoursException, error)
+	DeleteHoursException(storeID int, date string) (bool, error)
+	PlaceOrder(username string) (*Order, error)
+	GetOrder(orderID int, actor *OrderActor) (*Order, error)
+	GetOrders(*OrderQuery) (*OrderPage, error)
+	UpdateOrderStatus(orderID int, status string, actor *OrderActor, note string) (*Order, error)
+	GetPayments(orderID int) ([]*Payment, error)
+	GetOrderPayment(orderID int) (*Payment, error)
+	RecordPayment(*Payment) (*Payment, error)
+	SyncPayment(*Payment) (*Payment, error)
+	SetSettleError(orderID int, message string) error
+	GetSlotTemplates(storeID int) ([]*SlotTemplate, error)
+	CreateSlotTemplate(*SlotTemplate) (*SlotTemplate, error)
+	UpdateSlotTemplate(*SlotTemplate) (*SlotTemplate, error)
+	DeleteSlotTemplate(storeID, templateID int) (bool, error)
+	GetSlots(storeID int, from, to time.Time) ([]*PickupSlot, error)
+	ReserveSlot(username string, templateID int, startsAt time.Time) (*SlotBooking, error)
+	GetSlotReservation(username string) (*SlotBooking, error)
+	ReleaseSlot(username string) (bool, error)
+	GetPickList(storeID int, startsAt time.Time) (*PickList, error)
+	CreatePickBatch(storeID int, request *PickBatchRequest, picker string) (*PickBatch, error)
+	GetPickBatch(storeID, batchID int) (*PickBatch, error)
+	GetPickBatches(storeID int, status string) ([]*PickBatch, error)
+	PickLine(storeID, batchID, lineID int, update *PickUpdate, picker string) (*PickBatch, error)
+	RecordReturn(orderID int, request *ReturnRequest, actor *OrderActor) (*Return, error)
+	GetReturns(orderID int, actor *OrderActor) ([]*Return, error)
+	GetReturn(orderID, returnID int) (*Return, error)
+	SetReturnRefund(*Return) (*Return, error)
+	GetReturnsReport(storeID int, from, to string) (*ReturnsReport, error)
 }
 
 type shopService struct {
@@ -32,27 +123,72 @@ func NewService(conn string) ShopService {
 }
 
 type Item struct {
-	ItemID      int     `json:"itemID" gorm:"primaryKey;column:itemid"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	ItemID      int             `json:"itemID" gorm:"primaryKey;column:itemid"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Price       float64         `json:"price"`
+	BasePrice   float64         `json:"basePrice,omitempty" gorm:"-"` // set when Price is a store override
+	Dietary     pq.StringArray  `json:"dietary" gorm:"type:text[]"`
+	Allergens   pq.StringArray  `json:"allergens" gorm:"type:text[]"`
+	Nutrition   *NutritionFacts `json:"nutrition" gorm:"type:jsonb"`
+	Rating      float64         `json:"rating" gorm:"column:rating;->"` // average over published reviews
+	ReviewCount int             `json:"reviewCount" gorm:"column:review_count;->"`
+	ItemImage
 	Category
+	// Conflicts is only filled in for an authenticated shopper and lists why
+	// the item doesn't match their dietary preferences.
+	Conflicts []string   `json:"conflicts,omitempty" gorm:"-"`
+	Barcodes  []*Barcode `json:"barcodes,omitempty" gorm:"-"`
+	Variants  []*Variant `json:"variants,omitempty" gorm:"-"`
+	// SalePrice is the price of one unit after promotions, and Deals the
+	// promotions currently running on the item.
+	SalePrice *float64     `json:"salePrice,omitempty" gorm:"-"`
+	Deals     []*Promotion `json:"deals,omitempty" gorm:"-"`
+}
+
+// ItemImage is where an item's picture and its thumbnail are served from. The
+// keys locate the files in image storage and stay internal.
+type ItemImage struct {
+	ImageURL     string `json:"imageURL" gorm:"column:image_url"`
+	ThumbnailURL string `json:"thumbnailURL" gorm:"column:thumbnail_url"`
+	ImageKey     string `json:"-" gorm:"column:image_key"`
+	ThumbnailKey string `json:"-" gorm:"column:thumbnail_key"`
 }
 
+// Store is a shop location. Province is its tax jurisdiction, and Latitude and
+// Longitude, when set, put it on the map. Hours and Exceptions are read in the
+// store's Timezone, and OpenNow is nil when they don't say.
 type Store struct {
-	StoreID int    `json:"storeID" gorm:"primaryKey;column:storeid"`
-	Address string `json:"address"`
+	StoreID    int               `json:"storeID" gorm:"primaryKey;column:storeid"`
+	Address    string            `json:"address"`
+	Province   string            `json:"province" gorm:"column:province"`
+	Latitude   *float64          `json:"latitude,omitempty" gorm:"column:latitude"`
+	Longitude  *float64          `json:"longitude,omitempty" gorm:"column:longitude"`
+	Timezone   string            `json:"timezone,omitempty" gorm:"column:timezone"`
+	Hours      []*OpeningHours   `json:"hours,omitempty" gorm:"-"`
+	Exceptions []*HoursException `json:"exceptions,omitempty" gorm:"-"`
+	OpenNow    *bool             `json:"open_now,omitempty" gorm:"-"`
+	Distance   *float64          `json:"distance,omitempty" gorm:"-"`
 }
 
+// ItemInStock is one placement of an item in a store. VariantID is 0 when the
+// item is stocked as a whole rather than per variant.
 type ItemInStock struct {
 	Item
+	VariantID int      `json:"variantID,omitempty" gorm:"column:variantid"`
+	Variant   *Variant `json:"variant,omitempty" gorm:"-"`
 	Location
+	Quantity int `json:"quantity" gorm:"column:quantity"`
 }
 
+// StockRequest places an item in a store. Quantity is how many are on the
+// shelf; leaving it out of an update keeps the count as it is.
 type StockRequest struct {
-	StoreID int `json:"storeID" gorm:"primaryKey;column:storeid"`
-	ItemID  int `json:"itemID" gorm:"primaryKey;column:itemid"`
+	StoreID   int `json:"storeID" gorm:"primaryKey;column:storeid"`
+	ItemID    int `json:"itemID" gorm:"primaryKey;column:itemid"`
+	VariantID int `json:"variantID" gorm:"column:variantid"`
 	Location
+	Quantity *int `json:"quantity,omitempty" gorm:"column:quantity"`
 }
 
 type Location struct {
@@ -60,9 +196,13 @@ type Location struct {
 	Col int `json:"col"`
 }
 
+// Category is a node in the category tree. ParentID is 0 for top-level
+// categories.
 type Category struct {
 	CategoryID int    `json:"categoryID" gorm:"primaryKey;column:categoryid"`
 	Name       string `json:"category" gorm:"column:category"`
+	TaxClass   string `json:"taxClass" gorm:"column:tax_class"`
+	ParentID   int    `json:"parentID" gorm:"column:parentid"`
 }
 
 func (s *shopService) GetItems() ([]*Item, error) {
@@ -72,6 +212,16 @@ func (s *shopService) GetItems() ([]*Item, error) {
 		return nil, err
 	}
 
+	if err := s.attachVariants(item); err != nil {
+		return nil, err
+	}
+
+	promotions, err := s.activePromotions(0)
+	if err != nil {
+		return nil, err
+	}
+	promotions.items(item)
+
 	return item, nil
 }
 func (s *shopService) GetItemsFromStore(ID int) ([]*Item, error) {
@@ -81,6 +231,24 @@ func (s *shopService) GetItemsFromStore(ID int) ([]*Item, error) {
 		return nil, err
 	}
 
+	if err := s.attachVariants(item); err != nil {
+		return nil, err
+	}
+
+	prices, err := s.loadStorePrices(ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range item {
+		prices.item(i)
+	}
+
+	promotions, err := s.activePromotions(ID)
+	if err != nil {
+		return nil, err
+	}
+	promotions.items(item)
+
 	return item, nil
 }
 
@@ -91,11 +259,35 @@ func (s *shopService) GetItem(ID int) (*Item, error) {
 		return nil, err
 	}
 
+	item.Barcodes, err = s.db.getBarcodes(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.attachVariants([]*Item{item}); err != nil {
+		return nil, err
+	}
+
+	promotions, err := s.activePromotions(0)
+	if err != nil {
+		return nil, err
+	}
+	promotions.item(item)
+
 	return item, nil
 }
 
-func (s *shopService) CreateItem(item *Item) (*Item, error) {
-	item, err := s.db.addItem(item)
+func (s *shopService) CreateItem(item *Item, actor string) (*Item, error) {
+	if err := normalizeItemLabels(item); err != nil {
+		return nil, err
+	}
+	if item.Nutrition != nil {
+		if err := item.Nutrition.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	item, err := s.db.addItem(item, actor)
 	if err != nil {
 		// log.Printf("%v", err)
 		return nil, err
@@ -111,6 +303,10 @@ func (s *shopService) GetStores() ([]*Store, error) {
 		return nil, err
 	}
 
+	if err := s.attachHours(stores); err != nil {
+		return nil, err
+	}
+
 	return stores, nil
 }
 
@@ -121,10 +317,43 @@ func (s *shopService) GetStore(ID int) ([]*ItemInStock, error) {
 		return nil, err
 	}
 
+	if err := s.attachStockVariants(stock); err != nil {
+		return nil, err
+	}
+
+	prices, err := s.loadStorePrices(ID)
+	if err != nil {
+		return nil, err
+	}
+	promotions, err := s.activePromotions(ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, inStock := range stock {
+		prices.item(&inStock.Item)
+		promotions.item(&inStock.Item)
+		if inStock.Variant != nil {
+			prices.variant(inStock.Variant)
+			promotions.variant(&inStock.Item, inStock.Variant)
+		}
+	}
+
 	return stock, nil
 }
 
 func (s *shopService) CreateStore(store *Store) (*Store, error) {
+	province, err := ParseProvince(store.Province)
+	if err != nil {
+		return nil, err
+	}
+	store.Province = province
+	if err := store.validateLocation(); err != nil {
+		return nil, err
+	}
+	if err := store.validateTimezone(); err != nil {
+		return nil, err
+	}
+
 	item, err := s.db.addStore(store)
 	if err != nil {
 		// log.Printf("%v", err)
@@ -135,6 +364,20 @@ func (s *shopService) CreateStore(store *Store) (*Store, error) {
 }
 
 func (s *shopService) UpdateStore(store *Store) (*Store, error) {
+	if store.Province != "" {
+		province, err := ParseProvince(store.Province)
+		if err != nil {
+			return nil, err
+		}
+		store.Province = province
+	}
+	if err := store.validateLocation(); err != nil {
+		return nil, err
+	}
+	if err := store.validateTimezone(); err != nil {
+		return nil, err
+	}
+
 	item, err := s.db.updateStore(store)
 	if err != nil {
 		// log.Printf("%v", err)
@@ -144,8 +387,17 @@ func (s *shopService) UpdateStore(store *Store) (*Store, error) {
 	return item, nil
 }
 
-func (s *shopService) UpdateItem(item *Item) (*Item, error) {
-	updatedItem, err := s.db.updateItem(item)
+func (s *shopService) UpdateItem(item *Item, actor string) (*Item, error) {
+	if err := normalizeItemLabels(item); err != nil {
+		return nil, err
+	}
+	if item.Nutrition != nil {
+		if err := item.Nutrition.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	updatedItem, err := s.db.updateItem(item, actor)
 	if err != nil {
 		return nil, err
 	}
@@ -161,15 +413,29 @@ func (s *shopService) DeleteItem(itemID int) (bool, error) {
 	}
 	return deleteResult, nil
 }
-func (s *shopService) DeleteStore(storeID int) (bool, error) {
-	result, err := s.db.deleteStore(storeID)
+
+// DeleteStore deletes a store, dealing with whatever depends on it as
+// options say. The dependents are returned even when it refuses to delete.
+func (s *shopService) DeleteStore(storeID int, options DeleteOptions) (*StoreDependents, error) {
+	if err := options.validate(storeID); err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.deleteStore(storeID, options)
 	if err != nil {
 		// log.Printf("%v", err)
-		return false, err
+		return result, err
 	}
 	return result, nil
 }
 func (s *shopService) CreateStock(request *StockRequest) (*StockRequest, error) {
+	if err := s.checkStockVariant(request); err != nil {
+		return nil, err
+	}
+	if request.Quantity != nil && *request.Quantity < 0 {
+		return nil, invalid("quantity cannot be negative")
+	}
+
 	item, err := s.db.addStock(request)
 	if err != nil {
 		// log.Printf("%v", err)
@@ -180,6 +446,13 @@ func (s *shopService) CreateStock(request *StockRequest) (*StockRequest, error)
 }
 
 func (s *shopService) UpdateStock(request *StockRequest) (*StockRequest, error) {
+	if err := s.checkStockVariant(request); err != nil {
+		return nil, err
+	}
+	if request.Quantity != nil && *request.Quantity < 0 {
+		return nil, invalid("quantity cannot be negative")
+	}
+
 	item, err := s.db.updateStock(request)
 	if err != nil {
 		// log.Printf("%v", err)
@@ -205,8 +478,24 @@ func (s *shopService) GetCategories() ([]*Category, error) {
 	}
 	return result, nil
 }
-func (s *shopService) CreateCategory(name string) (*Category, error) {
-	result, err := s.db.createCategory(name)
+func (s *shopService) CreateCategory(cat *Category) (*Category, error) {
+	taxClass, err := ParseTaxClass(cat.TaxClass)
+	if err != nil {
+		return nil, err
+	}
+	cat.TaxClass = taxClass
+
+	if cat.ParentID != 0 {
+		parents, err := s.categoryParents()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := parents[cat.ParentID]; !ok {
+			return nil, ErrCategoryNotFound
+		}
+	}
+
+	result, err := s.db.createCategory(cat)
 	if err != nil {
 		// log.Printf("%v", err)
 		return nil, err
@@ -214,6 +503,14 @@ func (s *shopService) CreateCategory(name string) (*Category, error) {
 	return result, nil
 }
 func (s *shopService) UpdateCategory(cat *Category) (*Category, error) {
+	if cat.TaxClass != "" {
+		taxClass, err := ParseTaxClass(cat.TaxClass)
+		if err != nil {
+			return nil, err
+		}
+		cat.TaxClass = taxClass
+	}
+
 	result, err := s.db.editCategory(cat)
 	if err != nil {
 		// log.Printf("%v", err)
@@ -221,10 +518,53 @@ func (s *shopService) UpdateCategory(cat *Category) (*Category, error) {
 	}
 	return result, nil
 }
-func (s *shopService) DeleteCategory(categoryID int) (bool, error) {
-	result, err := s.db.deleteCategory(categoryID)
+
+// DeleteCategory deletes a category, dealing with its items, subcategories
+// and deals as options say. The dependents are returned even when it refuses
+// to delete.
+func (s *shopService) DeleteCategory(categoryID int, options DeleteOptions) (*CategoryDependents, error) {
+	if err := options.validate(categoryID); err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.deleteCategory(categoryID, options)
 	if err != nil {
 		// log.Printf("%v", err)
+		return result, err
+	}
+	return result, nil
+}
+
+func (s *shopService) SetItemImage(itemID int, image *ItemImage) (*ItemImage, error) {
+	previous, err := s.db.setItemImage(itemID, image)
+	if err != nil {
+		return nil, err
+	}
+
+	return previous, nil
+}
+
+// checkStockVariant makes sure a per-variant placement names one of the item's
+// own variants.
+func (s *shopService) checkStockVariant(request *StockRequest) error {
+	if request.VariantID == 0 {
+		return nil
+	}
+
+	variant, err := s.db.getVariant(request.VariantID)
+	if err != nil {
+		return err
+	}
+	if variant.ItemID != request.ItemID {
+		return invalid("variant %d is not a variant of item %d", request.VariantID, request.ItemID)
+	}
+
+	return nil
+}
+
+func (s *shopService) DeleteVariantStock(storeID, itemID, variantID int) (bool, error) {
+	result, err := s.db.deleteVariantStock(storeID, itemID, variantID)
+	if err != nil {
 		return false, err
 	}
 	return result, nil
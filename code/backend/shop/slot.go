@@ -0,0 +1,447 @@
+package shop
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrSlotTemplateNotFound = errors.New("slot template not found")
+	ErrSlotNotFound         = errors.New("there is no pickup slot at that time")
+	ErrSlotFull             = errors.New("that pickup slot is full, choose another")
+	ErrSlotRequired         = errors.New("reserve a pickup slot before checking out")
+	ErrSlotOtherStore       = errors.New("your pickup slot is at another store, reserve one at this store")
+	ErrNoReservation        = errors.New("you have no pickup slot reserved")
+)
+
+const (
+	// slotHold is how long a reserved slot is kept for a shopper who hasn't
+	// checked out yet.
+	slotHold = 30 * time.Minute
+	// maxSlotDays is the furthest ahead slots are listed.
+	maxSlotDays        = 14
+	minSlotDuration    = 15
+	maxSlotDuration    = 240
+	defaultSlotListing = 7 * 24 * time.Hour
+)
+
+// SlotTemplate is how a store hands out pickup slots on a day of the week:
+// Duration-minute windows from Opens until Closes, each taking up to
+// Capacity orders. Weekday 0 is Sunday and times are in the store's
+// timezone.
+type SlotTemplate struct {
+	TemplateID int    `json:"templateID" gorm:"primaryKey;column:templateid"`
+	StoreID    int    `json:"storeID" gorm:"column:storeid"`
+	Weekday    int    `json:"weekday" gorm:"column:weekday"`
+	Opens      string `json:"opens" gorm:"column:opens"`
+	Closes     string `json:"closes" gorm:"column:closes"`
+	Duration   int    `json:"duration" gorm:"column:duration"`
+	Capacity   int    `json:"capacity" gorm:"column:capacity"`
+}
+
+// PickupSlot is one window shoppers can collect an order in, and how many
+// more orders it can take.
+type PickupSlot struct {
+	StoreID    int       `json:"storeID"`
+	TemplateID int       `json:"templateID"`
+	StartsAt   time.Time `json:"startsAt"`
+	EndsAt     time.Time `json:"endsAt"`
+	Capacity   int       `json:"capacity"`
+	Booked     int       `json:"booked"`
+	Available  int       `json:"available"`
+}
+
+// SlotBooking takes a place in a slot. Until the shopper checks out OrderID
+// is 0 and the place is only held until HeldUntil.
+type SlotBooking struct {
+	BookingID  int       `json:"bookingID" gorm:"primaryKey;column:bookingid"`
+	StoreID    int       `json:"storeID" gorm:"column:storeid"`
+	TemplateID int       `json:"templateID" gorm:"column:templateid"`
+	StartsAt   time.Time `json:"startsAt" gorm:"column:starts_at"`
+	EndsAt     time.Time `json:"endsAt" gorm:"column:ends_at"`
+	Username   string    `json:"username" gorm:"column:username"`
+	OrderID    *int      `json:"orderID,omitempty" gorm:"column:orderid"`
+	HeldAt     time.Time `json:"-" gorm:"column:held_at"`
+	HeldUntil  time.Time `json:"heldUntil" gorm:"-"`
+}
+
+// PickList is what staff need to pick for one slot: its orders, and every
+// item across them in the order they are shelved.
+type PickList struct {
+	StoreID  int         `json:"storeID"`
+	StartsAt time.Time   `json:"startsAt"`
+	Orders   []*Order    `json:"orders"`
+	Items    []*PickItem `json:"items"`
+}
+
+// PickItem is how many of an item a slot's orders need in all. Location is
+// nil when the store has no shelf for it.
+type PickItem struct {
+	ItemID    int       `json:"itemID"`
+	VariantID int       `json:"variantID,omitempty"`
+	Name      string    `json:"name"`
+	Quantity  int       `json:"quantity"`
+	Location  *Location `json:"location,omitempty"`
+	Orders    []int     `json:"orders"`
+}
+
+func (t *SlotTemplate) validate() error {
+	if t.Weekday < 0 || t.Weekday > 6 {
+		return invalid("weekday must be from 0 (Sunday) to 6 (Saturday)")
+	}
+	p, err := parsePeriod(t.Opens, t.Closes)
+	if err != nil {
+		return err
+	}
+	if p.overnight() {
+		return invalid("pickup slots must close after they open, on the same day")
+	}
+	if t.Duration < minSlotDuration || t.Duration > maxSlotDuration {
+		return invalid("duration must be from %d to %d minutes", minSlotDuration, maxSlotDuration)
+	}
+	if t.Duration > p.closes-p.opens {
+		return invalid("duration is longer than the time between opens and closes")
+	}
+	if t.Capacity < 1 {
+		return invalid("capacity must be at least 1")
+	}
+	return nil
+}
+
+// slotsOn lists the template's windows on a local date.
+func (t *SlotTemplate) slotsOn(date time.Time) []*PickupSlot {
+	if int(date.Weekday()) != t.Weekday {
+		return nil
+	}
+	p, err := parsePeriod(t.Opens, t.Closes)
+	if err != nil {
+		return nil
+	}
+
+	var slots []*PickupSlot
+	for start := p.opens; start+t.Duration <= p.closes; start += t.Duration {
+		startsAt := time.Date(date.Year(), date.Month(), date.Day(), start/60, start%60, 0, 0, date.Location())
+		end := start + t.Duration
+		endsAt := time.Date(date.Year(), date.Month(), date.Day(), end/60, end%60, 0, 0, date.Location())
+		slots = append(slots, &PickupSlot{
+			StoreID:    t.StoreID,
+			TemplateID: t.TemplateID,
+			StartsAt:   startsAt,
+			EndsAt:     endsAt,
+			Capacity:   t.Capacity,
+		})
+	}
+	return slots
+}
+
+// location is the store's timezone, UTC when it hasn't got one.
+func (s *Store) location() *time.Location {
+	if s.Timezone != "" {
+		if zone, err := time.LoadLocation(s.Timezone); err == nil {
+			return zone
+		}
+	}
+	return time.UTC
+}
+
+// closedOn reports whether a holiday exception closes the store on a local
+// date.
+func (s *Store) closedOn(date time.Time) bool {
+	for _, e := range s.Exceptions {
+		if e.Closed && e.Date == date.Format(dateLayout) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *shopService) GetSlotTemplates(storeID int) ([]*SlotTemplate, error) {
+	templates, err := s.db.getSlotTemplates(storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return templates, nil
+}
+
+func (s *shopService) CreateSlotTemplate(template *SlotTemplate) (*SlotTemplate, error) {
+	if err := template.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.getStoreByID(template.StoreID); err != nil {
+		return nil, err
+	}
+
+	template, err := s.db.addSlotTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// UpdateSlotTemplate changes a template. Places already booked are kept even
+// if the slot they are in no longer exists.
+func (s *shopService) UpdateSlotTemplate(template *SlotTemplate) (*SlotTemplate, error) {
+	if err := template.validate(); err != nil {
+		return nil, err
+	}
+
+	template, err := s.db.updateSlotTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// DeleteSlotTemplate stops a template handing out slots. Holds on its slots
+// are let go; orders keep theirs.
+func (s *shopService) DeleteSlotTemplate(storeID, templateID int) (bool, error) {
+	result, err := s.db.deleteSlotTemplate(storeID, templateID)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// GetSlots lists a store's pickup slots starting from from until to, at most
+// two weeks ahead, with how many places each has left. Slots that have
+// started and days the store is closed for a holiday are left out.
+func (s *shopService) GetSlots(storeID int, from, to time.Time) ([]*PickupSlot, error) {
+	now := time.Now()
+	if from.Before(now) {
+		from = now
+	}
+	if to.IsZero() {
+		to = from.Add(defaultSlotListing)
+	}
+	if limit := now.AddDate(0, 0, maxSlotDays); to.After(limit) {
+		to = limit
+	}
+
+	store, err := s.db.getStoreByID(storeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachHours([]*Store{store}); err != nil {
+		return nil, err
+	}
+	templates, err := s.db.getSlotTemplates(storeID)
+	if err != nil {
+		return nil, err
+	}
+	booked, err := s.db.getSlotBookingCounts(storeID, from, to, now.Add(-slotHold))
+	if err != nil {
+		return nil, err
+	}
+
+	zone := store.location()
+	slots := []*PickupSlot{}
+	local := from.In(zone)
+	for date := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, zone); date.Before(to); date = date.AddDate(0, 0, 1) {
+		if store.closedOn(date) {
+			continue
+		}
+		for _, t := range templates {
+			for _, slot := range t.slotsOn(date) {
+				if slot.StartsAt.Before(from) || !slot.StartsAt.Before(to) {
+					continue
+				}
+				slot.Booked = booked[slotKey{slot.TemplateID, slot.StartsAt.Unix()}]
+				slot.Available = slot.Capacity - slot.Booked
+				if slot.Available < 0 {
+					slot.Available = 0
+				}
+				slots = append(slots, slot)
+			}
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		if !slots[i].StartsAt.Equal(slots[j].StartsAt) {
+			return slots[i].StartsAt.Before(slots[j].StartsAt)
+		}
+		return slots[i].TemplateID < slots[j].TemplateID
+	})
+
+	return slots, nil
+}
+
+// slotKey picks out a slot's bookings: its template and start.
+type slotKey struct {
+	templateID int
+	startsAt   int64
+}
+
+// ReserveSlot holds a place in a slot for a shopper's next order, in place of
+// any slot they held before. The hold lasts half an hour; checking out in
+// that time keeps the place for the order.
+func (s *shopService) ReserveSlot(username string, templateID int, startsAt time.Time) (*SlotBooking, error) {
+	template, err := s.db.getSlotTemplate(templateID)
+	if err != nil {
+		return nil, err
+	}
+	store, err := s.db.getStoreByID(template.StoreID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachHours([]*Store{store}); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	local := startsAt.In(store.location())
+	date := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	var slot *PickupSlot
+	for _, candidate := range template.slotsOn(date) {
+		if candidate.StartsAt.Equal(startsAt) {
+			slot = candidate
+		}
+	}
+	if slot == nil || store.closedOn(date) || !slot.StartsAt.After(now) || slot.StartsAt.After(now.AddDate(0, 0, maxSlotDays)) {
+		return nil, ErrSlotNotFound
+	}
+
+	booking := &SlotBooking{
+		StoreID:    template.StoreID,
+		TemplateID: templateID,
+		StartsAt:   slot.StartsAt,
+		EndsAt:     slot.EndsAt,
+		Username:   username,
+		HeldAt:     now,
+	}
+	booking, err = s.db.reserveSlot(booking, now.Add(-slotHold))
+	if err != nil {
+		return nil, err
+	}
+
+	booking.HeldUntil = booking.HeldAt.Add(slotHold)
+	return booking, nil
+}
+
+// GetSlotReservation is the slot a shopper holds for their next order.
+func (s *shopService) GetSlotReservation(username string) (*SlotBooking, error) {
+	booking, err := s.db.getSlotReservation(username, time.Now().Add(-slotHold))
+	if err != nil {
+		return nil, err
+	}
+
+	booking.HeldUntil = booking.HeldAt.Add(slotHold)
+	return booking, nil
+}
+
+func (s *shopService) ReleaseSlot(username string) (bool, error) {
+	result, err := s.db.releaseSlot(username)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// checkoutSlot is the slot an order at a store will be collected in: the one
+// the shopper holds, required when the store hands out slots. Its place is
+// claimed again at checkout in case the hold ran out.
+func (s *shopService) checkoutSlot(username string, storeID int) (*SlotBooking, error) {
+	booking, err := s.db.getSlotReservation(username, time.Time{})
+	if err != nil && err != ErrNoReservation {
+		return nil, err
+	}
+	if booking != nil && booking.StoreID == storeID {
+		if !booking.StartsAt.After(time.Now()) {
+			return nil, ErrSlotNotFound
+		}
+		return booking, nil
+	}
+
+	templates, err := s.db.getSlotTemplates(storeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		return nil, nil
+	}
+	if booking != nil {
+		return nil, ErrSlotOtherStore
+	}
+	return nil, ErrSlotRequired
+}
+
+// GetPickList gathers what a store's orders collected in the slot starting
+// at startsAt need, shelf by shelf.
+func (s *shopService) GetPickList(storeID int, startsAt time.Time) (*PickList, error) {
+	orders, err := s.db.getSlotOrders(storeID, startsAt)
+	if err != nil {
+		return nil, err
+	}
+	placements, err := s.db.getStockPlacements(storeID)
+	if err != nil {
+		return nil, err
+	}
+	shelves := make(map[priceKey]Location)
+	for _, p := range placements {
+		shelves[priceKey{p.ItemID, p.VariantID}] = p.Location
+	}
+
+	list := &PickList{StoreID: storeID, StartsAt: startsAt, Orders: orders, Items: []*PickItem{}}
+	byKey := make(map[priceKey]*PickItem)
+	for _, order := range orders {
+		for _, line := range order.Lines {
+			key := priceKey{line.ItemID, line.VariantID}
+			item, ok := byKey[key]
+			if !ok {
+				item = &PickItem{ItemID: line.ItemID, VariantID: line.VariantID, Name: line.Name, Location: shelfOf(shelves, line.ItemID, line.VariantID)}
+				byKey[key] = item
+				list.Items = append(list.Items, item)
+			}
+			item.Quantity += line.Quantity
+			item.Orders = append(item.Orders, order.OrderID)
+		}
+	}
+	sortByShelf(list.Items)
+
+	return list, nil
+}
+
+// shelfOf is where a store keeps an item: the variant's own shelf if it has
+// one, else the item's.
+func shelfOf(shelves map[priceKey]Location, itemID, variantID int) *Location {
+	if shelf, ok := shelves[priceKey{itemID, variantID}]; ok {
+		return &shelf
+	}
+	if shelf, ok := shelves[priceKey{itemID, 0}]; ok {
+		return &shelf
+	}
+	return nil
+}
+
+// compareShelves orders shelves the way a picker walks the store: row by
+// row, up the even rows and back down the odd ones so the picker doesn't
+// walk back to the start of each, with nowhere last.
+func compareShelves(a, b *Location) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	case a.Row != b.Row:
+		return a.Row - b.Row
+	case a.Row%2 != 0:
+		return b.Col - a.Col
+	}
+	return a.Col - b.Col
+}
+
+// sortByShelf orders items along the pick path.
+func sortByShelf(items []*PickItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if c := compareShelves(items[i].Location, items[j].Location); c != 0 {
+			return c < 0
+		}
+		return items[i].Name < items[j].Name
+	})
+}
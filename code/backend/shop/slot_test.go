@@ -0,0 +1,106 @@
+package shop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlotTemplateValidate(t *testing.T) {
+	valid := func() *SlotTemplate {
+		return &SlotTemplate{Weekday: 1, Opens: "09:00", Closes: "12:00", Duration: 60, Capacity: 5}
+	}
+
+	tests := []struct {
+		name   string
+		change func(*SlotTemplate)
+		valid  bool
+	}{
+		{"valid", func(*SlotTemplate) {}, true},
+		{"Sunday", func(t *SlotTemplate) { t.Weekday = 0 }, true},
+		{"Saturday", func(t *SlotTemplate) { t.Weekday = 6 }, true},
+		{"weekday too low", func(t *SlotTemplate) { t.Weekday = -1 }, false},
+		{"weekday too high", func(t *SlotTemplate) { t.Weekday = 7 }, false},
+		{"bad opening time", func(t *SlotTemplate) { t.Opens = "9am" }, false},
+		{"bad closing time", func(t *SlotTemplate) { t.Closes = "25:00" }, false},
+		{"opens at 24:00", func(t *SlotTemplate) { t.Opens = "24:00" }, false},
+		{"closes at 24:00", func(t *SlotTemplate) { t.Opens, t.Closes = "20:00", "24:00" }, true},
+		{"overnight", func(t *SlotTemplate) { t.Opens, t.Closes = "22:00", "02:00" }, false},
+		{"closes as it opens", func(t *SlotTemplate) { t.Closes = "09:00" }, false},
+		{"shortest duration", func(t *SlotTemplate) { t.Duration = minSlotDuration }, true},
+		{"duration too short", func(t *SlotTemplate) { t.Duration = minSlotDuration - 1 }, false},
+		{"longest duration", func(t *SlotTemplate) { t.Opens, t.Closes, t.Duration = "08:00", "12:00", maxSlotDuration }, true},
+		{"duration too long", func(t *SlotTemplate) { t.Opens, t.Closes, t.Duration = "08:00", "20:00", maxSlotDuration+1 }, false},
+		{"duration longer than the day", func(t *SlotTemplate) { t.Duration = 181 }, false},
+		{"duration the whole day", func(t *SlotTemplate) { t.Duration = 180 }, true},
+		{"no capacity", func(t *SlotTemplate) { t.Capacity = 0 }, false},
+		{"negative capacity", func(t *SlotTemplate) { t.Capacity = -1 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := valid()
+			tt.change(template)
+			err := template.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("validate = %v, want valid %v", err, tt.valid)
+			}
+			if err != nil && !IsInvalid(err) {
+				t.Errorf("validate = %v, want an InvalidError", err)
+			}
+		})
+	}
+}
+
+func TestSlotsOn(t *testing.T) {
+	zone, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	// 4 January 2021 is a Monday
+	monday := time.Date(2021, time.January, 4, 0, 0, 0, 0, zone)
+	tuesday := monday.AddDate(0, 0, 1)
+
+	tests := []struct {
+		name     string
+		template *SlotTemplate
+		date     time.Time
+		starts   []string
+		lastEnds string
+	}{
+		{"hourly", &SlotTemplate{Weekday: 1, Opens: "09:00", Closes: "12:00", Duration: 60}, monday, []string{"09:00", "10:00", "11:00"}, "12:00"},
+		{"leftover time unused", &SlotTemplate{Weekday: 1, Opens: "09:00", Closes: "10:40", Duration: 30}, monday, []string{"09:00", "09:30", "10:00"}, "10:30"},
+		{"one slot", &SlotTemplate{Weekday: 1, Opens: "17:15", Closes: "17:30", Duration: 15}, monday, []string{"17:15"}, "17:30"},
+		{"until midnight", &SlotTemplate{Weekday: 1, Opens: "22:00", Closes: "24:00", Duration: 60}, monday, []string{"22:00", "23:00"}, "00:00"},
+		{"another weekday", &SlotTemplate{Weekday: 1, Opens: "09:00", Closes: "12:00", Duration: 60}, tuesday, nil, ""},
+		{"bad times", &SlotTemplate{Weekday: 1, Opens: "nine", Closes: "12:00", Duration: 60}, monday, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.template.StoreID, tt.template.TemplateID, tt.template.Capacity = 3, 7, 4
+			slots := tt.template.slotsOn(tt.date)
+			if len(slots) != len(tt.starts) {
+				t.Fatalf("slotsOn gave %d slots, want %d", len(slots), len(tt.starts))
+			}
+			for i, slot := range slots {
+				if got := slot.StartsAt.Format("15:04"); got != tt.starts[i] {
+					t.Errorf("slot %d starts at %s, want %s", i, got, tt.starts[i])
+				}
+				if got := slot.EndsAt.Sub(slot.StartsAt); got != time.Duration(tt.template.Duration)*time.Minute {
+					t.Errorf("slot %d lasts %s, want %d minutes", i, got, tt.template.Duration)
+				}
+				if slot.StartsAt.Location() != zone {
+					t.Errorf("slot %d is in %s, want %s", i, slot.StartsAt.Location(), zone)
+				}
+				if slot.StoreID != 3 || slot.TemplateID != 7 || slot.Capacity != 4 {
+					t.Errorf("slot %d = store %d template %d capacity %d, want 3, 7, 4", i, slot.StoreID, slot.TemplateID, slot.Capacity)
+				}
+			}
+			if len(slots) > 0 {
+				if got := slots[len(slots)-1].EndsAt.Format("15:04"); got != tt.lastEnds {
+					t.Errorf("last slot ends at %s, want %s", got, tt.lastEnds)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package shop
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultSubstitutes = 5
+	maxSubstitutes     = 20
+	// cartSubstitutes is how many suggestions an unavailable cart line gets.
+	cartSubstitutes = 3
+	// minSubstituteScore keeps out items that only share a word or a price.
+	minSubstituteScore = 0.25
+)
+
+// How much each signal counts towards a substitute's score, out of 1.
+const (
+	weightCategory = 0.35
+	weightPrice    = 0.2
+	weightDietary  = 0.2
+	weightText     = 0.25
+)
+
+// Why an item was suggested as a substitute.
+const (
+	SubstituteSameCategory    = "same_category"
+	SubstituteRelatedCategory = "related_category"
+	SubstitutePrice           = "similar_price"
+	SubstituteDietary         = "same_dietary"
+	SubstituteName            = "similar_name"
+)
+
+// Substitute is an item suggested in place of one a store doesn't stock.
+type Substitute struct {
+	Item    *Item    `json:"item"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// stockedItems is what a store stocks, by item and variant. An item stocked
+// as a whole (variant 0) has every variant available.
+type stockedItems map[priceKey]bool
+
+func (s stockedItems) has(itemID, variantID int) bool {
+	if s[priceKey{itemID, 0}] {
+		return true
+	}
+	if variantID != 0 {
+		return s[priceKey{itemID, variantID}]
+	}
+	for key := range s {
+		if key.itemID == itemID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *shopService) stockedItems(storeID int) (stockedItems, error) {
+	placements, err := s.db.getStockPlacements(storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	stocked := make(stockedItems)
+	for _, p := range placements {
+		stocked[priceKey{p.ItemID, p.VariantID}] = true
+	}
+
+	return stocked, nil
+}
+
+// GetSubstitutes ranks what a store stocks as replacements for an item, by
+// category, price, dietary labels and how alike their names and descriptions
+// read. Items conflicting with profile are left out.
+func (s *shopService) GetSubstitutes(storeID, itemID, limit int, profile *DietaryProfile) ([]*Substitute, error) {
+	if limit < 0 {
+		return nil, errors.New("limit cannot be negative")
+	}
+	if limit == 0 {
+		limit = defaultSubstitutes
+	}
+	if limit > maxSubstitutes {
+		limit = maxSubstitutes
+	}
+
+	items, err := s.db.getItemsByID([]int{itemID})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrItemNotFound
+	}
+	if _, err := s.db.getStoreByID(storeID); err != nil {
+		return nil, err
+	}
+
+	candidates, err := s.GetItemsFromStore(storeID)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := s.categoryParents()
+	if err != nil {
+		return nil, err
+	}
+
+	return rankSubstitutes(items[0], candidates, parents, profile, limit), nil
+}
+
+// flagUnavailable marks the lines of a cart priced at a store that the store
+// doesn't stock, and suggests what it has instead, leaving out items that
+// conflict with profile. Unavailable lines are still priced and counted in the
+// totals.
+func (s *shopService) flagUnavailable(cart *PricedCart, items map[int]*Item, profile *DietaryProfile) error {
+	if cart.StoreID == 0 || len(cart.Lines) == 0 {
+		return nil
+	}
+
+	stocked, err := s.stockedItems(cart.StoreID)
+	if err != nil {
+		return err
+	}
+
+	var unavailable []*PricedLine
+	for _, line := range cart.Lines {
+		if !stocked.has(line.ItemID, line.VariantID) {
+			line.Unavailable = true
+			unavailable = append(unavailable, line)
+		}
+	}
+	if len(unavailable) == 0 {
+		return nil
+	}
+
+	candidates, err := s.GetItemsFromStore(cart.StoreID)
+	if err != nil {
+		return err
+	}
+	parents, err := s.categoryParents()
+	if err != nil {
+		return err
+	}
+
+	// nothing already in the cart is suggested
+	inCart := make(map[int]bool)
+	for _, line := range cart.Lines {
+		inCart[line.ItemID] = true
+	}
+	available := candidates[:0]
+	for _, item := range candidates {
+		if !inCart[item.ItemID] {
+			available = append(available, item)
+		}
+	}
+
+	for _, line := range unavailable {
+		line.Substitutes = rankSubstitutes(items[line.ItemID], available, parents, profile, cartSubstitutes)
+	}
+
+	return nil
+}
+
+func rankSubstitutes(original *Item, candidates []*Item, parents categoryParents, profile *DietaryProfile, limit int) []*Substitute {
+	words := textTokens(original.Name)
+	about := textTokens(original.Description)
+
+	substitutes := []*Substitute{}
+	for _, item := range candidates {
+		if item.ItemID == original.ItemID {
+			continue
+		}
+		if profile != nil && len(profile.ConflictsWith(item)) > 0 {
+			continue
+		}
+
+		sub := &Substitute{Item: item, Reasons: []string{}}
+		score := 0.0
+
+		switch {
+		case item.CategoryID == original.CategoryID:
+			score += weightCategory
+			sub.Reasons = append(sub.Reasons, SubstituteSameCategory)
+		case parents[item.CategoryID] != 0 && parents[item.CategoryID] == parents[original.CategoryID],
+			parents.within(item.CategoryID, original.CategoryID),
+			parents.within(original.CategoryID, item.CategoryID):
+			score += weightCategory / 2
+			sub.Reasons = append(sub.Reasons, SubstituteRelatedCategory)
+		}
+
+		if closeness := priceCloseness(original.Price, item.Price); closeness > 0 {
+			score += weightPrice * closeness
+			if closeness >= 0.8 {
+				sub.Reasons = append(sub.Reasons, SubstitutePrice)
+			}
+		}
+
+		dietary := dietaryMatch(original, item)
+		score += weightDietary * dietary
+		if dietary == 1 && len(original.Dietary) > 0 {
+			sub.Reasons = append(sub.Reasons, SubstituteDietary)
+		}
+
+		text := 0.8*jaccard(words, textTokens(item.Name)) + 0.2*jaccard(about, textTokens(item.Description))
+		score += weightText * text
+		if text >= 0.2 {
+			sub.Reasons = append(sub.Reasons, SubstituteName)
+		}
+
+		if score < minSubstituteScore {
+			continue
+		}
+		sub.Score = roundCents(score)
+		substitutes = append(substitutes, sub)
+	}
+
+	sort.Slice(substitutes, func(i, j int) bool {
+		a, b := substitutes[i], substitutes[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Item.Name < b.Item.Name
+	})
+	if len(substitutes) > limit {
+		substitutes = substitutes[:limit]
+	}
+
+	return substitutes
+}
+
+// priceCloseness is 1 for the same price, falling to 0 at twice or half of it.
+func priceCloseness(original, price float64) float64 {
+	if original <= 0 || price <= 0 {
+		return 0
+	}
+	return math.Max(0, 1-math.Abs(math.Log2(price/original)))
+}
+
+// dietaryMatch is the share of the original's dietary labels the substitute
+// keeps, less a penalty for each allergen the original didn't have.
+func dietaryMatch(original, item *Item) float64 {
+	match := 1.0
+	if len(original.Dietary) > 0 {
+		kept := 0
+		for _, label := range original.Dietary {
+			for _, l := range item.Dietary {
+				if l == label {
+					kept++
+					break
+				}
+			}
+		}
+		match = float64(kept) / float64(len(original.Dietary))
+	}
+
+	had := make(map[string]bool)
+	for _, a := range original.Allergens {
+		had[a] = true
+	}
+	for _, a := range item.Allergens {
+		if !had[a] {
+			match -= 0.5
+		}
+	}
+
+	return math.Max(0, match)
+}
+
+// textTokens splits text into its lower-case words, leaving out one-letter
+// ones.
+func textTokens(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) > 1 {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -0,0 +1,50 @@
+package shop
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRankSubstitutes(t *testing.T) {
+	item := func(id int, name string, categoryID int, price float64, dietary, allergens []string) *Item {
+		i := &Item{ItemID: id, Name: name, Price: price, Dietary: dietary, Allergens: allergens}
+		i.CategoryID = categoryID
+		return i
+	}
+	original := item(1, "Oat Milk", 10, 4, []string{"vegan"}, nil)
+	candidates := []*Item{
+		original,
+		item(2, "Almond Milk", 10, 4, []string{"vegan"}, []string{"nuts"}),
+		item(3, "Soy Milk", 10, 4.4, []string{"vegan"}, []string{"soy"}),
+		item(4, "Cow Milk", 11, 8, nil, []string{"milk"}),
+		item(5, "Rice Crackers", 20, 4, nil, nil),
+		item(6, "Oat Milk Barista", 10, 4, []string{"vegan"}, nil),
+	}
+	parents := categoryParents{10: 1, 11: 1}
+
+	tests := []struct {
+		name    string
+		profile *DietaryProfile
+		limit   int
+		want    []int
+	}{
+		{"no profile", nil, 5, []int{6, 2, 3}},
+		{"limited", nil, 1, []int{6}},
+		{"empty profile", &DietaryProfile{}, 5, []int{6, 2, 3}},
+		{"avoids an allergen", &DietaryProfile{Allergens: []string{"nuts"}}, 5, []int{6, 3}},
+		{"requires a label", &DietaryProfile{Dietary: []string{"vegan"}, Allergens: []string{"soy"}}, 5, []int{6, 2}},
+		{"nothing suits", &DietaryProfile{Dietary: []string{"kosher"}}, 5, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []int{}
+			for _, sub := range rankSubstitutes(original, candidates, parents, tt.profile, tt.limit) {
+				got = append(got, sub.Item.ItemID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rankSubstitutes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package shop
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tax classes a category can be in. Basic groceries are zero-rated for
+// GST/HST and exempt from the provincial sales taxes; everything else is
+// taxed at the full rate. Categories without a class are taxed.
+const (
+	TaxZeroRated = "zero_rated"
+	TaxStandard  = "standard"
+)
+
+var TaxClasses = []string{TaxZeroRated, TaxStandard}
+
+// TaxRate is one tax levied in a province, Rate in percent.
+type TaxRate struct {
+	Type string  `json:"type"`
+	Rate float64 `json:"rate"`
+}
+
+// ProvinceTaxes are the sales taxes charged on taxable goods in each province
+// and territory.
+var ProvinceTaxes = map[string][]TaxRate{
+	"AB": {{"GST", 5}},
+	"BC": {{"GST", 5}, {"PST", 7}},
+	"MB": {{"GST", 5}, {"RST", 7}},
+	"NB": {{"HST", 15}},
+	"NL": {{"HST", 15}},
+	"NS": {{"HST", 14}},
+	"NT": {{"GST", 5}},
+	"NU": {{"GST", 5}},
+	"ON": {{"HST", 13}},
+	"PE": {{"HST", 15}},
+	"QC": {{"GST", 5}, {"QST", 9.975}},
+	"SK": {{"GST", 5}, {"PST", 6}},
+	"YT": {{"GST", 5}},
+}
+
+// Provinces lists the jurisdictions a store can be in.
+func Provinces() []string {
+	provinces := make([]string, 0, len(ProvinceTaxes))
+	for p := range ProvinceTaxes {
+		provinces = append(provinces, p)
+	}
+	sort.Strings(provinces)
+	return provinces
+}
+
+// ParseProvince matches a two-letter province or territory code. Stores
+// have no default province, so an empty one is invalid.
+func ParseProvince(province string) (string, error) {
+	province = strings.ToUpper(strings.TrimSpace(province))
+	if province == "" {
+		return "", invalid("province is required, expected one of %s", strings.Join(Provinces(), ", "))
+	}
+	if _, ok := ProvinceTaxes[province]; !ok {
+		return "", invalid("unknown province %q, expected one of %s", province, strings.Join(Provinces(), ", "))
+	}
+	return province, nil
+}
+
+// ParseTaxClass matches a tax class, defaulting to standard.
+func ParseTaxClass(class string) (string, error) {
+	class = strings.ToLower(strings.TrimSpace(class))
+	switch class {
+	case "":
+		return TaxStandard, nil
+	case TaxZeroRated, TaxStandard:
+		return class, nil
+	}
+	return "", invalid("unknown tax class %q, expected one of %s", class, strings.Join(TaxClasses, ", "))
+}
+
+// LineTax is one tax on a cart line, or the total of that tax over the cart.
+type LineTax struct {
+	Type   string  `json:"type"`
+	Rate   float64 `json:"rate"`
+	Amount float64 `json:"amount"`
+}
+
+// taxLine charges the province's taxes on what is left of a line after
+// discounts.
+func taxLine(line *PricedLine, province string, class string) {
+	line.Taxes = []*LineTax{}
+	if class == TaxZeroRated {
+		return
+	}
+
+	for _, rate := range ProvinceTaxes[province] {
+		amount := roundCents(line.Total * rate.Rate / 100)
+		line.Taxes = append(line.Taxes, &LineTax{Type: rate.Type, Rate: rate.Rate, Amount: amount})
+		line.Tax += amount
+	}
+	line.Tax = roundCents(line.Tax)
+}
+
+// taxCart taxes every line and totals each tax type over the cart. Carts not
+// priced at a store, or at one without a province, carry no tax.
+func taxCart(cart *PricedCart, items map[int]*Item, province string) {
+	cart.Taxes = []*LineTax{}
+	cart.Tax = 0
+	if province == "" {
+		return
+	}
+
+	totals := make(map[string]*LineTax)
+	for _, line := range cart.Lines {
+		line.Tax = 0
+		taxLine(line, province, items[line.ItemID].TaxClass)
+		for _, tax := range line.Taxes {
+			total, ok := totals[tax.Type]
+			if !ok {
+				total = &LineTax{Type: tax.Type, Rate: tax.Rate}
+				totals[tax.Type] = total
+				cart.Taxes = append(cart.Taxes, total)
+			}
+			total.Amount = roundCents(total.Amount + tax.Amount)
+		}
+		cart.Tax += line.Tax
+	}
+	cart.Tax = roundCents(cart.Tax)
+}
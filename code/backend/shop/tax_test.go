@@ -0,0 +1,57 @@
+package shop
+
+import "testing"
+
+func TestTaxCart(t *testing.T) {
+	items := make(map[int]*Item)
+	for id, class := range map[int]string{1: TaxStandard, 2: TaxZeroRated} {
+		items[id] = &Item{ItemID: id}
+		items[id].TaxClass = class
+	}
+
+	tests := []struct {
+		name     string
+		province string
+		totals   []float64 // line totals, of item 1 then item 2 and so on
+		itemIDs  []int
+		lineTax  []float64
+		taxes    map[string]float64
+		tax      float64
+	}{
+		{"no province", "", []float64{10}, []int{1}, []float64{0}, map[string]float64{}, 0},
+		{"HST", "ON", []float64{10}, []int{1}, []float64{1.30}, map[string]float64{"HST": 1.30}, 1.30},
+		{"zero-rated line", "ON", []float64{10, 10}, []int{1, 2}, []float64{1.30, 0}, map[string]float64{"HST": 1.30}, 1.30},
+		{"only zero-rated", "ON", []float64{10}, []int{2}, []float64{0}, map[string]float64{}, 0},
+		{"GST and QST", "QC", []float64{10}, []int{1}, []float64{1.50}, map[string]float64{"GST": 0.50, "QST": 1.00}, 1.50},
+		{"each tax rounded per line", "QC", []float64{3.33, 3.33}, []int{1, 1}, []float64{0.50, 0.50}, map[string]float64{"GST": 0.34, "QST": 0.66}, 1.00},
+		{"fully discounted", "AB", []float64{0}, []int{1}, []float64{0}, map[string]float64{"GST": 0}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cart := &PricedCart{}
+			for i, total := range tt.totals {
+				cart.Lines = append(cart.Lines, &PricedLine{ItemID: tt.itemIDs[i], Total: total})
+			}
+
+			taxCart(cart, items, tt.province)
+
+			for i, line := range cart.Lines {
+				if line.Tax != tt.lineTax[i] {
+					t.Errorf("line %d tax = %.2f, want %.2f", i, line.Tax, tt.lineTax[i])
+				}
+			}
+			if len(cart.Taxes) != len(tt.taxes) {
+				t.Fatalf("cart taxes = %d types, want %d", len(cart.Taxes), len(tt.taxes))
+			}
+			for _, tax := range cart.Taxes {
+				if want, ok := tt.taxes[tax.Type]; !ok || tax.Amount != want {
+					t.Errorf("%s = %.2f, want %.2f", tax.Type, tax.Amount, want)
+				}
+			}
+			if cart.Tax != tt.tax {
+				t.Errorf("cart tax = %.2f, want %.2f", cart.Tax, tt.tax)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package shop
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrVariantNotFound = errors.New("variant not found")
+	ErrSKUInUse        = errors.New("SKU is already used by another variant")
+)
+
+// VariantUnits are the units a variant's size can be given in.
+var VariantUnits = []string{"each", "g", "kg", "ml", "L"}
+
+// unitBase converts a unit to the one unit prices are compared in: weights per
+// kg, volumes per L and counted items per each.
+var unitBase = map[string]struct {
+	unit   string
+	factor float64
+}{
+	"each": {"each", 1},
+	"g":    {"kg", 0.001},
+	"kg":   {"kg", 1},
+	"ml":   {"L", 0.001},
+	"L":    {"L", 1},
+}
+
+// Variant is a purchasable form of an item, e.g. "Milk 1L" and "Milk 2L", or
+// produce sold by weight (size 1, unit kg). UnitPrice is computed from Price
+// and Size so shoppers can compare value across sizes.
+type Variant struct {
+	VariantID     int      `json:"variantID" gorm:"primaryKey;column:variantid"`
+	ItemID        int      `json:"itemID" gorm:"column:itemid"`
+	Name          string   `json:"name" gorm:"column:name"`
+	SKU           string   `json:"sku" gorm:"column:sku"`
+	Size          float64  `json:"size" gorm:"column:size"`
+	Unit          string   `json:"unit" gorm:"column:unit"`
+	Price         float64  `json:"price" gorm:"column:price"`
+	BasePrice     float64  `json:"basePrice,omitempty" gorm:"-"`
+	SalePrice     *float64 `json:"salePrice,omitempty" gorm:"-"`
+	UnitPrice     float64  `json:"unitPrice" gorm:"-"`
+	UnitPriceUnit string   `json:"unitPriceUnit" gorm:"-"`
+}
+
+// ParseUnit matches a unit case-insensitively against VariantUnits.
+func ParseUnit(unit string) (string, error) {
+	unit = strings.TrimSpace(unit)
+	if unit == "" {
+		return "each", nil
+	}
+	for _, u := range VariantUnits {
+		if strings.EqualFold(u, unit) {
+			return u, nil
+		}
+	}
+
+	return "", invalid("unknown unit %q, expected one of %s", unit, strings.Join(VariantUnits, ", "))
+}
+
+// computeUnitPrice fills in the normalized price, e.g. $4.50 for 500 g is
+// $9.00 per kg.
+func (v *Variant) computeUnitPrice() {
+	base, ok := unitBase[v.Unit]
+	if !ok || v.Size <= 0 {
+		return
+	}
+
+	v.UnitPrice = roundCents(v.Price / (v.Size * base.factor))
+	v.UnitPriceUnit = base.unit
+}
+
+func (v *Variant) validate() error {
+	unit, err := ParseUnit(v.Unit)
+	if err != nil {
+		return err
+	}
+	v.Unit = unit
+	v.Name = strings.TrimSpace(v.Name)
+	v.SKU = strings.TrimSpace(v.SKU)
+
+	if v.Size <= 0 {
+		return invalid("variant size must be positive")
+	}
+	if v.Price < 0 {
+		return invalid("variant price cannot be negative")
+	}
+	if v.Name == "" {
+		v.Name = fmt.Sprintf("%g %s", v.Size, v.Unit)
+	}
+
+	return nil
+}
+
+func roundCents(amount float64) float64 {
+	if amount < 0 {
+		return -roundCents(-amount)
+	}
+	return float64(int64(amount*100+0.5)) / 100
+}
+
+func (s *shopService) GetVariants(itemID int) ([]*Variant, error) {
+	variants, err := s.db.getVariants([]int{itemID})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range variants {
+		v.computeUnitPrice()
+	}
+
+	return variants, nil
+}
+
+func (s *shopService) CreateVariant(variant *Variant, actor string) (*Variant, error) {
+	if err := variant.validate(); err != nil {
+		return nil, err
+	}
+
+	variant, err := s.db.addVariant(variant, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	variant.computeUnitPrice()
+	return variant, nil
+}
+
+func (s *shopService) UpdateVariant(variant *Variant, actor string) (*Variant, error) {
+	if err := variant.validate(); err != nil {
+		return nil, err
+	}
+
+	variant, err := s.db.updateVariant(variant, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	variant.computeUnitPrice()
+	return variant, nil
+}
+
+func (s *shopService) DeleteVariant(itemID, variantID int) (bool, error) {
+	result, err := s.db.deleteVariant(itemID, variantID)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+// attachVariants loads the variants of all the given items in one query.
+func (s *shopService) attachVariants(items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	var ids []int
+	byID := make(map[int][]*Item)
+	for _, item := range items {
+		if _, ok := byID[item.ItemID]; !ok {
+			ids = append(ids, item.ItemID)
+		}
+		byID[item.ItemID] = append(byID[item.ItemID], item)
+	}
+
+	variants, err := s.db.getVariants(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range variants {
+		v.computeUnitPrice()
+		for _, item := range byID[v.ItemID] {
+			item.Variants = append(item.Variants, v)
+		}
+	}
+
+	return nil
+}
+
+// attachStockVariants points each stock row placed per variant at its variant.
+func (s *shopService) attachStockVariants(stock []*ItemInStock) error {
+	var ids []int
+	for _, inStock := range stock {
+		if inStock.VariantID != 0 {
+			ids = append(ids, inStock.ItemID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	variants, err := s.db.getVariants(ids)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int]*Variant)
+	for _, v := range variants {
+		v.computeUnitPrice()
+		byID[v.VariantID] = v
+	}
+	for _, inStock := range stock {
+		if inStock.VariantID != 0 {
+			inStock.Variant = byID[inStock.VariantID]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func slotError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrStoreNotFound, err == shop.ErrSlotTemplateNotFound, err == shop.ErrSlotNotFound, err == shop.ErrNoReservation:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrSlotFull:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+// slotTime reads an RFC 3339 time from the query, the zero time when it is
+// not given.
+func slotTime(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func getSlotTemplates(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	resp, err := shopSrv.GetSlotTemplates(storeID)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createSlotTemplate(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+
+	var request *shop.SlotTemplate
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.StoreID = storeID
+
+	log.Printf("[Main] [CreateSlotTemplate] %d: weekday %d %s-%s every %d min for %d", storeID, request.Weekday, request.Opens, request.Closes, request.Duration, request.Capacity)
+	resp, err := shopSrv.CreateSlotTemplate(request)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func updateSlotTemplate(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	templateID, err := strconv.Atoi(c.Param("template"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.SlotTemplate
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.StoreID = storeID
+	request.TemplateID = templateID
+
+	log.Printf("[Main] [UpdateSlotTemplate] %d: template %d", storeID, templateID)
+	resp, err := shopSrv.UpdateSlotTemplate(request)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteSlotTemplate(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	templateID, err := strconv.Atoi(c.Param("template"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [DeleteSlotTemplate] %d: template %d", storeID, templateID)
+	resp, err := shopSrv.DeleteSlotTemplate(storeID, templateID)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getSlots lists a store's pickup slots between ?from= and ?to=, the coming
+// week by default.
+func getSlots(c *gin.Context) {
+	storeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	from, err := slotTime(c, "from")
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	to, err := slotTime(c, "to")
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetSlots(storeID, from, to)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+type slotRequest struct {
+	TemplateID int       `json:"templateID" binding:"required"`
+	StartsAt   time.Time `json:"startsAt" binding:"required"`
+}
+
+// reserveSlot holds a pickup slot for the caller's next order.
+func reserveSlot(c *gin.Context) {
+	username := c.GetString("username")
+
+	var request slotRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	log.Printf("[Main] [ReserveSlot] %s: template %d at %s", username, request.TemplateID, request.StartsAt.Format(time.RFC3339))
+	resp, err := shopSrv.ReserveSlot(username, request.TemplateID, request.StartsAt)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func getSlotReservation(c *gin.Context) {
+	resp, err := shopSrv.GetSlotReservation(c.GetString("username"))
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func releaseSlot(c *gin.Context) {
+	resp, err := shopSrv.ReleaseSlot(c.GetString("username"))
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// getPickList gathers what the store's orders for the slot starting at
+// ?start= need picking, shelf by shelf.
+func getPickList(c *gin.Context) {
+	storeID, ok := priceStore(c)
+	if !ok {
+		return
+	}
+	start, err := slotTime(c, "start")
+	if err != nil || start.IsZero() {
+		c.AbortWithStatusJSON(400, gin.H{"error": "start is required and must be an RFC 3339 time"})
+		return
+	}
+
+	resp, err := shopSrv.GetPickList(storeID, start)
+	if err != nil {
+		slotError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
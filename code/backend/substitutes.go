@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+// getSubstitutes suggests what ?storeID= stocks in place of an item, ?limit=
+// caps how many. Items that conflict with the shopper's dietary preferences
+// are left out.
+func getSubstitutes(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	storeID, err := strconv.Atoi(c.Query("storeID"))
+	if err != nil {
+		c.AbortWithStatusJSON(400, gin.H{"error": "storeID is required"})
+		return
+	}
+	limit := 0
+	if l := c.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+	}
+
+	profile, err := shopperProfile(c)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	resp, err := shopSrv.GetSubstitutes(storeID, itemID, limit, profile)
+	switch err {
+	case nil:
+	case shop.ErrItemNotFound, shop.ErrStoreNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+		return
+	default:
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, &resp)
+}
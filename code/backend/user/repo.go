@@ -1,6 +1,9 @@
 package user
 
 import (
+	"time"
+
+	"github.com/lib/pq"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -11,6 +14,15 @@ type UserRepo interface {
 	getProfile(input string) (*User, error)
 	createProfile(Username string, StoreID int, FirstName string, LastName string, Email string) error
 	deleteProfile(username string) (bool, error)
+	updatePreferences(username string, dietary []string, allergens []string) error
+	createShift(*Shift) (*Shift, error)
+	getShift(shiftID int) (*Shift, error)
+	updateShift(*Shift) (*Shift, error)
+	deleteShift(shiftID int) (bool, error)
+	getShifts(username string, storeID int, from, to time.Time) ([]*Shift, error)
+	clockIn(*TimeEntry) (*TimeEntry, error)
+	clockOut(username string, at time.Time) (*TimeEntry, error)
+	getTimeEntries(storeID int, from, to time.Time) ([]*TimeEntry, error)
 }
 
 type userRepo struct {
@@ -76,3 +88,159 @@ func (r *userRepo) deleteProfile(username string) (bool, error) {
 	}
 	return true, nil
 }
+
+func (r *userRepo) updatePreferences(username string, dietary []string, allergens []string) error {
+	result := r.db.Table("accounts").Where("username = ?", username).Updates(map[string]interface{}{
+		"dietary":   pq.StringArray(dietary),
+		"allergens": pq.StringArray(allergens),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// overlappingShift reports whether the employee already has a shift that
+// overlaps the given one. It is run inside the insert/update transaction.
+func overlappingShift(tx *gorm.DB, shift *Shift) (bool, error) {
+	var count int64
+	result := tx.Table("shifts").
+		Where("username = ? AND shiftid <> ? AND starts_at < ? AND ends_at > ?", shift.Username, shift.ShiftID, shift.End, shift.Start).
+		Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+func (r *userRepo) createShift(shift *Shift) (*Shift, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		overlap, err := overlappingShift(tx, shift)
+		if err != nil {
+			return err
+		}
+		if overlap {
+			return ErrShiftOverlap
+		}
+		return tx.Table("shifts").Omit("shiftid").Create(shift).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shift, nil
+}
+
+func (r *userRepo) getShift(shiftID int) (*Shift, error) {
+	var shifts []*Shift
+	result := r.db.Table("shifts").Where("shiftid = ?", shiftID).Find(&shifts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(shifts) == 0 {
+		return nil, ErrShiftNotFound
+	}
+	return shifts[0], nil
+}
+
+func (r *userRepo) updateShift(shift *Shift) (*Shift, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		overlap, err := overlappingShift(tx, shift)
+		if err != nil {
+			return err
+		}
+		if overlap {
+			return ErrShiftOverlap
+		}
+		result := tx.Table("shifts").Where("shiftid = ?", shift.ShiftID).Updates(map[string]interface{}{
+			"username":  shift.Username,
+			"storeid":   shift.StoreID,
+			"starts_at": shift.Start,
+			"ends_at":   shift.End,
+			"note":      shift.Note,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrShiftNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shift, nil
+}
+
+func (r *userRepo) deleteShift(shiftID int) (bool, error) {
+	result := r.db.Exec("DELETE FROM shifts WHERE shiftid = ?", shiftID)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return true, nil
+}
+
+func (r *userRepo) getShifts(username string, storeID int, from, to time.Time) ([]*Shift, error) {
+	var shifts []*Shift
+	query := r.db.Table("shifts").Where("starts_at < ? AND ends_at > ?", to, from)
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+	if storeID != 0 {
+		query = query.Where("storeid = ?", storeID)
+	}
+	result := query.Order("starts_at").Find(&shifts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return shifts, nil
+}
+
+func (r *userRepo) clockIn(entry *TimeEntry) (*TimeEntry, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var open int64
+		result := tx.Table("time_entries").Where("username = ? AND clock_out IS NULL", entry.Username).Count(&open)
+		if result.Error != nil {
+			return result.Error
+		}
+		if open > 0 {
+			return ErrAlreadyClockedIn
+		}
+		return tx.Table("time_entries").Omit("entryid").Create(entry).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (r *userRepo) clockOut(username string, at time.Time) (*TimeEntry, error) {
+	var entries []*TimeEntry
+	result := r.db.Table("time_entries").Where("username = ? AND clock_out IS NULL", username).Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotClockedIn
+	}
+
+	entry := entries[0]
+	result = r.db.Table("time_entries").Where("entryid = ?", entry.EntryID).Update("clock_out", at)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	entry.ClockOut = &at
+	return entry, nil
+}
+
+func (r *userRepo) getTimeEntries(storeID int, from, to time.Time) ([]*TimeEntry, error) {
+	var entries []*TimeEntry
+	result := r.db.Table("time_entries").
+		Where("storeid = ? AND clock_in < ? AND (clock_out IS NULL OR clock_out > ?)", storeID, to, from).
+		Order("clock_in").
+		Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
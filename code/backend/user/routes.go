@@ -2,6 +2,7 @@ package user
 
 import (
 	"fmt"
+	"time"
 
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
 )
@@ -19,8 +20,17 @@ type UserService interface {
 	GetProfile(username string) (*User, error)
 	UpdateProfile(user *User) (*User, error)
 	DeleteProfile(username string) (bool, error)
+	UpdatePreferences(username string, dietary []string, allergens []string) (*User, error)
 	// DeleteUser(username string) (bool, error)
 	ListGroupsForUser(input *cognito.AdminListGroupsForUserInput) (*cognito.AdminListGroupsForUserOutput, error)
+	CreateShift(*Shift) (*Shift, error)
+	GetShift(shiftID int) (*Shift, error)
+	UpdateShift(*Shift) (*Shift, error)
+	DeleteShift(shiftID int) (bool, error)
+	GetShifts(username string, storeID int, from, to time.Time) ([]*Shift, error)
+	ClockIn(username string, storeID int) (*TimeEntry, error)
+	ClockOut(username string) (*TimeEntry, error)
+	GetTimesheet(storeID int, from, to time.Time) (*Timesheet, error)
 }
 
 //cognito = CognitoIdentityProvider
@@ -177,3 +187,12 @@ func (s *userService) DeleteProfile(username string) (bool, error) {
 
 	return true, nil
 }
+
+func (s *userService) UpdatePreferences(username string, dietary []string, allergens []string) (*User, error) {
+	err := s.db.updatePreferences(username, dietary, allergens)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.getProfile(username)
+}
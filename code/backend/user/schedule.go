@@ -0,0 +1,213 @@
+package user
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidShift     = errors.New("shift must end after it starts")
+	ErrShiftOverlap     = errors.New("shift overlaps another shift for this employee")
+	ErrShiftNotFound    = errors.New("shift not found")
+	ErrAlreadyClockedIn = errors.New("already clocked in")
+	ErrNotClockedIn     = errors.New("not clocked in")
+)
+
+type Shift struct {
+	ShiftID   int       `json:"shiftID" gorm:"primaryKey;column:shiftid"`
+	Username  string    `json:"username" gorm:"column:username"`
+	StoreID   int       `json:"storeID" gorm:"column:storeid"`
+	Start     time.Time `json:"start" gorm:"column:starts_at"`
+	End       time.Time `json:"end" gorm:"column:ends_at"`
+	Note      string    `json:"note" gorm:"column:note"`
+	CreatedBy string    `json:"createdBy" gorm:"column:createdby"`
+}
+
+// TimeEntry is one clock in/out pair. ClockOut is nil while the employee is
+// still on the clock. Unassigned is set when the employee clocked in at a
+// store that is neither their home store nor covered by one of their shifts.
+type TimeEntry struct {
+	EntryID    int        `json:"entryID" gorm:"primaryKey;column:entryid"`
+	Username   string     `json:"username" gorm:"column:username"`
+	StoreID    int        `json:"storeID" gorm:"column:storeid"`
+	ShiftID    *int       `json:"shiftID" gorm:"column:shiftid"`
+	ClockIn    time.Time  `json:"clockIn" gorm:"column:clock_in"`
+	ClockOut   *time.Time `json:"clockOut" gorm:"column:clock_out"`
+	Unassigned bool       `json:"unassigned" gorm:"column:unassigned"`
+}
+
+type Timesheet struct {
+	StoreID   int                  `json:"storeID"`
+	From      time.Time            `json:"from"`
+	To        time.Time            `json:"to"`
+	Employees []*EmployeeTimesheet `json:"employees"`
+}
+
+type EmployeeTimesheet struct {
+	Username       string       `json:"username"`
+	ScheduledHours float64      `json:"scheduledHours"`
+	WorkedHours    float64      `json:"workedHours"`
+	Flagged        int          `json:"flagged"`
+	Shifts         []*Shift     `json:"shifts"`
+	Entries        []*TimeEntry `json:"entries"`
+}
+
+func (s *userService) CreateShift(shift *Shift) (*Shift, error) {
+	if !shift.End.After(shift.Start) {
+		return nil, ErrInvalidShift
+	}
+
+	shift, err := s.db.createShift(shift)
+	if err != nil {
+		return nil, err
+	}
+
+	return shift, nil
+}
+
+func (s *userService) GetShift(shiftID int) (*Shift, error) {
+	shift, err := s.db.getShift(shiftID)
+	if err != nil {
+		return nil, err
+	}
+
+	return shift, nil
+}
+
+func (s *userService) UpdateShift(shift *Shift) (*Shift, error) {
+	if !shift.End.After(shift.Start) {
+		return nil, ErrInvalidShift
+	}
+
+	shift, err := s.db.updateShift(shift)
+	if err != nil {
+		return nil, err
+	}
+
+	return shift, nil
+}
+
+func (s *userService) DeleteShift(shiftID int) (bool, error) {
+	_, err := s.db.deleteShift(shiftID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetShifts lists shifts overlapping [from, to). An empty username or a zero
+// storeID matches everyone.
+func (s *userService) GetShifts(username string, storeID int, from, to time.Time) ([]*Shift, error) {
+	shifts, err := s.db.getShifts(username, storeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return shifts, nil
+}
+
+func (s *userService) ClockIn(username string, storeID int) (*TimeEntry, error) {
+	profile, err := s.db.getProfile(username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry := &TimeEntry{
+		Username: username,
+		StoreID:  storeID,
+		ClockIn:  now,
+	}
+
+	// match the entry to the shift being worked, if there is one at this store
+	shifts, err := s.db.getShifts(username, storeID, now, now.Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	if len(shifts) > 0 {
+		entry.ShiftID = &shifts[0].ShiftID
+	}
+
+	entry.Unassigned = profile.StoreID != storeID && entry.ShiftID == nil
+
+	entry, err = s.db.clockIn(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func (s *userService) ClockOut(username string) (*TimeEntry, error) {
+	entry, err := s.db.clockOut(username, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// GetTimesheet totals scheduled and worked hours per employee at a store.
+// Entries still on the clock count up to now, capped at the end of the period.
+func (s *userService) GetTimesheet(storeID int, from, to time.Time) (*Timesheet, error) {
+	shifts, err := s.db.getShifts("", storeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := s.db.getTimeEntries(storeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	sheet := &Timesheet{StoreID: storeID, From: from, To: to}
+	byUser := make(map[string]*EmployeeTimesheet)
+	employee := func(username string) *EmployeeTimesheet {
+		if e, ok := byUser[username]; ok {
+			return e
+		}
+		e := &EmployeeTimesheet{Username: username}
+		byUser[username] = e
+		sheet.Employees = append(sheet.Employees, e)
+		return e
+	}
+
+	for _, shift := range shifts {
+		e := employee(shift.Username)
+		e.Shifts = append(e.Shifts, shift)
+		e.ScheduledHours += overlapHours(shift.Start, shift.End, from, to)
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		e := employee(entry.Username)
+		e.Entries = append(e.Entries, entry)
+
+		end := now
+		if entry.ClockOut != nil {
+			end = *entry.ClockOut
+		}
+		e.WorkedHours += overlapHours(entry.ClockIn, end, from, to)
+
+		if entry.Unassigned {
+			e.Flagged++
+		}
+	}
+
+	return sheet, nil
+}
+
+func overlapHours(start, end, from, to time.Time) float64 {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+
+	return end.Sub(start).Hours()
+}
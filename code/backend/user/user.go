@@ -5,6 +5,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	cognito "github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/lib/pq"
 )
 
 type userService struct {
@@ -32,6 +33,9 @@ type User struct {
 	FirstName string `json:"firstName" gorm:"column:firstname"`
 	LastName  string `json:"lastName" gorm:"column:lastname"`
 	Email     string `json:"email" gorm:"column:email"`
+	// dietary labels the shopper requires and allergens they avoid, see shop.DietaryProfile
+	Dietary   pq.StringArray `json:"dietary" gorm:"column:dietary;type:text[]"`
+	Allergens pq.StringArray `json:"allergens" gorm:"column:allergens;type:text[]"`
 }
 
 func awsSession(awsRegion, awsID, awsSecret string) (*session.Session, error) {
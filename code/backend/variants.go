@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strconv"
+
+	shop "github.com/AkinAD/basedCode/shop"
+	"github.com/gin-gonic/gin"
+)
+
+func variantError(c *gin.Context, err error) {
+	switch {
+	case err == shop.ErrVariantNotFound, err == shop.ErrItemNotFound:
+		c.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+	case err == shop.ErrSKUInUse:
+		c.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+	case shop.IsInvalid(err):
+		c.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithError(500, err)
+	}
+}
+
+func getVariants(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.GetVariants(itemID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func createVariant(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.Variant
+	err = c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.VariantID = 0
+	request.ItemID = itemID
+
+	resp, err := shopSrv.CreateVariant(request, c.GetString("username"))
+	if err != nil {
+		variantError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func updateVariant(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	variantID, err := strconv.Atoi(c.Param("variant"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	var request *shop.Variant
+	err = c.ShouldBind(&request)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	request.VariantID = variantID
+	request.ItemID = itemID
+
+	resp, err := shopSrv.UpdateVariant(request, c.GetString("username"))
+	if err != nil {
+		variantError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+func deleteVariant(c *gin.Context) {
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	variantID, err := strconv.Atoi(c.Param("variant"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	resp, err := shopSrv.DeleteVariant(itemID, variantID)
+	if err != nil {
+		variantError(c, err)
+		return
+	}
+
+	c.JSON(200, &resp)
+}
+
+// deleteVariantStock removes one variant's placement. Like deleteStock,
+// non-admins can only change their own store.
+func deleteVariantStock(c *gin.Context) {
+	storeID, err := strconv.Atoi(c.Param("store"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	itemID, err := strconv.Atoi(c.Param("item"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	variantID, err := strconv.Atoi(c.Param("variant"))
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	if !isAdmin(c) {
+		username := c.MustGet("username").(string)
+		user, err := userSrv.GetProfile(username)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		storeID = user.StoreID
+	}
+
+	resp, err := shopSrv.DeleteVariantStock(storeID, itemID, variantID)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
@@ -45,6 +45,7 @@ const actions = {
     let session = await Auth.currentSession();
     store = {
       address : store.address,
+      province : store.province,
       storeID : Number(store.storeID)
     };
 
@@ -77,6 +78,7 @@ const actions = {
    
     store = {
       address : store.address,
+      province : store.province,
       storeID : Number(store.storeID)
     };
     console.log(store);
@@ -99,6 +101,17 @@ const actions = {
     }
   },
 
+  async fetchNearbyStores({ commit }, { latitude, longitude }) {
+    try {
+      const res = await axios.get(domain + "/store/nearby", {
+        params: { lat: latitude, lon: longitude },
+      }); //nearest first, only those within 25 km
+      commit("sortStoresByDistance", res.data);
+    } catch {
+      //the list stays as it was
+    }
+  },
+
   async setSelectedStore({ commit }, store) {
     try {
       const res = await axios.get(domain + `/store/${store.storeID}`); //selected store's items
@@ -272,6 +285,23 @@ const mutations = {
   updateStores: (state, newStores) => {
     state.stores = newStores;
   },
+  //nearby stores get their distance and move to the front, nearest first; the rest keep their order after them
+  sortStoresByDistance: (state, nearby) => {
+    const near = {};
+    for (const store of nearby) near[store.storeID] = store;
+
+    const distance = (store) => (store.distance === undefined ? Infinity : store.distance);
+    const stores = state.stores.map((store) => {
+      const found = near[store.storeID];
+      delete near[store.storeID];
+      return found ? { ...store, distance: found.distance, open_now: found.open_now } : store;
+    });
+    stores.push(...Object.values(near));
+    state.stores = stores.sort((a, b) => {
+      if (distance(a) === distance(b)) return 0;
+      return distance(a) < distance(b) ? -1 : 1;
+    });
+  },
   setSelectedStore: (state, data) => {
     (state.selectedStore = data[0]), (state.items = data[1]);
   },